@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"trybook/web"
+)
+
+// Subcommands. "trybook serve" (or no subcommand, so existing scripts keep
+// working) runs the server. The others drive a running server over HTTP,
+// for scripts and SSH sessions; -server picks it (default $TRYBOOK_URL,
+// else http://localhost:$PORT) and, when TRYBOOK_TOKEN is set, they sign
+// in with it like the login page does.
+
+type subcommand struct {
+	usage string
+	run   func(c *client, opts cliOptions, args []string) error
+}
+
+// cliOptions holds the flags of individual subcommands.
+type cliOptions struct {
+	intent string // run, try: skip the router with this intent
+	dryRun bool   // run, try: editing models only preview the edit
+	dir    string // try: the repository, or a directory in it
+}
+
+var subcommands = map[string]subcommand{
+	"open":   {"open <org/repo or git URL>\tcreate a notebook and print its ID", cmdOpen},
+	"run":    {"run [-intent question|edit] [-dry-run] <nb> [prompt]\tadd an entry (prompt from stdin if omitted) and print its output", cmdRun},
+	"try":    {"try [-intent question|edit] [-dry-run] [-dir path] [prompt]\topen a notebook on the local repository at -dir (default .) and run prompt in it", cmdTry},
+	"list":   {"list [archived]\tlist notebooks, or the archived ones", cmdList},
+	"export": {"export <nb>\twrite the notebook's archive (JSON) to stdout", cmdExport},
+}
+
+var subcommandOrder = []string{"open", "run", "try", "list", "export"}
+
+// errUsage makes a subcommand print its usage and exit with status 2.
+var errUsage = errors.New("usage")
+
+func usage() {
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "Usage:")
+	fmt.Fprintln(w, "  trybook [serve] [flags]\trun the server (trybook serve -h lists its flags)")
+	for _, name := range subcommandOrder {
+		fmt.Fprintln(w, "  trybook "+subcommands[name].usage)
+	}
+	fmt.Fprintln(w, "\nClient flags (after the command, before its arguments):")
+	fmt.Fprintln(w, "  -server URL\tserver to talk to, or unix:/path for a unix socket (default $TRYBOOK_URL, else http://localhost:$PORT)")
+	fmt.Fprintln(w, "  -user NAME\tname to sign in as with TRYBOOK_TOKEN (default $USER)")
+	w.Flush()
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	switch name {
+	case "serve":
+		_ = flag.CommandLine.Parse(args) // exits on error
+		web.Serve()
+		return
+	case "help":
+		usage()
+		return
+	case web.FakeProcessCommand:
+		os.Exit(web.RunFakeProcess(args))
+	}
+	cmd, ok := subcommands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "trybook: unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("trybook "+name, flag.ExitOnError)
+	fs.Usage = usage
+	server := fs.String("server", defaultServerURL(), "")
+	user := fs.String("user", os.Getenv("USER"), "")
+	var opts cliOptions
+	if name == "run" || name == "try" {
+		fs.StringVar(&opts.intent, "intent", "", "")
+		fs.BoolVar(&opts.dryRun, "dry-run", false, "")
+	}
+	if name == "try" {
+		fs.StringVar(&opts.dir, "dir", ".", "")
+	}
+	_ = fs.Parse(args)
+	c, err := newClient(*server, *user)
+	if err == nil {
+		err = cmd.run(c, opts, fs.Args())
+	}
+	switch {
+	case errors.Is(err, errUsage):
+		fmt.Fprintln(os.Stderr, "usage: trybook "+strings.Replace(cmd.usage, "\t", "\n  ", 1))
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "trybook "+name+": "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func defaultServerURL() string {
+	if u := os.Getenv("TRYBOOK_URL"); u != "" {
+		return u
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	return "http://localhost:" + port
+}
+
+type client struct {
+	base string
+	hc   *http.Client
+	csrf string // the server's tb_csrf cookie, sent back with posts
+}
+
+// newClient returns a client for the server at base, signed in if
+// TRYBOOK_TOKEN is set. Redirects are not followed: they carry results.
+func newClient(base, user string) (*client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{
+		base: strings.TrimRight(base, "/"),
+		hc: &http.Client{
+			Jar:           jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	// unix:/path talks to a server listening on a unix socket.
+	if path, ok := strings.CutPrefix(base, "unix:"); ok {
+		c.base = "http://trybook"
+		c.hc.Transport = &http.Transport{DialContext: unixSocketDialer(path)}
+	}
+	// Any response carries the CSRF cookie.
+	res, err := c.hc.Get(c.base + "/healthz")
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	for _, ck := range res.Cookies() {
+		if ck.Name == web.CSRFCookie {
+			c.csrf = ck.Value
+		}
+	}
+	token := web.SharedToken()
+	if token == "" {
+		return c, nil
+	}
+	if user == "" {
+		return nil, errors.New("-user is required to sign in with TRYBOOK_TOKEN ($USER is not set)")
+	}
+	res, err = c.postForm("/login", url.Values{"user": {user}, "token": {token}})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		return nil, fmt.Errorf("sign in as %q: %s", user, responseError(res))
+	}
+	return c, nil
+}
+
+var pageErrorRE = regexp.MustCompile(`<p class="msg error">([^<]*)</p>`)
+
+// responseError describes a failed response: the message of an HTML page's
+// error paragraph, else the (plain text) body.
+func responseError(res *http.Response) string {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if m := pageErrorRE.FindSubmatch(b); m != nil {
+		return html.UnescapeString(string(m[1]))
+	}
+	if msg := strings.TrimSpace(string(b)); msg != "" && !strings.HasPrefix(msg, "<") {
+		return msg
+	}
+	return res.Status
+}
+
+func (c *client) get(path string) (*http.Response, error) {
+	res, err := c.hc.Get(c.base + path)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, errors.New(responseError(res))
+	}
+	return res, nil
+}
+
+func (c *client) postForm(path string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, c.base+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(web.CSRFHeader, c.csrf)
+	return c.hc.Do(req)
+}
+
+// postRedirect posts a form and returns where the server redirected to.
+func (c *client) postRedirect(path string, form url.Values) (string, error) {
+	res, err := c.postForm(path, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		return "", errors.New(responseError(res))
+	}
+	return res.Header.Get("Location"), nil
+}
+
+func cmdOpen(c *client, _ cliOptions, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	nbID, err := c.openNotebook(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(nbID)
+	return nil
+}
+
+// openNotebook creates a notebook on repo, as /try does, prints its URL to
+// stderr and returns its ID. Its repository may still be cloning.
+func (c *client) openNotebook(repo string) (string, error) {
+	loc, err := c.postRedirect("/try", url.Values{"url": {repo}})
+	if err != nil {
+		return "", err
+	}
+	// A server behind a proxy under a base path redirects to that path.
+	if u, err := url.Parse(c.base); err == nil {
+		loc = strings.TrimPrefix(loc, u.Path)
+	}
+	nbID, ok := strings.CutPrefix(loc, "/n/")
+	if !ok {
+		return "", fmt.Errorf("unexpected redirect to %s", loc)
+	}
+	fmt.Fprintln(os.Stderr, c.base+loc)
+	return nbID, nil
+}
+
+// cmdTry runs a prompt against the repository on this machine that -dir
+// is in: it opens a notebook on it by its path (see localrepo.go), so the
+// server must share this machine's disk, waits for the clone, and then
+// runs the prompt as "run" does. A directory below the repository's top
+// scopes the notebook to it. The checkout itself is left alone; edits go
+// to the notebook's worktree and branch.
+func cmdTry(c *client, opts cliOptions, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	prompt, err := promptArg(args)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(opts.dir)
+	if err != nil {
+		return err
+	}
+	nbID, err := c.openNotebook(dir)
+	if err != nil {
+		return err
+	}
+	if err := c.waitCloned(nbID); err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	return c.runPrompt(opts, nbID, prompt)
+}
+
+// waitCloned follows a new notebook's clone until it is ready, printing
+// its progress to stderr: each step's messages, and each phase once done.
+func (c *client) waitCloned(nbID string) error {
+	res, err := c.get("/events/clone?nb=" + url.QueryEscape(nbID))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusNoContent {
+		res.Body.Close()
+		return nil // already done
+	}
+	_, err = followRun(res, io.Discard, func(event, data string) {
+		var p struct {
+			Percent int    `json:"percent"`
+			Line    string `json:"line"`
+		}
+		if event == "progress" && json.Unmarshal([]byte(data), &p) == nil && p.Line != "" && (p.Percent < 0 || p.Percent == 100) {
+			fmt.Fprintln(os.Stderr, p.Line)
+		}
+	})
+	return err
+}
+
+func cmdList(c *client, _ cliOptions, args []string) error {
+	path := fmt.Sprintf("/api/notebooks?limit=%d", web.APINotebooksMax)
+	switch {
+	case len(args) == 1 && args[0] == "archived":
+		path += "&archived=1"
+	case len(args) != 0:
+		return errUsage
+	}
+	res, err := c.get(path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var nbs []web.APINotebook
+	if err := json.NewDecoder(res.Body).Decode(&nbs); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, nb := range nbs {
+		fmt.Fprintf(w, "%s\t%s\t%s@%s\t%s\t%s\n", nb.ID, nb.Repo, nb.Branch, nb.Commit, nb.CreatedAt, nb.Title)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if total, _ := strconv.Atoi(res.Header.Get("X-Total-Count")); total > len(nbs) {
+		fmt.Fprintf(os.Stderr, "(the newest %d of %d)\n", len(nbs), total)
+	}
+	return nil
+}
+
+func cmdExport(c *client, _ cliOptions, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	res, err := c.get("/api/export?nb=" + url.QueryEscape(args[0]))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, err = io.Copy(os.Stdout, res.Body)
+	return err
+}
+
+// cmdRun adds an entry to a notebook and prints its output.
+func cmdRun(c *client, opts cliOptions, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+	prompt, err := promptArg(args[1:])
+	if err != nil {
+		return err
+	}
+	return c.runPrompt(opts, args[0], prompt)
+}
+
+// promptArg returns the prompt in args, or read from stdin if there is
+// none.
+func promptArg(args []string) (string, error) {
+	prompt := ""
+	if len(args) == 1 {
+		prompt = args[0]
+	} else {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		prompt = string(b)
+	}
+	if strings.TrimSpace(prompt) == "" {
+		return "", errors.New("empty prompt")
+	}
+	return prompt, nil
+}
+
+// runPrompt adds prompt to notebook nbID and follows its runs as the page
+// would: the router, then each model it queued (and the tests after an
+// edit), printing their output in turn. An edit the router held for
+// confirmation is left to the notebook page. All are attached to at once so
+// none is missed; the server keeps their events until they are read. It
+// fails if any run failed.
+func (c *client) runPrompt(opts cliOptions, nbID, prompt string) error {
+	// A prompt from a file or pipe is deliberate, however large.
+	form := url.Values{"nb": {nbID}, "prompt": {prompt}, "large": {"1"}}
+	if opts.intent != "" {
+		form.Set("intent", opts.intent)
+	}
+	if opts.dryRun {
+		form.Set("dry_run", "1")
+	}
+	loc, err := c.postRedirect("/prompt", form)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return err
+	}
+	idx, err := strconv.Atoi(u.Query().Get("pending"))
+	if err != nil {
+		return fmt.Errorf("prompt not accepted (redirected to %s)", loc)
+	}
+
+	router, err := c.attachRun(nbID, idx, "router")
+	if err != nil {
+		return err
+	}
+	var models []string
+	held := false
+	if _, err := followRun(router, io.Discard, func(event, data string) {
+		if event == "routed" {
+			var r struct {
+				Models []string `json:"models"`
+				Intent string   `json:"intent"`
+				Held   bool     `json:"held"`
+			}
+			if json.Unmarshal([]byte(data), &r) == nil {
+				models, held = r.Models, r.Held
+				if r.Intent != "" {
+					fmt.Fprintf(os.Stderr, "intent: %s\n", r.Intent)
+				}
+			}
+		}
+	}); err != nil {
+		return fmt.Errorf("router: %w", err)
+	}
+	if held {
+		return fmt.Errorf("the prompt was taken for an edit, which waits for Confirm or Dry run at %s/n/%s#entry-%d; pass -intent edit to run edits at once", c.base, nbID, idx)
+	}
+	if len(models) == 0 {
+		return errors.New("no models to run")
+	}
+
+	streams := make(map[string]*http.Response)
+	for _, m := range models {
+		if streams[m], err = c.attachRun(nbID, idx, m); err != nil {
+			return fmt.Errorf("%s: %w", m, err)
+		}
+	}
+	var failed []string
+	for i := 0; i < len(models); i++ {
+		m := models[i]
+		if len(models) > 1 {
+			fmt.Printf("==> %s <==\n", m)
+		}
+		code, err := followRun(streams[m], os.Stdout, func(event, data string) {
+			if event == "tests" && streams[web.TestsModel] == nil {
+				if res, err := c.attachRun(nbID, idx, web.TestsModel); err == nil {
+					streams[web.TestsModel] = res
+					models = append(models, web.TestsModel)
+				}
+			}
+		})
+		if err != nil || code != 0 {
+			failed = append(failed, m)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", m, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// attachRun opens the event stream of a queued or running run.
+func (c *client) attachRun(nbID string, idx int, model string) (*http.Response, error) {
+	q := url.Values{"nb": {nbID}, "idx": {strconv.Itoa(idx)}, "model": {model}, "attach": {"1"}}
+	res, err := c.get("/events/run?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// followRun copies a run's output to out until it is done and returns its
+// exit code. Other events go to fn.
+func followRun(res *http.Response, out io.Writer, fn func(event, data string)) (int, error) {
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNoContent {
+		return 0, errors.New("run not found")
+	}
+	code := 0
+	var runErr error
+	sc := bufio.NewScanner(res.Body)
+	sc.Buffer(make([]byte, 64<<10), 16<<20)
+	var event, data string
+	for sc.Scan() {
+		line := sc.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			event = v
+			continue
+		}
+		if v, ok := strings.CutPrefix(line, "data: "); ok {
+			data = v
+			continue
+		}
+		if line != "" || event == "" {
+			continue
+		}
+		switch event {
+		case "chunk", "stderr":
+			var s string
+			if json.Unmarshal([]byte(data), &s) == nil {
+				if event == "chunk" {
+					_, _ = io.WriteString(out, s)
+				} else {
+					_, _ = io.WriteString(os.Stderr, s)
+				}
+			}
+		case "exit-code":
+			var v struct {
+				Code int `json:"code"`
+			}
+			_ = json.Unmarshal([]byte(data), &v)
+			code = v.Code
+		case "error":
+			var v struct {
+				Message string `json:"message"`
+			}
+			_ = json.Unmarshal([]byte(data), &v)
+			runErr = errors.New(v.Message)
+		case "done":
+			return code, runErr
+		default:
+			fn(event, data)
+		}
+		event, data = "", ""
+	}
+	if err := sc.Err(); err != nil {
+		return code, err
+	}
+	if runErr != nil {
+		return code, runErr // a clone's stream ends after its error
+	}
+	return code, errors.New("stream ended before the run was done")
+}
+
+// unixSocketDialer dials the socket at path whatever address is asked
+// for, for clients of a -listen unix: server.
+func unixSocketDialer(path string) func(ctx context.Context, _, _ string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
@@ -0,0 +1,130 @@
+// Package client is a Go client for the trybook HTTP API described by
+// openapi.json, which the server also publishes at /api/openapi.json.
+// The operations and types in client_gen.go are generated from it with go
+// generate; this file holds the Client itself: its cookie session, the
+// CSRF header every write carries, and errors.
+//
+//	c, err := client.New(ctx, "http://localhost:8080")
+//	loc, err := c.CreateNotebook(ctx, client.CreateNotebookParams{URL: "org/repo", Reuse: "new"})
+//
+// Operations answered with a redirect return its Location; run events
+// are returned as the open Server-Sent Events stream for the caller to
+// read and close.
+package client
+
+//go:generate go run gen.go
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Spec is openapi.json, which the server serves at /api/openapi.json.
+//
+//go:embed openapi.json
+var Spec []byte
+
+const (
+	csrfCookie = "tb_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Client talks to one trybook server. Its methods are safe for concurrent
+// use once New and Login have returned.
+type Client struct {
+	base string
+	hc   *http.Client
+	csrf string
+}
+
+// New returns a client for the server at baseURL and fetches the CSRF
+// cookie. A server with auth enabled needs Login before anything else.
+func New(ctx context.Context, baseURL string) (*Client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		base: strings.TrimRight(baseURL, "/"),
+		hc: &http.Client{
+			Jar: jar,
+			// Redirects are answers: their Location is what a write returns.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	// Any response carries the CSRF cookie.
+	res, err := c.do(ctx, http.MethodGet, "/healthz", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	for _, ck := range res.Cookies() {
+		if ck.Name == csrfCookie {
+			c.csrf = ck.Value
+		}
+	}
+	return c, nil
+}
+
+// Error is a response with a status the operation does not expect.
+type Error struct {
+	StatusCode int
+	Message    string // the page's error message, or the plain-text body
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("trybook: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("trybook: %d %s", e.StatusCode, e.Message)
+}
+
+// do sends a request, with form as an urlencoded body if it is not nil.
+func (c *Client) do(ctx context.Context, method, path string, query, form url.Values) (*http.Response, error) {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if method != http.MethodGet {
+		req.Header.Set(csrfHeader, c.csrf)
+	}
+	return c.hc.Do(req)
+}
+
+var pageErrorRE = regexp.MustCompile(`<p class="msg error">([^<]*)</p>`)
+
+// expect returns an *Error unless res has one of the codes.
+func expect(res *http.Response, codes ...int) error {
+	for _, code := range codes {
+		if res.StatusCode == code {
+			return nil
+		}
+	}
+	e := &Error{StatusCode: res.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if m := pageErrorRE.FindSubmatch(b); m != nil {
+		e.Message = html.UnescapeString(string(m[1]))
+	} else if msg := strings.TrimSpace(string(b)); !strings.HasPrefix(msg, "<") {
+		e.Message = msg
+	}
+	return e
+}
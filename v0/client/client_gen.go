@@ -0,0 +1,377 @@
+// Code generated by gen.go from openapi.json; DO NOT EDIT.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+)
+
+// HealthCheck is the HealthCheck schema.
+type HealthCheck struct {
+	Name      string `json:"name,omitempty"`
+	Status    string `json:"status,omitempty"`
+	Required  bool   `json:"required,omitempty"`
+	Path      string `json:"path,omitempty"`
+	FreeBytes int64  `json:"free_bytes,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HealthReport is the HealthReport schema.
+type HealthReport struct {
+	Status string        `json:"status,omitempty"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// Notebook is the Notebook schema.
+type Notebook struct {
+	ID string `json:"id,omitempty"`
+	// org/repo, or host/org/repo off github.com.
+	Repo      string   `json:"repo,omitempty"`
+	Branch    string   `json:"branch,omitempty"`
+	Commit    string   `json:"commit,omitempty"`
+	CreatedAt string   `json:"created_at,omitempty"`
+	Title     string   `json:"title,omitempty"`
+	Summary   string   `json:"summary,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	// Until the worktree is ready: cloning, or failed with status_message saying why.
+	Status        string `json:"status,omitempty"`
+	StatusMessage string `json:"status_message,omitempty"`
+}
+
+// Run is the Run schema.
+type Run struct {
+	ID        int64  `json:"id,omitempty"`
+	Model     string `json:"model,omitempty"`
+	StartedAt string `json:"started_at,omitempty"`
+	// Unset while it runs.
+	FinishedAt string `json:"finished_at,omitempty"`
+	// Unset while it runs.
+	ExitCode int `json:"exit_code,omitempty"`
+	// How long the process ran; unset while it runs.
+	DurationMs int64      `json:"duration_ms,omitempty"`
+	Command    RunCommand `json:"command,omitempty"`
+}
+
+// RunCommand is the RunCommand schema.
+type RunCommand struct {
+	Argv []string `json:"argv,omitempty"`
+	// The working directory.
+	Dir string `json:"dir,omitempty"`
+	// Names of the environment variables it was given; never their values.
+	Env []string `json:"env,omitempty"`
+}
+
+// StopResult is the StopResult schema.
+type StopResult struct {
+	Stopped       int   `json:"stopped,omitempty"`
+	ProcessGroups []int `json:"process_groups,omitempty"`
+}
+
+// AddEntryParams are the parameters of AddEntry.
+type AddEntryParams struct {
+	Notebook string
+	Prompt   string
+	// Skip the router: question or edit.
+	Intent string
+	// The one model to make an edit.
+	EditModel string
+	// Send a prompt past the size warning anyway.
+	Large bool
+	// Editing models preview the edit in a scratch worktree; nothing is applied or committed.
+	DryRun bool
+}
+
+// AddEntry calls POST /prompt: add a prompt to a notebook and queue its runs.
+func (c *Client) AddEntry(ctx context.Context, p AddEntryParams) (string, error) {
+	form := url.Values{}
+	form.Set("nb", p.Notebook)
+	form.Set("prompt", p.Prompt)
+	if p.Intent != "" {
+		form.Set("intent", p.Intent)
+	}
+	if p.EditModel != "" {
+		form.Set("edit_model", p.EditModel)
+	}
+	if p.Large {
+		form.Set("large", "1")
+	}
+	if p.DryRun {
+		form.Set("dry_run", "1")
+	}
+	res, err := c.do(ctx, "POST", "/prompt", nil, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 303); err != nil {
+		return "", err
+	}
+	return res.Header.Get("Location"), nil
+}
+
+// CreateBatchParams are the parameters of CreateBatch.
+type CreateBatchParams struct {
+	// Git URLs or org/repo, one per line; at most 50.
+	Repos  string
+	Prompt string
+	// Skip the router: question or edit.
+	Intent string
+}
+
+// CreateBatch calls POST /batch: run one prompt in several repositories, each in a notebook of its own.
+func (c *Client) CreateBatch(ctx context.Context, p CreateBatchParams) (string, error) {
+	form := url.Values{}
+	form.Set("repos", p.Repos)
+	form.Set("prompt", p.Prompt)
+	if p.Intent != "" {
+		form.Set("intent", p.Intent)
+	}
+	res, err := c.do(ctx, "POST", "/batch", nil, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 303); err != nil {
+		return "", err
+	}
+	return res.Header.Get("Location"), nil
+}
+
+// CreateNotebookParams are the parameters of CreateNotebook.
+type CreateNotebookParams struct {
+	// A git URL or org/repo on github.com. A directory's web URL, like https://github.com/org/repo/tree/main/dir, scopes the notebook to that directory.
+	URL string
+	// new starts another notebook regardless; recent reopens the newest open one.
+	Reuse string
+}
+
+// CreateNotebook calls POST /try: open a repository: clone it if needed and create a notebook on it.
+func (c *Client) CreateNotebook(ctx context.Context, p CreateNotebookParams) (string, error) {
+	form := url.Values{}
+	form.Set("url", p.URL)
+	if p.Reuse != "" {
+		form.Set("reuse", p.Reuse)
+	}
+	res, err := c.do(ctx, "POST", "/try", nil, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 303); err != nil {
+		return "", err
+	}
+	return res.Header.Get("Location"), nil
+}
+
+// ExportNotebookParams are the parameters of ExportNotebook.
+type ExportNotebookParams struct {
+	Notebook string
+}
+
+// ExportNotebook calls GET /api/export: a notebook's archive, which POST /import takes back.
+func (c *Client) ExportNotebook(ctx context.Context, p ExportNotebookParams) (json.RawMessage, error) {
+	query := url.Values{}
+	query.Set("nb", p.Notebook)
+	res, err := c.do(ctx, "GET", "/api/export", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 200); err != nil {
+		return nil, err
+	}
+	var v json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Health calls GET /healthz: the server's checks; 200 while the server is up, whatever they say.
+func (c *Client) Health(ctx context.Context) (*HealthReport, error) {
+	res, err := c.do(ctx, "GET", "/healthz", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 200); err != nil {
+		return nil, err
+	}
+	var v HealthReport
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ListNotebooksParams are the parameters of ListNotebooks.
+type ListNotebooksParams struct {
+	Archived bool
+	// Only the notebooks with this tag.
+	Tag    string
+	Offset int
+	// At most 1000; 100 when not given.
+	Limit int
+}
+
+// ListNotebooks calls GET /api/notebooks: the notebooks the index page lists, newest first.
+func (c *Client) ListNotebooks(ctx context.Context, p ListNotebooksParams) ([]Notebook, error) {
+	query := url.Values{}
+	if p.Archived {
+		query.Set("archived", "1")
+	}
+	if p.Tag != "" {
+		query.Set("tag", p.Tag)
+	}
+	if p.Offset != 0 {
+		query.Set("offset", strconv.FormatInt(int64(p.Offset), 10))
+	}
+	if p.Limit != 0 {
+		query.Set("limit", strconv.FormatInt(int64(p.Limit), 10))
+	}
+	res, err := c.do(ctx, "GET", "/api/notebooks", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 200); err != nil {
+		return nil, err
+	}
+	var v []Notebook
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ListRunsParams are the parameters of ListRuns.
+type ListRunsParams struct {
+	Notebook string
+	Entry    int
+	// Only this model's runs.
+	Model string
+}
+
+// ListRuns calls GET /api/runs: an entry's runs, oldest first, with the command each ran.
+func (c *Client) ListRuns(ctx context.Context, p ListRunsParams) ([]Run, error) {
+	query := url.Values{}
+	query.Set("nb", p.Notebook)
+	query.Set("idx", strconv.FormatInt(int64(p.Entry), 10))
+	if p.Model != "" {
+		query.Set("model", p.Model)
+	}
+	res, err := c.do(ctx, "GET", "/api/runs", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 200); err != nil {
+		return nil, err
+	}
+	var v []Run
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// LoginParams are the parameters of Login.
+type LoginParams struct {
+	User  string
+	Token string
+}
+
+// Login calls POST /login: sign in with the shared TRYBOOK_TOKEN; the session cookie is set on the response.
+func (c *Client) Login(ctx context.Context, p LoginParams) (string, error) {
+	form := url.Values{}
+	form.Set("user", p.User)
+	form.Set("token", p.Token)
+	res, err := c.do(ctx, "POST", "/login", nil, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 303); err != nil {
+		return "", err
+	}
+	return res.Header.Get("Location"), nil
+}
+
+// Ready calls GET /readyz: the server's checks; 503 when a required one fails.
+func (c *Client) Ready(ctx context.Context) (*HealthReport, error) {
+	res, err := c.do(ctx, "GET", "/readyz", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 200, 503); err != nil {
+		return nil, err
+	}
+	var v HealthReport
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// RunEventsParams are the parameters of RunEvents.
+type RunEventsParams struct {
+	Notebook string
+	Entry    int
+	Model    string
+	Attach   bool
+}
+
+// RunEvents calls GET /events/run: follow a run's output as Server-Sent Events.
+func (c *Client) RunEvents(ctx context.Context, p RunEventsParams) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("nb", p.Notebook)
+	query.Set("idx", strconv.FormatInt(int64(p.Entry), 10))
+	query.Set("model", p.Model)
+	if p.Attach {
+		query.Set("attach", "1")
+	}
+	res, err := c.do(ctx, "GET", "/events/run", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := expect(res, 200); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// StopRunParams are the parameters of StopRun.
+type StopRunParams struct {
+	Notebook string
+	Entry    int
+	Model    string
+}
+
+// StopRun calls POST /api/run/stop: stop an entry's runs, or one model's.
+func (c *Client) StopRun(ctx context.Context, p StopRunParams) (*StopResult, error) {
+	query := url.Values{}
+	query.Set("nb", p.Notebook)
+	query.Set("idx", strconv.FormatInt(int64(p.Entry), 10))
+	if p.Model != "" {
+		query.Set("model", p.Model)
+	}
+	res, err := c.do(ctx, "POST", "/api/run/stop", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := expect(res, 200); err != nil {
+		return nil, err
+	}
+	var v StopResult
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
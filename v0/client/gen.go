@@ -0,0 +1,343 @@
+//go:build ignore
+
+// gen writes client_gen.go from openapi.json: a struct per component
+// schema, and per operation a params struct and a Client method. It
+// handles what the trybook API uses: query parameters, urlencoded form
+// bodies, and responses that are a redirect, JSON or an event stream.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+type spec struct {
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas map[string]schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	OperationID string      `json:"operationId"`
+	Summary     string      `json:"summary"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema schema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+}
+
+type parameter struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Required    bool   `json:"required"`
+	Description string `json:"description"`
+	Schema      schema `json:"schema"`
+	GoName      string `json:"x-go-name"`
+}
+
+type schema struct {
+	Ref         string     `json:"$ref"`
+	Type        string     `json:"type"`
+	Format      string     `json:"format"`
+	Description string     `json:"description"`
+	Items       *schema    `json:"items"`
+	Properties  properties `json:"properties"`
+	Required    []string   `json:"required"`
+	GoName      string     `json:"x-go-name"`
+}
+
+type property struct {
+	Name   string
+	Schema schema
+}
+
+// properties keeps the order the spec lists them in.
+type properties []property
+
+func (ps *properties) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil { // {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var s schema
+		if err := dec.Decode(&s); err != nil {
+			return err
+		}
+		*ps = append(*ps, property{Name: tok.(string), Schema: s})
+	}
+	return nil
+}
+
+var initialisms = map[string]string{"id": "ID", "url": "URL", "idx": "Idx"}
+
+// goName turns snake_case into an exported Go name.
+func goName(s string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(s, "_") {
+		if v, ok := initialisms[part]; ok {
+			b.WriteString(v)
+		} else if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+func goType(s schema) string {
+	switch {
+	case s.Ref != "":
+		return strings.TrimPrefix(s.Ref, "#/components/schemas/")
+	case s.Type == "array":
+		return "[]" + goType(*s.Items)
+	case s.Type == "integer" && s.Format == "int64":
+		return "int64"
+	case s.Type == "integer":
+		return "int"
+	case s.Type == "boolean":
+		return "bool"
+	case s.Type == "object":
+		return "json.RawMessage"
+	}
+	return "string"
+}
+
+// field is a parameter or form field of an operation.
+type field struct {
+	name, goName, doc, in string
+	required              bool
+	schema                schema
+}
+
+type generator struct {
+	buf     bytes.Buffer
+	imports map[string]bool
+}
+
+func (g *generator) p(format string, args ...any) { fmt.Fprintf(&g.buf, format+"\n", args...) }
+
+func comment(g *generator, indent, text string) {
+	if text != "" {
+		g.p("%s// %s", indent, text)
+	}
+}
+
+func (g *generator) schemaType(name string, s schema) {
+	comment(g, "", name+" is the "+name+" schema.")
+	g.p("type %s struct {", name)
+	for _, p := range s.Properties {
+		comment(g, "\t", p.Schema.Description)
+		n := p.Schema.GoName
+		if n == "" {
+			n = goName(p.Name)
+		}
+		g.p("\t%s %s `json:\"%s,omitempty\"`", n, goType(p.Schema), p.Name)
+	}
+	g.p("}\n")
+}
+
+// setValue writes the code adding f to the url.Values named v.
+func (g *generator) setValue(v string, f field) {
+	ref := "p." + f.goName
+	switch goType(f.schema) {
+	case "bool":
+		g.p("\tif %s {\n\t\t%s.Set(%q, \"1\")\n\t}", ref, v, f.name)
+	case "int", "int64":
+		g.imports["strconv"] = true
+		set := fmt.Sprintf("%s.Set(%q, strconv.FormatInt(int64(%s), 10))", v, f.name, ref)
+		if f.required {
+			g.p("\t%s", set)
+		} else {
+			g.p("\tif %s != 0 {\n\t\t%s\n\t}", ref, set)
+		}
+	default:
+		if f.required {
+			g.p("\t%s.Set(%q, %s)", v, f.name, ref)
+		} else {
+			g.p("\tif %s != \"\" {\n\t\t%s.Set(%q, %s)\n\t}", ref, v, f.name, ref)
+		}
+	}
+}
+
+func (g *generator) operation(method, path string, op operation) {
+	name := goName(op.OperationID)
+	var fields []field
+	for _, p := range op.Parameters {
+		fields = append(fields, field{p.Name, p.GoName, p.Description, "query", p.Required, p.Schema})
+	}
+	hasForm := false
+	if op.RequestBody != nil {
+		s := op.RequestBody.Content["application/x-www-form-urlencoded"].Schema
+		hasForm = true
+		for _, p := range s.Properties {
+			req := false
+			for _, r := range s.Required {
+				req = req || r == p.Name
+			}
+			fields = append(fields, field{p.Name, p.Schema.GoName, p.Schema.Description, "form", req, p.Schema})
+		}
+	}
+	for i := range fields {
+		if fields[i].goName == "" {
+			fields[i].goName = goName(fields[i].name)
+		}
+	}
+
+	// What the operation returns comes from its responses.
+	var codes []string
+	var result, kind string
+	for code, r := range op.Responses {
+		if code == "default" {
+			continue
+		}
+		codes = append(codes, code)
+		switch {
+		case code == "303":
+			result, kind = "string", "redirect"
+		case r.Content["text/event-stream"].Schema.Type != "":
+			result, kind = "io.ReadCloser", "stream"
+			g.imports["io"] = true
+		default:
+			s := r.Content["application/json"].Schema
+			g.imports["encoding/json"] = true
+			result, kind = goType(s), "json"
+			if s.Ref != "" {
+				result = "*" + result
+			}
+		}
+	}
+	sort.Strings(codes)
+
+	params := ""
+	if len(fields) > 0 {
+		params = ", p " + name + "Params"
+		g.p("// %sParams are the parameters of %s.", name, name)
+		g.p("type %sParams struct {", name)
+		for _, f := range fields {
+			comment(g, "\t", f.doc)
+			g.p("\t%s %s", f.goName, goType(f.schema))
+		}
+		g.p("}\n")
+	}
+	g.p("// %s calls %s %s: %s", name, strings.ToUpper(method), path, lowerFirst(op.Summary))
+	g.p("func (c *Client) %s(ctx context.Context%s) (%s, error) {", name, params, result)
+	zero := map[string]string{"string": `""`}[result]
+	if zero == "" {
+		zero = "nil"
+	}
+	query, form := "nil", "nil"
+	for _, f := range fields {
+		if f.in == "query" && query == "nil" {
+			query = "query"
+			g.p("\tquery := url.Values{}")
+		}
+	}
+	if hasForm {
+		form = "form"
+		g.p("\tform := url.Values{}")
+	}
+	for _, f := range fields {
+		g.setValue(f.in, f)
+	}
+	g.p("\tres, err := c.do(ctx, %q, %q, %s, %s)", strings.ToUpper(method), path, query, form)
+	g.p("\tif err != nil {\n\t\treturn %s, err\n\t}", zero)
+	if kind == "stream" {
+		g.p("\tif err := expect(res, %s); err != nil {\n\t\tres.Body.Close()\n\t\treturn nil, err\n\t}", strings.Join(codes, ", "))
+		g.p("\treturn res.Body, nil\n}\n")
+		return
+	}
+	g.p("\tdefer res.Body.Close()")
+	g.p("\tif err := expect(res, %s); err != nil {\n\t\treturn %s, err\n\t}", strings.Join(codes, ", "), zero)
+	switch kind {
+	case "redirect":
+		g.p("\treturn res.Header.Get(\"Location\"), nil\n}\n")
+	case "json":
+		g.p("\tvar v %s", strings.TrimPrefix(result, "*"))
+		g.p("\tif err := json.NewDecoder(res.Body).Decode(&v); err != nil {\n\t\treturn %s, err\n\t}", zero)
+		if strings.HasPrefix(result, "*") {
+			g.p("\treturn &v, nil\n}\n")
+		} else {
+			g.p("\treturn v, nil\n}\n")
+		}
+	}
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func main() {
+	b, err := os.ReadFile("openapi.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var sp spec
+	if err := json.Unmarshal(b, &sp); err != nil {
+		log.Fatal(err)
+	}
+	g := &generator{imports: map[string]bool{"context": true, "net/url": true}}
+
+	var names []string
+	for name := range sp.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g.schemaType(name, sp.Components.Schemas[name])
+	}
+	type op struct {
+		method, path string
+		operation
+	}
+	var ops []op
+	for path, methods := range sp.Paths {
+		for method, o := range methods {
+			ops = append(ops, op{method, path, o})
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].OperationID < ops[j].OperationID })
+	for _, o := range ops {
+		g.operation(o.method, o.path, o.operation)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "// Code generated by gen.go from openapi.json; DO NOT EDIT.\n\npackage client\n\nimport (")
+	var imports []string
+	for imp := range g.imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(&out, "\t%q\n", imp)
+	}
+	fmt.Fprintln(&out, ")\n")
+	out.Write(g.buf.Bytes())
+	src, err := format.Source(out.Bytes())
+	if err != nil {
+		log.Fatalf("format: %v\n%s", err, out.Bytes())
+	}
+	if err := os.WriteFile("client_gen.go", src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,29 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Scoped worktrees. A notebook scoped to a subdirectory of a monorepo gets
+// a sparse worktree in cone mode: the subdirectory, plus the files (not
+// directories) at the top of the repository, where build files live.
+// Sparse checkout is set per worktree, so the shared clone and the other
+// notebooks keep every file.
+
+// SparseCheckout limits the worktree at wtDir to subdir and checks it out.
+// The worktree may have been added with --no-checkout.
+func SparseCheckout(ctx context.Context, wtDir, subdir string) error {
+	for _, args := range [][]string{
+		{"sparse-checkout", "set", "--cone", "--", subdir},
+		{"checkout"},
+	} {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", wtDir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+// Package gitops lays out trybook's clones and notebook worktrees on disk
+// and creates and removes the worktrees. It has no state of its own beyond
+// the directories it is given, so it can be used and tested without the
+// server.
+package gitops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultHost is the git host whose repositories keep the original
+// <org>/<repo> layout.
+const DefaultHost = "github.com"
+
+// LocalHost is the host of repositories cloned from a directory on the
+// server, whose org is the directory's parent path.
+const LocalHost = "local"
+
+// WorktreeManager knows where clones and worktrees live. Clones are at
+// CloneRoot/[host/]org/repo and a notebook's worktree at
+// WorktreeRoot/[host/]org/repo/nb-<id>, on the branch nb-<id>. The org is
+// always one directory (see OrgDir), so no repository's directory is ever
+// inside another's.
+type WorktreeManager struct {
+	CloneRoot    string
+	WorktreeRoot string
+	// NewID returns a fresh notebook ID for each attempt to add a worktree.
+	NewID func() string
+}
+
+// HostDir is the path component for a git host. github.com repos keep the
+// original <org>/<repo> layout; other hosts get their own directory, which
+// must not be a name a GitHub owner can have. Host names with a dot cannot
+// be one; dotless hosts (a LAN server, localhost:3000) and local
+// repositories get a leading "_", which GitHub owners cannot start with and
+// host names cannot contain.
+func HostDir(host string) string {
+	switch {
+	case host == "" || host == DefaultHost:
+		return ""
+	case host == LocalHost:
+		return "_local"
+	case !strings.Contains(host, "."):
+		return "_" + strings.ReplaceAll(host, ":", "_")
+	}
+	return strings.ReplaceAll(host, ":", "_")
+}
+
+// OrgDir is the path component for an org. Nested GitLab groups and the
+// parent path of a local repository have slashes, which are escaped so the
+// org stays one directory: otherwise group a's repository b would hold
+// every repository of group a/b.
+func OrgDir(org string) string {
+	return strings.ReplaceAll(org, "/", "%2F")
+}
+
+// RepoDir is where a repository is cloned.
+func (m *WorktreeManager) RepoDir(host, org, repo string) string {
+	return filepath.Join(m.CloneRoot, HostDir(host), OrgDir(org), repo)
+}
+
+// WorktreeDir is where a repository's worktree name is checked out.
+func (m *WorktreeManager) WorktreeDir(host, org, repo, name string) string {
+	return filepath.Join(m.WorktreeRoot, HostDir(host), OrgDir(org), repo, name)
+}
+
+// legacyDir is where the layout before OrgDir and the "_" of dotless hosts
+// put root's directory for a repository.
+func legacyDir(root, host, org, repo string) string {
+	hostDir := HostDir(host)
+	if host != LocalHost {
+		hostDir = strings.TrimPrefix(hostDir, "_")
+	}
+	return filepath.Join(root, hostDir, org, repo)
+}
+
+// Relayout moves a clone and its worktrees names from where the old layout
+// put them to RepoDir and WorktreeDir, and has git repair the links between
+// them. Whatever is already in place, or missing, is left alone. A clone
+// whose org is nested in another's holds that clone's old directory, so
+// callers relayout the deeper orgs first.
+func (m *WorktreeManager) Relayout(ctx context.Context, host, org, repo string, names []string) error {
+	cloneDir := m.RepoDir(host, org, repo)
+	oldClone := legacyDir(m.CloneRoot, host, org, repo)
+	if oldClone == cloneDir {
+		return nil
+	}
+	moved := false
+	if !pathExists(filepath.Join(cloneDir, ".git")) && pathExists(filepath.Join(oldClone, ".git")) {
+		if err := moveDir(oldClone, cloneDir); err != nil {
+			return err
+		}
+		moved = true
+	}
+	var wtDirs []string
+	for _, name := range names {
+		wtDir := m.WorktreeDir(host, org, repo, name)
+		oldWt := filepath.Join(legacyDir(m.WorktreeRoot, host, org, repo), name)
+		if !pathExists(wtDir) && pathExists(oldWt) {
+			if err := moveDir(oldWt, wtDir); err != nil {
+				return err
+			}
+			moved = true
+		}
+		if pathExists(wtDir) {
+			wtDirs = append(wtDirs, wtDir)
+		}
+	}
+	if !moved || !pathExists(filepath.Join(cloneDir, ".git")) {
+		return nil
+	}
+	slog.InfoContext(ctx, "relayout: moved", "from", oldClone, "to", cloneDir, "worktrees", len(wtDirs))
+	args := append([]string{"-C", cloneDir, "worktree", "repair"}, wtDirs...)
+	if out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("git worktree repair in %s: %v\n%s", cloneDir, err, out)
+	}
+	return nil
+}
+
+func moveDir(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// Adding a notebook's worktree. git worktree add can fail for reasons a
+// fresh attempt fixes: the random branch name is taken, a directory or a
+// stale worktree registration is in the way, or another git process holds
+// the repository's lock. Those are retried under a new notebook ID (after
+// git worktree prune, or a short wait for the lock). Whatever a failed
+// attempt created, directory or branch, is removed again. Other failures
+// come back as a *WorktreeError saying what went wrong.
+
+const worktreeAttempts = 3
+
+// WorktreeError is a failed git worktree add.
+type WorktreeError struct {
+	Reason string // what went wrong, for the user
+	Output string // git's output
+}
+
+func (e *WorktreeError) Error() string {
+	return "create worktree: " + e.Reason + "\n" + e.Output
+}
+
+type worktreeRetry int
+
+const (
+	retryNever worktreeRetry = iota
+	retryRenamed
+	retryPruned
+	retryWaited
+)
+
+// classifyWorktreeAdd explains git worktree add's output and says whether
+// and how another attempt may succeed.
+func classifyWorktreeAdd(out string) (string, worktreeRetry) {
+	o := strings.ToLower(out)
+	switch {
+	case strings.Contains(o, "a branch named") && strings.Contains(o, "already exists"):
+		return "the branch name is already taken", retryRenamed
+	case strings.Contains(o, "missing but locked worktree"), strings.Contains(o, "missing but already registered worktree"):
+		return "a stale worktree is registered at that path", retryPruned
+	case strings.Contains(o, "already exists"):
+		return "the worktree directory already exists", retryRenamed
+	case strings.Contains(o, ".lock': file exists"):
+		return "the repository is locked by another git process (remove the .lock file if none is running)", retryWaited
+	case strings.Contains(o, "invalid reference"), strings.Contains(o, "not a valid object name"), strings.Contains(o, "not a valid branch point"), strings.Contains(o, "not a commit"):
+		return "the start commit is not in the clone", retryNever
+	case strings.Contains(o, "no space left on device"):
+		return "the disk is full", retryNever
+	case strings.Contains(o, "permission denied"):
+		return "permission denied", retryNever
+	}
+	return "git worktree add failed", retryNever
+}
+
+// BranchExists reports whether the clone at cloneDir has branch.
+func BranchExists(ctx context.Context, cloneDir, branch string) bool {
+	return exec.CommandContext(ctx, "git", "-C", cloneDir, "rev-parse", "--verify", "--quiet", "refs/heads/"+branch).Run() == nil
+}
+
+func pathExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// Add creates the worktree and branch for a new notebook, started at
+// commit (HEAD if empty), and returns the notebook's ID and the worktree's
+// name.
+func (m *WorktreeManager) Add(ctx context.Context, host, org, repo, commit string) (id, wtName string, err error) {
+	return m.AddScoped(ctx, host, org, repo, commit, "")
+}
+
+// AddScoped is Add for a notebook scoped to subdir of the repository; see
+// SparseCheckout. An empty subdir is the whole repository.
+func (m *WorktreeManager) AddScoped(ctx context.Context, host, org, repo, commit, subdir string) (id, wtName string, err error) {
+	return m.addScoped(ctx, m.NewID, host, org, repo, commit, subdir)
+}
+
+// AddScopedAs is AddScoped for a notebook whose ID is already chosen.
+func (m *WorktreeManager) AddScopedAs(ctx context.Context, id, host, org, repo, commit, subdir string) (wtName string, err error) {
+	_, wtName, err = m.addScoped(ctx, func() string { return id }, host, org, repo, commit, subdir)
+	return wtName, err
+}
+
+func (m *WorktreeManager) addScoped(ctx context.Context, newID func() string, host, org, repo, commit, subdir string) (id, wtName string, err error) {
+	cloneDir := m.RepoDir(host, org, repo)
+	if subdir != "" {
+		rev := commit
+		if rev == "" {
+			rev = "HEAD"
+		}
+		out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "cat-file", "-t", rev+":"+subdir).Output()
+		if err != nil || strings.TrimSpace(string(out)) != "tree" {
+			return "", "", &WorktreeError{Reason: "the repository has no directory " + subdir}
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		id = newID()
+		wtName = "nb-" + id
+		wtDir := m.WorktreeDir(host, org, repo, wtName)
+		dirExisted, branchExisted := pathExists(wtDir), BranchExists(ctx, cloneDir, wtName)
+
+		// git -C <clone> worktree add -b <wtName> <wtDir> [<commit>]
+		args := []string{"-C", cloneDir, "worktree", "add", "-b", wtName, wtDir}
+		if subdir != "" {
+			// SparseCheckout fills it in.
+			args = append(args, "--no-checkout")
+		}
+		if commit != "" {
+			args = append(args, commit)
+		}
+		out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput()
+		if err == nil && subdir != "" {
+			if err := SparseCheckout(ctx, wtDir, subdir); err != nil {
+				m.Remove(ctx, host, org, repo, wtName)
+				return "", "", &WorktreeError{Reason: "sparse checkout of " + subdir + " failed", Output: err.Error()}
+			}
+		}
+		if err == nil {
+			return id, wtName, nil
+		}
+		reason, retry := classifyWorktreeAdd(string(out))
+		cleanupWorktreeAttempt(ctx, cloneDir, wtDir, wtName, dirExisted, branchExisted)
+		if retry == retryNever || attempt == worktreeAttempts || ctx.Err() != nil {
+			return "", "", &WorktreeError{Reason: reason, Output: strings.TrimSpace(string(out))}
+		}
+		slog.WarnContext(ctx, "worktree add failed; retrying", "attempt", attempt, "reason", reason, "dir", wtDir)
+		switch retry {
+		case retryPruned:
+			_ = exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "prune").Run()
+		case retryWaited:
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+	}
+}
+
+// cleanupWorktreeAttempt removes what a failed git worktree add left
+// behind, but nothing that was there before it ran.
+func cleanupWorktreeAttempt(ctx context.Context, cloneDir, wtDir, branch string, dirExisted, branchExisted bool) {
+	ctx = context.WithoutCancel(ctx)
+	if !dirExisted && pathExists(wtDir) {
+		if err := os.RemoveAll(wtDir); err != nil {
+			slog.ErrorContext(ctx, "worktree cleanup: remove dir", "dir", wtDir, "err", err)
+		}
+	}
+	_ = exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "prune").Run()
+	if !branchExisted && BranchExists(ctx, cloneDir, branch) {
+		if out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "branch", "-D", branch).CombinedOutput(); err != nil {
+			slog.ErrorContext(ctx, "worktree cleanup: delete branch", "branch", branch, "err", err, "output", strings.TrimSpace(string(out)))
+		}
+	}
+}
+
+// Remove undoes Add when creating the notebook fails afterwards.
+func (m *WorktreeManager) Remove(ctx context.Context, host, org, repo, wtName string) {
+	ctx = context.WithoutCancel(ctx)
+	cloneDir := m.RepoDir(host, org, repo)
+	wtDir := m.WorktreeDir(host, org, repo, wtName)
+	if out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "remove", "--force", wtDir).CombinedOutput(); err != nil {
+		slog.ErrorContext(ctx, "worktree cleanup: remove worktree", "dir", wtDir, "err", err, "output", strings.TrimSpace(string(out)))
+	}
+	cleanupWorktreeAttempt(ctx, cloneDir, wtDir, wtName, false, false)
+}
+
+// ErrorMessage is err's reason, for the user, if it is a *WorktreeError.
+func ErrorMessage(err error) (string, bool) {
+	var we *WorktreeError
+	if errors.As(err, &we) {
+		return fmt.Sprintf("Failed to create notebook: %s.", we.Reason), true
+	}
+	return "", false
+}
@@ -0,0 +1,235 @@
+package gitops
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	m := &WorktreeManager{CloneRoot: "/c", WorktreeRoot: "/w"}
+	for _, tc := range []struct {
+		host, org, hostDir, repoDir, wtDir string
+	}{
+		{"", "acme", "", "/c/acme/widget", "/w/acme/widget/nb-1"},
+		{DefaultHost, "acme", "", "/c/acme/widget", "/w/acme/widget/nb-1"},
+		{LocalHost, "home/me", "_local", "/c/_local/home%2Fme/widget", "/w/_local/home%2Fme/widget/nb-1"},
+		{"git.example.com:8443", "acme", "git.example.com_8443", "/c/git.example.com_8443/acme/widget", "/w/git.example.com_8443/acme/widget/nb-1"},
+		{"gitlab.com", "acme/widget", "gitlab.com", "/c/gitlab.com/acme%2Fwidget/widget", "/w/gitlab.com/acme%2Fwidget/widget/nb-1"},
+		{"gitserver", "acme", "_gitserver", "/c/_gitserver/acme/widget", "/w/_gitserver/acme/widget/nb-1"},
+		{"localhost:3000", "acme", "_localhost_3000", "/c/_localhost_3000/acme/widget", "/w/_localhost_3000/acme/widget/nb-1"},
+	} {
+		if got := HostDir(tc.host); got != tc.hostDir {
+			t.Errorf("HostDir(%q) = %q, want %q", tc.host, got, tc.hostDir)
+		}
+		if got := m.RepoDir(tc.host, tc.org, "widget"); got != tc.repoDir {
+			t.Errorf("RepoDir(%q, %q) = %q, want %q", tc.host, tc.org, got, tc.repoDir)
+		}
+		if got := m.WorktreeDir(tc.host, tc.org, "widget", "nb-1"); got != tc.wtDir {
+			t.Errorf("WorktreeDir(%q, %q) = %q, want %q", tc.host, tc.org, got, tc.wtDir)
+		}
+	}
+}
+
+// No repository's directory may be inside another's, or cleaning up one
+// could delete the other.
+func TestLayoutNoNesting(t *testing.T) {
+	m := &WorktreeManager{CloneRoot: "/c", WorktreeRoot: "/w"}
+	repos := [][3]string{
+		{DefaultHost, "acme", "widget"},
+		{DefaultHost, "gitserver", "acme"},
+		{"gitserver", "acme", "widget"},
+		{"gitlab.com", "a", "b"},
+		{"gitlab.com", "a/b", "repo"},
+		{"gitlab.com", "a/b/repo", "x"},
+		{LocalHost, "home", "me"},
+		{LocalHost, "home/me", "src"},
+	}
+	for _, a := range repos {
+		for _, b := range repos {
+			if a == b {
+				continue
+			}
+			da, db := m.RepoDir(a[0], a[1], a[2]), m.RepoDir(b[0], b[1], b[2])
+			if strings.HasPrefix(db+"/", da+"/") {
+				t.Errorf("%v's clone %s is inside %v's clone %s", b, db, a, da)
+			}
+		}
+	}
+}
+
+func TestClassifyWorktreeAdd(t *testing.T) {
+	for _, tc := range []struct {
+		out   string
+		retry worktreeRetry
+	}{
+		{"fatal: a branch named 'nb-1' already exists", retryRenamed},
+		{"fatal: '/w/acme/widget/nb-1' already exists", retryRenamed},
+		{"fatal: '/w/acme/widget/nb-1' is a missing but already registered worktree;", retryPruned},
+		{"fatal: Unable to create '/c/acme/widget/.git/worktrees.lock': File exists.", retryWaited},
+		{"fatal: invalid reference: deadbeef", retryNever},
+		{"fatal: not a valid branch point: 'deadbeef'", retryNever},
+		{"something else entirely", retryNever},
+	} {
+		if _, retry := classifyWorktreeAdd(tc.out); retry != tc.retry {
+			t.Errorf("classifyWorktreeAdd(%q) retry = %d, want %d", tc.out, retry, tc.retry)
+		}
+	}
+}
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newManager returns a manager over a temporary clone of acme/widget with
+// one commit holding README, pkg/b.go, pkg/a/a.go and lib/c.go, and IDs
+// 1, 2, 3, ...
+func newManager(t *testing.T) *WorktreeManager {
+	t.Helper()
+	root := t.TempDir()
+	n := 0
+	m := &WorktreeManager{
+		CloneRoot:    filepath.Join(root, "clones"),
+		WorktreeRoot: filepath.Join(root, "worktrees"),
+		NewID:        func() string { n++; return strconv.Itoa(n) },
+	}
+	clone := m.RepoDir("", "acme", "widget")
+	if err := os.MkdirAll(filepath.Join(clone, "pkg", "a"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(clone, "lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range map[string]string{"README": "widget\n", "pkg/a/a.go": "package a\n", "pkg/b.go": "package pkg\n", "lib/c.go": "package lib\n"} {
+		if err := os.WriteFile(filepath.Join(clone, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(t, clone, "init", "-q", "-b", "main")
+	git(t, clone, "add", ".")
+	git(t, clone, "commit", "-q", "-m", "init")
+	return m
+}
+
+func TestAddAndRemove(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t)
+	clone := m.RepoDir("", "acme", "widget")
+
+	id, wtName, err := m.Add(ctx, "", "acme", "widget", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1" || wtName != "nb-1" {
+		t.Errorf("Add = %q, %q; want 1, nb-1", id, wtName)
+	}
+	wtDir := m.WorktreeDir("", "acme", "widget", wtName)
+	if _, err := os.Stat(filepath.Join(wtDir, "pkg", "a", "a.go")); err != nil {
+		t.Errorf("worktree is missing a file: %v", err)
+	}
+	if got := git(t, wtDir, "branch", "--show-current"); got != wtName {
+		t.Errorf("worktree is on %q, want %q", got, wtName)
+	}
+
+	// nb-2 is taken, so the next Add retries as nb-3.
+	git(t, clone, "branch", "nb-2")
+	id, wtName, err = m.Add(ctx, "", "acme", "widget", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "3" || wtName != "nb-3" {
+		t.Errorf("Add over a taken branch = %q, %q; want 3, nb-3", id, wtName)
+	}
+	if !BranchExists(ctx, clone, "nb-2") {
+		t.Error("a failed attempt deleted the branch that was in its way")
+	}
+
+	m.Remove(ctx, "", "acme", "widget", "nb-1")
+	if _, err := os.Stat(wtDir); !os.IsNotExist(err) {
+		t.Errorf("Remove left the worktree directory: %v", err)
+	}
+	if BranchExists(ctx, clone, "nb-1") {
+		t.Error("Remove left the branch")
+	}
+}
+
+func TestAddBadCommit(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t)
+	_, _, err := m.Add(ctx, "", "acme", "widget", "0123456789abcdef0123456789abcdef01234567")
+	msg, ok := ErrorMessage(err)
+	if !ok || !strings.Contains(msg, "not in the clone") {
+		t.Fatalf("Add at a missing commit: %v (%q)", err, msg)
+	}
+	if BranchExists(ctx, m.RepoDir("", "acme", "widget"), "nb-1") {
+		t.Error("the failed Add left its branch")
+	}
+}
+
+func TestAddScoped(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t)
+	_, wtName, err := m.AddScoped(ctx, "", "acme", "widget", "", "pkg/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wtDir := m.WorktreeDir("", "acme", "widget", wtName)
+	for name, want := range map[string]bool{"README": true, "pkg/a/a.go": true, "pkg/b.go": true, "lib/c.go": false} {
+		_, err := os.Stat(filepath.Join(wtDir, name))
+		if got := err == nil; got != want {
+			t.Errorf("%s checked out = %v, want %v", name, got, want)
+		}
+	}
+
+	if _, _, err := m.AddScoped(ctx, "", "acme", "widget", "", "nope"); err == nil {
+		t.Error("AddScoped to a missing directory succeeded")
+	} else if msg, _ := ErrorMessage(err); !strings.Contains(msg, "no directory nope") {
+		t.Errorf("AddScoped to a missing directory: %q", msg)
+	}
+}
+
+func TestRelayout(t *testing.T) {
+	ctx := context.Background()
+	m := newManager(t)
+	const host, org = "gitlab.com", "acme/tools"
+	old := legacyDir(m.CloneRoot, host, org, "widget")
+	if err := os.MkdirAll(filepath.Dir(old), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(m.RepoDir("", "acme", "widget"), old); err != nil {
+		t.Fatal(err)
+	}
+	oldWt := filepath.Join(legacyDir(m.WorktreeRoot, host, org, "widget"), "nb-1")
+	git(t, old, "worktree", "add", "-q", "-b", "nb-1", oldWt)
+
+	if err := m.Relayout(ctx, host, org, "widget", []string{"nb-1"}); err != nil {
+		t.Fatal(err)
+	}
+	wtDir := m.WorktreeDir(host, org, "widget", "nb-1")
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Relayout left the old clone: %v", err)
+	}
+	if got := git(t, wtDir, "branch", "--show-current"); got != "nb-1" {
+		t.Errorf("moved worktree is on %q, want nb-1", got)
+	}
+	if got := git(t, m.RepoDir(host, org, "widget"), "worktree", "list", "--porcelain"); !strings.Contains(got, "worktree "+wtDir+"\n") {
+		t.Errorf("the moved clone does not know the moved worktree:\n%s", got)
+	}
+	// A second run finds everything in place.
+	if err := m.Relayout(ctx, host, org, "widget", []string{"nb-1"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,10 +2,12 @@ module trybook
 
 go 1.23.6
 
-require modernc.org/sqlite v1.38.2
+require (
+	github.com/creack/pty v1.1.24
+	modernc.org/sqlite v1.38.2
+)
 
 require (
-	github.com/creack/pty v1.1.24 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
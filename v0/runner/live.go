@@ -0,0 +1,67 @@
+package runner
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Live holds the runs in flight and those finished within Retention, by
+// Key. Checking for a run and registering one usually go together, so
+// callers Lock it around Get, Set, Delete and Each; Has and Retire lock it
+// themselves.
+type Live struct {
+	sync.Mutex
+	runs map[string]*Run
+}
+
+func NewLive() *Live {
+	return &Live{runs: make(map[string]*Run)}
+}
+
+// Get returns the run under key, or nil. The caller holds the lock.
+func (g *Live) Get(key string) *Run { return g.runs[key] }
+
+// Set registers r under key, replacing any earlier run. The caller holds
+// the lock.
+func (g *Live) Set(key string, r *Run) { g.runs[key] = r }
+
+// Delete forgets the run under key. The caller holds the lock.
+func (g *Live) Delete(key string) { delete(g.runs, key) }
+
+// Each calls fn with every run, in no particular order; fn may Delete
+// them. The caller holds the lock.
+func (g *Live) Each(fn func(key string, r *Run)) {
+	for key, r := range g.runs {
+		fn(key, r)
+	}
+}
+
+// Notebook calls fn with the runs of notebook nbID. The caller holds the
+// lock.
+func (g *Live) Notebook(nbID string, fn func(key string, r *Run)) {
+	for key, r := range g.runs {
+		if strings.HasPrefix(key, nbID+"/") {
+			fn(key, r)
+		}
+	}
+}
+
+// Has reports whether a run is registered under key.
+func (g *Live) Has(key string) bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.runs[key] != nil
+}
+
+// Retire forgets r once Retention has passed, unless another run has
+// taken its key by then.
+func (g *Live) Retire(key string, r *Run) {
+	time.AfterFunc(Retention, func() {
+		g.Lock()
+		defer g.Unlock()
+		if g.runs[key] == r {
+			delete(g.runs, key)
+		}
+	})
+}
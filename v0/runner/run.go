@@ -0,0 +1,165 @@
+// Package runner describes the model runners trybook can start (Runner,
+// and the Registry of them a config defines) and keeps the runs it has in
+// flight: each run's event log, which clients follow and resume over SSE or
+// a WebSocket, and the Live runs by notebook entry and model. It does not
+// start processes or store anything; the server emits the events of the
+// runs it starts and registers them here.
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Retention is how long finished runs stay replayable.
+	Retention = 5 * time.Minute
+	// MaxBytes caps the event data kept per run.
+	MaxBytes = 4 << 20
+)
+
+// Event is one event of a run. Data is JSON.
+type Event struct {
+	ID   int
+	Name string
+	Data string
+}
+
+// Run is a run's event log: a ring buffer of up to MaxBytes of event data.
+// A client that resumes after the oldest events it missed were dropped is
+// told how many (see Since and Truncated).
+type Run struct {
+	mu      sync.Mutex
+	events  []Event // the retained events, oldest first
+	base    int     // events with IDs up to base were dropped
+	size    int     // bytes of data in events
+	done    bool
+	changed chan struct{} // closed and replaced whenever events are added
+	cancel  context.CancelFunc
+	last    time.Time // when the latest event was added, or the run created
+
+	// The entry and model the run is for, set before its first event.
+	NotebookID string
+	Idx        int
+	Model      string
+	Seq        int64 // distinguishes attempts at the same entry and model
+	// OnEvent, if set, is called with each event after it is added.
+	OnEvent func(*Run, Event)
+}
+
+var seq atomic.Int64
+
+// NextSeq returns a new Seq.
+func NextSeq() int64 { return seq.Add(1) }
+
+// NewRun returns an empty run; Cancel calls cancel.
+func NewRun(cancel context.CancelFunc) *Run {
+	return &Run{changed: make(chan struct{}), cancel: cancel, last: time.Now()}
+}
+
+// Emit adds an event with v, as JSON, for its data.
+func (r *Run) Emit(name string, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b = []byte("null")
+	}
+	r.mu.Lock()
+	ev := Event{ID: r.base + len(r.events) + 1, Name: name, Data: string(b)}
+	r.events = append(r.events, ev)
+	r.size += len(ev.Data)
+	r.last = time.Now()
+	for r.size > MaxBytes && len(r.events) > 1 {
+		r.size -= len(r.events[0].Data)
+		r.events[0] = Event{}
+		r.events = r.events[1:]
+		r.base++
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mu.Unlock()
+	if r.OnEvent != nil {
+		r.OnEvent(r, ev)
+	}
+}
+
+// Finish marks the run finished; followers stop after its last event.
+func (r *Run) Finish() {
+	r.mu.Lock()
+	r.done = true
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.mu.Unlock()
+}
+
+// Cancel stops the run, or takes it out of the queue.
+func (r *Run) Cancel() { r.cancel() }
+
+// Since returns the retained events after id, how many events after id
+// were dropped from the buffer, whether the run has finished, and a
+// channel that is closed when more events arrive.
+func (r *Run) Since(id int) ([]Event, int, bool, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id < 0 {
+		id = 0
+	}
+	missed := 0
+	if id < r.base {
+		missed, id = r.base-id, r.base
+	}
+	var evs []Event
+	if i := id - r.base; i < len(r.events) {
+		evs = append(evs, r.events[i:]...)
+	}
+	return evs, missed, r.done, r.changed
+}
+
+// Quiet returns how long it has been since the run's latest event.
+func (r *Run) Quiet() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return time.Since(r.last)
+}
+
+// Finished reports whether Finish was called.
+func (r *Run) Finished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.done
+}
+
+// Truncated is the event telling a client that missed events were dropped.
+func Truncated(missed int) Event {
+	return Event{Name: "truncated", Data: fmt.Sprintf(`{"missed":%d}`, missed)}
+}
+
+// CompactChunks merges runs of consecutive chunk (or stderr) events into
+// one event with the last one's ID, so a replay is a few messages, not
+// thousands.
+func CompactChunks(evs []Event) []Event {
+	var out []Event
+	for _, ev := range evs {
+		if n := len(out); n > 0 && (ev.Name == "chunk" || ev.Name == "stderr") && out[n-1].Name == ev.Name {
+			var a, b string
+			if json.Unmarshal([]byte(out[n-1].Data), &a) == nil && json.Unmarshal([]byte(ev.Data), &b) == nil {
+				if d, err := json.Marshal(a + b); err == nil {
+					out[n-1] = Event{ID: ev.ID, Name: ev.Name, Data: string(d)}
+					continue
+				}
+			}
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// Key is the registry key of the run of model for entry idx of notebook
+// nbID.
+func Key(nbID string, idx int, model string) string {
+	return nbID + "/" + strconv.Itoa(idx) + "/" + model
+}
@@ -0,0 +1,98 @@
+package runner
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSince(t *testing.T) {
+	r := NewRun(func() {})
+	r.Emit("chunk", "a")
+	r.Emit("chunk", "b")
+	_, _, _, changed := r.Since(2)
+	r.Emit("done", map[string]int{"code": 0})
+	select {
+	case <-changed:
+	default:
+		t.Error("Emit did not wake a follower")
+	}
+	r.Finish()
+
+	evs, missed, done, _ := r.Since(1)
+	if missed != 0 || !done || len(evs) != 2 || evs[0].ID != 2 || evs[0].Data != `"b"` || evs[1].Name != "done" {
+		t.Errorf("Since(1) = %+v, %d, %v", evs, missed, done)
+	}
+	if evs, _, _, _ := r.Since(3); len(evs) != 0 {
+		t.Errorf("Since(3) = %+v, want none", evs)
+	}
+}
+
+func TestSinceTruncated(t *testing.T) {
+	r := NewRun(func() {})
+	big := strings.Repeat("x", MaxBytes/2-8) // two fit, with their quotes
+	for range 3 {
+		r.Emit("chunk", big)
+	}
+	evs, missed, _, _ := r.Since(0)
+	if missed != 1 || len(evs) != 2 || evs[0].ID != 2 {
+		t.Errorf("Since(0) after overflow: %d events from %d, %d missed", len(evs), evs[0].ID, missed)
+	}
+}
+
+func TestCompactChunks(t *testing.T) {
+	r := NewRun(func() {})
+	r.Emit("chunk", "a")
+	r.Emit("chunk", "b")
+	r.Emit("stderr", "warn")
+	r.Emit("chunk", "c")
+	evs, _, _, _ := r.Since(0)
+	got := CompactChunks(evs)
+	want := []Event{{2, "chunk", `"ab"`}, {3, "stderr", `"warn"`}, {4, "chunk", `"c"`}}
+	if len(got) != len(want) {
+		t.Fatalf("CompactChunks = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("CompactChunks[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLive(t *testing.T) {
+	g := NewLive()
+	a, b := NewRun(func() {}), NewRun(func() {})
+	g.Lock()
+	g.Set(Key("nb1", 0, "echo"), a)
+	g.Set(Key("nb1", 1, "echo"), b)
+	g.Set(Key("nb10", 0, "echo"), NewRun(func() {}))
+	var keys []string
+	g.Notebook("nb1", func(key string, _ *Run) { keys = append(keys, key) })
+	g.Unlock()
+	if len(keys) != 2 {
+		t.Errorf("Notebook(nb1) = %v, want its two runs", keys)
+	}
+	if !g.Has("nb1/1/echo") || g.Has("nb1/2/echo") {
+		t.Error("Has disagrees with Set")
+	}
+}
+
+type namedRunner string
+
+func (n namedRunner) Name() string              { return string(n) }
+func (n namedRunner) Command(p string) []string { return []string{string(n), p} }
+func (n namedRunner) Env() []string             { return nil }
+func (n namedRunner) Stdin(string) io.Reader    { return nil }
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry([]Runner{namedRunner("router"), namedRunner("b"), namedRunner("a")}, []string{"b", "a"})
+	if got := r.Models(); len(got) != 2 || got[0] != "b" || got[1] != "a" {
+		t.Errorf("Models() = %v, want [b a]", got)
+	}
+	if rn, ok := r.Get("router"); !ok || rn.Name() != "router" {
+		t.Errorf("Get(router) = %v, %v", rn, ok)
+	}
+	if _, ok := r.Get("c"); ok {
+		t.Error("Get(c) found a runner")
+	}
+}
@@ -0,0 +1,40 @@
+package runner
+
+import "io"
+
+// Runner describes how to invoke one model CLI. The server only talks to
+// Runners; which ones exist is decided by its config.
+type Runner interface {
+	Name() string
+	// Command returns the argv for a run of prompt.
+	Command(prompt string) []string
+	// Env returns the child process environment.
+	Env() []string
+	// Stdin returns the input to feed the process, or nil.
+	Stdin(prompt string) io.Reader
+}
+
+// Registry holds the runners of one config snapshot.
+type Registry struct {
+	byName map[string]Runner
+	order  []string
+}
+
+// NewRegistry returns a registry of runners. models names the user-facing
+// ones in display order; the rest (the router) are only found by Get.
+func NewRegistry(runners []Runner, models []string) *Registry {
+	r := &Registry{byName: make(map[string]Runner, len(runners)), order: models}
+	for _, rn := range runners {
+		r.byName[rn.Name()] = rn
+	}
+	return r
+}
+
+// Get returns the runner called name.
+func (r *Registry) Get(name string) (Runner, bool) {
+	rn, ok := r.byName[name]
+	return rn, ok
+}
+
+// Models returns the user-facing model names in display order.
+func (r *Registry) Models() []string { return r.order }
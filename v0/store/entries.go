@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Prompt returns the prompt of entry idx of notebook nbID.
+func (s *NotebookStore) Prompt(ctx context.Context, nbID string, idx int) (string, error) {
+	var prompt string
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT prompt FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, nbID, idx).Scan(&prompt)
+	return prompt, err
+}
+
+// Intent returns the entry's recorded intent, or "" if none is.
+func (s *NotebookStore) Intent(ctx context.Context, nbID string, idx int) (string, error) {
+	var intent string
+	err := s.DB.QueryRowContext(ctx, `
+		SELECT intent FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, nbID, idx).Scan(&intent)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return intent, err
+}
+
+// SetIntent records the entry's intent and who decided it.
+func (s *NotebookStore) SetIntent(ctx context.Context, nbID string, idx int, intent, source string) error {
+	_, err := s.Exec(ctx, `
+		UPDATE notebook_entries
+		SET intent = ?, intent_source = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+		WHERE notebook_id = ? AND idx = ?
+	`, intent, source, nbID, idx)
+	return err
+}
+
+// EditModel returns the model picked to make the entry's edit, or "".
+func (s *NotebookStore) EditModel(ctx context.Context, nbID string, idx int) string {
+	var m string
+	_ = s.DB.QueryRowContext(ctx, `
+		SELECT edit_model FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, nbID, idx).Scan(&m)
+	return m
+}
+
+// SetTests records the outcome of the tests run after the entry's edit:
+// "pass", "fail", or "" while they run.
+func (s *NotebookStore) SetTests(ctx context.Context, nbID string, idx int, status string) error {
+	_, err := s.Exec(ctx, `
+		UPDATE notebook_entries
+		SET tests = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+		WHERE notebook_id = ? AND idx = ?
+	`, status, nbID, idx)
+	return err
+}
+
+// ClearInterrupted drops the entry's interrupted flag as it runs again.
+func (s *NotebookStore) ClearInterrupted(ctx context.Context, nbID string, idx int) error {
+	_, err := s.Exec(ctx, `
+		UPDATE notebook_entries SET interrupted = 0 WHERE notebook_id = ? AND idx = ? AND interrupted = 1
+	`, nbID, idx)
+	return err
+}
+
+// SetOutput stores model's output for the entry (entry_outputs).
+func (s *NotebookStore) SetOutput(ctx context.Context, nbID string, idx int, model, out string) error {
+	return s.InTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO entry_outputs(notebook_id, idx, model, output)
+			VALUES(?, ?, ?, ?)
+			ON CONFLICT(notebook_id, idx, model) DO UPDATE SET
+				output = excluded.output,
+				updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+		`, nbID, idx, model, out); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE notebook_entries
+			SET updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+			WHERE notebook_id = ? AND idx = ?
+		`, nbID, idx)
+		return err
+	})
+}
+
+// SetOutputStderr stores what model printed on standard error.
+func (s *NotebookStore) SetOutputStderr(ctx context.Context, nbID string, idx int, model, stderr string) error {
+	_, err := s.Exec(ctx, `
+		UPDATE entry_outputs SET stderr = ?
+		WHERE notebook_id = ? AND idx = ? AND model = ?
+	`, stderr, nbID, idx, model)
+	return err
+}
+
+// SetOutputHeads stores the worktree HEAD before and after model's run.
+func (s *NotebookStore) SetOutputHeads(ctx context.Context, nbID string, idx int, model, before, after string) error {
+	_, err := s.Exec(ctx, `
+		UPDATE entry_outputs SET head_before = ?, head_after = ?
+		WHERE notebook_id = ? AND idx = ? AND model = ?
+	`, before, after, nbID, idx, model)
+	return err
+}
@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// CreateJob records a queued job running model on the entry and returns
+// its id.
+func (s *NotebookStore) CreateJob(ctx context.Context, nbID string, idx int, model string) (int64, error) {
+	res, err := s.Exec(ctx, `
+		INSERT INTO jobs(notebook_id, idx, model) VALUES(?, ?, ?)
+	`, nbID, idx, model)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// SetJobStatus moves job id to status: "running" stamps its start, any
+// other status its end.
+func (s *NotebookStore) SetJobStatus(ctx context.Context, id int64, status, errMsg string) error {
+	q := `UPDATE jobs SET status = ?, error = ?, finished_at = strftime('%Y-%m-%dT%H:%M:%SZ','now') WHERE id = ?`
+	if status == "running" {
+		q = `UPDATE jobs SET status = ?, error = ?, started_at = strftime('%Y-%m-%dT%H:%M:%SZ','now') WHERE id = ?`
+	}
+	_, err := s.Exec(ctx, q, status, errMsg, id)
+	return err
+}
+
+// Interrupted counts what MarkInterrupted closed out.
+type Interrupted struct {
+	Jobs, Runs, Entries int64
+}
+
+// MarkInterrupted closes out the jobs and runs a previous process left
+// queued or running: they end as interrupted, and their entries are
+// flagged (notebook_entries.interrupted).
+func (s *NotebookStore) MarkInterrupted(ctx context.Context) (Interrupted, error) {
+	var n Interrupted
+	err := s.InTx(ctx, func(tx *sql.Tx) error {
+		for _, q := range []struct {
+			n   *int64
+			sql string
+		}{
+			{&n.Entries, `
+				UPDATE notebook_entries SET interrupted = 1
+				WHERE EXISTS (SELECT 1 FROM jobs j WHERE j.notebook_id = notebook_entries.notebook_id AND j.idx = notebook_entries.idx AND j.status IN ('queued', 'running'))
+				   OR EXISTS (SELECT 1 FROM runs r WHERE r.notebook_id = notebook_entries.notebook_id AND r.idx = notebook_entries.idx AND r.finished_at IS NULL)`},
+			{&n.Jobs, `
+				UPDATE jobs SET status = 'interrupted', finished_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+				WHERE status IN ('queued', 'running')`},
+			{&n.Runs, `
+				UPDATE runs SET finished_at = strftime('%Y-%m-%dT%H:%M:%SZ','now'), exit_code = -1, interrupted = 1
+				WHERE finished_at IS NULL`},
+		} {
+			res, err := tx.ExecContext(ctx, q.sql)
+			if err != nil {
+				return err
+			}
+			*q.n, _ = res.RowsAffected()
+		}
+		return nil
+	})
+	return n, err
+}
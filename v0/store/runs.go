@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// StartRun records that model started on the entry and returns the run's
+// id.
+func (s *NotebookStore) StartRun(ctx context.Context, nbID string, idx int, model string) (int64, error) {
+	res, err := s.Exec(ctx, `
+		INSERT INTO runs(notebook_id, idx, model) VALUES(?, ?, ?)
+	`, nbID, idx, model)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// FinishRun records how run id ended.
+func (s *NotebookStore) FinishRun(ctx context.Context, id int64, code int, output, stderr string, timedOut bool, elapsed time.Duration) error {
+	_, err := s.Exec(ctx, `
+		UPDATE runs SET
+			finished_at = strftime('%Y-%m-%dT%H:%M:%SZ','now'),
+			exit_code = ?,
+			output = ?,
+			stderr = ?,
+			timed_out = ?,
+			duration_ms = ?
+		WHERE id = ?
+	`, code, output, stderr, timedOut, elapsed.Milliseconds(), id)
+	return err
+}
+
+// SaveProgress stores a running model's output and standard error so far,
+// on the entry and on run runID unless it is 0.
+func (s *NotebookStore) SaveProgress(ctx context.Context, runID int64, nbID string, idx int, model, output, stderr string) error {
+	return s.InTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO entry_outputs(notebook_id, idx, model, output, stderr)
+			VALUES(?, ?, ?, ?, ?)
+			ON CONFLICT(notebook_id, idx, model) DO UPDATE SET
+				output = excluded.output,
+				stderr = excluded.stderr,
+				updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+		`, nbID, idx, model, output, stderr); err != nil {
+			return err
+		}
+		if runID == 0 {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE runs SET output = ?, stderr = ? WHERE id = ? AND finished_at IS NULL
+		`, output, stderr, runID)
+		return err
+	})
+}
+
+// SetRunHeads stores the worktree HEAD before and after a run, on run
+// runID unless it is 0 and, for the after, on its entry. A run brings a
+// stale entry up to date again.
+func (s *NotebookStore) SetRunHeads(ctx context.Context, runID int64, nbID string, idx int, before, after string) error {
+	return s.InTx(ctx, func(tx *sql.Tx) error {
+		if runID != 0 {
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE runs SET head_before = ?, head_after = ? WHERE id = ?
+			`, before, after, runID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE notebook_entries SET head = ?, stale = 0 WHERE notebook_id = ? AND idx = ?
+		`, after, nbID, idx)
+		return err
+	})
+}
@@ -0,0 +1,91 @@
+// Package store keeps trybook's notebook entries and the runs and jobs
+// that answer them in SQLite. A NotebookStore wraps a database the server
+// has opened and migrated. SQLite lets one writer in at a time, so writes
+// that still come back busy after busy_timeout are retried a few times,
+// waiting longer before each retry; statements that belong together go
+// through InTx.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// busyRetries is how many times a busy write is retried.
+const busyRetries = 4
+
+// NotebookStore reads and writes notebook entries, runs and jobs.
+type NotebookStore struct {
+	DB *sql.DB
+}
+
+func New(db *sql.DB) *NotebookStore {
+	return &NotebookStore{DB: db}
+}
+
+// IsBusy reports whether err is SQLite saying the database or a table is
+// locked by another connection.
+func IsBusy(err error) bool {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return false
+	}
+	switch se.Code() & 0xff { // the primary code, without the extended bits
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+// retryBusy runs op until it succeeds, fails otherwise than busy, or has
+// been retried busyRetries times.
+func retryBusy(ctx context.Context, op func() error) error {
+	wait := 25 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !IsBusy(err) || attempt == busyRetries {
+			return err
+		}
+		slog.WarnContext(ctx, "sqlite: busy; retrying", "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// Exec is DB.ExecContext, retried while the database is busy.
+func (s *NotebookStore) Exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	var res sql.Result
+	err := retryBusy(ctx, func() error {
+		var err error
+		res, err = s.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+// InTx runs fn in a transaction and commits it, or rolls it back if fn
+// fails. When the database is busy the whole transaction is retried, so fn
+// must not have effects outside it.
+func (s *NotebookStore) InTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return retryBusy(ctx, func() error {
+		tx, err := s.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
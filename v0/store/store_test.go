@@ -0,0 +1,313 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// schema has the columns the store reads and writes; the server's
+// migrations make the rest.
+const schema = `
+CREATE TABLE notebook_entries (
+	notebook_id TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	prompt TEXT NOT NULL DEFAULT '',
+	intent TEXT NOT NULL DEFAULT '',
+	intent_source TEXT NOT NULL DEFAULT '',
+	edit_model TEXT NOT NULL DEFAULT '',
+	tests TEXT NOT NULL DEFAULT '',
+	interrupted INTEGER NOT NULL DEFAULT 0,
+	head TEXT NOT NULL DEFAULT '',
+	stale INTEGER NOT NULL DEFAULT 0,
+	updated_at TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY(notebook_id, idx)
+);
+CREATE TABLE entry_outputs (
+	notebook_id TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	model TEXT NOT NULL,
+	output TEXT NOT NULL DEFAULT '',
+	stderr TEXT NOT NULL DEFAULT '',
+	head_before TEXT NOT NULL DEFAULT '',
+	head_after TEXT NOT NULL DEFAULT '',
+	updated_at TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY(notebook_id, idx, model)
+);
+CREATE TABLE runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	notebook_id TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	model TEXT NOT NULL,
+	finished_at TEXT,
+	exit_code INTEGER,
+	output TEXT NOT NULL DEFAULT '',
+	stderr TEXT NOT NULL DEFAULT '',
+	timed_out INTEGER NOT NULL DEFAULT 0,
+	duration_ms INTEGER NOT NULL DEFAULT 0,
+	interrupted INTEGER NOT NULL DEFAULT 0,
+	head_before TEXT NOT NULL DEFAULT '',
+	head_after TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	notebook_id TEXT NOT NULL,
+	idx INTEGER NOT NULL,
+	model TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'queued',
+	error TEXT NOT NULL DEFAULT '',
+	started_at TEXT NOT NULL DEFAULT '',
+	finished_at TEXT NOT NULL DEFAULT ''
+);
+`
+
+// newTestStore returns a store on a fresh database holding schema and
+// entries 0 and 1 of notebook "nb".
+func newTestStore(t *testing.T) *NotebookStore {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO notebook_entries(notebook_id, idx, prompt, edit_model) VALUES('nb', 0, 'first', 'claude'), ('nb', 1, 'second', '')
+	`); err != nil {
+		t.Fatal(err)
+	}
+	return New(db)
+}
+
+func TestEntries(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	if p, err := s.Prompt(ctx, "nb", 1); err != nil || p != "second" {
+		t.Errorf("Prompt = %q, %v; want second", p, err)
+	}
+	if _, err := s.Prompt(ctx, "nb", 2); err != sql.ErrNoRows {
+		t.Errorf("Prompt of a missing entry: err = %v, want sql.ErrNoRows", err)
+	}
+	if m := s.EditModel(ctx, "nb", 0); m != "claude" {
+		t.Errorf("EditModel = %q, want claude", m)
+	}
+	if m := s.EditModel(ctx, "nb", 2); m != "" {
+		t.Errorf("EditModel of a missing entry = %q, want empty", m)
+	}
+
+	if i, err := s.Intent(ctx, "nb", 2); err != nil || i != "" {
+		t.Errorf("Intent of a missing entry = %q, %v; want empty, nil", i, err)
+	}
+	if err := s.SetIntent(ctx, "nb", 0, "edit", "router"); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := s.Intent(ctx, "nb", 0); err != nil || i != "edit" {
+		t.Errorf("Intent = %q, %v; want edit", i, err)
+	}
+	if err := s.SetTests(ctx, "nb", 0, "fail"); err != nil {
+		t.Fatal(err)
+	}
+	var source, tests string
+	if err := s.DB.QueryRow(`SELECT intent_source, tests FROM notebook_entries WHERE notebook_id = 'nb' AND idx = 0`).Scan(&source, &tests); err != nil {
+		t.Fatal(err)
+	}
+	if source != "router" || tests != "fail" {
+		t.Errorf("intent_source, tests = %q, %q; want router, fail", source, tests)
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	steps := []struct {
+		name string
+		do   func() error
+		want [4]string // output, stderr, head_before, head_after
+	}{
+		{"progress", func() error { return s.SaveProgress(ctx, 0, "nb", 0, "gemini", "so far", "warn") }, [4]string{"so far", "warn", "", ""}},
+		{"output", func() error { return s.SetOutput(ctx, "nb", 0, "gemini", "done") }, [4]string{"done", "warn", "", ""}},
+		{"stderr", func() error { return s.SetOutputStderr(ctx, "nb", 0, "gemini", "") }, [4]string{"done", "", "", ""}},
+		{"heads", func() error { return s.SetOutputHeads(ctx, "nb", 0, "gemini", "a1", "b2") }, [4]string{"done", "", "a1", "b2"}},
+	}
+	for _, st := range steps {
+		if err := st.do(); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		var got [4]string
+		if err := s.DB.QueryRow(`
+			SELECT output, stderr, head_before, head_after FROM entry_outputs WHERE notebook_id = 'nb' AND idx = 0 AND model = 'gemini'
+		`).Scan(&got[0], &got[1], &got[2], &got[3]); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		if got != st.want {
+			t.Errorf("after %s: entry_outputs = %q, want %q", st.name, got, st.want)
+		}
+	}
+}
+
+func TestRuns(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	id, err := s.StartRun(ctx, "nb", 0, "claude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveProgress(ctx, id, "nb", 0, "claude", "partial", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FinishRun(ctx, id, 2, "all", "oops", true, 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// A finished run keeps what it finished with.
+	if err := s.SaveProgress(ctx, id, "nb", 0, "claude", "late", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DB.Exec(`UPDATE notebook_entries SET stale = 1 WHERE notebook_id = 'nb' AND idx = 0`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRunHeads(ctx, id, "nb", 0, "a1", "b2"); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		code, ms                      int
+		timedOut                      bool
+		output, stderr, before, after string
+		finished                      sql.NullString
+	)
+	if err := s.DB.QueryRow(`
+		SELECT finished_at, exit_code, output, stderr, timed_out, duration_ms, head_before, head_after FROM runs WHERE id = ?
+	`, id).Scan(&finished, &code, &output, &stderr, &timedOut, &ms, &before, &after); err != nil {
+		t.Fatal(err)
+	}
+	if !finished.Valid || code != 2 || output != "all" || stderr != "oops" || !timedOut || ms != 1500 || before != "a1" || after != "b2" {
+		t.Errorf("run = %v %d %q %q %v %d %q %q; want finished 2 all oops true 1500 a1 b2", finished, code, output, stderr, timedOut, ms, before, after)
+	}
+	var head string
+	var stale bool
+	if err := s.DB.QueryRow(`SELECT head, stale FROM notebook_entries WHERE notebook_id = 'nb' AND idx = 0`).Scan(&head, &stale); err != nil {
+		t.Fatal(err)
+	}
+	if head != "b2" || stale {
+		t.Errorf("entry head, stale = %q, %v; want b2, false", head, stale)
+	}
+
+	// Run id 0 (no runs row) still moves the entry.
+	if err := s.SetRunHeads(ctx, 0, "nb", 1, "", "c3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DB.QueryRow(`SELECT head FROM notebook_entries WHERE notebook_id = 'nb' AND idx = 1`).Scan(&head); err != nil || head != "c3" {
+		t.Errorf("entry 1 head = %q, %v; want c3", head, err)
+	}
+}
+
+func TestMarkInterrupted(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	queued, err := s.CreateJob(ctx, "nb", 0, "claude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := s.CreateJob(ctx, "nb", 1, "claude")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetJobStatus(ctx, done, "running", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetJobStatus(ctx, done, "done", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartRun(ctx, "nb", 1, "gemini"); err != nil { // never finished
+		t.Fatal(err)
+	}
+
+	n, err := s.MarkInterrupted(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Interrupted{Jobs: 1, Runs: 1, Entries: 2}); n != want {
+		t.Errorf("MarkInterrupted = %+v, want %+v", n, want)
+	}
+	for _, tc := range []struct {
+		id     int64
+		status string
+	}{
+		{queued, "interrupted"},
+		{done, "done"},
+	} {
+		var status, started, finished string
+		if err := s.DB.QueryRow(`SELECT status, started_at, finished_at FROM jobs WHERE id = ?`, tc.id).Scan(&status, &started, &finished); err != nil {
+			t.Fatal(err)
+		}
+		if status != tc.status || finished == "" {
+			t.Errorf("job %d: status %q, finished_at %q; want %s and stamped", tc.id, status, finished, tc.status)
+		}
+		if tc.id == done && started == "" {
+			t.Errorf("job %d: started_at not stamped", tc.id)
+		}
+	}
+
+	if err := s.ClearInterrupted(ctx, "nb", 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.MarkInterrupted(ctx); err != nil || n != (Interrupted{}) {
+		t.Errorf("second MarkInterrupted = %+v, %v; want nothing", n, err)
+	}
+	var interrupted [2]bool
+	for idx := range interrupted {
+		if err := s.DB.QueryRow(`SELECT interrupted FROM notebook_entries WHERE notebook_id = 'nb' AND idx = ?`, idx).Scan(&interrupted[idx]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if interrupted != [2]bool{false, true} {
+		t.Errorf("entries interrupted = %v, want [false true]", interrupted)
+	}
+}
+
+// TestBusy holds the write lock on one connection while the store writes
+// on another: the write comes back busy, is retried, and lands once the
+// lock is let go.
+func TestBusy(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	conn, err := s.DB.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.DB.ExecContext(ctx, `UPDATE notebook_entries SET tests = 'pass'`)
+	if !IsBusy(err) {
+		t.Fatalf("write under a held lock: err = %v, want busy", err)
+	}
+	if IsBusy(sql.ErrNoRows) {
+		t.Error("IsBusy(sql.ErrNoRows) = true")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.ExecContext(ctx, `COMMIT`)
+	}()
+	if err := s.SetTests(ctx, "nb", 0, "pass"); err != nil {
+		t.Fatalf("SetTests while locked, then released: %v", err)
+	}
+	var tests string
+	if err := s.DB.QueryRow(`SELECT tests FROM notebook_entries WHERE notebook_id = 'nb' AND idx = 0`).Scan(&tests); err != nil || tests != "pass" {
+		t.Errorf("tests = %q, %v; want pass", tests, err)
+	}
+}
@@ -0,0 +1,190 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"trybook/runner"
+)
+
+// Active runs. Every model process that is executing is in runRegistry
+// from just before it starts until it has been waited on. GET /admin/runs
+// lists them: model, notebook, how long they have run, how much output
+// they have streamed and the process id. POST /admin/runs/kill stops one
+// (run=<id>) or all of them (all=1) the way the Stop button does, by
+// canceling the run, so its process group gets SIGTERM and then SIGKILL
+// after stopGrace, and what it wrote so far is kept.
+
+type activeRun struct {
+	ID         int64
+	NotebookID string
+	Idx        int
+	Model      string
+	Repo       string
+	Started    time.Time
+	pid        atomic.Int64 // 0 until the process has started
+	bytes      atomic.Int64 // stdout and stderr so far
+}
+
+var runRegistry = struct {
+	mu   sync.Mutex
+	next int64
+	runs map[int64]*activeRun
+}{runs: make(map[int64]*activeRun)}
+
+// registerRun adds pr's run to the registry and returns it with a func
+// that removes it.
+func registerRun(pr *preparedRun) (*activeRun, func()) {
+	a := &activeRun{NotebookID: pr.nbID, Idx: pr.idx, Model: pr.model, Repo: pr.meta.repoSpec().String(), Started: time.Now()}
+	runRegistry.mu.Lock()
+	runRegistry.next++
+	a.ID = runRegistry.next
+	runRegistry.runs[a.ID] = a
+	runRegistry.mu.Unlock()
+	return a, func() {
+		runRegistry.mu.Lock()
+		delete(runRegistry.runs, a.ID)
+		runRegistry.mu.Unlock()
+	}
+}
+
+// counter returns w, counting what passes through it into the run's bytes.
+func (a *activeRun) counter(w io.Writer) io.Writer {
+	return countingWriter{w, &a.bytes}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// registeredRuns returns the registered runs, longest-running first.
+func registeredRuns() []*activeRun {
+	runRegistry.mu.Lock()
+	out := make([]*activeRun, 0, len(runRegistry.runs))
+	for _, a := range runRegistry.runs {
+		out = append(out, a)
+	}
+	runRegistry.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// kill cancels the run through its live run, or signals its process group
+// if it has none.
+func (a *activeRun) kill() {
+	liveRuns.Lock()
+	lr := liveRuns.Get(runner.Key(a.NotebookID, a.Idx, a.Model))
+	liveRuns.Unlock()
+	if lr != nil && !lr.Finished() {
+		lr.Cancel()
+		return
+	}
+	if pid := a.pid.Load(); pid > 0 {
+		_ = terminateProcGroup(int(pid))
+	}
+}
+
+// killRuns kills the run with id, or every run when id is 0, and returns
+// how many it killed.
+func killRuns(ctx context.Context, id int64) int {
+	n := 0
+	for _, a := range registeredRuns() {
+		if id != 0 && a.ID != id {
+			continue
+		}
+		slog.InfoContext(ctx, "admin: killing run", "nb", a.NotebookID, "idx", a.Idx, "model", a.Model, "pid", a.pid.Load())
+		a.kill()
+		n++
+	}
+	return n
+}
+
+// activeRunRow is a row of the runs page.
+type activeRunRow struct {
+	ID         int64
+	NotebookID string
+	Idx        int
+	Model      string
+	Repo       string
+	Started    string
+	Runtime    string
+	Bytes      byteSize
+	PID        int64 // 0 while starting
+}
+
+type adminRunsView struct {
+	User     string
+	CSRF     string
+	Runs     []activeRunRow
+	Message  string
+	MsgClass string
+}
+
+// GET /admin/runs; POST /admin/runs/kill (run=<id> or all=1)
+func adminRunsHandler(w http.ResponseWriter, r *http.Request) {
+	var msg, class string
+	switch r.URL.Path {
+	case "/admin/runs":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	case "/admin/runs/kill":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var id int64
+		if r.FormValue("all") == "" {
+			var err error
+			if id, err = strconv.ParseInt(r.FormValue("run"), 10, 64); err != nil || id <= 0 {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+		}
+		switch n := killRuns(r.Context(), id); {
+		case n == 0 && id == 0:
+			msg = "No runs were running."
+		case n == 0:
+			msg, class = "That run has already finished.", "error"
+		case n == 1:
+			msg = "Stopped 1 run."
+		default:
+			msg = fmt.Sprintf("Stopped %d runs.", n)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	v := adminRunsView{User: currentUser(r.Context()), CSRF: csrfToken(r), Message: msg, MsgClass: class}
+	for _, a := range registeredRuns() {
+		v.Runs = append(v.Runs, activeRunRow{
+			ID:         a.ID,
+			NotebookID: a.NotebookID,
+			Idx:        a.Idx,
+			Model:      a.Model,
+			Repo:       a.Repo,
+			Started:    a.Started.UTC().Format("2006-01-02 15:04:05"),
+			Runtime:    time.Since(a.Started).Round(time.Second).String(),
+			Bytes:      byteSize(a.bytes.Load()),
+			PID:        a.pid.Load(),
+		})
+	}
+	setHTMLHeaders(w)
+	_ = renderPage(w, "runs", v)
+}
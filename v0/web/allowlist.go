@@ -0,0 +1,60 @@
+package web
+
+import (
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+)
+
+// Client allowlist. -allow-ips lists the addresses and CIDR ranges that
+// may use the server; a request from anywhere else gets 403 before it
+// reaches sign-in or any handler. The address checked is the client's, so
+// behind a reverse proxy it is the one the trusted proxies forwarded (see
+// proxy.go), and without -trusted-proxies it is the proxy's own. Requests
+// over a unix socket have no address and are not checked; any other
+// request whose address does not parse is refused. Without the flag every
+// address is allowed, as before.
+
+var allowIPs = flag.String("allow-ips", "", "comma-separated addresses or CIDR ranges allowed to connect, such as 127.0.0.1,10.0.0.0/8 (default any)")
+
+var allowedNets []netip.Prefix
+
+// setupAllowlist checks -allow-ips.
+func setupAllowlist() error {
+	var err error
+	allowedNets, err = parseNets("-allow-ips", *allowIPs)
+	return err
+}
+
+// allowClients refuses requests from addresses outside -allow-ips. It runs
+// inside behindProxy, which has put the client's address in RemoteAddr.
+func allowClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(allowedNets) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if overUnixSocket(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !inNets(allowedNets, host) {
+			slog.WarnContext(r.Context(), "allowlist: request refused", "remote", host)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// overUnixSocket reports whether the request came in on a unix socket.
+func overUnixSocket(r *http.Request) bool {
+	_, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr)
+	return ok
+}
@@ -0,0 +1,46 @@
+package web
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowClients(t *testing.T) {
+	nets, err := parseNets("-allow-ips", "10.0.0.0/8, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := allowedNets
+	allowedNets = nets
+	t.Cleanup(func() { allowedNets = old })
+	h := allowClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		remote string
+		unix   bool
+		want   int
+	}{
+		{"10.1.2.3:5000", false, http.StatusOK},
+		{"[::ffff:10.1.2.3]:5000", false, http.StatusOK},
+		{"[2001:db8::1]:5000", false, http.StatusOK},
+		{"203.0.113.7:5000", false, http.StatusForbidden},
+		{"10.1.2.3", false, http.StatusOK},
+		{"not-an-address:5000", false, http.StatusForbidden},
+		{"garbage", false, http.StatusForbidden},
+		{"", false, http.StatusForbidden},
+		{"@", true, http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.unix {
+			r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/trybook.sock", Net: "unix"}))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("RemoteAddr %q (unix %v): %d, want %d", tc.remote, tc.unix, w.Code, tc.want)
+		}
+	}
+}
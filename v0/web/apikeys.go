@@ -0,0 +1,231 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Model API keys, edited by admins at /settings/keys. Keys saved there are
+// the server's, used for every user's runs. They are encrypted like
+// notebook secrets and added to the environment of every model command and
+// llm call, over whatever the server process inherited. Each key can be
+// checked with a call that lists the provider's models, which costs
+// nothing.
+
+const apiKeysSchema = `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		name       TEXT PRIMARY KEY,
+		value      TEXT NOT NULL,
+		updated_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now'))
+	);`
+
+// apiKeyScope authenticates sealed API keys, in place of a notebook ID.
+const apiKeyScope = "api-keys"
+
+// apiKeyCheck describes how to test one provider's key.
+type apiKeyCheck struct {
+	Name     string
+	Provider string
+	URL      string
+	Header   func(h http.Header, key string)
+}
+
+var apiKeyChecks = []apiKeyCheck{
+	{"OPENAI_API_KEY", "OpenAI", "https://api.openai.com/v1/models", func(h http.Header, key string) {
+		h.Set("Authorization", "Bearer "+key)
+	}},
+	{"ANTHROPIC_API_KEY", "Anthropic", "https://api.anthropic.com/v1/models", func(h http.Header, key string) {
+		h.Set("x-api-key", key)
+		h.Set("anthropic-version", "2023-06-01")
+	}},
+	{"GEMINI_API_KEY", "Gemini", "https://generativelanguage.googleapis.com/v1beta/models", func(h http.Header, key string) {
+		h.Set("x-goog-api-key", key)
+	}},
+}
+
+var (
+	apiKeysMu sync.RWMutex
+	apiKeys   = make(map[string]string) // name -> decrypted value
+)
+
+// loadAPIKeys reads the saved keys into memory. A key that can't be
+// decrypted is skipped, so the inherited environment is used for it.
+func loadAPIKeys(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT name, value FROM api_keys`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	keys := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		plain, err := openSecret(apiKeyScope, name, value)
+		if err != nil {
+			slog.WarnContext(ctx, "api keys: skipping saved key", "name", name, "err", err)
+			continue
+		}
+		keys[name] = plain
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	apiKeysMu.Lock()
+	apiKeys = keys
+	apiKeysMu.Unlock()
+	return nil
+}
+
+// apiKey returns the saved key name, else the inherited one.
+func apiKey(name string) string {
+	apiKeysMu.RLock()
+	v := apiKeys[name]
+	apiKeysMu.RUnlock()
+	if v != "" {
+		return v
+	}
+	return os.Getenv(name)
+}
+
+// modelEnv is the server's environment with the saved API keys added.
+func modelEnv() []string {
+	env := os.Environ()
+	apiKeysMu.RLock()
+	defer apiKeysMu.RUnlock()
+	for name, v := range apiKeys {
+		env = append(env, name+"="+v)
+	}
+	return env
+}
+
+func setAPIKey(ctx context.Context, name, value string) error {
+	if value == "" {
+		if _, err := db.ExecContext(ctx, `DELETE FROM api_keys WHERE name = ?`, name); err != nil {
+			return err
+		}
+		return loadAPIKeys(ctx)
+	}
+	sealed, err := sealSecret(apiKeyScope, name, value)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO api_keys(name, value) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			value = excluded.value,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, name, sealed); err != nil {
+		return err
+	}
+	return loadAPIKeys(ctx)
+}
+
+// checkAPIKey lists the provider's models with the key in use for c.
+func checkAPIKey(ctx context.Context, c apiKeyCheck) error {
+	key := apiKey(c.Name)
+	if key == "" {
+		return fmt.Errorf("not set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	c.Header(req.Header, key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, truncate(strings.TrimSpace(string(body)), 200))
+	}
+	return nil
+}
+
+type apiKeyRow struct {
+	Name     string
+	Provider string
+	Source   string // "saved", "environment" or ""
+}
+
+type apiKeysView struct {
+	User    string
+	Keys    []apiKeyRow
+	Message string
+}
+
+// GET, POST /settings/keys
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	msg := ""
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var c *apiKeyCheck
+		for i := range apiKeyChecks {
+			if apiKeyChecks[i].Name == r.FormValue("name") {
+				c = &apiKeyChecks[i]
+			}
+		}
+		if c == nil {
+			http.Error(w, "bad key name", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch r.FormValue("action") {
+		case "set":
+			value := strings.TrimSpace(r.FormValue("value"))
+			if value == "" || strings.ContainsAny(value, "\x00\n") {
+				http.Error(w, "bad value", http.StatusBadRequest)
+				return
+			}
+			err = setAPIKey(r.Context(), c.Name, value)
+			msg = c.Name + " saved."
+		case "delete":
+			err = setAPIKey(r.Context(), c.Name, "")
+			msg = c.Name + " removed."
+		case "check":
+			if cerr := checkAPIKey(r.Context(), *c); cerr != nil {
+				msg = c.Name + " did not work: " + cerr.Error()
+			} else {
+				msg = c.Name + " works."
+			}
+		default:
+			http.Error(w, "bad action", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "apiKeysHandler", "err", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v := apiKeysView{User: currentUser(r.Context()), Message: msg}
+	apiKeysMu.RLock()
+	for _, c := range apiKeyChecks {
+		row := apiKeyRow{Name: c.Name, Provider: c.Provider}
+		if apiKeys[c.Name] != "" {
+			row.Source = "saved"
+		} else if os.Getenv(c.Name) != "" {
+			row.Source = "environment"
+		}
+		v.Keys = append(v.Keys, row)
+	}
+	apiKeysMu.RUnlock()
+	setHTMLHeaders(w)
+	_ = renderPage(w, "keys", v)
+}
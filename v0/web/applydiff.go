@@ -0,0 +1,148 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"trybook/runner"
+)
+
+// Diff-apply edits. A model with "apply_diff": true is asked for a unified
+// diff instead of editing files itself, so any plain CLI (claude, llm, ...)
+// can make edits without aider. When it exits successfully the diff is
+// taken from its output, applied to the worktree with git apply and
+// committed with the entry's prompt as the message. The outcome is appended
+// to the run's output; a diff that does not apply fails the run and leaves
+// the worktree untouched.
+
+const defaultDiffPrompt = `You are editing the git repository in the current directory. Make the following change:
+
+{prompt}
+
+Reply with a single unified diff against the current files, in the format of git diff (--- a/path, +++ b/path, @@ hunks with 3 lines of context), inside a ` + "```diff" + ` code block. Use /dev/null as the old path for new files. Do not include anything else.`
+
+var (
+	errNoDiff       = errors.New("no diff found in the output")
+	errDiffConflict = errors.New("diff does not apply")
+)
+
+// diffRunner is implemented by runners whose output is a diff to apply.
+type diffRunner interface {
+	AppliesDiff() bool
+}
+
+func appliesDiff(rn runner.Runner) bool {
+	d, ok := rn.(diffRunner)
+	return ok && d.AppliesDiff()
+}
+
+// editsWorktree reports whether runs of rn change the worktree, by editing
+// it themselves (aider, claude-edit) or through an applied diff.
+func editsWorktree(rn runner.Runner) bool {
+	return usesPTY(rn) || appliesDiff(rn) || agentEdits(rn)
+}
+
+// extractDiff returns the diff in a model's reply: the contents of its
+// ```diff or ```patch blocks, or else everything from the first diff
+// header on.
+func extractDiff(output string) string {
+	lines := strings.SplitAfter(output, "\n")
+	var b strings.Builder
+	in := false
+	for _, l := range lines {
+		t := strings.TrimSpace(l)
+		switch {
+		case !in && (t == "```diff" || t == "```patch"):
+			in = true
+		case in && t == "```":
+			in = false
+		case in:
+			b.WriteString(l)
+		}
+	}
+	if b.Len() > 0 {
+		return ensureNewline(b.String())
+	}
+	for i, l := range lines {
+		if strings.HasPrefix(l, "diff --git ") || strings.HasPrefix(l, "--- ") {
+			return ensureNewline(strings.Join(lines[i:], ""))
+		}
+	}
+	return ""
+}
+
+func ensureNewline(s string) string {
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
+}
+
+// applyDiff applies diff to the worktree in dir and commits it with
+// message, returning the new HEAD.
+func applyDiff(ctx context.Context, dir, diff, message string) (string, error) {
+	if strings.TrimSpace(diff) == "" {
+		return "", errNoDiff
+	}
+	f, err := os.CreateTemp("", "trybook-*.diff")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(diff); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	// Models often get hunk line counts wrong, which --recount fixes; but
+	// it can misread diffs without "diff --git" headers, so try it second.
+	var apply []string
+	var out []byte
+	for _, a := range [][]string{{"apply"}, {"apply", "--recount"}} {
+		apply = append(a, "--whitespace=nowarn")
+		check := exec.CommandContext(ctx, "git", append(append([]string{"-C", dir}, apply...), "--check", f.Name())...)
+		if out, err = check.CombinedOutput(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w:\n%s", errDiffConflict, strings.TrimSpace(string(out)))
+	}
+	cmd := exec.CommandContext(ctx, "git", append(append([]string{"-C", dir}, apply...), "--index", f.Name())...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%w:\n%s", errDiffConflict, strings.TrimSpace(string(out)))
+	}
+	commit := exec.CommandContext(ctx, "git", append(append([]string{"-C", dir}, gitIdentity...), "commit", "--quiet", "-m", message)...)
+	if out, err := commit.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git commit: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return gitHead(ctx, dir)
+}
+
+// applyOutput applies the diff in a finished run's output and reports the
+// outcome on out.
+func (pr *preparedRun) applyOutput(ctx context.Context, dir, output string, out io.Writer) error {
+	var prompt string
+	if err := db.QueryRowContext(ctx, `
+		SELECT prompt FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, pr.nbID, pr.idx).Scan(&prompt); err != nil {
+		return err
+	}
+	head, err := applyDiff(ctx, dir, extractDiff(output), strings.TrimSpace(prompt))
+	if err != nil {
+		fmt.Fprintf(out, "\n[trybook: %v]\n", err)
+		return err
+	}
+	if len(head) > 7 {
+		head = head[:7]
+	}
+	fmt.Fprintf(out, "\n[trybook: diff applied as commit %s]\n", head)
+	return nil
+}
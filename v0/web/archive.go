@@ -0,0 +1,278 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Notebook archives. GET /api/export?nb=.. downloads a notebook as JSON;
+// POST /import uploads one and recreates the notebook, cloning the repo if
+// needed. Worktree contents are not included: the archive records the
+// commit the worktree was at, and the import can start the new worktree
+// there (fetching it from the remote if the clone lacks it) or at the
+// clone's current HEAD.
+
+const archiveVersion = 1
+
+// importMaxBody caps an uploaded archive.
+const importMaxBody = 32 << 20
+
+type notebookArchive struct {
+	Version   int            `json:"version"`
+	Host      string         `json:"host"`
+	Org       string         `json:"org"`
+	Repo      string         `json:"repo"`
+	CloneURL  string         `json:"clone_url,omitempty"`
+	Subdir    string         `json:"subdir,omitempty"` // directory the notebook is scoped to
+	Commit    string         `json:"commit"`           // worktree start commit
+	Head      string         `json:"head,omitempty"`   // worktree HEAD at export
+	CreatedAt string         `json:"created_at"`
+	Entries   []archiveEntry `json:"entries"`
+}
+
+type archiveEntry struct {
+	Prompt  string                   `json:"prompt"`
+	Intent  string                   `json:"intent,omitempty"`
+	Tests   string                   `json:"tests,omitempty"`
+	Outputs map[string]archiveOutput `json:"outputs,omitempty"`
+	Ratings map[string]int           `json:"ratings,omitempty"`
+	// Attachments hold worktree paths, not their contents.
+	Attachments []attachment `json:"attachments,omitempty"`
+}
+
+type archiveOutput struct {
+	Output     string `json:"output"`
+	HeadBefore string `json:"head_before,omitempty"`
+	HeadAfter  string `json:"head_after,omitempty"`
+}
+
+func exportNotebook(ctx context.Context, nbID string) (notebookArchive, error) {
+	meta, entries, err := loadNotebook(ctx, nbID)
+	if err != nil {
+		return notebookArchive{}, err
+	}
+	a := notebookArchive{
+		Version: archiveVersion,
+		Host:    meta.Host,
+		Org:     meta.Org,
+		Repo:    meta.Repo,
+		Subdir:  meta.Subdir,
+		Commit:  meta.SHA,
+	}
+	if err := db.QueryRowContext(ctx, `SELECT created_at FROM notebooks WHERE id = ?`, nbID).Scan(&a.CreatedAt); err != nil {
+		return a, err
+	}
+	// Best effort: the clone row and worktree may be gone.
+	_ = db.QueryRowContext(ctx, `
+		SELECT clone_url FROM clones WHERE host = ? AND org = ? AND repo = ?
+	`, meta.Host, meta.Org, meta.Repo).Scan(&a.CloneURL)
+	a.Head, _ = gitHead(ctx, worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree))
+	for _, e := range entries {
+		ae := archiveEntry{Prompt: e.Prompt, Intent: e.Intent, Tests: e.Tests, Ratings: e.Ratings, Attachments: e.Attachments}
+		for m, o := range e.Outputs {
+			if ae.Outputs == nil {
+				ae.Outputs = make(map[string]archiveOutput)
+			}
+			ae.Outputs[m] = archiveOutput{Output: o.Output, HeadBefore: o.HeadBefore, HeadAfter: o.HeadAfter}
+		}
+		a.Entries = append(a.Entries, ae)
+	}
+	return a, nil
+}
+
+// GET /api/export?nb=..
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.URL.Query().Get("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	a, err := exportNotebook(r.Context(), nbID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "exportHandler", "err", err)
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	name := fmt.Sprintf("trybook-%s-%s.json", strings.ReplaceAll(a.Repo, "/", "-"), nbID)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(a)
+}
+
+// archiveSpec validates the archive's repository by running it through the
+// same parser as the index page.
+func archiveSpec(a notebookArchive) (repoSpec, error) {
+	input := a.CloneURL
+	if input == "" {
+		input = "https://" + a.Host + "/" + a.Org + "/" + a.Repo
+	}
+	spec, err := parseRepoInput(input)
+	if err != nil {
+		return spec, err
+	}
+	if spec.Host != a.Host || spec.Org != a.Org || spec.Repo != a.Repo {
+		return spec, fmt.Errorf("clone_url %q does not match %s/%s/%s", a.CloneURL, a.Host, a.Org, a.Repo)
+	}
+	return spec, nil
+}
+
+// ensureCommit makes sure the clone has commit, fetching it from origin if
+// the (shallow) clone does not.
+func ensureCommit(ctx context.Context, spec repoSpec, commit string) error {
+	dir := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	if exec.CommandContext(ctx, "git", "-C", dir, "cat-file", "-e", commit+"^{commit}").Run() == nil {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "fetch", "--depth", "1", "origin", commit)
+	cmd.Env = remoteEnv(ctx, spec)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("fetch %s: %v\n%s", commit, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func importEntries(ctx context.Context, nbID string, es []archiveEntry) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, e := range es {
+		pi := inspectPrompt(e.Prompt)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO notebook_entries(notebook_id, idx, prompt, intent, tests, prompt_tokens, prompt_lang) VALUES(?, ?, ?, ?, ?, ?, ?)
+		`, nbID, i, e.Prompt, e.Intent, e.Tests, pi.Tokens, pi.Lang); err != nil {
+			return err
+		}
+		for m, o := range e.Outputs {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO entry_outputs(notebook_id, idx, model, output, head_before, head_after) VALUES(?, ?, ?, ?, ?, ?)
+			`, nbID, i, m, o.Output, o.HeadBefore, o.HeadAfter); err != nil {
+				return err
+			}
+		}
+		for pos, a := range e.Attachments {
+			if a.Kind != attachFile && a.Kind != attachSnippet && a.Kind != attachUpload {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO attachments(notebook_id, idx, pos, kind, name, content) VALUES(?, ?, ?, ?, ?, ?)
+			`, nbID, i, pos, a.Kind, a.Name, a.Content); err != nil {
+				return err
+			}
+		}
+		for m, rating := range e.Ratings {
+			if rating != 1 && rating != -1 {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO feedback(notebook_id, idx, model, rating) VALUES(?, ?, ?, ?)
+			`, nbID, i, m, rating); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func importNotebook(ctx context.Context, owner string, a notebookArchive, atCommit bool) (string, error) {
+	if a.Version != archiveVersion {
+		return "", fmt.Errorf("unsupported archive version %d", a.Version)
+	}
+	spec, err := archiveSpec(a)
+	if err != nil {
+		return "", err
+	}
+	for _, dir := range []string{cloneBaseDir(), worktreeBaseDir()} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", err
+		}
+	}
+	if err := ensureRepoCloned(ctx, spec, nil); err != nil {
+		return "", fmt.Errorf("clone failed: %w", err)
+	}
+	if err := recordClone(ctx, spec); err != nil {
+		slog.ErrorContext(ctx, "importNotebook: recordClone error", "err", err)
+	}
+	start := ""
+	if atCommit {
+		// Prefer where the session left off; edits made on the exporting
+		// server were never pushed, so fall back to the start commit.
+		for _, c := range []string{a.Head, a.Commit} {
+			if !isCommitish(c) {
+				continue
+			}
+			if err := ensureCommit(ctx, spec, c); err != nil {
+				slog.ErrorContext(ctx, "importNotebook", "err", err)
+				continue
+			}
+			start = c
+			break
+		}
+		if start == "" {
+			return "", errors.New("the recorded commit is not available from the repository")
+		}
+	}
+	nbID, err := createNotebookAt(ctx, owner, spec.Host, spec.Org, spec.Repo, a.Subdir, start)
+	if err != nil {
+		return "", err
+	}
+	if err := importEntries(ctx, nbID, a.Entries); err != nil {
+		if _, derr := purgeNotebook(context.WithoutCancel(ctx), nbID); derr != nil {
+			slog.ErrorContext(ctx, "importNotebook: clean up", "nb", nbID, "err", derr)
+		}
+		return "", fmt.Errorf("import entries: %w", err)
+	}
+	return nbID, nil
+}
+
+// POST /import (multipart: archive, at_commit)
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	fail := func(msg string) {
+		setHTMLHeaders(w)
+		_ = renderPage(w, "index", viewModel{Title: "Trybook", Message: msg, MsgClass: "error", User: currentUser(r.Context())})
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxBody)
+	f, _, err := r.FormFile("archive")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "importHandler", "err", err)
+		fail("Choose a notebook archive to import.")
+		return
+	}
+	defer f.Close()
+	var a notebookArchive
+	if err := json.NewDecoder(io.LimitReader(f, 32<<20)).Decode(&a); err != nil {
+		slog.ErrorContext(r.Context(), "importHandler: decode", "err", err)
+		fail("Not a notebook archive: " + err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	nbID, err := importNotebook(ctx, currentUser(r.Context()), a, r.FormValue("at_commit") != "")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "importHandler", "err", err)
+		fail("Import failed: " + err.Error())
+		return
+	}
+	slog.InfoContext(r.Context(), "importHandler: imported", "repo", a.Org+"/"+a.Repo, "nb", nbID)
+	http.Redirect(w, r, "/n/"+nbID, http.StatusSeeOther)
+}
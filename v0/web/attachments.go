@@ -0,0 +1,319 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"trybook/runner"
+)
+
+// Entry attachments. A prompt can carry files from the worktree, pasted
+// snippets and uploaded files. Worktree files are stored as paths and read
+// when the entry runs, so a re-run sees the file as it is then; snippets
+// and uploads are stored as given. Models with file_arg in the config
+// (aider: --file) get the worktree files as arguments; everything else is
+// added to the prompt after the request. The router and test commands get
+// no attachments. GET /n/{id}/files lists the worktree's files for the
+// picker.
+
+const attachmentsSchema = `
+	CREATE TABLE IF NOT EXISTS attachments (
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		pos         INTEGER NOT NULL,
+		kind        TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		content     TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, idx, pos),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);`
+
+const (
+	attachFile    = "file"    // Name is a worktree path
+	attachSnippet = "snippet" // pasted text
+	attachUpload  = "upload"  // Name is the uploaded file's name
+
+	attachMaxBytes = 256 << 10 // per attachment
+	attachMaxTotal = 1 << 20   // per entry
+	attachMaxCount = 20
+	// promptMaxBody caps a /prompt post: the attachments, the prompt (up
+	// to four bytes a character) and room for the other fields.
+	promptMaxBody = attachMaxTotal + 4*promptMaxChars + 64<<10
+	filesListMax  = 20000
+)
+
+type attachment struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Content string `json:"content,omitempty"` // empty for worktree files
+}
+
+// fileArgRunner is implemented by runners that take worktree files as
+// command-line arguments (aider --file).
+type fileArgRunner interface {
+	FileArg() string
+}
+
+func fileArg(rn runner.Runner) string {
+	if f, ok := rn.(fileArgRunner); ok {
+		return f.FileArg()
+	}
+	return ""
+}
+
+// ignoreArgRunner is implemented by runners that take a file of ignore
+// patterns as a command-line argument (aider --aiderignore).
+type ignoreArgRunner interface {
+	IgnoreArg() string
+}
+
+func ignoreArg(rn runner.Runner) string {
+	if f, ok := rn.(ignoreArgRunner); ok {
+		return f.IgnoreArg()
+	}
+	return ""
+}
+
+// cleanWorktreePath normalizes a path typed by the user, which must name
+// something inside the worktree.
+func cleanWorktreePath(p string) (string, bool) {
+	p = path.Clean(filepath.ToSlash(strings.TrimSpace(p)))
+	if p == "." || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") || strings.ContainsRune(p, 0) ||
+		p == ".git" || strings.HasPrefix(p, ".git/") {
+		return "", false
+	}
+	return p, true
+}
+
+// readAttachable returns b as text if it can be attached: small enough and
+// not binary.
+func readAttachable(name string, r io.Reader) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(r, attachMaxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > attachMaxBytes {
+		return "", fmt.Errorf("%s is larger than %d KB", name, attachMaxBytes>>10)
+	}
+	if !utf8.Valid(b) || strings.ContainsRune(string(b), 0) {
+		return "", fmt.Errorf("%s is not a text file", name)
+	}
+	return string(b), nil
+}
+
+// readWorktreeFile reads rel from the worktree dir, refusing symlinks that
+// lead outside it.
+func readWorktreeFile(dir, rel string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", fmt.Errorf("%s is not in the worktree", rel)
+	}
+	if r, err := filepath.Rel(root, p); err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not in the worktree", rel)
+	}
+	if fi, err := os.Stat(p); err != nil || !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a file", rel)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readAttachable(rel, f)
+}
+
+// attachmentsFromForm reads the prompt form's attachments: files (worktree
+// paths separated by spaces, commas or newlines), snippet and upload. Its
+// errors are meant for the user.
+func attachmentsFromForm(r *http.Request, wtDir string, ignore *ignoreRules) ([]attachment, error) {
+	var as []attachment
+	total := 0
+	add := func(a attachment, size int) error {
+		total += size
+		if len(as) == attachMaxCount {
+			return fmt.Errorf("at most %d attachments per prompt", attachMaxCount)
+		}
+		if total > attachMaxTotal {
+			return fmt.Errorf("attachments may not add up to more than %d KB", attachMaxTotal>>10)
+		}
+		as = append(as, a)
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, p := range strings.FieldsFunc(r.FormValue("files"), func(c rune) bool { return c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t' }) {
+		rel, ok := cleanWorktreePath(p)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a path in the worktree", p)
+		}
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+		if ignore.Ignored(rel) {
+			return nil, fmt.Errorf("%s is kept from models by the ignore rules (%s or the config)", rel, ignoreFile)
+		}
+		content, err := readWorktreeFile(wtDir, rel)
+		if err != nil {
+			return nil, err
+		}
+		if err := add(attachment{Kind: attachFile, Name: rel}, len(content)); err != nil {
+			return nil, err
+		}
+	}
+	if s := strings.TrimSpace(r.FormValue("snippet")); s != "" {
+		if len(s) > attachMaxBytes {
+			return nil, fmt.Errorf("the snippet is larger than %d KB", attachMaxBytes>>10)
+		}
+		if err := add(attachment{Kind: attachSnippet, Name: "snippet", Content: s}, len(s)); err != nil {
+			return nil, err
+		}
+	}
+	if r.MultipartForm != nil {
+		for _, fh := range r.MultipartForm.File["upload"] {
+			name := filepath.Base(filepath.Clean("/" + fh.Filename))
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			content, err := readAttachable(name, f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			if err := add(attachment{Kind: attachUpload, Name: name, Content: content}, len(content)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return as, nil
+}
+
+func saveAttachments(ctx context.Context, nbID string, idx int, as []attachment) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for pos, a := range as {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO attachments(notebook_id, idx, pos, kind, name, content) VALUES (?, ?, ?, ?, ?, ?)
+		`, nbID, idx, pos, a.Kind, a.Name, a.Content); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// loadAttachments returns idx -> attachments for a notebook, in order.
+func loadAttachments(ctx context.Context, nbID string) (map[int][]attachment, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT idx, kind, name, content FROM attachments WHERE notebook_id = ? ORDER BY idx, pos
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int][]attachment)
+	for rows.Next() {
+		var idx int
+		var a attachment
+		if err := rows.Scan(&idx, &a.Kind, &a.Name, &a.Content); err != nil {
+			return nil, err
+		}
+		out[idx] = append(out[idx], a)
+	}
+	return out, rows.Err()
+}
+
+// withAttachments adds the entry's attachments to prompt, except the
+// worktree files a runner with a file argument gets as arguments, which
+// are returned.
+func withAttachments(ctx context.Context, wtDir, prompt string, as []attachment, fileArg string, ignore *ignoreRules) (string, []string) {
+	var files []string
+	var b strings.Builder
+	for _, a := range as {
+		content := a.Content
+		if a.Kind == attachFile {
+			// Read it either way: a path from an imported notebook could
+			// lead anywhere, the file may be gone since, and the ignore
+			// rules may have changed.
+			var err error
+			if ignore.Ignored(a.Name) {
+				slog.WarnContext(ctx, "attachments: ignored", "path", a.Name)
+				content = "(not attached: kept from models by the ignore rules)"
+			} else if content, err = readWorktreeFile(wtDir, a.Name); err != nil {
+				slog.WarnContext(ctx, "attachments: cannot read", "path", a.Name, "err", err)
+				content = fmt.Sprintf("(not attached: %v)", err)
+			} else if fileArg != "" {
+				files = append(files, "./"+a.Name) // never read as an option
+				continue
+			}
+		}
+		label := a.Name
+		switch a.Kind {
+		case attachFile:
+			label = "file " + a.Name
+		case attachUpload:
+			label = "uploaded file " + a.Name
+		}
+		fmt.Fprintf(&b, "\n===== %s =====\n%s\n===== end of %s =====\n", label, strings.TrimRight(content, "\n"), a.Name)
+	}
+	if b.Len() == 0 {
+		return prompt, files
+	}
+	return prompt + "\n\nAttached:\n" + b.String(), files
+}
+
+// GET /n/{id}/files: the worktree's tracked files, for the attachment
+// picker, without those the ignore rules keep from models.
+func worktreeFilesHandler(w http.ResponseWriter, r *http.Request, nbID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	out, err := exec.CommandContext(r.Context(), "git", "-C", dir, "ls-files", "-z").Output()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "worktreeFilesHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	files := strings.Split(strings.TrimRight(string(out), "\x00"), "\x00")
+	if len(files) == 1 && files[0] == "" {
+		files = nil
+	}
+	ignore, err := currentConfig().contextIgnore(meta, dir)
+	if err != nil {
+		slog.WarnContext(r.Context(), "worktreeFilesHandler: ignore rules", "err", err)
+	}
+	files = ignore.filter(files)
+	if len(files) > filesListMax {
+		files = files[:filesListMax]
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"files": files})
+}
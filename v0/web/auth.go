@@ -0,0 +1,406 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Authentication. Off unless TRYBOOK_TOKEN or GitHub OAuth credentials are
+// set. With a shared token, anyone who knows it signs in under a name of
+// their choosing; with GitHub OAuth the name is "github:<login>". Sessions
+// live in SQLite and notebooks belong to the user who created them.
+// Notebooks created before auth was turned on have no owner and are visible
+// to everyone.
+
+const (
+	sessionCookie = "tb_auth"
+	oauthCookie   = "tb_oauth_state"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+const authSchema = `
+	CREATE TABLE IF NOT EXISTS users (
+		name       TEXT PRIMARY KEY,
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now'))
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+		id_hash    TEXT PRIMARY KEY,
+		user       TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		expires_at TEXT NOT NULL,
+		FOREIGN KEY (user) REFERENCES users(name) ON DELETE CASCADE
+	);`
+
+func SharedToken() string { return os.Getenv("TRYBOOK_TOKEN") }
+
+func githubOAuthEnabled() bool {
+	return os.Getenv("GITHUB_CLIENT_ID") != "" && os.Getenv("GITHUB_CLIENT_SECRET") != ""
+}
+
+func authEnabled() bool { return SharedToken() != "" || githubOAuthEnabled() }
+
+type userCtxKey struct{}
+
+// currentUser returns the signed-in user, or "" when auth is disabled.
+func currentUser(ctx context.Context) string {
+	u, _ := ctx.Value(userCtxKey{}).(string)
+	return u
+}
+
+// isAdmin reports whether the request's user may use /admin/*: anyone
+// when auth is disabled, otherwise only the config's admins.
+func isAdmin(ctx context.Context) bool {
+	return !authEnabled() || slices.Contains(currentConfig().Admins, currentUser(ctx))
+}
+
+// requireAdmin refuses /admin/* and /settings/keys to users who are not
+// admins. The pages there act on every user's runs, notebooks, files and
+// model API keys.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r.Context()) {
+			slog.WarnContext(r.Context(), "auth: admin denied", "path", r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startSession records the user and a new session and sets the cookie.
+func startSession(w http.ResponseWriter, r *http.Request, user string) error {
+	id, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	ctx := r.Context()
+	if _, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO users(name) VALUES(?)`, user); err != nil {
+		return err
+	}
+	// Expired sessions are cleaned up whenever someone signs in.
+	_, _ = db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < strftime('%Y-%m-%dT%H:%M:%SZ','now')`)
+	expires := time.Now().Add(sessionTTL).UTC()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO sessions(id_hash, user, expires_at) VALUES(?, ?, ?)
+	`, hashSessionID(id), user, expires.Format("2006-01-02T15:04:05Z")); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     cookiePath("/"),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// sessionUser returns the user for the request's session cookie, if valid.
+func sessionUser(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+	var user string
+	err = db.QueryRowContext(r.Context(), `
+		SELECT user FROM sessions
+		WHERE id_hash = ? AND expires_at > strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, hashSessionID(c.Value)).Scan(&user)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "auth: session lookup", "err", err)
+		}
+		return "", false
+	}
+	return user, true
+}
+
+// Paths reachable without a session.
+var publicPaths = map[string]bool{
+	"/login":                true,
+	"/logout":               true,
+	"/auth/github":          true,
+	"/auth/github/callback": true,
+	"/healthz":              true,
+	"/readyz":               true,
+	"/api/openapi.json":     true,
+}
+
+// requestNotebookID returns the notebook a request is about, if any.
+func requestNotebookID(r *http.Request) string {
+	if id, ok := strings.CutPrefix(r.URL.Path, "/n/"); ok {
+		// /n/{id}/entries/{idx}, /n/{id}/search, ...
+		id, _, _ = strings.Cut(id, "/")
+		return id
+	}
+	if id := r.URL.Query().Get("nb"); id != "" {
+		return id
+	}
+	if r.Method == http.MethodPost {
+		return r.PostFormValue("nb")
+	}
+	return ""
+}
+
+// canAccessNotebook reports whether user may see notebook id. Unknown ids
+// are allowed through so the handler can answer 404 itself.
+func canAccessNotebook(ctx context.Context, user, id string) bool {
+	var owner string
+	err := db.QueryRowContext(ctx, `SELECT owner FROM notebooks WHERE id = ?`, id).Scan(&owner)
+	if err != nil {
+		return errors.Is(err, sql.ErrNoRows)
+	}
+	return owner == "" || owner == user
+}
+
+// requireAuth wraps the whole mux. When auth is enabled every request
+// except the public paths needs a session, and requests naming a notebook
+// must come from its owner.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, ok := sessionUser(r)
+		if !ok {
+			if r.Method == http.MethodGet && (r.URL.Path == "/" || strings.HasPrefix(r.URL.Path, "/n/") || strings.HasPrefix(r.URL.Path, "/r/")) {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx := withLogAttrs(context.WithValue(r.Context(), userCtxKey{}, user), "user", user)
+		r = r.WithContext(ctx)
+		if id := requestNotebookID(r); id != "" && !canAccessNotebook(ctx, user, id) {
+			slog.WarnContext(ctx, "auth: notebook denied", "user", user, "nb", id)
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// safeNext only allows redirects back into this site.
+func safeNext(s string) string {
+	if !strings.HasPrefix(s, "/") || strings.HasPrefix(s, "//") || strings.HasPrefix(s, "/\\") {
+		return "/"
+	}
+	return s
+}
+
+// isValidUserName accepts names typed at the token login. ":" is reserved
+// for provider-qualified names such as github:<login>.
+func isValidUserName(s string) bool {
+	return len(s) <= 64 && isSafeToken(s)
+}
+
+type loginView struct {
+	Next    string
+	Token   bool
+	GitHub  bool
+	Message string
+}
+
+func renderLogin(w http.ResponseWriter, next, msg string, status int) {
+	setHTMLHeaders(w)
+	w.WriteHeader(status)
+	_ = renderPage(w, "login", loginView{Next: next, Token: SharedToken() != "", GitHub: githubOAuthEnabled(), Message: msg})
+}
+
+// GET, POST /login
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled() {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	next := safeNext(r.FormValue("next"))
+	switch r.Method {
+	case http.MethodGet:
+		renderLogin(w, next, "", http.StatusOK)
+	case http.MethodPost:
+		token := SharedToken()
+		user := strings.TrimSpace(r.FormValue("user"))
+		given := r.FormValue("token")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			slog.WarnContext(r.Context(), "loginHandler: bad token", "user", user, "remote", r.RemoteAddr)
+			renderLogin(w, next, "Invalid token.", http.StatusUnauthorized)
+			return
+		}
+		if !isValidUserName(user) {
+			renderLogin(w, next, "Names may only use letters, digits, '-', '_' and '.'.", http.StatusBadRequest)
+			return
+		}
+		if err := startSession(w, r, user); err != nil {
+			slog.ErrorContext(r.Context(), "loginHandler: startSession error", "err", err)
+			renderLogin(w, next, "Could not start a session.", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "loginHandler: signed in", "user", user)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /logout
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		if _, err := db.ExecContext(r.Context(), `DELETE FROM sessions WHERE id_hash = ?`, hashSessionID(c.Value)); err != nil {
+			slog.ErrorContext(r.Context(), "logoutHandler", "err", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: cookiePath("/"), MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// GET /auth/github
+func githubLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !githubOAuthEnabled() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	state, err := randomHex(16)
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	// The state cookie carries where to go after the callback.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthCookie,
+		Value:    state + "|" + safeNext(r.URL.Query().Get("next")),
+		Path:     cookiePath("/auth/github"),
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{}
+	q.Set("client_id", os.Getenv("GITHUB_CLIENT_ID"))
+	q.Set("state", state)
+	q.Set("scope", "read:user")
+	http.Redirect(w, r, "https://github.com/login/oauth/authorize?"+q.Encode(), http.StatusSeeOther)
+}
+
+// GET /auth/github/callback
+func githubCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !githubOAuthEnabled() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	c, err := r.Cookie(oauthCookie)
+	if err != nil {
+		renderLogin(w, "/", "Sign-in expired; try again.", http.StatusBadRequest)
+		return
+	}
+	state, next, _ := strings.Cut(c.Value, "|")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1 {
+		renderLogin(w, "/", "Sign-in state mismatch; try again.", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthCookie, Value: "", Path: cookiePath("/auth/github"), MaxAge: -1})
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	login, err := githubLogin(ctx, r.URL.Query().Get("code"))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "githubCallbackHandler", "err", err)
+		renderLogin(w, "/", "GitHub sign-in failed.", http.StatusBadGateway)
+		return
+	}
+	if err := startSession(w, r, "github:"+login); err != nil {
+		slog.ErrorContext(r.Context(), "githubCallbackHandler: startSession error", "err", err)
+		renderLogin(w, "/", "Could not start a session.", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "githubCallbackHandler: signed in", "user", "github:"+login)
+	http.Redirect(w, r, safeNext(next), http.StatusSeeOther)
+}
+
+// githubLogin exchanges an OAuth code for a token and returns the user's login.
+func githubLogin(ctx context.Context, code string) (string, error) {
+	if code == "" {
+		return "", fmt.Errorf("missing code")
+	}
+	form := url.Values{}
+	form.Set("client_id", os.Getenv("GITHUB_CLIENT_ID"))
+	form.Set("client_secret", os.Getenv("GITHUB_CLIENT_SECRET"))
+	form.Set("code", code)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://github.com/login/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := doJSON(req, &tok); err != nil {
+		return "", fmt.Errorf("token exchange: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("token exchange: %s", tok.Error)
+	}
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "https://api.github.com/user", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	var u struct {
+		Login string `json:"login"`
+	}
+	if err := doJSON(req, &u); err != nil {
+		return "", fmt.Errorf("get user: %w", err)
+	}
+	if !isValidUserName(u.Login) {
+		return "", fmt.Errorf("unexpected login %q", u.Login)
+	}
+	return u.Login, nil
+}
+
+func doJSON(req *http.Request, v any) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,459 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// Backups. With "backup" in the config, trybook snapshots its database
+// with SQLite's online backup API every interval_minutes, together with
+// every notebook's export (GET /api/export), into a directory named
+// trybook-<UTC time> under dest:
+//
+//   - a local directory, e.g. /mnt/backups/trybook;
+//   - s3://bucket/prefix, uploaded with the aws CLI;
+//   - gs://bucket/prefix, uploaded with the gcloud CLI.
+//
+// The CLIs use their own credentials from the environment. Only the
+// newest keep backups stay in a local directory; buckets have lifecycle
+// rules for that. POST /admin/backup takes one right away.
+//
+// -restore replaces trybook.db with a backup's before the server starts:
+// the path or URL of one trybook-... directory, or "latest" for the newest
+// under dest. The database it replaces is kept next to it. Exports are
+// for POST /import, one notebook at a time.
+
+var restoreFrom = flag.String("restore", "", `restore trybook.db from a backup before starting: its directory, s3:// or gs:// URL, or "latest" in the config's backup dest`)
+
+const (
+	backupPrefix  = "trybook-"
+	backupTimeFmt = "20060102T150405Z"
+	backupPoll    = time.Minute
+)
+
+// backupConfig turns on scheduled backups.
+type backupConfig struct {
+	// Dest is a directory, s3://bucket/prefix or gs://bucket/prefix;
+	// empty disables backups.
+	Dest string `json:"dest,omitempty"`
+	// IntervalMinutes is the time between backups (default 360).
+	IntervalMinutes int `json:"interval_minutes,omitempty"`
+	// Keep is how many backups a directory dest keeps (default 7).
+	Keep int `json:"keep,omitempty"`
+}
+
+func (b backupConfig) validate() error {
+	if b.Dest != "" && !isBucketURL(b.Dest) && !filepath.IsAbs(b.Dest) {
+		return fmt.Errorf("dest must be an absolute directory, s3:// or gs:// URL")
+	}
+	if b.IntervalMinutes < 0 || b.Keep < 0 {
+		return fmt.Errorf("interval_minutes and keep must be >= 0")
+	}
+	return nil
+}
+
+func (b backupConfig) interval() time.Duration {
+	if b.IntervalMinutes == 0 {
+		return 6 * time.Hour
+	}
+	return time.Duration(b.IntervalMinutes) * time.Minute
+}
+
+func (b backupConfig) keep() int {
+	if b.Keep == 0 {
+		return 7
+	}
+	return b.Keep
+}
+
+func isBucketURL(s string) bool {
+	return strings.HasPrefix(s, "s3://") || strings.HasPrefix(s, "gs://")
+}
+
+const backupsSchema = `
+	CREATE TABLE IF NOT EXISTS backups (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		name        TEXT NOT NULL,
+		dest        TEXT NOT NULL,
+		notebooks   INTEGER NOT NULL DEFAULT 0,
+		bytes       INTEGER NOT NULL DEFAULT 0,
+		error       TEXT NOT NULL DEFAULT '',
+		started_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		finished_at TEXT
+	)`
+
+type backupResult struct {
+	Name      string `json:"name"`
+	Dest      string `json:"dest"`
+	Notebooks int    `json:"notebooks"`
+	Bytes     int64  `json:"bytes"`
+	Error     string `json:"error,omitempty"`
+}
+
+var (
+	backupMu     sync.Mutex // one backup at a time
+	errBackingUp = errors.New("a backup is already running")
+)
+
+// snapshotDB copies the live database to path with the backup API.
+func snapshotDB(ctx context.Context, path string) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(dc any) error {
+		bc, ok := dc.(interface {
+			NewBackup(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return fmt.Errorf("sqlite driver has no backup API")
+		}
+		b, err := bc.NewBackup(path)
+		if err != nil {
+			return err
+		}
+		if _, err := b.Step(-1); err != nil {
+			_ = b.Finish()
+			return err
+		}
+		return b.Finish()
+	})
+}
+
+// writeExports writes every notebook's export to dir and returns how many.
+func writeExports(ctx context.Context, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT id FROM notebooks`)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		a, err := exportNotebook(ctx, id)
+		if err != nil {
+			return 0, fmt.Errorf("export %s: %w", id, err)
+		}
+		b, err := json.MarshalIndent(a, "", "  ")
+		if err != nil {
+			return 0, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, id+".json"), b, 0o644); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// runBackup takes a backup to cfg.Dest and records it in backups.
+func runBackup(ctx context.Context, cfg backupConfig) (backupResult, error) {
+	if !backupMu.TryLock() {
+		return backupResult{}, errBackingUp
+	}
+	defer backupMu.Unlock()
+	res := backupResult{Name: backupPrefix + time.Now().UTC().Format(backupTimeFmt), Dest: cfg.Dest}
+	var id int64
+	if r, err := execDB(ctx, `INSERT INTO backups(name, dest) VALUES(?, ?)`, res.Name, res.Dest); err != nil {
+		slog.ErrorContext(ctx, "backup: record start", "err", err)
+	} else {
+		id, _ = r.LastInsertId()
+	}
+	err := takeBackup(ctx, cfg, &res)
+	if err != nil {
+		res.Error = err.Error()
+		slog.ErrorContext(ctx, "backup failed", "name", res.Name, "dest", res.Dest, "err", err)
+	} else {
+		slog.InfoContext(ctx, "backup done", "name", res.Name, "dest", res.Dest, "notebooks", res.Notebooks, "bytes", res.Bytes)
+	}
+	if _, dbErr := execDB(ctx, `
+		UPDATE backups SET notebooks = ?, bytes = ?, error = ?, finished_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+		WHERE id = ?
+	`, res.Notebooks, res.Bytes, res.Error, id); dbErr != nil {
+		slog.ErrorContext(ctx, "backup: record end", "err", dbErr)
+	}
+	return res, err
+}
+
+func takeBackup(ctx context.Context, cfg backupConfig, res *backupResult) error {
+	// A local dest gets the backup under a temporary name, renamed once
+	// complete; a bucket gets it uploaded from a staging directory.
+	var stage string
+	if isBucketURL(cfg.Dest) {
+		stage = filepath.Join(*appDir, "backup-staging", res.Name)
+	} else {
+		stage = filepath.Join(cfg.Dest, "."+res.Name+".partial")
+	}
+	if err := os.MkdirAll(stage, 0o755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stage)
+	if err := snapshotDB(ctx, filepath.Join(stage, "trybook.db")); err != nil {
+		return fmt.Errorf("snapshot database: %w", err)
+	}
+	n, err := writeExports(ctx, filepath.Join(stage, "exports"))
+	if err != nil {
+		return err
+	}
+	res.Notebooks, res.Bytes = n, dirSize(stage)
+	switch {
+	case strings.HasPrefix(cfg.Dest, "s3://"):
+		return runCLI(ctx, "aws", "s3", "cp", "--recursive", "--only-show-errors", stage, bucketPath(cfg.Dest, res.Name)+"/")
+	case strings.HasPrefix(cfg.Dest, "gs://"):
+		return runCLI(ctx, "gcloud", "storage", "cp", "--recursive", stage, strings.TrimRight(cfg.Dest, "/")+"/")
+	}
+	if err := os.Rename(stage, filepath.Join(cfg.Dest, res.Name)); err != nil {
+		return err
+	}
+	pruneBackups(cfg.Dest, cfg.keep())
+	return nil
+}
+
+func bucketPath(dest, name string) string {
+	return strings.TrimRight(dest, "/") + "/" + name
+}
+
+func runCLI(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v\n%s", name, strings.Join(args[:2], " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// localBackups returns the backups in dir, oldest first.
+func localBackups(dir string) ([]string, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, de := range des {
+		if de.IsDir() && strings.HasPrefix(de.Name(), backupPrefix) {
+			names = append(names, de.Name())
+		}
+	}
+	sort.Strings(names) // the times sort as strings
+	return names, nil
+}
+
+// pruneBackups removes all but the newest keep backups in dir.
+func pruneBackups(dir string, keep int) {
+	names, err := localBackups(dir)
+	if err != nil {
+		slog.Warn("backup: prune", "err", err)
+		return
+	}
+	for len(names) > keep {
+		if err := os.RemoveAll(filepath.Join(dir, names[0])); err != nil {
+			slog.Warn("backup: prune", "name", names[0], "err", err)
+		}
+		names = names[1:]
+	}
+}
+
+// lastBackupStart returns when the latest backup started, or the zero time.
+func lastBackupStart(ctx context.Context) time.Time {
+	var s sql.NullString
+	_ = db.QueryRowContext(ctx, `SELECT MAX(started_at) FROM backups`).Scan(&s)
+	t, _ := time.Parse("2006-01-02T15:04:05Z", s.String)
+	return t
+}
+
+// runBackups takes a backup whenever the config's interval has passed
+// since the last one, failed ones included, until ctx is done.
+func runBackups(ctx context.Context) {
+	t := time.NewTicker(backupPoll)
+	defer t.Stop()
+	for {
+		cfg := currentConfig().Backup
+		if cfg.Dest != "" && time.Since(lastBackupStart(ctx)) >= cfg.interval() {
+			_, _ = runBackup(ctx, cfg)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// POST /admin/backup
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cfg := currentConfig().Backup
+	if cfg.Dest == "" {
+		http.Error(w, "backups are not configured", http.StatusConflict)
+		return
+	}
+	res, err := runBackup(r.Context(), cfg)
+	if errors.Is(err, errBackingUp) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// latestBackup returns the newest backup under dest, as a path or URL.
+func latestBackup(ctx context.Context, dest string) (string, error) {
+	var names []string
+	switch {
+	case isBucketURL(dest):
+		cmd := exec.CommandContext(ctx, "aws", "s3", "ls", strings.TrimRight(dest, "/")+"/")
+		if strings.HasPrefix(dest, "gs://") {
+			cmd = exec.CommandContext(ctx, "gcloud", "storage", "ls", strings.TrimRight(dest, "/")+"/")
+		}
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("list %s: %w", dest, err)
+		}
+		// aws prints "PRE trybook-.../", gcloud the whole URL.
+		for _, f := range strings.Fields(string(out)) {
+			if name := filepath.Base(strings.TrimRight(f, "/")); strings.HasPrefix(name, backupPrefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	default:
+		var err error
+		if names, err = localBackups(dest); err != nil {
+			return "", err
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no backups in %s", dest)
+	}
+	if isBucketURL(dest) {
+		return bucketPath(dest, names[len(names)-1]), nil
+	}
+	return filepath.Join(dest, names[len(names)-1]), nil
+}
+
+// restoreBackup puts the database of the backup src in place of
+// trybook.db. It runs before the database is opened.
+func restoreBackup(ctx context.Context, src string) error {
+	if src == "latest" {
+		cfg, err := loadConfig(configPath())
+		if err != nil {
+			return err
+		}
+		if cfg.Backup.Dest == "" {
+			return fmt.Errorf("-restore latest: no backup dest in the config")
+		}
+		if src, err = latestBackup(ctx, cfg.Backup.Dest); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*appDir, 0o755); err != nil {
+		return err
+	}
+	tmp := dbPath() + ".restore"
+	defer func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} { // checkBackupDB opens it in WAL mode
+			os.Remove(tmp + suffix)
+		}
+	}()
+	switch {
+	case strings.HasPrefix(src, "s3://"):
+		err := runCLI(ctx, "aws", "s3", "cp", "--only-show-errors", strings.TrimRight(src, "/")+"/trybook.db", tmp)
+		if err != nil {
+			return err
+		}
+	case strings.HasPrefix(src, "gs://"):
+		if err := runCLI(ctx, "gcloud", "storage", "cp", strings.TrimRight(src, "/")+"/trybook.db", tmp); err != nil {
+			return err
+		}
+	default:
+		if err := copyFile(filepath.Join(src, "trybook.db"), tmp); err != nil {
+			return err
+		}
+	}
+	if err := checkBackupDB(ctx, tmp); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	// Keep the database being replaced, with its WAL, in case.
+	aside := dbPath() + ".before-restore-" + time.Now().UTC().Format(backupTimeFmt)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if pathExists(dbPath() + suffix) {
+			if err := os.Rename(dbPath()+suffix, aside+suffix); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Rename(tmp, dbPath()); err != nil {
+		return err
+	}
+	slog.Info("restored database from backup", "from", src, "previous", aside)
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// checkBackupDB makes sure path is an intact trybook database.
+func checkBackupDB(ctx context.Context, path string) error {
+	bdb, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer bdb.Close()
+	var res string
+	if err := bdb.QueryRowContext(ctx, `PRAGMA quick_check`).Scan(&res); err != nil {
+		return err
+	}
+	if res != "ok" {
+		return fmt.Errorf("database check: %s", res)
+	}
+	var n int
+	if err := bdb.QueryRowContext(ctx, `SELECT COUNT(*) FROM notebooks`).Scan(&n); err != nil {
+		return fmt.Errorf("not a trybook database: %w", err)
+	}
+	return nil
+}
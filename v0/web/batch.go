@@ -0,0 +1,373 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"trybook/gitops"
+)
+
+// Batch runs. The index page's batch form takes a list of repositories and
+// one prompt ("find uses of deprecated API X"). POST /batch records the
+// batch and, in the background, clones each repo if needed, creates a
+// notebook for it and queues the prompt there like any other; the runs
+// themselves go through the job queue. GET /batch/{id} is a dashboard with
+// each repo's status and answers, linking to the notebooks.
+
+const (
+	batchMaxRepos = 50
+	// batchSetupTimeout bounds cloning a repo and creating its notebook.
+	batchSetupTimeout = 10 * time.Minute
+)
+
+const batchSchema = `
+	CREATE TABLE IF NOT EXISTS batches (
+		id         TEXT PRIMARY KEY,
+		owner      TEXT NOT NULL DEFAULT '',
+		prompt     TEXT NOT NULL,
+		intent     TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now'))
+	);
+	CREATE TABLE IF NOT EXISTS batch_items (
+		batch_id    TEXT NOT NULL,
+		pos         INTEGER NOT NULL,
+		repo        TEXT NOT NULL,
+		notebook_id TEXT NOT NULL DEFAULT '',
+		idx         INTEGER NOT NULL DEFAULT 0,
+		error       TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (batch_id, pos),
+		FOREIGN KEY (batch_id) REFERENCES batches(id) ON DELETE CASCADE
+	);`
+
+// parseBatchRepos reads the form's repositories, one per line (or
+// separated by spaces or commas), dropping duplicates.
+func parseBatchRepos(s string) ([]repoSpec, error) {
+	var specs []repoSpec
+	seen := make(map[string]bool)
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == '\r' || r == ' ' || r == ',' }) {
+		spec, err := parseRepoInput(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f, err)
+		}
+		if seen[spec.String()] {
+			continue
+		}
+		seen[spec.String()] = true
+		specs = append(specs, spec)
+	}
+	switch {
+	case len(specs) == 0:
+		return nil, errors.New("list at least one repository")
+	case len(specs) > batchMaxRepos:
+		return nil, fmt.Errorf("at most %d repositories per batch", batchMaxRepos)
+	}
+	return specs, nil
+}
+
+// POST /batch
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := currentUser(r.Context())
+	fail := func(msg string) {
+		setHTMLHeaders(w)
+		_ = renderPage(w, "index", viewModel{Title: "Trybook", Message: msg, MsgClass: "error", User: user, CSRF: csrfToken(r)})
+	}
+	specs, err := parseBatchRepos(r.FormValue("repos"))
+	if err != nil {
+		fail("Cannot start the batch: " + err.Error() + ".")
+		return
+	}
+	prompt, _, err := checkPrompt(r.FormValue("prompt"), false)
+	if err != nil {
+		fail("Cannot start the batch: " + err.Error() + ".")
+		return
+	}
+	intent := r.FormValue("intent")
+	if _, ok := currentConfig().Intents[intent]; intent != "" && !ok {
+		fail("Unknown intent: " + intent)
+		return
+	}
+	for _, d := range []string{cloneBaseDir(), worktreeBaseDir()} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			slog.ErrorContext(r.Context(), "batchHandler: MkdirAll", "dir", d, "err", err)
+			fail("Server cannot create its data directories.")
+			return
+		}
+	}
+	id := genNotebookID()
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "batchHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(r.Context(), `
+		INSERT INTO batches(id, owner, prompt, intent) VALUES(?, ?, ?, ?)
+	`, id, user, prompt, intent); err != nil {
+		slog.ErrorContext(r.Context(), "batchHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	for i, spec := range specs {
+		if _, err := tx.ExecContext(r.Context(), `
+			INSERT INTO batch_items(batch_id, pos, repo) VALUES(?, ?, ?)
+		`, id, i, spec.String()); err != nil {
+			slog.ErrorContext(r.Context(), "batchHandler", "err", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.ErrorContext(r.Context(), "batchHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "batch: started", "batch", id, "repos", len(specs))
+	go runBatch(context.WithoutCancel(r.Context()), id, user, prompt, intent, specs)
+	http.Redirect(w, r, "/batch/"+id, http.StatusSeeOther)
+}
+
+// runBatch sets up each repo of a batch in turn and queues the prompt in
+// its new notebook. A repo that fails records why and the rest go on.
+func runBatch(ctx context.Context, id, user, prompt, intent string, specs []repoSpec) {
+	for i, spec := range specs {
+		nbID, idx, err := startBatchItem(ctx, user, prompt, intent, spec)
+		if err != nil {
+			slog.WarnContext(ctx, "batch: repo failed", "batch", id, "repo", spec.String(), "err", err)
+			if msg, ok := gitops.ErrorMessage(err); ok {
+				err = errors.New(msg)
+			}
+		}
+		errText := ""
+		if err != nil {
+			errText = err.Error()
+		}
+		if _, uerr := db.ExecContext(ctx, `
+			UPDATE batch_items SET notebook_id = ?, idx = ?, error = ? WHERE batch_id = ? AND pos = ?
+		`, nbID, idx, errText, id, i); uerr != nil {
+			slog.ErrorContext(ctx, "batch: record item", "batch", id, "err", uerr)
+		}
+	}
+	slog.InfoContext(ctx, "batch: notebooks created", "batch", id)
+}
+
+// markInterruptedBatches fails the repos of batches the server stopped
+// setting up; their notebooks were never created.
+func markInterruptedBatches() {
+	res, err := db.Exec(`
+		UPDATE batch_items SET error = 'interrupted: the server stopped before the notebook was created'
+		WHERE notebook_id = '' AND error = ''
+	`)
+	if err != nil {
+		slog.Error("batch: mark interrupted", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Warn("batch: marked repos interrupted", "repos", n)
+	}
+}
+
+func startBatchItem(ctx context.Context, user, prompt, intent string, spec repoSpec) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, batchSetupTimeout)
+	defer cancel()
+	cfg := currentConfig()
+	if err := checkRepoSize(ctx, spec, cfg.Quotas.MaxRepoSizeMB); err != nil {
+		return "", 0, err
+	}
+	mu := cloneLock(repoDirPath(spec.Host, spec.Org, spec.Repo))
+	mu.Lock()
+	err := ensureRepoCloned(ctx, spec, nil)
+	mu.Unlock()
+	if err != nil {
+		return "", 0, err
+	}
+	if err := recordClone(ctx, spec); err != nil {
+		slog.ErrorContext(ctx, "batch: recordClone", "repo", spec.String(), "err", err)
+	}
+	nbID, err := createNotebook(ctx, user, spec.Host, spec.Org, spec.Repo, spec.Subdir)
+	if err != nil {
+		return "", 0, err
+	}
+	idx, err := appendNotebookEntry(ctx, nbID, prompt)
+	if err != nil {
+		return nbID, 0, err
+	}
+	if intent != "" {
+		if err := setNotebookEntryIntent(ctx, nbID, idx, intent, intentManual); err != nil {
+			slog.ErrorContext(ctx, "batch: set intent", "nb", nbID, "err", err)
+		}
+	}
+	return nbID, idx, enqueueEntry(ctx, cfg, nbID, idx)
+}
+
+type batchAnswer struct {
+	Model    string
+	Output   string
+	Status   string // running, done, failed, timed out, interrupted
+	ExitCode int
+}
+
+type batchItem struct {
+	Repo       string
+	NotebookID string
+	Idx        int
+	Error      string
+	Status     string // setting up, queued, running, done, failed, entry deleted
+	Answers    []batchAnswer
+}
+
+type batchView struct {
+	ID        string
+	Prompt    string
+	Intent    string
+	CreatedAt string
+	Items     []batchItem
+	Done      int  // items finished, failed or not
+	Running   bool // some item is not finished; the page refreshes
+	User      string
+	CSRF      string
+}
+
+// GET /batch/{id}
+func batchPageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/batch/")
+	if !isSafeToken(id) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	v, err := loadBatch(r.Context(), id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && authEnabled() && v.User != currentUser(r.Context())) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "batchPageHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	v.User, v.CSRF = currentUser(r.Context()), csrfToken(r)
+	setHTMLHeaders(w)
+	_ = renderPage(w, "batch", v)
+}
+
+// loadBatch reads a batch and the state of each repo's runs. v.User is the
+// batch's owner.
+func loadBatch(ctx context.Context, id string) (batchView, error) {
+	v := batchView{ID: id}
+	if err := db.QueryRowContext(ctx, `
+		SELECT owner, prompt, intent, created_at FROM batches WHERE id = ?
+	`, id).Scan(&v.User, &v.Prompt, &v.Intent, &v.CreatedAt); err != nil {
+		return v, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT repo, notebook_id, idx, error FROM batch_items WHERE batch_id = ? ORDER BY pos
+	`, id)
+	if err != nil {
+		return v, err
+	}
+	for rows.Next() {
+		var it batchItem
+		if err := rows.Scan(&it.Repo, &it.NotebookID, &it.Idx, &it.Error); err != nil {
+			rows.Close()
+			return v, err
+		}
+		v.Items = append(v.Items, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return v, err
+	}
+	for i := range v.Items {
+		it := &v.Items[i]
+		switch {
+		case it.Error != "":
+			it.Status = "failed"
+		case it.NotebookID == "":
+			it.Status = "setting up"
+		case it.Idx < 0:
+			it.Status = "entry deleted"
+		default:
+			if err := loadBatchAnswers(ctx, it); err != nil {
+				return v, err
+			}
+		}
+		if it.Status == "done" || it.Status == "failed" || it.Status == "entry deleted" {
+			v.Done++
+		}
+	}
+	v.Running = v.Done < len(v.Items)
+	return v, nil
+}
+
+// loadBatchAnswers fills in an item's answers, from the latest run of each
+// model, and its status.
+func loadBatchAnswers(ctx context.Context, it *batchItem) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT r.model, COALESCE(o.output, r.output), r.finished_at IS NULL, COALESCE(r.exit_code, 0), r.timed_out, r.interrupted
+		FROM runs r
+		LEFT JOIN entry_outputs o ON o.notebook_id = r.notebook_id AND o.idx = r.idx AND o.model = r.model
+		WHERE r.notebook_id = ? AND r.idx = ? AND r.model != ?
+		  AND r.id = (SELECT MAX(id) FROM runs WHERE notebook_id = r.notebook_id AND idx = r.idx AND model = r.model)
+		ORDER BY r.model
+	`, it.NotebookID, it.Idx, TestsModel)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	failed := false
+	for rows.Next() {
+		var a batchAnswer
+		var running, timedOut, interrupted bool
+		if err := rows.Scan(&a.Model, &a.Output, &running, &a.ExitCode, &timedOut, &interrupted); err != nil {
+			return err
+		}
+		switch {
+		case running:
+			a.Status = "running"
+		case interrupted:
+			a.Status, failed = "interrupted", true
+		case timedOut:
+			a.Status, failed = "timed out", true
+		case a.ExitCode != 0:
+			a.Status, failed = fmt.Sprintf("exit %d", a.ExitCode), true
+		default:
+			a.Status = "done"
+		}
+		it.Answers = append(it.Answers, a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var pending int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM jobs WHERE notebook_id = ? AND idx = ? AND status IN ('queued', 'running')
+	`, it.NotebookID, it.Idx).Scan(&pending); err != nil {
+		return err
+	}
+	switch {
+	case pending > 0 && len(it.Answers) == 0:
+		it.Status = "queued"
+	case pending > 0:
+		it.Status = "running"
+	case failed:
+		it.Status = "failed"
+	default:
+		it.Status = "done"
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package web
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Taking a notebook's work elsewhere without pushing it. GET
+// /n/{id}/bundle?format=... downloads one of:
+//
+//   - bundle: a git bundle of the notebook's branch with the commits since
+//     its start commit, which git fetch or git pull can read in a clone
+//     that has that commit;
+//   - patch: the same commits as a git format-patch series in one mbox
+//     file, for git am;
+//   - tar: a gzipped tarball of the worktree as it is on disk, uncommitted
+//     changes included: the tracked files and the untracked ones
+//     .gitignore does not exclude.
+
+// notebookCommits counts the commits on the worktree's HEAD since the
+// notebook's start commit.
+func notebookCommits(ctx context.Context, meta notebookMeta, dir string) (int, error) {
+	if !isCommitish(meta.SHA) {
+		return 0, fmt.Errorf("no start commit recorded")
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-list", "--count", meta.SHA+"..HEAD").Output()
+	if err != nil {
+		return 0, fmt.Errorf("git rev-list: %w", err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// writeWorktreeTar writes dir's tracked and unignored untracked files to w
+// as a gzipped tarball under prefix/.
+func writeWorktreeTar(ctx context.Context, dir, prefix string, w io.Writer) error {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "ls-files", "-z", "--cached", "--others", "--exclude-standard").Output()
+	if err != nil {
+		return fmt.Errorf("git ls-files: %w", err)
+	}
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	seen := make(map[string]bool)
+	for _, rel := range strings.Split(string(out), "\x00") {
+		if rel == "" || seen[rel] {
+			continue
+		}
+		seen[rel] = true // a conflicted file is listed once per stage
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		fi, err := os.Lstat(p)
+		if err != nil {
+			continue // deleted, or outside a sparse checkout
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				continue
+			}
+		} else if !fi.Mode().IsRegular() {
+			continue // a submodule's directory
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + "/" + rel
+		hdr.Uname, hdr.Gname, hdr.Uid, hdr.Gid = "", "", 0, 0
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if link != "" {
+			continue
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, io.LimitReader(f, hdr.Size)) // the file may grow meanwhile
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// GET /n/{id}/bundle?format=bundle|patch|tar
+func bundleHandler(w http.ResponseWriter, r *http.Request, nbID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "bundle"
+	}
+	if format != "bundle" && format != "patch" && format != "tar" {
+		http.Error(w, "format must be bundle, patch or tar", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := ensureWorktree(r.Context(), meta); err != nil {
+		slog.ErrorContext(r.Context(), "bundleHandler", "err", err)
+		http.Error(w, "worktree unavailable", http.StatusInternalServerError)
+		return
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	name := fmt.Sprintf("trybook-%s-%s", strings.ReplaceAll(meta.Repo, "/", "-"), nbID)
+
+	if format == "tar" {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.tar.gz"`)
+		if err := writeWorktreeTar(r.Context(), dir, name, w); err != nil {
+			// Too late for an error status; the truncated download fails
+			// to unpack.
+			slog.ErrorContext(r.Context(), "bundleHandler: tar", "err", err)
+		}
+		return
+	}
+
+	n, err := notebookCommits(r.Context(), meta, dir)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "bundleHandler", "err", err)
+		http.Error(w, "cannot list the notebook's commits", http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "the notebook has no commits since its start commit", http.StatusConflict)
+		return
+	}
+	var args []string
+	if format == "bundle" {
+		// The bundle's ref is the notebook's branch, so
+		// git fetch file.bundle <branch> works without naming commits.
+		ref := "HEAD"
+		if b := strings.TrimSpace(meta.Branch); b != "" && b != "HEAD" &&
+			exec.CommandContext(r.Context(), "git", "-C", dir, "check-ref-format", "--branch", b).Run() == nil {
+			ref = "refs/heads/" + b
+		}
+		args = []string{"bundle", "create", "--quiet", "-", ref, "^" + meta.SHA}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.bundle"`)
+	} else {
+		args = []string{"format-patch", "--stdout", meta.SHA + "..HEAD"}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.patch"`)
+	}
+	cmd := exec.CommandContext(r.Context(), "git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdout = w
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		slog.ErrorContext(r.Context(), "bundleHandler: git "+args[0], "err", err, "stderr", strings.TrimSpace(stderr.String()))
+	}
+}
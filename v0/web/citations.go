@@ -0,0 +1,439 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Answer citations. After a question run (a model that does not edit the
+// worktree) finishes, its answer is checked against the worktree: code it
+// quotes in fenced blocks is looked up in the repo's files, and file:line
+// references (main.go:142, internal/db.go:10-20) are checked to exist. What
+// is found is listed under the answer as "Sources", each with the file and
+// lines and an excerpt of them as they are in the worktree. A quote that
+// says which file it is from (in the fence's info string, or on the line
+// before the fence) but is not in it, and a reference to a file or lines
+// the repo does not have, are listed as "not found in repo": likely made
+// up. Other code that matches nothing is taken for code the model wrote
+// and left alone. Files the context ignore rules keep from models are never
+// cited.
+
+const citationsSchema = `
+	CREATE TABLE IF NOT EXISTS citations (
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		model       TEXT NOT NULL,
+		pos         INTEGER NOT NULL,
+		path        TEXT NOT NULL,
+		start_line  INTEGER NOT NULL DEFAULT 0,
+		end_line    INTEGER NOT NULL DEFAULT 0,
+		excerpt     TEXT NOT NULL DEFAULT '',
+		quote       TEXT NOT NULL DEFAULT '',
+		found       INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (notebook_id, idx, model, pos)
+	);`
+
+const (
+	citationsMax        = 20  // per answer
+	citationExcerptMax  = 20  // lines of a file shown under a citation
+	citationMinLine     = 8   // characters for a quoted line to count
+	citationQuoteLines  = 200 // lines of a fenced block looked at
+	citationCandidates  = 50  // files a quote is compared with
+	citationMatchNeeded = 0.6 // share of a quote's lines found in order
+	citationMaxGap      = 20  // file lines allowed between two quoted lines
+)
+
+// citation is a file and lines an answer quoted or referred to.
+type citation struct {
+	Path    string `json:"path"` // slash-separated, from the worktree's top
+	Line    int    `json:"line,omitempty"`
+	End     int    `json:"end,omitempty"`
+	Excerpt string `json:"excerpt,omitempty"` // the lines in the worktree
+	Quote   string `json:"quote,omitempty"`   // the first line quoted, for those not found
+	Found   bool   `json:"found"`
+}
+
+// Lines shows the cited lines, as in "12-18" or "12".
+func (c citation) Lines() string {
+	switch {
+	case c.Line == 0:
+		return ""
+	case c.End > c.Line:
+		return fmt.Sprintf("%d-%d", c.Line, c.End)
+	default:
+		return fmt.Sprintf("%d", c.Line)
+	}
+}
+
+var (
+	// fileRefRE matches file:line references, like the notebook page's
+	// linker does.
+	fileRefRE = regexp.MustCompile(`((?:[\w.-]+/)*[\w-][\w.-]*\.[A-Za-z0-9]+):(\d+)(?:-(\d+))?`)
+	// filePathRE matches what may name a file in a fence or the line before.
+	filePathRE  = regexp.MustCompile(`(?:[\w.-]+/)*[\w-][\w.-]*\.[A-Za-z0-9]+`)
+	codeFenceRE = regexp.MustCompile("^\\s*(```+|~~~+)\\s*(.*)$")
+)
+
+// quotedBlock is a fenced code block of an answer.
+type quotedBlock struct {
+	Info  string // the fence's info string, such as "go" or "go main.go"
+	Hint  string // the line before the fence
+	Lines []string
+}
+
+// fencedBlocks returns the answer's fenced code blocks.
+func fencedBlocks(answer string) []quotedBlock {
+	var out []quotedBlock
+	var cur *quotedBlock
+	var fence, prev string
+	for _, l := range strings.Split(answer, "\n") {
+		m := codeFenceRE.FindStringSubmatch(l)
+		switch {
+		case cur == nil && m != nil:
+			cur, fence = &quotedBlock{Info: strings.TrimSpace(m[2]), Hint: prev}, m[1]
+		case cur != nil && m != nil && strings.HasPrefix(m[1], fence[:1]) && len(m[1]) >= len(fence) && m[2] == "":
+			out = append(out, *cur)
+			cur = nil
+		case cur != nil:
+			if len(cur.Lines) < citationQuoteLines {
+				cur.Lines = append(cur.Lines, l)
+			}
+		}
+		if strings.TrimSpace(l) != "" {
+			prev = l
+		}
+	}
+	return out
+}
+
+// distinctive reports whether a quoted line says enough to be looked up:
+// not a brace, a blank or an ellipsis standing for left-out code.
+func distinctive(l string) bool {
+	l = strings.TrimSpace(l)
+	if len(l) < citationMinLine || strings.Contains(l, "...") || strings.Contains(l, "…") {
+		return false
+	}
+	return strings.IndexFunc(l, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0
+}
+
+// citer checks an answer against a worktree.
+type citer struct {
+	ctx    context.Context
+	dir    string // the worktree's top
+	subdir string // where the model ran, relative to dir
+	ignore *ignoreRules
+	files  []string
+	texts  map[string][]string // file -> lines, as read
+}
+
+func newCiter(ctx context.Context, dir, subdir string, ignore *ignoreRules) (*citer, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "ls-files", "-z", "--cached", "--others", "--exclude-standard").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files: %w", err)
+	}
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return &citer{ctx: ctx, dir: dir, subdir: subdir, ignore: ignore, files: ignore.filter(files), texts: map[string][]string{}}, nil
+}
+
+// resolve returns the worktree file p names: p itself, p under the
+// directory the model ran in, or the one file p is the end of.
+func (c *citer) resolve(p string) string {
+	p = strings.TrimPrefix(p, "./")
+	var hit string
+	for _, f := range c.files {
+		switch {
+		case f == p || c.subdir != "" && f == path.Join(c.subdir, p):
+			return f
+		case strings.HasSuffix(f, "/"+p):
+			if hit != "" {
+				return "" // ambiguous
+			}
+			hit = f
+		}
+	}
+	return hit
+}
+
+func (c *citer) lines(f string) []string {
+	if ls, ok := c.texts[f]; ok {
+		return ls
+	}
+	text, err := readWorktreeFile(c.dir, f)
+	var ls []string
+	if err == nil {
+		ls = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	}
+	c.texts[f] = ls
+	return ls
+}
+
+// excerpt returns lines line to end of f, at most citationExcerptMax.
+func (c *citer) excerpt(f string, line, end int) string {
+	ls := c.lines(f)
+	if end > line+citationExcerptMax-1 {
+		end = line + citationExcerptMax - 1
+	}
+	if line < 1 || end > len(ls) {
+		return ""
+	}
+	return strings.Join(ls[line-1:end], "\n")
+}
+
+// candidates returns the files holding any of the quoted lines.
+func (c *citer) candidates(quoted []string) []string {
+	probes := append([]string(nil), quoted...)
+	sort.SliceStable(probes, func(i, j int) bool { return len(probes[i]) > len(probes[j]) })
+	if len(probes) > 5 {
+		probes = probes[:5]
+	}
+	args := []string{"-C", c.dir, "grep", "-F", "-l", "-z", "-I", "--untracked"}
+	for _, p := range probes {
+		args = append(args, "-e", p)
+	}
+	out, _ := exec.CommandContext(c.ctx, "git", args...).Output() // exit 1: no match
+	var fs []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f != "" && !c.ignore.Ignored(f) && len(fs) < citationCandidates {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+// match finds the quoted lines in f in order, each within citationMaxGap
+// lines of the one before, and returns how many it found and the span.
+func (c *citer) match(f string, quoted []string) (n, start, end int) {
+	pos := map[string][]int{}
+	for i, l := range c.lines(f) {
+		t := strings.TrimSpace(l)
+		pos[t] = append(pos[t], i+1)
+	}
+	for j, q := range quoted {
+		for _, anchor := range pos[q] {
+			k, e := 1, anchor
+			for _, next := range quoted[j+1:] {
+				for _, p := range pos[next] {
+					if p > e && p <= e+citationMaxGap {
+						k, e = k+1, p
+						break
+					}
+				}
+			}
+			if k > n {
+				n, start, end = k, anchor, e
+			}
+		}
+	}
+	return n, start, end
+}
+
+// block cites a fenced block, or reports it as not found if it names a
+// file; ok is false for code that matches nothing and names no file.
+func (c *citer) block(b quotedBlock) (cit citation, ok bool) {
+	lang, _, _ := strings.Cut(strings.ToLower(b.Info), " ")
+	if lang == "diff" || lang == "patch" {
+		return cit, false // a change proposed, not a quote
+	}
+	var quoted []string
+	for _, l := range b.Lines {
+		if distinctive(l) {
+			quoted = append(quoted, strings.TrimSpace(l))
+		}
+	}
+	if len(quoted) == 0 {
+		return cit, false
+	}
+	named, file := c.named(b) // the file the block says it is from
+	files := c.candidates(quoted)
+	if file != "" {
+		files = append([]string{file}, files...)
+	}
+	best, bestStart, bestEnd, bestFile := 0, 0, 0, ""
+	for _, f := range files {
+		if n, s, e := c.match(f, quoted); n > best {
+			best, bestStart, bestEnd, bestFile = n, s, e, f
+		}
+	}
+	if float64(best) >= citationMatchNeeded*float64(len(quoted)) {
+		return citation{Path: bestFile, Line: bestStart, End: bestEnd, Excerpt: c.excerpt(bestFile, bestStart, bestEnd), Found: true}, true
+	}
+	switch {
+	case file != "":
+		return citation{Path: file, Quote: quoted[0]}, true
+	case named != "":
+		return citation{Path: named, Quote: quoted[0]}, true
+	}
+	return cit, false
+}
+
+// named returns the file a block's fence or the line before it names: a
+// worktree file, or one with a source file's extension the worktree does
+// not have.
+func (c *citer) named(b quotedBlock) (name, file string) {
+	for _, s := range []string{b.Info, b.Hint} {
+		for _, m := range filePathRE.FindAllString(s, -1) {
+			if f := c.resolve(m); f != "" {
+				return m, f
+			}
+			if sourceExt[strings.ToLower(path.Ext(m))] {
+				return m, ""
+			}
+		}
+	}
+	return "", ""
+}
+
+// ref checks a file:line reference.
+func (c *citer) ref(m []string) citation {
+	line, _ := strconv.Atoi(m[2])
+	end, _ := strconv.Atoi(m[3])
+	if end < line {
+		end = line
+	}
+	f := c.resolve(m[1])
+	if f == "" {
+		return citation{Path: m[1], Line: line, End: end}
+	}
+	if n := len(c.lines(f)); line < 1 || end > n {
+		return citation{Path: f, Line: line, End: end}
+	}
+	return citation{Path: f, Line: line, End: end, Excerpt: c.excerpt(f, line, end), Found: true}
+}
+
+// cite returns the citations of an answer, once each.
+func (c *citer) cite(answer string) []citation {
+	var out []citation
+	seen := map[string]bool{}
+	add := func(cit citation) {
+		key := fmt.Sprintf("%s:%d-%d:%t:%s", cit.Path, cit.Line, cit.End, cit.Found, cit.Quote)
+		if len(out) < citationsMax && !seen[key] {
+			seen[key] = true
+			out = append(out, cit)
+		}
+	}
+	for _, b := range fencedBlocks(answer) {
+		if cit, ok := c.block(b); ok {
+			add(cit)
+		}
+	}
+	for _, m := range fileRefRE.FindAllStringSubmatch(answer, -1) {
+		if !sourceExt[strings.ToLower(path.Ext(m[1]))] && c.resolve(m[1]) == "" {
+			continue // host:port and the like
+		}
+		add(c.ref(m))
+	}
+	return out
+}
+
+// sourceExt are the extensions of files a reference to which, if the repo
+// does not have it, is reported as not found.
+var sourceExt = map[string]bool{
+	".go": true, ".py": true, ".js": true, ".jsx": true, ".ts": true, ".tsx": true, ".rs": true,
+	".java": true, ".kt": true, ".c": true, ".h": true, ".cc": true, ".cpp": true, ".hpp": true,
+	".cs": true, ".rb": true, ".php": true, ".swift": true, ".scala": true, ".sh": true, ".sql": true,
+	".html": true, ".css": true, ".md": true, ".json": true, ".yaml": true, ".yml": true, ".toml": true,
+}
+
+// recordCitations replaces the citations of the model's answer to the
+// entry with those of answer.
+func (pr *preparedRun) recordCitations(ctx context.Context, dir, answer string) {
+	ignore, err := pr.cfg.contextIgnore(pr.meta, dir)
+	if err != nil {
+		slog.WarnContext(ctx, "run: ignore rules", "err", err)
+	}
+	c, err := newCiter(ctx, dir, pr.meta.Subdir, ignore)
+	if err != nil {
+		slog.WarnContext(ctx, "run: citations", "err", err)
+		return
+	}
+	if err := setCitations(ctx, pr.nbID, pr.idx, pr.model, c.cite(answer)); err != nil {
+		slog.ErrorContext(ctx, "run: persist citations", "err", err)
+	}
+}
+
+func setCitations(ctx context.Context, nbID string, idx int, model string, cits []citation) error {
+	return inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM citations WHERE notebook_id = ? AND idx = ? AND model = ?`, nbID, idx, model); err != nil {
+			return err
+		}
+		for i, c := range cits {
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO citations(notebook_id, idx, model, pos, path, start_line, end_line, excerpt, quote, found)
+				VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, nbID, idx, model, i, c.Path, c.Line, c.End, c.Excerpt, c.Quote, c.Found); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GET /api/citations?nb=..&idx=N&model=.. lists the citations of an answer,
+// for the page to show them when a run it watched finishes.
+func citationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	nbID, model := strings.TrimSpace(q.Get("nb")), strings.TrimSpace(q.Get("model"))
+	idx, err := strconv.Atoi(q.Get("idx"))
+	if !isSafeToken(nbID) || !isSafeToken(model) || err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if _, _, err := loadNotebook(r.Context(), nbID); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	cits, err := loadCitations(r.Context(), nbID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "citationsHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(append([]citation{}, cits[idx][model]...))
+}
+
+// loadCitations returns the notebook's citations: idx -> model -> citations.
+func loadCitations(ctx context.Context, nbID string) (map[int]map[string][]citation, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT idx, model, path, start_line, end_line, excerpt, quote, found
+		FROM citations WHERE notebook_id = ? ORDER BY idx, model, pos
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int]map[string][]citation)
+	for rows.Next() {
+		var idx int
+		var model string
+		var c citation
+		if err := rows.Scan(&idx, &model, &c.Path, &c.Line, &c.End, &c.Excerpt, &c.Quote, &c.Found); err != nil {
+			return nil, err
+		}
+		if out[idx] == nil {
+			out[idx] = make(map[string][]citation)
+		}
+		out[idx][model] = append(out[idx][model], c)
+	}
+	return out, rows.Err()
+}
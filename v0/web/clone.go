@@ -0,0 +1,304 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"trybook/gitops"
+	"trybook/runner"
+)
+
+// Cloning in the background. POST /try creates the notebook at once, in
+// the "cloning" state, and opens it. A job on the server then clones the
+// repository with git clone --progress if it isn't cloned yet (its size
+// checked against quotas.max_repo_size_mb beforehand, which GitHub reports
+// before anything is downloaded), or checks access to the clone if it is,
+// and adds the notebook's worktree. The notebook page follows the job over
+// GET /events/clone?nb=.. with the prompt box disabled, and reloads when
+// the worktree is ready. A clone that fails leaves the notebook "failed",
+// with git's message, for the user to delete.
+//
+// Events: progress ({phase, percent, line}), done ({nb}) and error
+// ({message}). Clones of the same repository run one at a time. A server
+// restart fails the notebooks it was cloning for.
+
+var cloneTimeout = flag.Duration("clone-timeout", 10*time.Minute, "how long a clone may take")
+
+type cloneTask struct {
+	spec repoSpec
+	user string
+	lr   *runner.Run
+}
+
+// Notebook statuses; a notebook whose worktree is ready has none.
+const (
+	nbCloning    = "cloning"
+	nbCloneError = "failed"
+)
+
+var errNotebookNotReady = errors.New("the notebook's repository is not cloned yet")
+
+var (
+	cloneTasksMu sync.Mutex
+	cloneTasks   = make(map[string]*cloneTask) // notebook id -> task
+
+	cloneLocksMu sync.Mutex
+	cloneLocks   = make(map[string]*sync.Mutex) // clone dir -> lock
+)
+
+func cloneLock(dir string) *sync.Mutex {
+	cloneLocksMu.Lock()
+	defer cloneLocksMu.Unlock()
+	mu := cloneLocks[dir]
+	if mu == nil {
+		mu = new(sync.Mutex)
+		cloneLocks[dir] = mu
+	}
+	return mu
+}
+
+// errRepoTooLarge is returned by checkRepoSize.
+type errRepoTooLarge struct {
+	spec        repoSpec
+	sizeMB, max int
+}
+
+func (e errRepoTooLarge) Error() string {
+	return fmt.Sprintf("%s is %d MB, over this server's limit of %d MB", e.spec, e.sizeMB, e.max)
+}
+
+// checkRepoSize asks GitHub how big the repository is and refuses it if it
+// is over maxMB. Other hosts, and repositories GitHub won't describe, pass.
+func checkRepoSize(ctx context.Context, spec repoSpec, maxMB int) error {
+	if maxMB <= 0 || spec.Host != defaultHost {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var repo struct {
+		Size int `json:"size"` // KB
+	}
+	if _, err := githubAPI(ctx, gitToken(ctx, spec.Host), http.MethodGet, fmt.Sprintf("/repos/%s/%s", spec.Org, spec.Repo), nil, &repo); err != nil {
+		slog.WarnContext(ctx, "checkRepoSize: size unknown", "repo", spec.String(), "err", err)
+		return nil
+	}
+	if mb := (repo.Size + 1023) / 1024; mb > maxMB {
+		return errRepoTooLarge{spec: spec, sizeMB: mb, max: maxMB}
+	}
+	return nil
+}
+
+// gitProgressRe matches git's progress lines, e.g.
+// "Receiving objects:  45% (450/1000), 1.20 MiB | 1.10 MiB/s".
+var gitProgressRe = regexp.MustCompile(`^(?:remote: )?([A-Za-z ]+):\s+(\d+)%`)
+
+// progressWriter turns git's --progress output, which redraws lines with
+// \r, into progress events, one per phase and percent.
+type progressWriter struct {
+	lr      *runner.Run
+	partial []byte
+	phase   string
+	percent int
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	b := append(pw.partial, p...)
+	for {
+		i := bytes.IndexAny(b, "\r\n")
+		if i < 0 {
+			break
+		}
+		pw.line(strings.TrimSpace(string(b[:i])))
+		b = b[i+1:]
+	}
+	pw.partial = append([]byte(nil), b...)
+	return len(p), nil
+}
+
+func (pw *progressWriter) line(s string) {
+	if s == "" {
+		return
+	}
+	phase, percent := "", -1
+	if m := gitProgressRe.FindStringSubmatch(s); m != nil {
+		phase = m[1]
+		percent, _ = strconv.Atoi(m[2])
+		if phase == pw.phase && percent == pw.percent {
+			return
+		}
+	}
+	pw.phase, pw.percent = phase, percent
+	pw.lr.Emit("progress", map[string]any{"phase": phase, "percent": percent, "line": s})
+}
+
+// cloneErrorText is git's output without its progress lines.
+func cloneErrorText(out []byte) string {
+	var keep []string
+	for _, l := range strings.FieldsFunc(string(out), func(r rune) bool { return r == '\r' || r == '\n' }) {
+		if l = strings.TrimSpace(l); l != "" && !gitProgressRe.MatchString(l) {
+			keep = append(keep, l)
+		}
+	}
+	return strings.Join(keep, "\n")
+}
+
+// startClone creates a notebook on spec for the request's user and clones
+// it in the background. ctx carries the user; its cancellation is ignored.
+func startClone(ctx context.Context, spec repoSpec) (string, error) {
+	id, user := genNotebookID(), currentUser(ctx)
+	wtName := "nb-" + id
+	if _, err := execDB(ctx, `
+		INSERT INTO notebooks(id, owner, host, org, repo, subdir, branch, worktree, commit_sha, status)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, '', ?)
+	`, id, user, spec.Host, spec.Org, spec.Repo, spec.Subdir, wtName, wtName, nbCloning); err != nil {
+		return "", fmt.Errorf("insert notebook: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), *cloneTimeout)
+	t := &cloneTask{spec: spec, user: user, lr: runner.NewRun(cancel)}
+	cloneTasksMu.Lock()
+	cloneTasks[id] = t
+	cloneTasksMu.Unlock()
+	go func() {
+		defer cancel()
+		if err := runClone(ctx, id, t); err != nil {
+			slog.ErrorContext(ctx, "clone failed", "repo", spec.String(), "nb", id, "err", err)
+			if _, err := execDB(context.WithoutCancel(ctx), `
+				UPDATE notebooks SET status = ?, status_message = ? WHERE id = ? AND status = ?
+			`, nbCloneError, err.Error(), id, nbCloning); err != nil {
+				slog.ErrorContext(ctx, "clone: mark failed", "nb", id, "err", err)
+			}
+			t.lr.Emit("error", map[string]string{"message": err.Error()})
+		} else {
+			slog.InfoContext(ctx, "clone: notebook ready", "repo", spec.String(), "nb", id)
+			t.lr.Emit("done", map[string]string{"nb": id})
+		}
+		t.lr.Finish()
+		time.AfterFunc(runner.Retention, func() {
+			cloneTasksMu.Lock()
+			delete(cloneTasks, id)
+			cloneTasksMu.Unlock()
+		})
+	}()
+	return id, nil
+}
+
+func runClone(ctx context.Context, nbID string, t *cloneTask) error {
+	mu := cloneLock(repoDirPath(t.spec.Host, t.spec.Org, t.spec.Repo))
+	if !mu.TryLock() {
+		t.lr.Emit("progress", map[string]any{"phase": "", "percent": -1, "line": "Waiting for another clone of " + t.spec.String() + "..."})
+		mu.Lock()
+	}
+	err := ensureRepoCloned(ctx, t.spec, &progressWriter{lr: t.lr})
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := recordClone(ctx, t.spec); err != nil {
+		slog.ErrorContext(ctx, "runClone: recordClone error", "err", err)
+	}
+	t.lr.Emit("progress", map[string]any{"phase": "", "percent": -1, "line": "Creating the notebook's worktree..."})
+	if err := fillNotebookFor(ctx, nbID, t.spec); err != nil {
+		if msg, ok := gitops.ErrorMessage(err); ok {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// fillNotebook adds the worktree of notebook id, started at commit (the
+// clone's HEAD if empty), and marks the notebook ready.
+func fillNotebook(ctx context.Context, id string, spec repoSpec, commit string) error {
+	if err := os.MkdirAll(filepath.Dir(worktreeDirPath(spec.Host, spec.Org, spec.Repo, "nb-")), 0o755); err != nil {
+		return fmt.Errorf("create worktree parent dir: %w", err)
+	}
+	wtName, err := worktrees().AddScopedAs(ctx, id, spec.Host, spec.Org, spec.Repo, commit, spec.Subdir)
+	if err != nil {
+		return err
+	}
+	branch, sha, err := currentBranchAndCommit(ctx, worktreeDirPath(spec.Host, spec.Org, spec.Repo, wtName))
+	if err == nil {
+		_, err = execDB(ctx, `
+			UPDATE notebooks SET branch = ?, worktree = ?, commit_sha = ?, status = '', status_message = ''
+			WHERE id = ?
+		`, branch, wtName, sha, id)
+	}
+	if err != nil {
+		worktrees().Remove(ctx, spec.Host, spec.Org, spec.Repo, wtName)
+		return err
+	}
+	return nil
+}
+
+// cancelClone stops the clone for notebook nbID, if one is running.
+func cancelClone(nbID string) {
+	cloneTasksMu.Lock()
+	t := cloneTasks[nbID]
+	cloneTasksMu.Unlock()
+	if t != nil && !t.lr.Finished() {
+		t.lr.Cancel()
+	}
+}
+
+// markInterruptedClones fails the notebooks a previous run of the server
+// was cloning for and removes the clones it left half written.
+func markInterruptedClones() {
+	if err := os.RemoveAll(partialCloneDir()); err != nil {
+		slog.Error("clone: remove partial clones", "err", err)
+	}
+	res, err := db.Exec(`
+		UPDATE notebooks SET status = ?, status_message = 'interrupted: the server stopped before the clone finished'
+		WHERE status = ?
+	`, nbCloneError, nbCloning)
+	if err != nil {
+		slog.Error("clone: mark interrupted", "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Warn("clone: marked notebooks interrupted", "notebooks", n)
+	}
+}
+
+// findCloneTask returns the user's clone task for notebook nbID.
+func findCloneTask(r *http.Request, nbID string) *cloneTask {
+	cloneTasksMu.Lock()
+	t := cloneTasks[nbID]
+	cloneTasksMu.Unlock()
+	if t == nil || t.user != currentUser(r.Context()) {
+		return nil
+	}
+	return t
+}
+
+// GET /events/clone?nb=..
+func cloneEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t := findCloneTask(r, r.URL.Query().Get("nb"))
+	if t == nil {
+		// 204 tells EventSource to stop reconnecting.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	lastID, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	streamEvents(w, f, r, t.lr, lastID)
+}
@@ -0,0 +1,170 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Comparing two models' answers. The notebook page shows two answers to
+// the same prompt side by side, with synchronized scrolling and a line
+// diff, and records which one the user preferred. Preferences are kept per
+// entry and pair of models (choosing again replaces the choice) and add up
+// to win rates, shown on the index page and by GET /api/winrates.
+
+const preferencesSchema = `
+	CREATE TABLE IF NOT EXISTS preferences (
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		model_a     TEXT NOT NULL,
+		model_b     TEXT NOT NULL,
+		winner      TEXT NOT NULL,
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, idx, model_a, model_b),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);`
+
+// modelPair orders two models so a pair has one key.
+func modelPair(x, y string) (string, string) {
+	if x > y {
+		return y, x
+	}
+	return x, y
+}
+
+func setPreference(ctx context.Context, nbID string, idx int, winner, loser string) error {
+	a, b := modelPair(winner, loser)
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO preferences(notebook_id, idx, model_a, model_b, winner)
+		VALUES(?, ?, ?, ?, ?)
+		ON CONFLICT(notebook_id, idx, model_a, model_b) DO UPDATE SET
+			winner = excluded.winner,
+			created_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, nbID, idx, a, b, winner)
+	return err
+}
+
+// loadPreferences returns idx -> "a/b" (a < b) -> preferred model.
+func loadPreferences(ctx context.Context, nbID string) (map[int]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT idx, model_a, model_b, winner FROM preferences WHERE notebook_id = ?
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int]map[string]string)
+	for rows.Next() {
+		var idx int
+		var a, b, winner string
+		if err := rows.Scan(&idx, &a, &b, &winner); err != nil {
+			return nil, err
+		}
+		if out[idx] == nil {
+			out[idx] = make(map[string]string)
+		}
+		out[idx][a+"/"+b] = winner
+	}
+	return out, rows.Err()
+}
+
+type winRate struct {
+	Model       string  `json:"model"`
+	Month       string  `json:"month,omitempty"` // YYYY-MM, when broken down by month
+	Wins        int     `json:"wins"`
+	Comparisons int     `json:"comparisons"`
+	Rate        float64 `json:"rate"`
+}
+
+// Percent is the win rate for display.
+func (w winRate) Percent() int { return int(w.Rate*100 + 0.5) }
+
+// modelWinRates counts each model's preferences over the notebooks user
+// can see, best first; by month (newest first) if byMonth.
+func modelWinRates(ctx context.Context, user string, byMonth bool) ([]winRate, error) {
+	month := `''`
+	if byMonth {
+		month = `substr(p.created_at, 1, 7)`
+	}
+	// Each preference counts once for each of its two models.
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.model, `+month+` AS month, SUM(p.won), COUNT(*)
+		FROM (
+			SELECT notebook_id, created_at, model_a AS model, winner = model_a AS won FROM preferences
+			UNION ALL
+			SELECT notebook_id, created_at, model_b, winner = model_b FROM preferences
+		) p
+		JOIN notebooks n ON n.id = p.notebook_id
+		WHERE ? = '' OR n.owner = '' OR n.owner = ?
+		GROUP BY p.model, month
+		ORDER BY month DESC, 1.0 * SUM(p.won) / COUNT(*) DESC, p.model
+	`, user, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []winRate
+	for rows.Next() {
+		var w winRate
+		if err := rows.Scan(&w.Model, &w.Month, &w.Wins, &w.Comparisons); err != nil {
+			return nil, err
+		}
+		if w.Comparisons > 0 {
+			w.Rate = float64(w.Wins) / float64(w.Comparisons)
+		}
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+// POST /api/prefer (nb, idx, model, other): model's answer was better.
+func preferHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	idx, err := strconv.Atoi(strings.TrimSpace(r.FormValue("idx")))
+	winner := strings.TrimSpace(r.FormValue("model"))
+	loser := strings.TrimSpace(r.FormValue("other"))
+	if err != nil || !isSafeToken(nbID) || !isSafeToken(winner) || !isSafeToken(loser) || winner == loser {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var n int
+	if err := db.QueryRowContext(r.Context(), `
+		SELECT COUNT(*) FROM entry_outputs WHERE notebook_id = ? AND idx = ? AND model IN (?, ?)
+	`, nbID, idx, winner, loser).Scan(&n); err != nil || n != 2 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := setPreference(r.Context(), nbID, idx, winner, loser); err != nil {
+		slog.ErrorContext(r.Context(), "preferHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// GET /api/winrates[?by=month]
+func winRatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rates, err := modelWinRates(r.Context(), currentUser(r.Context()), r.URL.Query().Get("by") == "month")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "winRatesHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if rates == nil {
+		rates = []winRate{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(rates)
+}
@@ -0,0 +1,608 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"trybook/runner"
+)
+
+// Runtime configuration. Everything here can be reloaded while the server
+// is running (SIGHUP or POST /admin/reload); in-flight runs keep the
+// snapshot they started with.
+
+var configFile = flag.String("config", "", "path to JSON config file (default <dir>/config.json)")
+
+func configPath() string {
+	if *configFile != "" {
+		return *configFile
+	}
+	return filepath.Join(*appDir, "config.json")
+}
+
+type modelConfig struct {
+	// Command is the argv to run; "{prompt}" in any argument is replaced
+	// with the (templated) prompt.
+	Command []string `json:"command"`
+	// Prompt optionally wraps the user prompt; "{prompt}" is replaced.
+	Prompt string `json:"prompt,omitempty"`
+	// Stdin sends the prompt on standard input instead of argv.
+	Stdin bool `json:"stdin,omitempty"`
+	// PTY runs the command attached to a pseudo-terminal.
+	PTY bool `json:"pty,omitempty"`
+	// ApplyDiff asks for a unified diff and applies and commits it in the
+	// worktree; without a Prompt a default diff prompt is used.
+	ApplyDiff bool `json:"apply_diff,omitempty"`
+	// Edits means the command edits the worktree itself, in an agent mode
+	// such as claude --permission-mode acceptEdits; trybook commits what
+	// it changed after the run.
+	Edits bool `json:"edits,omitempty"`
+	// CleanOutput has the page ask for a cleaned-up copy of the output
+	// (reasoning, tool logs and banners removed) after each run.
+	CleanOutput bool `json:"clean_output,omitempty"`
+	// Format names a structured stdout to decode; "claude-stream-json" is
+	// claude --output-format stream-json --verbose.
+	Format string `json:"format,omitempty"`
+	// Env lists environment variables the command needs (e.g. API keys).
+	Env []string `json:"env,omitempty"`
+	// Order sorts the model's output box on the notebook page.
+	Order int `json:"order,omitempty"`
+	// Usage extracts token counts and cost from the output.
+	Usage *usageConfig `json:"usage,omitempty"`
+	// Result names the report the CLI prints at the end of a run, to be
+	// summarized above its output; "aider" is the only one (see result.go).
+	Result string `json:"result,omitempty"`
+	// ContextEntries overrides context.entries for this model.
+	ContextEntries *int `json:"context_entries,omitempty"`
+	// RepoMap overrides whether the model's prompts start with a map of
+	// the repository; by default those that answer without editing do
+	// (see repomap.go).
+	RepoMap *bool `json:"repo_map,omitempty"`
+	// FileArg is the option that passes a worktree file to the command,
+	// e.g. aider's "--file"; it is repeated for each attached file. Without
+	// it attached files are added to the prompt.
+	FileArg string `json:"file_arg,omitempty"`
+	// IgnoreArg is the option that names a file of gitignore patterns the
+	// command should leave out of what it reads, e.g. aider's
+	// "--aiderignore"; it gets the context ignore rules (see ignore.go).
+	IgnoreArg string `json:"ignore_arg,omitempty"`
+	// Timeouts overrides the global timeouts for this model.
+	Timeouts *timeoutConfig `json:"timeouts,omitempty"`
+	// Image is the container image the model runs in when sandbox.engine
+	// is set; the default is sandbox.image.
+	Image string `json:"image,omitempty"`
+	// NoSandbox runs the model on the host even with a sandbox, e.g. for
+	// a local ollama.
+	NoSandbox bool `json:"no_sandbox,omitempty"`
+	// Params are options the prompt form offers for each run, such as
+	// the model the CLI uses (see modelparams.go).
+	Params map[string]paramConfig `json:"params,omitempty"`
+	// Fallback is the model run instead when this one fails to start or
+	// exits non-zero (see fallback.go).
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// timeoutConfig bounds a model run; a run past either limit is killed and
+// recorded as timed out. 0 means no limit.
+type timeoutConfig struct {
+	// RunMinutes caps how long a run may take (default 60).
+	RunMinutes *int `json:"run_minutes,omitempty"`
+	// IdleMinutes kills a run that writes no output for that long, e.g. a
+	// CLI waiting for input (default 15).
+	IdleMinutes *int `json:"idle_minutes,omitempty"`
+}
+
+// sandboxConfig runs model CLIs and test commands in containers.
+type sandboxConfig struct {
+	// Engine is "docker" or "podman"; empty runs everything on the host.
+	Engine string `json:"engine,omitempty"`
+	// Image is the default image; it needs git and the model CLIs.
+	Image string `json:"image,omitempty"`
+	// CPUs and Memory are passed to --cpus and --memory (default "2" and
+	// "4g"); PIDs to --pids-limit (default 1024).
+	CPUs   string `json:"cpus,omitempty"`
+	Memory string `json:"memory,omitempty"`
+	PIDs   int    `json:"pids,omitempty"`
+	// Network is the internal network runs join (default
+	// "trybook-sandbox", created if missing); "none" gives them no network
+	// at all.
+	Network string `json:"network,omitempty"`
+	// AllowHosts are the hosts runs can reach on port 443, through
+	// trybook's proxy; "*.example.com" also matches subdomains. The default
+	// is the OpenAI, Anthropic and Gemini APIs.
+	AllowHosts []string `json:"allow_hosts,omitempty"`
+}
+
+type quotaConfig struct {
+	// MaxConcurrentRuns caps simultaneous model processes; 0 is unlimited.
+	MaxConcurrentRuns int `json:"max_concurrent_runs"`
+	// MaxRepoSizeMB refuses to clone larger GitHub repositories; 0 is
+	// unlimited.
+	MaxRepoSizeMB int `json:"max_repo_size_mb"`
+}
+
+// repoConfig holds per-repository settings, keyed in the config by
+// org/repo for GitHub and host/org/repo for other hosts.
+type repoConfig struct {
+	// TestCommand is run with sh -c in the worktree after each edit.
+	TestCommand string `json:"test_command,omitempty"`
+	// CloneDepth overrides the global clone_depth for this repository.
+	CloneDepth *int `json:"clone_depth,omitempty"`
+	// AutoTests false stops the detected test command (see repo_profiles)
+	// from running after edits when TestCommand is not set.
+	AutoTests *bool `json:"auto_tests,omitempty"`
+	// Ignore adds gitignore patterns of files kept from models in this
+	// repository, after the global ones.
+	Ignore []string `json:"ignore,omitempty"`
+}
+
+type config struct {
+	Models   map[string]modelConfig `json:"models"`
+	Intents  map[string][]string    `json:"intents"` // intent -> models to run
+	Quotas   quotaConfig            `json:"quotas"`
+	Webhooks []webhookConfig        `json:"webhooks"`
+	Repos    map[string]repoConfig  `json:"repos"`
+	Context  *contextConfig         `json:"context"`
+	// RepoMap sizes the repository map in answering models' prompts
+	// (see repomap.go).
+	RepoMap *repoMapConfig `json:"repo_map,omitempty"`
+	// CloneDepth is how many commits new clones fetch; 0 means the full
+	// history. Shallow clones can be deepened later from the notebook page.
+	CloneDepth *int          `json:"clone_depth"`
+	Timeouts   timeoutConfig `json:"timeouts"`
+	Sandbox    sandboxConfig `json:"sandbox"`
+	Notify     notifyConfig  `json:"notify"`
+	// Terminal offers a shell in the worktree on the notebook page; it
+	// also needs auth to be enabled.
+	Terminal bool `json:"terminal"`
+	// Routing is how entries without a chosen or obvious intent are
+	// routed: "auto" (the default) runs the router model when its command
+	// and API keys are there and classifies the prompt locally otherwise,
+	// "local" never runs the router, and "model" always does.
+	Routing string `json:"routing,omitempty"`
+	// Ignore lists gitignore patterns of files never handed to models,
+	// e.g. vendored dependencies or generated code (see ignore.go).
+	Ignore []string `json:"ignore,omitempty"`
+	// Backup snapshots the database and notebook exports on a schedule
+	// (see backup.go).
+	Backup backupConfig `json:"backup"`
+	// Transcribe turns recordings into prompt text (see transcribe.go).
+	Transcribe transcribeConfig `json:"transcribe"`
+	// LocalRepos lists the directories under which /try may open a
+	// repository on the server by its path (see localrepo.go).
+	LocalRepos []string `json:"local_repos,omitempty"`
+	// Admins lists the users who may use /admin/* when sign-in is on
+	// (see auth.go); with none, no one may.
+	Admins []string `json:"admins,omitempty"`
+	// HeartbeatSeconds is how often run streams send a heartbeat while
+	// nothing else is sent, so proxies keep quiet connections open
+	// (default 15); 0 sends none.
+	HeartbeatSeconds *int `json:"heartbeat_seconds,omitempty"`
+
+	registry *runner.Registry
+}
+
+// Parameters of the default claude and gemini models.
+var (
+	claudeParams = map[string]paramConfig{
+		"model": {Arg: "--model", Choices: []string{"sonnet", "opus", "haiku"}},
+	}
+	geminiParams = map[string]paramConfig{
+		"model": {Arg: "--model", Choices: []string{"gemini-2.5-flash", "gemini-2.5-pro", "gemini-2.5-flash-lite"}},
+	}
+)
+
+func defaultConfig() *config {
+	return &config{
+		Models: map[string]modelConfig{
+			"gemini": {
+				Command:     []string{"gemini", "--prompt", "{prompt}"},
+				Env:         []string{"GEMINI_API_KEY"},
+				Order:       20,
+				CleanOutput: true,
+				Params:      geminiParams,
+			},
+			// Not in any intent by default; add them to compare answers.
+			"codex": {
+				Command: []string{"codex", "exec", "--sandbox", "read-only", "{prompt}"},
+				Env:     []string{"OPENAI_API_KEY"},
+				Order:   40,
+				Params: map[string]paramConfig{
+					"model": {Arg: "--model", Choices: []string{"gpt-5", "gpt-5-codex", "gpt-5-mini"}},
+				},
+			},
+			"ollama": {
+				Command: []string{"ollama", "run", "llama3.2"},
+				Stdin:   true,
+				Order:   50,
+			},
+			"llm-local": {
+				Command: []string{"llm", "--model", "llama3.2"},
+				Stdin:   true,
+				Order:   60,
+				Params: map[string]paramConfig{
+					"temperature": {Arg: "-o temperature", Min: new(float64), Max: floatPtr(2)},
+				},
+			},
+			"claude": {
+				Command: []string{"claude", "--print", "--output-format", "stream-json", "--verbose"},
+				Format:  formatClaudeStreamJSON,
+				Stdin:   true,
+				Env:     []string{"ANTHROPIC_API_KEY"},
+				Order:   10,
+				Params:  claudeParams,
+			},
+			"aider": {
+				Command: []string{"aider",
+					"--model", "openai/gpt-5",
+					"--architect",
+					"--subtree-only",
+					"--yes-always",
+					"--auto-commits",
+					"--auto-accept-architect",
+					"--no-pretty",
+					"--message", "{prompt}",
+				},
+				PTY:       true,
+				FileArg:   "--file",
+				IgnoreArg: "--aiderignore",
+				Result:    "aider",
+				Env:       []string{"OPENAI_API_KEY"},
+				Order:     30,
+				Params: map[string]paramConfig{
+					"model":        {Arg: "--model", Choices: []string{"openai/gpt-5", "openai/gpt-5-mini", "sonnet", "opus", "gemini"}},
+					"editor_model": {Arg: "--editor-model", Choices: []string{"openai/gpt-5-mini", "openai/gpt-4.1", "sonnet", "haiku", "gemini/gemini-2.5-flash"}},
+				},
+				// "Tokens: 12k sent, 1.2k received. Cost: $0.04 message, $0.10 session."
+				Usage: &usageConfig{
+					InputTokens:  `Tokens: ([\d.,]+[kKmM]?) sent`,
+					OutputTokens: `([\d.,]+[kKmM]?) received`,
+					Cost:         `Cost: \$([\d.,]+) message`,
+				},
+			},
+			// Edit with claude or gemini instead of aider: pick them
+			// with "Edit with" on a prompt, or put them in the edit intent.
+			"claude-edit": {
+				Command: []string{"claude", "--print", "--permission-mode", "acceptEdits", "--output-format", "stream-json", "--verbose"},
+				Format:  formatClaudeStreamJSON,
+				Stdin:   true,
+				Edits:   true,
+				Env:     []string{"ANTHROPIC_API_KEY"},
+				Order:   31,
+				Params:  claudeParams,
+			},
+			"gemini-edit": {
+				Command: []string{"gemini", "--approval-mode", "auto_edit", "--prompt", "{prompt}"},
+				Edits:   true,
+				Env:     []string{"GEMINI_API_KEY"},
+				Order:   32,
+				Params:  geminiParams,
+			},
+			"router": {
+				Command: []string{"llm", "--model", "gpt-5-nano", "{prompt}"},
+				Prompt:  "Is the following prompt asking an informational question or requesting edits to the code? Please respond 'question' or 'edit' and nothing else: {prompt}",
+				Env:     []string{"OPENAI_API_KEY"},
+			},
+		},
+		Intents: map[string][]string{
+			"question": {"claude", "gemini"},
+			"edit":     {"aider"},
+		},
+		Context: &contextConfig{Entries: 5, MaxChars: 16000},
+	}
+}
+
+// loadConfig reads the config file on top of the defaults. A missing file
+// is not an error.
+func loadConfig(path string) (*config, error) {
+	cfg := defaultConfig()
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		cfg.registry = newRunnerRegistry(cfg)
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	var fc config
+	if err := json.Unmarshal(b, &fc); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	for name, mc := range fc.Models {
+		cfg.Models[name] = mc
+	}
+	for intent, models := range fc.Intents {
+		cfg.Intents[intent] = models
+	}
+	cfg.Quotas = fc.Quotas
+	cfg.Webhooks = fc.Webhooks
+	cfg.Repos = fc.Repos
+	if fc.Context != nil {
+		cfg.Context = fc.Context
+	}
+	cfg.RepoMap = fc.RepoMap
+	if fc.CloneDepth != nil {
+		cfg.CloneDepth = fc.CloneDepth
+	}
+	cfg.Timeouts = fc.Timeouts
+	cfg.Sandbox = fc.Sandbox
+	cfg.Notify = fc.Notify
+	cfg.Terminal = fc.Terminal
+	cfg.Routing = fc.Routing
+	cfg.Ignore = fc.Ignore
+	cfg.Backup = fc.Backup
+	cfg.Transcribe = fc.Transcribe
+	cfg.LocalRepos = fc.LocalRepos
+	cfg.Admins = fc.Admins
+	cfg.HeartbeatSeconds = fc.HeartbeatSeconds
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	cfg.registry = newRunnerRegistry(cfg)
+	return cfg, nil
+}
+
+func (c *config) validate() error {
+	for name, mc := range c.Models {
+		if !isSafeToken(name) {
+			return fmt.Errorf("invalid model name %q", name)
+		}
+		if name == TestsModel {
+			return fmt.Errorf("model name %q is reserved for repo test commands", name)
+		}
+		if len(mc.Command) == 0 {
+			return fmt.Errorf("model %s: empty command", name)
+		}
+		if mc.Format != "" && mc.Format != formatClaudeStreamJSON {
+			return fmt.Errorf("model %s: unknown format %q", name, mc.Format)
+		}
+		if _, ok := resultFormats[mc.Result]; mc.Result != "" && !ok {
+			return fmt.Errorf("model %s: unknown result %q", name, mc.Result)
+		}
+		if mc.Format != "" && mc.PTY {
+			return fmt.Errorf("model %s: format and pty cannot be combined", name)
+		}
+		if mc.ApplyDiff && mc.PTY {
+			return fmt.Errorf("model %s: apply_diff and pty cannot be combined", name)
+		}
+		if mc.ApplyDiff && mc.Edits {
+			return fmt.Errorf("model %s: apply_diff and edits cannot be combined", name)
+		}
+		if mc.ContextEntries != nil && *mc.ContextEntries < 0 {
+			return fmt.Errorf("model %s: context_entries must be >= 0", name)
+		}
+		if _, err := compileUsage(mc.Usage); err != nil {
+			return fmt.Errorf("model %s: usage: %w", name, err)
+		}
+		if mc.Timeouts != nil && !mc.Timeouts.valid() {
+			return fmt.Errorf("model %s: timeouts must be >= 0", name)
+		}
+		for pn, pc := range mc.Params {
+			if !isSafeToken(pn) || strings.Contains(pn, ".") {
+				return fmt.Errorf("model %s: invalid parameter name %q", name, pn)
+			}
+			if err := pc.validate(); err != nil {
+				return fmt.Errorf("model %s: parameter %s: %w", name, pn, err)
+			}
+		}
+		if c.Sandbox.Engine != "" && !mc.NoSandbox && c.sandboxImage(name) == "" {
+			return fmt.Errorf("model %s: no container image; set sandbox.image or image", name)
+		}
+	}
+	if _, ok := c.Models["router"]; !ok {
+		return fmt.Errorf("a router model is required")
+	}
+	if err := c.validateFallbacks(); err != nil {
+		return err
+	}
+	switch c.Routing {
+	case "", routingAuto, routingLocal, routingModel:
+	default:
+		return fmt.Errorf("unknown routing %q", c.Routing)
+	}
+	for intent, models := range c.Intents {
+		for _, m := range models {
+			if _, ok := c.Models[m]; !ok {
+				return fmt.Errorf("intent %s: unknown model %q", intent, m)
+			}
+		}
+	}
+	if _, err := parseIgnore(c.Ignore); err != nil {
+		return err
+	}
+	for name, rc := range c.Repos {
+		if _, err := parseIgnore(rc.Ignore); err != nil {
+			return fmt.Errorf("repos %s: %w", name, err)
+		}
+	}
+	if c.Context != nil && (c.Context.Entries < 0 || c.Context.MaxChars < 0) {
+		return fmt.Errorf("context: entries and max_chars must be >= 0")
+	}
+	if c.Quotas.MaxConcurrentRuns < 0 {
+		return fmt.Errorf("max_concurrent_runs must be >= 0")
+	}
+	if c.Quotas.MaxRepoSizeMB < 0 {
+		return fmt.Errorf("max_repo_size_mb must be >= 0")
+	}
+	if !c.Timeouts.valid() {
+		return fmt.Errorf("timeouts must be >= 0")
+	}
+	if err := c.Sandbox.validate(); err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+	if err := c.Notify.validate(); err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+	if err := c.Backup.validate(); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	if err := c.Transcribe.validate(); err != nil {
+		return fmt.Errorf("transcribe: %w", err)
+	}
+	for _, dir := range c.LocalRepos {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("local_repos: %q is not an absolute path", dir)
+		}
+	}
+	if c.CloneDepth != nil && *c.CloneDepth < 0 {
+		return fmt.Errorf("clone_depth must be >= 0")
+	}
+	if c.RepoMap != nil && c.RepoMap.MaxChars < 0 {
+		return fmt.Errorf("repo_map.max_chars must be >= 0")
+	}
+	if c.HeartbeatSeconds != nil && *c.HeartbeatSeconds < 0 {
+		return fmt.Errorf("heartbeat_seconds must be >= 0")
+	}
+	for key, rc := range c.Repos {
+		if rc.CloneDepth != nil && *rc.CloneDepth < 0 {
+			return fmt.Errorf("repos.%s: clone_depth must be >= 0", key)
+		}
+	}
+	return nil
+}
+
+var (
+	cfgPtr   atomic.Pointer[config]
+	reloadMu sync.Mutex
+)
+
+func currentConfig() *config {
+	if c := cfgPtr.Load(); c != nil {
+		return c
+	}
+	c := defaultConfig()
+	c.registry = newRunnerRegistry(c)
+	return c
+}
+
+// reloadConfig swaps in a freshly loaded config, and templates from
+// -template-dir if set. On error the previous config stays active.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		return err
+	}
+	cfgPtr.Store(cfg)
+	slog.Info("config: loaded", "path", configPath(), "models", len(cfg.Models), "intents", len(cfg.Intents), "webhooks", len(cfg.Webhooks))
+	if *templateDir != "" && pagesPtr.Load() != nil {
+		return loadTemplates()
+	}
+	return nil
+}
+
+// intentModels returns the models to run for a router decision.
+func (c *config) intentModels(intent string) []string {
+	if ms, ok := c.Intents[intent]; ok {
+		return ms
+	}
+	return c.Intents["question"]
+}
+
+// testCommand returns the configured test command for a repository, or "".
+func (c *config) testCommand(host, org, repo string) string {
+	return c.Repos[repoSpec{Host: host, Org: org, Repo: repo}.String()].TestCommand
+}
+
+// autoTests reports whether a repository's detected test command may run
+// after edits.
+func (c *config) autoTests(host, org, repo string) bool {
+	a := c.Repos[repoSpec{Host: host, Org: org, Repo: repo}.String()].AutoTests
+	return a == nil || *a
+}
+
+// cloneDepth is how many commits a new clone of spec fetches; 0 is all.
+func (c *config) cloneDepth(spec repoSpec) int {
+	if d := c.Repos[spec.String()].CloneDepth; d != nil {
+		return *d
+	}
+	if c.CloneDepth != nil {
+		return *c.CloneDepth
+	}
+	return 1
+}
+
+func (t timeoutConfig) valid() bool {
+	return (t.RunMinutes == nil || *t.RunMinutes >= 0) && (t.IdleMinutes == nil || *t.IdleMinutes >= 0)
+}
+
+// heartbeat returns how often run streams send a heartbeat; 0 means never.
+func (c *config) heartbeat() time.Duration {
+	if c.HeartbeatSeconds != nil {
+		return time.Duration(*c.HeartbeatSeconds) * time.Second
+	}
+	return 15 * time.Second
+}
+
+// runTimeouts returns the total and no-output limits for a run of model;
+// 0 means no limit.
+func (c *config) runTimeouts(model string) (run, idle time.Duration) {
+	runMin, idleMin := 60, 15
+	for _, t := range []*timeoutConfig{&c.Timeouts, c.Models[model].Timeouts} {
+		if t == nil {
+			continue
+		}
+		if t.RunMinutes != nil {
+			runMin = *t.RunMinutes
+		}
+		if t.IdleMinutes != nil {
+			idleMin = *t.IdleMinutes
+		}
+	}
+	return time.Duration(runMin) * time.Minute, time.Duration(idleMin) * time.Minute
+}
+
+// Concurrent run accounting against quotas.max_concurrent_runs.
+
+var activeRuns atomic.Int64
+
+var errTooManyRuns = errors.New("too many concurrent runs")
+
+func acquireRunSlot(cfg *config) error {
+	n := activeRuns.Add(1)
+	if max := cfg.Quotas.MaxConcurrentRuns; max > 0 && n > int64(max) {
+		activeRuns.Add(-1)
+		return errTooManyRuns
+	}
+	return nil
+}
+
+func releaseRunSlot() {
+	activeRuns.Add(-1)
+	wakeJobQueue() // a queued job may fit now
+}
+
+// POST /admin/reload
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := reloadConfig(); err != nil {
+		slog.ErrorContext(r.Context(), "reloadHandler", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write([]byte("reloaded"))
+}
+
+// watchSIGHUP reloads the config each time a value arrives on ch.
+func watchSIGHUP(ch <-chan os.Signal) {
+	for range ch {
+		if err := reloadConfig(); err != nil {
+			slog.Error("config: reload failed, keeping previous config", "err", err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Conversation context. Model CLIs are started fresh for every entry, so
+// each prompt is prefixed with the notebook's earlier prompts and answers
+// (config "context": the last N entries, at most max_chars in total, oldest
+// dropped first). For each earlier entry the model sees its own answer if
+// it gave one, else the first other model's. The router and test commands
+// never get context.
+
+type contextConfig struct {
+	// Entries is how many earlier entries to include; 0 disables context.
+	Entries int `json:"entries"`
+	// MaxChars caps the context text; 0 means no cap.
+	MaxChars int `json:"max_chars"`
+}
+
+// contextOutputChars caps each earlier answer; long outputs keep their end.
+const contextOutputChars = 4000
+
+func (c *config) contextEntries(model string) int {
+	if mc, ok := c.Models[model]; ok && mc.ContextEntries != nil {
+		return *mc.ContextEntries
+	}
+	if c.Context == nil {
+		return 0
+	}
+	return c.Context.Entries
+}
+
+type contextTurn struct {
+	prompt string
+	model  string
+	output string
+}
+
+// loadContextTurns returns up to n entries before idx, oldest first.
+func loadContextTurns(ctx context.Context, cfg *config, nbID string, idx int, model string, n int) ([]contextTurn, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.idx, e.prompt, COALESCE(o.model, ''), COALESCE(o.output, '')
+		FROM (
+			SELECT idx, prompt FROM notebook_entries
+			WHERE notebook_id = ? AND idx < ?
+			ORDER BY idx DESC LIMIT ?
+		) e
+		LEFT JOIN entry_outputs o ON o.notebook_id = ? AND o.idx = e.idx AND o.output != '' AND o.model != ?
+		ORDER BY e.idx ASC
+	`, nbID, idx, n, nbID, TestsModel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	// Pick one answer per entry: the model's own, else by display order.
+	rank := make(map[string]int)
+	for i, m := range cfg.registry.Models() {
+		rank[m] = i + 1
+	}
+	rank[model] = 0
+	var turns []contextTurn
+	last := -1
+	for rows.Next() {
+		var i int
+		var t contextTurn
+		if err := rows.Scan(&i, &t.prompt, &t.model, &t.output); err != nil {
+			return nil, err
+		}
+		if i != last {
+			turns = append(turns, t)
+			last = i
+			continue
+		}
+		cur := &turns[len(turns)-1]
+		if rankOf(rank, t.model) < rankOf(rank, cur.model) {
+			*cur = t
+		}
+	}
+	return turns, rows.Err()
+}
+
+func rankOf(rank map[string]int, m string) int {
+	if r, ok := rank[m]; ok {
+		return r
+	}
+	return len(rank) + 1 // models since removed from the config
+}
+
+// withContext returns prompt prefixed with the conversation so far, or
+// prompt unchanged if there is none.
+func withContext(ctx context.Context, cfg *config, nbID string, idx int, model, prompt string) (string, error) {
+	n := cfg.contextEntries(model)
+	if n <= 0 || idx == 0 || model == "router" || model == TestsModel {
+		return prompt, nil
+	}
+	turns, err := loadContextTurns(ctx, cfg, nbID, idx, model, n)
+	if err != nil {
+		return prompt, err
+	}
+	maxChars := 0
+	if cfg.Context != nil {
+		maxChars = cfg.Context.MaxChars
+	}
+	var parts []string
+	total := 0
+	for i := len(turns) - 1; i >= 0; i-- {
+		t := turns[i]
+		out := strings.TrimSpace(t.output)
+		if len(out) > contextOutputChars {
+			out = "..." + out[len(out)-contextOutputChars:]
+		}
+		s := "User: " + strings.TrimSpace(t.prompt) + "\n"
+		if out != "" {
+			s += fmt.Sprintf("Assistant (%s): %s\n", t.model, out)
+		}
+		if maxChars > 0 && total+len(s) > maxChars {
+			break
+		}
+		total += len(s)
+		parts = append([]string{s}, parts...)
+	}
+	if len(parts) == 0 {
+		return prompt, nil
+	}
+	return "Earlier in this session:\n\n" + strings.Join(parts, "\n") + "\nCurrent request:\n" + prompt, nil
+}
@@ -0,0 +1,120 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// CSRF protection by double submit. Every client gets a random token in
+// the tb_csrf cookie, which lasts the browser session. Requests that change
+// anything (every method but GET, HEAD and OPTIONS, and GET /events/run
+// when it starts a run) must repeat it in an X-CSRF-Token header or a csrf
+// form field; another site can make a browser send the cookie but cannot
+// read it. The layout's script fills both in for forms and fetch calls.
+// A request whose Origin is another site is refused outright. Pages with
+// forms also render the token (csrfToken) so they work without scripts.
+
+const (
+	CSRFCookie = "tb_csrf"
+	CSRFHeader = "X-CSRF-Token"
+	csrfField  = "csrf"
+)
+
+// Request bodies are capped before anything reads them. checkCSRF applies
+// the caps, since reading the csrf form field parses (and spools to disk)
+// the whole body before any handler runs. defaultMaxBody fits a form with
+// one prompt, every byte percent-encoded; bodyLimits raises it for the
+// posts that take uploads or several prompts.
+const defaultMaxBody = 12*promptMaxChars + 64<<10
+
+var bodyLimits = map[string]int64{
+	"/prompt":         promptMaxBody,
+	"/pipeline":       pipelineMaxSteps * defaultMaxBody,
+	"/import":         importMaxBody,
+	"/api/transcribe": transcribeMaxBytes + 1<<20,
+}
+
+// maxBody is the cap on the body of a request to path.
+func maxBody(path string) int64 {
+	if n, ok := bodyLimits[path]; ok {
+		return n
+	}
+	return defaultMaxBody
+}
+
+type csrfCtxKey struct{}
+
+// csrfToken returns the request's token, including one handed out with
+// this response.
+func csrfToken(r *http.Request) string {
+	if c, err := r.Cookie(CSRFCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token, _ := r.Context().Value(csrfCtxKey{}).(string)
+	return token
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// validCSRF reports whether the request repeats its cookie's token.
+func validCSRF(r *http.Request) bool {
+	c, err := r.Cookie(CSRFCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	given := r.Header.Get(CSRFHeader)
+	if given == "" {
+		given = r.FormValue(csrfField)
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(c.Value)) == 1
+}
+
+// sameOrigin reports whether the request's Origin, if any, is this server.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// checkCSRF wraps the mux: it hands out the token and refuses unsafe
+// requests without it.
+func checkCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(CSRFCookie); err != nil || c.Value == "" {
+			if token, err := randomHex(16); err == nil {
+				http.SetCookie(w, &http.Cookie{
+					Name:     CSRFCookie,
+					Value:    token,
+					Path:     cookiePath("/"),
+					Secure:   isHTTPS(r),
+					SameSite: http.SameSiteLaxMode,
+				})
+				r = r.WithContext(context.WithValue(r.Context(), csrfCtxKey{}, token))
+			}
+		}
+		if safeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n := maxBody(r.URL.Path)
+		if r.ContentLength > n {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		if !sameOrigin(r) || !validCSRF(r) {
+			slog.WarnContext(r.Context(), "csrf: request refused", "method", r.Method, "path", r.URL.Path, "origin", r.Header.Get("Origin"))
+			http.Error(w, "invalid or missing CSRF token; reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
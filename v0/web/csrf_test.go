@@ -0,0 +1,126 @@
+package web
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckCSRF(t *testing.T) {
+	h := checkCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	const token = "0123456789abcdef"
+	for _, tc := range []struct {
+		name, method, cookie, header, field, origin string
+		want                                        int
+	}{
+		{"GET needs no token", http.MethodGet, "", "", "", "", http.StatusOK},
+		{"HEAD needs no token", http.MethodHead, "", "", "", "", http.StatusOK},
+		{"OPTIONS needs no token", http.MethodOptions, "", "", "", "", http.StatusOK},
+		{"POST without a cookie", http.MethodPost, "", token, "", "", http.StatusForbidden},
+		{"POST without a token", http.MethodPost, token, "", "", "", http.StatusForbidden},
+		{"POST with another token", http.MethodPost, token, "fedcba9876543210", "", "", http.StatusForbidden},
+		{"POST with another field", http.MethodPost, token, "", "fedcba9876543210", "", http.StatusForbidden},
+		{"POST with the header", http.MethodPost, token, token, "", "", http.StatusOK},
+		{"POST with the field", http.MethodPost, token, "", token, "", http.StatusOK},
+		{"POST from this origin", http.MethodPost, token, token, "", "http://example.com", http.StatusOK},
+		{"POST from another origin", http.MethodPost, token, token, "", "https://evil.example", http.StatusForbidden},
+		{"DELETE without a token", http.MethodDelete, token, "", "", "", http.StatusForbidden},
+	} {
+		body := ""
+		if tc.field != "" {
+			body = url.Values{csrfField: {tc.field}}.Encode()
+		}
+		r := httptest.NewRequest(tc.method, "/prompt", strings.NewReader(body))
+		if tc.field != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if tc.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: CSRFCookie, Value: tc.cookie})
+		}
+		if tc.header != "" {
+			r.Header.Set(CSRFHeader, tc.header)
+		}
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s: %d, want %d", tc.name, w.Code, tc.want)
+		}
+		if gotCookie := strings.Contains(w.Header().Get("Set-Cookie"), CSRFCookie+"="); gotCookie != (tc.cookie == "") {
+			t.Errorf("%s: Set-Cookie %q", tc.name, w.Header().Get("Set-Cookie"))
+		}
+	}
+}
+
+// GET /events/run is safe when it attaches to a run, but starting one
+// needs the token like a POST.
+func TestRunEventsCSRF(t *testing.T) {
+	c := newTestClient(t)
+	nbID := c.newNotebook()
+	idx, err := appendNotebookEntry(context.Background(), nbID, "start me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		query url.Values
+		want  int
+	}{
+		{url.Values{"attach": {"1"}}, http.StatusNoContent},
+		{url.Values{}, http.StatusForbidden},
+		{url.Values{"csrf": {"fedcba9876543210"}}, http.StatusForbidden},
+	} {
+		tc.query.Set("nb", nbID)
+		tc.query.Set("idx", strconv.Itoa(idx))
+		tc.query.Set("model", "echo")
+		res, err := c.hc.Get(c.srv.URL + "/events/run?" + tc.query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.want {
+			t.Errorf("GET /events/run?%s: %s, want %d", tc.query.Encode(), res.Status, tc.want)
+		}
+	}
+}
+
+// Every post is capped, at defaultMaxBody unless bodyLimits says more.
+func TestBodyLimits(t *testing.T) {
+	var readErr error
+	h := checkCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+	const token = "0123456789abcdef"
+	for _, tc := range []struct {
+		path    string
+		size    int64
+		chunked bool // no Content-Length, so only reading finds out
+		want    int
+		readErr bool
+	}{
+		{"/api/commit", defaultMaxBody, false, http.StatusOK, false},
+		{"/api/commit", defaultMaxBody + 1, false, http.StatusRequestEntityTooLarge, false},
+		{"/api/commit", defaultMaxBody + 1, true, http.StatusOK, true},
+		{"/prompt", defaultMaxBody + 1, false, http.StatusOK, false},
+		{"/prompt", promptMaxBody + 1, false, http.StatusRequestEntityTooLarge, false},
+	} {
+		readErr = nil
+		r := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(strings.Repeat("x", int(tc.size))))
+		if tc.chunked {
+			r.ContentLength = -1
+		}
+		r.AddCookie(&http.Cookie{Name: CSRFCookie, Value: token})
+		r.Header.Set(CSRFHeader, token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want || (readErr != nil) != tc.readErr {
+			t.Errorf("POST %s of %d bytes (chunked %v): %d, read error %v", tc.path, tc.size, tc.chunked, w.Code, readErr)
+		}
+	}
+}
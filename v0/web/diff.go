@@ -0,0 +1,142 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Diffs of the commits an edit run made in the notebook's worktree.
+
+const maxDiffPatch = 1 << 20 // bytes of patch text returned to the browser
+
+func gitHead(ctx context.Context, dir string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("rev-parse HEAD: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func isCommitish(s string) bool {
+	if len(s) < 4 || len(s) > 64 {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+type diffFile struct {
+	Path    string `json:"path"`
+	Added   int    `json:"added"`
+	Deleted int    `json:"deleted"`
+	Binary  bool   `json:"binary,omitempty"`
+}
+
+type diffResult struct {
+	From      string     `json:"from"`
+	To        string     `json:"to"`
+	Files     []diffFile `json:"files"`
+	Patch     string     `json:"patch"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+// gitDiff diffs from..to in dir; an empty to diffs against the working tree.
+func gitDiff(ctx context.Context, dir, from, to string) (diffResult, error) {
+	res := diffResult{From: from, To: to}
+	rng := []string{from}
+	if to != "" {
+		rng = append(rng, to)
+	}
+	ns := exec.CommandContext(ctx, "git", append([]string{"diff", "--numstat"}, rng...)...)
+	ns.Dir = dir
+	out, err := ns.Output()
+	if err != nil {
+		return res, fmt.Errorf("git diff --numstat: %w", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		f := diffFile{Path: parts[2]}
+		if parts[0] == "-" && parts[1] == "-" {
+			f.Binary = true
+		} else {
+			f.Added, _ = strconv.Atoi(parts[0])
+			f.Deleted, _ = strconv.Atoi(parts[1])
+		}
+		res.Files = append(res.Files, f)
+	}
+	pc := exec.CommandContext(ctx, "git", append([]string{"diff", "--no-color"}, rng...)...)
+	pc.Dir = dir
+	patch, err := pc.Output()
+	if err != nil {
+		return res, fmt.Errorf("git diff: %w", err)
+	}
+	if len(patch) > maxDiffPatch {
+		patch = patch[:maxDiffPatch]
+		res.Truncated = true
+	}
+	res.Patch = string(patch)
+	return res, nil
+}
+
+// GET /api/diff?nb=..&from=..&to=..
+// GET /api/diff?nb=..&idx=..&model=.. (commits recorded for that run)
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	nbID := strings.TrimSpace(q.Get("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	from, to := strings.TrimSpace(q.Get("from")), strings.TrimSpace(q.Get("to"))
+	if from == "" && q.Get("idx") != "" {
+		idx, err := strconv.Atoi(q.Get("idx"))
+		model := strings.TrimSpace(q.Get("model"))
+		if err != nil || !isSafeToken(model) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := db.QueryRowContext(r.Context(), `
+			SELECT head_before, head_after FROM entry_outputs
+			WHERE notebook_id = ? AND idx = ? AND model = ?
+		`, nbID, idx, model).Scan(&from, &to); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	}
+	if !isCommitish(from) || (to != "" && !isCommitish(to)) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	res, err := gitDiff(r.Context(), worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree), from, to)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "diffHandler", "err", err)
+		http.Error(w, "diff failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
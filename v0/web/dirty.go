@@ -0,0 +1,188 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Uncommitted changes in a worktree. Runs commit what they change, but
+// the terminal, a run that failed half way or a model that does not
+// commit can leave files modified or untracked. The notebook header shows
+// a badge with what git status --porcelain reports, refreshed through
+// /api/head after runs and while the page is open, with three ways out:
+// "Commit" (POST /api/commit, see manualcommit.go), "Stash" and "Discard"
+// (POST /api/worktree with action=stash or discard).
+//
+// Stashes go to the clone's stash list, which all of its worktrees share,
+// so their message names the notebook.
+
+const dirtyFilesMax = 50 // files listed in the badge's title
+
+type statusFile struct {
+	Path string `json:"path"`
+	Code string `json:"code"` // git's two-letter XY status, "??" for untracked
+}
+
+// worktreeStatus is the state of a worktree as /api/head reports it.
+type worktreeStatus struct {
+	Head       string       `json:"head"` // short commit
+	Dirty      bool         `json:"dirty"`
+	Staged     int          `json:"staged"`
+	Modified   int          `json:"modified"` // changed in the worktree, not staged
+	Untracked  int          `json:"untracked"`
+	Conflicted int          `json:"conflicted"`
+	Files      []statusFile `json:"files,omitempty"` // the first dirtyFilesMax
+}
+
+// Summary describes the changes for the badge, such as "2 modified, 1
+// untracked".
+func (s worktreeStatus) Summary() string {
+	var parts []string
+	for _, p := range []struct {
+		n    int
+		what string
+	}{{s.Conflicted, "conflicted"}, {s.Staged, "staged"}, {s.Modified, "modified"}, {s.Untracked, "untracked"}} {
+		if p.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", p.n, p.what))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FileList is the listed files, one per line, for the badge's title.
+func (s worktreeStatus) FileList() string {
+	var b strings.Builder
+	for _, f := range s.Files {
+		fmt.Fprintf(&b, "%s %s\n", f.Code, f.Path)
+	}
+	if n := s.Staged + s.Modified + s.Untracked + s.Conflicted; n > len(s.Files) {
+		fmt.Fprintf(&b, "and %d more\n", n-len(s.Files))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// readWorktreeStatus runs git status in dir.
+func readWorktreeStatus(ctx context.Context, dir string) (worktreeStatus, error) {
+	var s worktreeStatus
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--short=7", "HEAD").Output()
+	if err != nil {
+		return s, fmt.Errorf("git rev-parse: %w", err)
+	}
+	s.Head = strings.TrimSpace(string(out))
+	out, err = exec.CommandContext(ctx, "git", "-C", dir, "status", "--porcelain=v1", "-z", "--untracked-files=all").Output()
+	if err != nil {
+		return s, fmt.Errorf("git status: %w", err)
+	}
+	recs := strings.Split(string(out), "\x00")
+	for i := 0; i < len(recs); i++ {
+		rec := recs[i]
+		if len(rec) < 4 {
+			continue
+		}
+		code, p := rec[:2], rec[3:]
+		if code[0] == 'R' || code[0] == 'C' {
+			i++ // the source path follows a rename or copy
+		}
+		switch {
+		case code == "??":
+			s.Untracked++
+		case code == "!!":
+			continue
+		case strings.ContainsRune(code, 'U') || code == "AA" || code == "DD":
+			s.Conflicted++
+		default:
+			if code[0] != ' ' {
+				s.Staged++
+			}
+			if code[1] != ' ' {
+				s.Modified++
+			}
+		}
+		if len(s.Files) < dirtyFilesMax {
+			s.Files = append(s.Files, statusFile{Path: p, Code: code})
+		}
+	}
+	s.Dirty = s.Staged+s.Modified+s.Untracked+s.Conflicted > 0
+	return s, nil
+}
+
+// stashWorktree stashes the worktree's changes, untracked files included.
+func stashWorktree(ctx context.Context, meta notebookMeta) error {
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	msg := fmt.Sprintf("trybook: notebook %s, %s", meta.ID, time.Now().UTC().Format(time.RFC3339))
+	cmd := exec.CommandContext(ctx, "git", append(append([]string{"-C", dir}, gitIdentity...), "stash", "push", "--include-untracked", "--message", msg)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git stash: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// discardWorktree throws the worktree's changes away, like a rollback to
+// HEAD: ignored files such as build output are kept.
+func discardWorktree(ctx context.Context, meta notebookMeta) error {
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	for _, args := range [][]string{{"reset", "--quiet", "--hard", "HEAD"}, {"clean", "-fdq"}} {
+		if out, err := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %v\n%s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// POST /api/worktree (nb, action=stash|discard)
+func worktreeActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	action := r.FormValue("action")
+	if !isSafeToken(nbID) || (action != "stash" && action != "discard") {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if notebookBusy(nbID) {
+		http.Error(w, errNotebookBusy.Error(), http.StatusConflict)
+		return
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	st, err := readWorktreeStatus(r.Context(), dir)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "worktreeActionHandler", "err", err)
+		http.Error(w, "worktree unavailable", http.StatusInternalServerError)
+		return
+	}
+	if !st.Dirty {
+		http.Error(w, errNothingToCommit.Error(), http.StatusConflict)
+		return
+	}
+	if action == "stash" {
+		err = stashWorktree(r.Context(), meta)
+	} else {
+		err = discardWorktree(r.Context(), meta)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "worktreeActionHandler", "action", action, "err", err)
+		http.Error(w, action+" failed", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "worktreeActionHandler: done", "nb", nbID, "action", action, "files", st.Staged+st.Modified+st.Untracked+st.Conflicted)
+	if st, err = readWorktreeStatus(r.Context(), dir); err != nil {
+		slog.ErrorContext(r.Context(), "worktreeActionHandler", "err", err)
+		http.Error(w, "worktree unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,412 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk usage. GET /admin/disk reports the size of each clone, each
+// notebook's worktree and the whole -dir. Walking the tree is slow on big
+// clones, so the sizes are measured in the background and cached in
+// disk_usage; the page shows when they were taken and can measure again.
+// Each clone can be pruned (git gc, then git prune) and a clone no
+// notebook uses can be deleted.
+
+const diskUsageSchema = `
+	CREATE TABLE IF NOT EXISTS disk_usage (
+		kind        TEXT NOT NULL, -- app, clone or worktree
+		key         TEXT NOT NULL, -- '', host/org/repo or the notebook id
+		bytes       INTEGER NOT NULL,
+		measured_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (kind, key)
+	);`
+
+// diskScanTimeout bounds one measurement of the whole -dir.
+const diskScanTimeout = 30 * time.Minute
+
+var diskScan struct {
+	mu      sync.Mutex
+	running bool
+}
+
+// byteSize prints as a human-readable size.
+type byteSize int64
+
+func (b byteSize) String() string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", int64(b))
+	}
+	div, exp := int64(unit), 0
+	for n := int64(b) / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+type diskClone struct {
+	Host      string
+	Org       string
+	Repo      string
+	Bytes     byteSize
+	Missing   bool // the clones row has no directory
+	Notebooks int
+	UpdatedAt string
+}
+
+func (c diskClone) Spec() string { return c.Host + "/" + c.Org + "/" + c.Repo }
+
+type diskWorktree struct {
+	NotebookID string
+	Title      string
+	Repo       string
+	Bytes      byteSize
+}
+
+type diskView struct {
+	User           string
+	CSRF           string
+	MeasuredAt     string // empty until the first measurement
+	Scanning       bool
+	Total          byteSize
+	ClonesTotal    byteSize
+	WorktreesTotal byteSize
+	Clones         []diskClone
+	Worktrees      []diskWorktree
+	Message        string
+	MsgClass       string
+}
+
+// startDiskScan measures the disk usage in the background, unless a
+// measurement is already running. It reports whether it started one.
+func startDiskScan() bool {
+	diskScan.mu.Lock()
+	defer diskScan.mu.Unlock()
+	if diskScan.running {
+		return false
+	}
+	diskScan.running = true
+	go func() {
+		defer func() {
+			diskScan.mu.Lock()
+			diskScan.running = false
+			diskScan.mu.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), diskScanTimeout)
+		defer cancel()
+		if err := measureDiskUsage(ctx); err != nil {
+			slog.Error("disk: measure", "err", err)
+		}
+	}()
+	return true
+}
+
+func diskScanning() bool {
+	diskScan.mu.Lock()
+	defer diskScan.mu.Unlock()
+	return diskScan.running
+}
+
+// measureDiskUsage walks -dir, every clone and every notebook's worktree,
+// and replaces the cached sizes.
+func measureDiskUsage(ctx context.Context) error {
+	start := time.Now()
+	type size struct {
+		kind, key string
+		bytes     int64
+	}
+	sizes := []size{{"app", "", dirSize(*appDir)}}
+
+	rows, err := db.QueryContext(ctx, `SELECT host, org, repo FROM clones`)
+	if err != nil {
+		return err
+	}
+	var specs []repoSpec
+	for rows.Next() {
+		var s repoSpec
+		if err := rows.Scan(&s.Host, &s.Org, &s.Repo); err != nil {
+			rows.Close()
+			return err
+		}
+		specs = append(specs, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range specs {
+		sizes = append(sizes, size{"clone", s.Host + "/" + s.Org + "/" + s.Repo, dirSize(repoDirPath(s.Host, s.Org, s.Repo))})
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT id, host, org, repo, worktree FROM notebooks`)
+	if err != nil {
+		return err
+	}
+	var nbs []notebookMeta
+	for rows.Next() {
+		var m notebookMeta
+		if err := rows.Scan(&m.ID, &m.Host, &m.Org, &m.Repo, &m.Worktree); err != nil {
+			rows.Close()
+			return err
+		}
+		nbs = append(nbs, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, m := range nbs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		dir := worktreeDirPath(m.Host, m.Org, m.Repo, m.Worktree)
+		if pathExists(dir) {
+			sizes = append(sizes, size{"worktree", m.ID, dirSize(dir)})
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM disk_usage`); err != nil {
+		return err
+	}
+	for _, s := range sizes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO disk_usage(kind, key, bytes) VALUES(?, ?, ?)`, s.kind, s.key, s.bytes); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "disk: measured", "bytes", sizes[0].bytes, "clones", len(specs), "notebooks", len(nbs), "took", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// setDiskUsage updates one cached size, after pruning a clone.
+func setDiskUsage(ctx context.Context, kind, key string, bytes int64) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO disk_usage(kind, key, bytes) VALUES(?, ?, ?)
+		ON CONFLICT(kind, key) DO UPDATE SET bytes = excluded.bytes, measured_at = excluded.measured_at
+	`, kind, key, bytes)
+	return err
+}
+
+// loadDiskView reads the cached sizes, joined with the clones and
+// notebooks they belong to.
+func loadDiskView(ctx context.Context) (diskView, error) {
+	var v diskView
+	var total sql.NullInt64
+	var measured sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT bytes, measured_at FROM disk_usage WHERE kind = 'app' AND key = ''`).Scan(&total, &measured)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return v, err
+	}
+	v.Total, v.MeasuredAt = byteSize(total.Int64), measured.String
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.host, c.org, c.repo, c.updated_at, COALESCE(d.bytes, 0),
+			(SELECT COUNT(*) FROM notebooks n WHERE n.host = c.host AND n.org = c.org AND n.repo = c.repo)
+		FROM clones c
+		LEFT JOIN disk_usage d ON d.kind = 'clone' AND d.key = c.host || '/' || c.org || '/' || c.repo
+	`)
+	if err != nil {
+		return v, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c diskClone
+		if err := rows.Scan(&c.Host, &c.Org, &c.Repo, &c.UpdatedAt, &c.Bytes, &c.Notebooks); err != nil {
+			return v, err
+		}
+		c.Missing = !pathExists(repoDirPath(c.Host, c.Org, c.Repo))
+		v.ClonesTotal += c.Bytes
+		v.Clones = append(v.Clones, c)
+	}
+	if err := rows.Err(); err != nil {
+		return v, err
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT n.id, n.title, n.host, n.org, n.repo, d.bytes
+		FROM disk_usage d JOIN notebooks n ON n.id = d.key
+		WHERE d.kind = 'worktree'
+	`)
+	if err != nil {
+		return v, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var wt diskWorktree
+		var host, org, repo string
+		if err := rows.Scan(&wt.NotebookID, &wt.Title, &host, &org, &repo, &wt.Bytes); err != nil {
+			return v, err
+		}
+		wt.Repo = org + "/" + repo
+		if host != defaultHost {
+			wt.Repo = host + "/" + wt.Repo
+		}
+		v.WorktreesTotal += wt.Bytes
+		v.Worktrees = append(v.Worktrees, wt)
+	}
+	if err := rows.Err(); err != nil {
+		return v, err
+	}
+
+	sort.SliceStable(v.Clones, func(i, j int) bool { return v.Clones[i].Bytes > v.Clones[j].Bytes })
+	sort.SliceStable(v.Worktrees, func(i, j int) bool { return v.Worktrees[i].Bytes > v.Worktrees[j].Bytes })
+	return v, nil
+}
+
+// pruneClone runs git gc and git prune in a clone and returns its size
+// before and after.
+func pruneClone(ctx context.Context, spec repoSpec) (before, after int64, err error) {
+	dir := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	mu := cloneLock(dir)
+	mu.Lock()
+	defer mu.Unlock()
+	before = dirSize(dir)
+	for _, args := range [][]string{{"gc", "--quiet"}, {"prune"}} {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return before, before, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	after = dirSize(dir)
+	return before, after, setDiskUsage(ctx, "clone", spec.Host+"/"+spec.Org+"/"+spec.Repo, after)
+}
+
+// errCloneInUse is returned by deleteClone for a clone notebooks still use.
+var errCloneInUse = errors.New("notebooks still use this clone; delete them first")
+
+// deleteClone removes a clone no notebook uses, with its row, profile and
+// cached size. It returns the bytes freed.
+func deleteClone(ctx context.Context, spec repoSpec) (int64, error) {
+	dir := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	mu := cloneLock(dir)
+	mu.Lock()
+	defer mu.Unlock()
+	var n int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM notebooks WHERE host = ? AND org = ? AND repo = ?
+	`, spec.Host, spec.Org, spec.Repo).Scan(&n); err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, errCloneInUse
+	}
+	size := dirSize(dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, err
+	}
+	// The repo's worktree directory is empty once its notebooks are gone.
+	_ = os.Remove(filepath.Dir(worktreeDirPath(spec.Host, spec.Org, spec.Repo, "x")))
+	for _, q := range []string{
+		`DELETE FROM clones WHERE host = ? AND org = ? AND repo = ?`,
+		`DELETE FROM repo_profiles WHERE host = ? AND org = ? AND repo = ?`,
+		`DELETE FROM repo_maps WHERE host = ? AND org = ? AND repo = ?`,
+	} {
+		if _, err := db.ExecContext(ctx, q, spec.Host, spec.Org, spec.Repo); err != nil {
+			return size, err
+		}
+	}
+	_, err := db.ExecContext(ctx, `DELETE FROM disk_usage WHERE kind = 'clone' AND key = ?`, spec.Host+"/"+spec.Org+"/"+spec.Repo)
+	return size, err
+}
+
+// cloneFromForm returns the clone named by the form's host, org and repo,
+// if there is such a clone.
+func cloneFromForm(r *http.Request) (repoSpec, bool) {
+	spec := repoSpec{Host: r.FormValue("host"), Org: r.FormValue("org"), Repo: r.FormValue("repo")}
+	var n int
+	err := db.QueryRowContext(r.Context(), `
+		SELECT COUNT(*) FROM clones WHERE host = ? AND org = ? AND repo = ?
+	`, spec.Host, spec.Org, spec.Repo).Scan(&n)
+	return spec, err == nil && n > 0
+}
+
+// GET /admin/disk, POST /admin/disk/scan, /admin/disk/prune and
+// /admin/disk/delete (host, org, repo).
+func diskHandler(w http.ResponseWriter, r *http.Request) {
+	var msg, class string
+	switch r.URL.Path {
+	case "/admin/disk":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	case "/admin/disk/scan":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		startDiskScan()
+		http.Redirect(w, r, "/admin/disk", http.StatusSeeOther)
+		return
+	case "/admin/disk/prune", "/admin/disk/delete":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		spec, ok := cloneFromForm(r)
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		name := spec.Host + "/" + spec.Org + "/" + spec.Repo
+		if r.URL.Path == "/admin/disk/prune" {
+			before, after, err := pruneClone(r.Context(), spec)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "diskHandler: prune", "repo", name, "err", err)
+				msg, class = "Pruning "+name+" failed: "+err.Error(), "error"
+				break
+			}
+			msg = fmt.Sprintf("Pruned %s: %s, was %s.", name, byteSize(after), byteSize(before))
+			break
+		}
+		freed, err := deleteClone(r.Context(), spec)
+		switch {
+		case errors.Is(err, errCloneInUse):
+			msg, class = "Cannot delete "+name+": "+err.Error()+".", "error"
+		case err != nil:
+			slog.ErrorContext(r.Context(), "diskHandler: delete", "repo", name, "err", err)
+			msg, class = "Deleting "+name+" failed: "+err.Error(), "error"
+		default:
+			slog.InfoContext(r.Context(), "diskHandler: clone deleted", "repo", name, "bytes", freed)
+			msg = fmt.Sprintf("Deleted %s, freeing %s.", name, byteSize(freed))
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	v, err := loadDiskView(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "diskHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if v.MeasuredAt == "" {
+		startDiskScan()
+	}
+	v.Scanning = diskScanning()
+	v.User, v.CSRF = currentUser(r.Context()), csrfToken(r)
+	v.Message, v.MsgClass = msg, class
+	setHTMLHeaders(w)
+	_ = renderPage(w, "disk", v)
+}
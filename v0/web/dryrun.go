@@ -0,0 +1,217 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Edit confirmation and dry runs. A prompt sent with the Edit toggle first
+// shows what is about to happen: the tool, its model, the branch the edit
+// lands on and who commits it. "Dry run" sends it as a preview instead
+// (notebook_entries.dry_run): each editing model gets the prompt with a
+// request for a plan and a diff, and runs in a scratch worktree detached at
+// the notebook's HEAD, removed afterwards, so nothing it does reaches the
+// notebook's branch. Its output ends with the diff of what it changed
+// there. Nothing is applied or committed and no tests run; "Run edit" on
+// the entry runs it again for real.
+//
+// An edit the user did not choose, because Auto, the first-word heuristic
+// or the router decided the prompt is one, is held on the server before
+// any editing model runs (notebook_entries.edit_confirm). The entry then
+// shows the same summary with Confirm and Dry run, plain forms posting to
+// /rerun, so the page needs no scripts for it. Once confirmed, re-runs of
+// the entry are not held again; editing its prompt clears that.
+
+const dryRunPrompt = "This is a dry run: do not change, create or delete any files. Describe your plan for the request below, step by step, and show the changes you would make as a unified diff.\n\n"
+
+// Values of notebook_entries.edit_confirm.
+const (
+	confirmPending   = "pending"
+	confirmConfirmed = "confirmed"
+)
+
+// editPlan is what the confirmation says about one edit tool.
+type editPlan struct {
+	Model   string `json:"model"`   // the model its command picks, if any
+	Commits string `json:"commits"` // who commits the edit; "" if nothing does
+}
+
+// editConfirm is what the prompt form's edit confirmation shows.
+type editConfirm struct {
+	Branch  string              `json:"branch"`
+	Default []string            `json:"default"` // tools the edit intent runs unless one is picked
+	Tools   map[string]editPlan `json:"tools"`
+}
+
+func newEditConfirm(cfg *config, meta notebookMeta, intents map[string][]string, p userPrefs) editConfirm {
+	c := editConfirm{Branch: meta.Worktree, Default: []string{}, Tools: map[string]editPlan{}}
+	for _, m := range withEditModel(cfg, intents["edit"], p.EditModel) {
+		if isEditTool(cfg, m) {
+			c.Default = append(c.Default, m)
+		}
+	}
+	for _, t := range editTools(cfg) {
+		c.Tools[t.Name] = editPlan{Model: commandValue(cfg.Models[t.Name].Command, "--model"), Commits: editCommits(cfg, t.Name)}
+	}
+	return c
+}
+
+// heldEdit is what a held entry says is about to happen.
+type heldEdit struct {
+	Branch string
+	Tools  []heldTool
+}
+
+type heldTool struct {
+	Name string
+	editPlan
+}
+
+// withHeld fills in Held on the entries waiting for confirmation.
+func withHeld(cfg *config, meta notebookMeta, es []entry) []entry {
+	for i := range es {
+		e := &es[i]
+		if e.Confirm != confirmPending {
+			continue
+		}
+		e.Held = &heldEdit{Branch: meta.Worktree}
+		for _, m := range withEditModel(cfg, intentModelsFor(cfg, meta, e.Intent), e.EditModel) {
+			if isEditTool(cfg, m) {
+				e.Held.Tools = append(e.Held.Tools, heldTool{m, editPlan{Model: commandValue(cfg.Models[m].Command, "--model"), Commits: editCommits(cfg, m)}})
+			}
+		}
+	}
+	return es
+}
+
+// holdsEdit reports whether an entry's runs of models wait for the user
+// to confirm them: some of them edit, the intent was not the user's
+// choice, and the entry is neither a dry run nor confirmed already.
+func holdsEdit(ctx context.Context, cfg *config, nbID string, idx int, source string, models []string) bool {
+	if source == intentManual || !slices.ContainsFunc(models, func(m string) bool { return isEditTool(cfg, m) }) {
+		return false
+	}
+	var dryRun bool
+	var confirm string
+	err := db.QueryRowContext(ctx, `
+		SELECT dry_run, edit_confirm FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, nbID, idx).Scan(&dryRun, &confirm)
+	if err != nil {
+		slog.ErrorContext(ctx, "jobs: load edit confirmation", "nb", nbID, "idx", idx, "err", err)
+		return true
+	}
+	return !dryRun && confirm != confirmConfirmed
+}
+
+func setEntryConfirm(ctx context.Context, nbID string, idx int, state string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE notebook_entries SET edit_confirm = ? WHERE notebook_id = ? AND idx = ?
+	`, state, nbID, idx)
+	return err
+}
+
+// confirmEntry records the user's go-ahead for an entry's edit, as a dry
+// run or for real.
+func confirmEntry(ctx context.Context, nbID string, idx int, dryRun bool) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE notebook_entries SET dry_run = ?, edit_confirm = ? WHERE notebook_id = ? AND idx = ?
+	`, dryRun, confirmConfirmed, nbID, idx)
+	return err
+}
+
+// editCommits returns who commits an edit by model: trybook for models
+// whose changes it applies or collects, otherwise the tool itself unless
+// its command turns that off (aider's --no-auto-commits).
+func editCommits(cfg *config, model string) string {
+	rn, _ := cfg.registry.Get(model)
+	switch {
+	case appliesDiff(rn) || agentEdits(rn):
+		return "trybook"
+	case slices.Contains(cfg.Models[model].Command, "--no-auto-commits"):
+		return ""
+	}
+	return model
+}
+
+func setEntryDryRun(ctx context.Context, nbID string, idx int, on bool) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE notebook_entries SET dry_run = ? WHERE notebook_id = ? AND idx = ?
+	`, on, nbID, idx)
+	return err
+}
+
+// dryRunDir returns the scratch worktree of model's dry run of entry idx.
+func dryRunDir(meta notebookMeta, idx int, model string) string {
+	return worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree+"-dry-"+strconv.Itoa(idx)+"-"+model)
+}
+
+// prepareDryRun makes model's scratch worktree for entry idx, detached at
+// the notebook's HEAD; one left by an earlier dry run is reset. It returns
+// the worktree's directory.
+func prepareDryRun(ctx context.Context, meta notebookMeta, idx int, model string) (string, error) {
+	base, err := gitHead(ctx, worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree))
+	if err != nil {
+		return "", err
+	}
+	cloneDir := repoDirPath(meta.Host, meta.Org, meta.Repo)
+	dir := dryRunDir(meta, idx, model)
+	if pathExists(dir) {
+		for _, args := range [][]string{{"reset", "--quiet", "--hard", base}, {"clean", "-fdq"}} {
+			if out, err := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+				return "", fmt.Errorf("reset dry run: %v\n%s", err, strings.TrimSpace(string(out)))
+			}
+		}
+		return dir, nil
+	}
+	_ = exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "prune").Run()
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return "", err
+	}
+	if out, err := addWorktree(ctx, cloneDir, dir, meta.Subdir, "--quiet", "--detach", dir, base); err != nil {
+		return "", fmt.Errorf("add dry run worktree: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return dir, nil
+}
+
+// removeDryRun deletes a dry run's scratch worktree.
+func removeDryRun(ctx context.Context, meta notebookMeta, dir string) error {
+	if !pathExists(dir) {
+		return nil
+	}
+	cloneDir := repoDirPath(meta.Host, meta.Org, meta.Repo)
+	if out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "remove", "--force", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("remove dry run worktree: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// reportDryRun writes to out what the dry run changed in its worktree
+// since base, commits included, and removes the worktree.
+func (pr *preparedRun) reportDryRun(ctx context.Context, base string, out io.Writer) {
+	defer func() {
+		if err := removeDryRun(ctx, pr.meta, pr.dir); err != nil {
+			slog.ErrorContext(ctx, "run: remove dry run", "err", err)
+		}
+	}()
+	var diff []byte
+	err := exec.CommandContext(ctx, "git", "-C", pr.dir, "add", "--all").Run()
+	if err == nil {
+		diff, err = exec.CommandContext(ctx, "git", "-C", pr.dir, "diff", "--cached", "--no-color", base).Output()
+	}
+	switch {
+	case err != nil:
+		fmt.Fprintf(out, "\n[trybook: dry run; nothing was applied, and what it changed could not be read: %v]\n", err)
+	case len(strings.TrimSpace(string(diff))) == 0:
+		fmt.Fprint(out, "\n[trybook: dry run; nothing was applied, and it changed no files]\n")
+	default:
+		fmt.Fprintf(out, "\n[trybook: dry run; nothing was applied. It changed, in a scratch worktree:]\n%s", diff)
+	}
+}
@@ -0,0 +1,138 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"trybook/runner"
+)
+
+// Native edit modes. Besides aider, models with "edits" in the config
+// change the worktree themselves: claude with --permission-mode
+// acceptEdits and gemini with --approval-mode auto_edit. They do not
+// commit, so trybook commits whatever they changed when the run ends,
+// with the prompt as the message. The prompt form's "Edit with" picker
+// chooses one of the editing models for a single prompt; it takes the
+// place of the intent's editing models, and is stored in
+// notebook_entries.edit_model so re-runs use it too.
+
+// agentEditRunner is implemented by runners that edit the worktree in
+// their own agent mode but leave committing to trybook.
+type agentEditRunner interface {
+	AgentEdits() bool
+}
+
+func agentEdits(rn runner.Runner) bool {
+	a, ok := rn.(agentEditRunner)
+	return ok && a.AgentEdits()
+}
+
+// editTool is an entry in the prompt form's "Edit with" picker.
+type editTool struct {
+	Name      string
+	Installed bool // false if its command is not on the host's PATH
+}
+
+// editTools returns the models that can serve an edit, in display order.
+func editTools(cfg *config) []editTool {
+	var out []editTool
+	for _, m := range cfg.registry.Models() {
+		rn, _ := cfg.registry.Get(m)
+		if !editsWorktree(rn) {
+			continue
+		}
+		t := editTool{Name: m, Installed: true}
+		if cmd := cfg.Models[m].Command; cfg.sandboxImage(m) == "" && len(cmd) > 0 {
+			_, err := exec.LookPath(cmd[0])
+			t.Installed = err == nil
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// isEditTool reports whether model can be picked to serve an edit.
+func isEditTool(cfg *config, model string) bool {
+	rn, ok := cfg.registry.Get(model)
+	return ok && model != "router" && editsWorktree(rn)
+}
+
+// withEditModel replaces the editing models in models with edit, the one
+// picked for the entry. Models that only answer stay, and models without
+// any editing model (a question) are returned as they are.
+func withEditModel(cfg *config, models []string, edit string) []string {
+	if edit == "" || !isEditTool(cfg, edit) {
+		return models
+	}
+	var out []string
+	replaced := false
+	for _, m := range models {
+		if rn, ok := cfg.registry.Get(m); ok && editsWorktree(rn) {
+			if !replaced {
+				out = append(out, edit)
+				replaced = true
+			}
+			continue
+		}
+		out = append(out, m)
+	}
+	if !replaced {
+		return models
+	}
+	return out
+}
+
+func setEntryEditModel(ctx context.Context, nbID string, idx int, model string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE notebook_entries SET edit_model = ? WHERE notebook_id = ? AND idx = ?
+	`, model, nbID, idx)
+	return err
+}
+
+// commitWorktree commits every change in dir with message and returns the
+// new HEAD, or "" if there was nothing to commit.
+func commitWorktree(ctx context.Context, dir, message string) (string, error) {
+	status, err := exec.CommandContext(ctx, "git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil {
+		return "", fmt.Errorf("git status: %w", err)
+	}
+	if len(strings.TrimSpace(string(status))) == 0 {
+		return "", nil
+	}
+	if out, err := exec.CommandContext(ctx, "git", "-C", dir, "add", "--all").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git add: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	commit := exec.CommandContext(ctx, "git", append(append([]string{"-C", dir}, gitIdentity...), "commit", "--quiet", "-m", message)...)
+	if out, err := commit.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git commit: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return gitHead(ctx, dir)
+}
+
+// commitEdits commits what an agent-mode run changed and reports it on out.
+// It runs after failed runs too: whatever the model got done is in the
+// worktree either way.
+func (pr *preparedRun) commitEdits(ctx context.Context, dir string, out io.Writer) error {
+	var prompt string
+	if err := db.QueryRowContext(ctx, `
+		SELECT prompt FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, pr.nbID, pr.idx).Scan(&prompt); err != nil {
+		return err
+	}
+	head, err := commitWorktree(ctx, dir, strings.TrimSpace(prompt))
+	if err != nil {
+		fmt.Fprintf(out, "\n[trybook: %v]\n", err)
+		return err
+	}
+	if head == "" {
+		return nil
+	}
+	if len(head) > 7 {
+		head = head[:7]
+	}
+	fmt.Fprintf(out, "\n[trybook: changes committed as %s]\n", head)
+	return nil
+}
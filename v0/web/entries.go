@@ -0,0 +1,387 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"trybook/runner"
+)
+
+// Notebook entries. Each prompt is a row of notebook_entries keyed by
+// (notebook_id, idx); its outputs (one per model), runs, ratings and
+// attachments live in the tables listed in entryTables, and loadNotebook
+// puts them together as entries.
+//
+// Editing and deleting entries. PUT /n/{id}/entries/{idx} replaces an
+// entry's prompt; its outputs, ratings, intent and test result no longer
+// describe it and are cleared, while earlier runs stay in its history.
+// DELETE /n/{id}/entries/{idx} removes the entry and everything recorded
+// for it, and moves later entries up so idx stays 0..n-1. Neither touches
+// the worktree: commits made by the entry's runs remain. Both are refused
+// while runs are queued or running on the notebook.
+
+// entry is one prompt of a notebook with everything recorded for it.
+type entry struct {
+	Prompt  string
+	Outputs map[string]entryOutput // model -> output
+	Intent  string
+	// IntentSource says who decided Intent: intentRouter, intentManual,
+	// intentHeuristic or intentClassifier.
+	IntentSource string
+	Tests        string                 // "pass" or "fail" after a test run, else ""
+	Stale        bool                   // the worktree was rolled back past it
+	Interrupted  bool                   // the server stopped while it ran
+	Ratings      map[string]int         // model -> +1/-1 user feedback
+	Runs         map[string][]runRecord // model -> every attempt, oldest first
+	Usage        runUsage               // summed over every run of the entry
+	Attachments  []attachment           // files and snippets sent with the prompt
+	PromptTokens int                    // estimated; see inspectPrompt
+	PromptLang   string                 // "text", or the language of the code in it
+	EditModel    string                 // the model picked to make the edit, if any
+	ABEdits      bool                   // editing models run in lanes of their own
+	DryRun       bool                   // editing models only preview the edit; see dryrun.go
+	Confirm      string                 // confirmPending or confirmConfirmed for a routed edit, else ""
+	Held         *heldEdit              // what waits for confirmation while Confirm is confirmPending
+	Lanes        []lane                 // their lanes, by model
+	OpenLanes    []lane                 // the lanes still waiting for a choice
+	KeptLane     string                 // the model whose lane was kept
+	Comparable   []string               // models with answers to compare side by side
+	Boxes        []outputBox            // filled in for rendering by withBoxes
+	Pinned       bool                   // shown at the top of the notebook page
+	Citations    map[string][]citation  // model -> what its answer quoted
+}
+
+type entryOutput struct {
+	Output     string
+	Stderr     string // what the model printed on standard error
+	HeadBefore string // worktree HEAD when the run started
+	HeadAfter  string // worktree HEAD when the run finished
+}
+
+// loadEntryOutputs returns idx -> model -> output for a notebook.
+func loadEntryOutputs(ctx context.Context, nbID string) (map[int]map[string]entryOutput, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT idx, model, output, stderr, head_before, head_after FROM entry_outputs WHERE notebook_id = ?
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int]map[string]entryOutput)
+	for rows.Next() {
+		var idx int
+		var model string
+		var o entryOutput
+		if err := rows.Scan(&idx, &model, &o.Output, &o.Stderr, &o.HeadBefore, &o.HeadAfter); err != nil {
+			return nil, err
+		}
+		if out[idx] == nil {
+			out[idx] = make(map[string]entryOutput)
+		}
+		out[idx][model] = o
+	}
+	return out, rows.Err()
+}
+
+func appendNotebookEntry(ctx context.Context, nbID, prompt string) (int, error) {
+	pi := inspectPrompt(prompt)
+	var next int
+	err := inTx(ctx, func(tx *sql.Tx) error {
+		var status string
+		if err := tx.QueryRowContext(ctx, `SELECT status FROM notebooks WHERE id = ?`, nbID).Scan(&status); err == nil && status != "" {
+			return errNotebookNotReady
+		}
+		if err := tx.QueryRowContext(ctx, `
+			SELECT COALESCE(MAX(idx), -1) + 1 FROM notebook_entries WHERE notebook_id = ?
+		`, nbID).Scan(&next); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO notebook_entries(notebook_id, idx, prompt, prompt_tokens, prompt_lang)
+			VALUES(?, ?, ?, ?, ?)
+		`, nbID, next, prompt, pi.Tokens, pi.Lang)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+	return next, nil
+}
+
+// setNotebookEntryIntent records an entry's intent and where it came from
+// (intentRouter, intentManual, intentHeuristic or intentClassifier).
+func setNotebookEntryIntent(ctx context.Context, nbID string, idx int, intent, source string) error {
+	intent = strings.ToLower(strings.TrimSpace(intent))
+	if _, ok := currentConfig().Intents[intent]; !ok {
+		intent, source = "", ""
+	}
+	return notebooks.SetIntent(ctx, nbID, idx, intent, source)
+}
+
+var errEntryNotFound = errors.New("entry not found")
+
+// entryTables holds the tables keyed by (notebook_id, idx); those with a
+// unique key over idx are re-sequenced in two steps.
+var entryTables = []struct {
+	name   string
+	unique bool
+}{
+	{"feedback", true},
+	{"preferences", true},
+	{"attachments", true},
+	{"entry_lanes", true},
+	{"runs", false},
+	{"jobs", false},
+	{"run_stats", false},
+	{"entry_outputs", true},
+	{"citations", true},
+	{"notebook_entries", true},
+}
+
+// entryRefs are columns elsewhere that point at an entry: they follow it
+// when entries are renumbered, and become -1 when it is deleted. where
+// picks the notebook's rows.
+var entryRefs = []struct {
+	table, where string
+}{
+	{"batch_items", "notebook_id = ?"},
+	{"pipeline_steps", "pipeline_id IN (SELECT id FROM pipelines WHERE notebook_id = ?)"},
+}
+
+// forgetLiveRuns drops the notebook's finished live runs, whose keys would
+// otherwise point at the wrong entries once idx changes.
+func forgetLiveRuns(nbID string) {
+	liveRuns.Lock()
+	defer liveRuns.Unlock()
+	liveRuns.Notebook(nbID, func(key string, lr *runner.Run) {
+		if lr.Finished() {
+			liveRuns.Delete(key)
+		}
+	})
+}
+
+func editEntry(ctx context.Context, nbID string, idx int, prompt string) error {
+	if notebookBusy(nbID) {
+		return errNotebookBusy
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	pi := inspectPrompt(prompt)
+	res, err := tx.ExecContext(ctx, `
+		UPDATE notebook_entries
+		SET prompt = ?, prompt_tokens = ?, prompt_lang = ?,
+			intent = '', intent_source = '', edit_confirm = '', tests = '', interrupted = 0, output = '', output_claude = '',
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+		WHERE notebook_id = ? AND idx = ?
+	`, prompt, pi.Tokens, pi.Lang, nbID, idx)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errEntryNotFound
+	}
+	for _, q := range []string{
+		`DELETE FROM entry_outputs WHERE notebook_id = ? AND idx = ?`,
+		`DELETE FROM citations WHERE notebook_id = ? AND idx = ?`,
+		`DELETE FROM feedback WHERE notebook_id = ? AND idx = ?`,
+		`DELETE FROM preferences WHERE notebook_id = ? AND idx = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, nbID, idx); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetLiveRuns(nbID)
+	return nil
+}
+
+func deleteEntry(ctx context.Context, nbID string, idx int) error {
+	if notebookBusy(nbID) {
+		return errNotebookBusy
+	}
+	if meta, _, err := loadNotebook(ctx, nbID); err == nil {
+		removeOpenLanes(ctx, meta, idx)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var one int
+	err = tx.QueryRowContext(ctx, `SELECT 1 FROM notebook_entries WHERE notebook_id = ? AND idx = ?`, nbID, idx).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errEntryNotFound
+	}
+	if err != nil {
+		return err
+	}
+	for _, t := range entryTables {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+t.name+` WHERE notebook_id = ? AND idx = ?`, nbID, idx); err != nil {
+			return fmt.Errorf("delete from %s: %w", t.name, err)
+		}
+		// Shifting a unique idx down in place can collide with the row
+		// below it, so move later rows to negatives first.
+		shift := []string{`UPDATE ` + t.name + ` SET idx = idx - 1 WHERE notebook_id = ? AND idx > ?`}
+		if t.unique {
+			shift = []string{
+				`UPDATE ` + t.name + ` SET idx = -idx WHERE notebook_id = ? AND idx > ?`,
+				`UPDATE ` + t.name + ` SET idx = -idx - 1 WHERE notebook_id = ? AND idx < -?`,
+			}
+		}
+		for _, q := range shift {
+			if _, err := tx.ExecContext(ctx, q, nbID, idx); err != nil {
+				return fmt.Errorf("renumber %s: %w", t.name, err)
+			}
+		}
+	}
+	for _, ref := range entryRefs {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE `+ref.table+` SET idx = CASE WHEN idx = ? THEN -1 ELSE idx - 1 END
+			WHERE `+ref.where+` AND idx >= ?
+		`, idx, nbID, idx); err != nil {
+			return fmt.Errorf("renumber %s: %w", ref.table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetLiveRuns(nbID)
+	return nil
+}
+
+// moveEntry moves entry from to position to, shifting the entries between
+// them up or down by one, and renumbers every table keyed by idx with it in
+// one transaction.
+func moveEntry(ctx context.Context, nbID string, from, to int) error {
+	if notebookBusy(nbID) {
+		return errNotebookBusy
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM notebook_entries WHERE notebook_id = ?`, nbID).Scan(&n); err != nil {
+		return err
+	}
+	if from < 0 || from >= n || to < 0 || to >= n {
+		return errEntryNotFound
+	}
+	if from == to {
+		return nil
+	}
+	lo, hi, step := from+1, to, -1
+	if to < from {
+		lo, hi, step = to, from-1, 1
+	}
+	// As in deleteEntry, rows go through negatives (-1 - new idx) so a
+	// unique idx never collides on the way.
+	for _, t := range entryTables {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE `+t.name+` SET idx = -1 - (CASE WHEN idx = ? THEN ? ELSE idx + ? END)
+			WHERE notebook_id = ? AND (idx = ? OR idx BETWEEN ? AND ?)
+		`, from, to, step, nbID, from, lo, hi); err != nil {
+			return fmt.Errorf("renumber %s: %w", t.name, err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE `+t.name+` SET idx = -1 - idx WHERE notebook_id = ? AND idx < 0`, nbID); err != nil {
+			return fmt.Errorf("renumber %s: %w", t.name, err)
+		}
+	}
+	// References are not unique, and -1 in them means no entry, so they
+	// move in one step.
+	for _, ref := range entryRefs {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE `+ref.table+` SET idx = CASE WHEN idx = ? THEN ? ELSE idx + ? END
+			WHERE `+ref.where+` AND (idx = ? OR idx BETWEEN ? AND ?)
+		`, from, to, step, nbID, from, lo, hi); err != nil {
+			return fmt.Errorf("renumber %s: %w", ref.table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	forgetLiveRuns(nbID)
+	return nil
+}
+
+// pinEntry pins or unpins an entry.
+func pinEntry(ctx context.Context, nbID string, idx int, pinned bool) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE notebook_entries SET pinned = ? WHERE notebook_id = ? AND idx = ?
+	`, pinned, nbID, idx)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errEntryNotFound
+	}
+	return nil
+}
+
+// PUT, DELETE /n/{id}/entries/{idx}
+// POST /n/{id}/entries/{idx} (action move: to; action pin: pinned=1 or 0)
+func entryHandler(w http.ResponseWriter, r *http.Request, nbID, idxStr string) {
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil || idx < 0 || !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		// Editing is deliberate enough to skip the pasted-file check.
+		prompt, _, perr := checkPrompt(r.FormValue("prompt"), true)
+		if perr != nil {
+			http.Error(w, "prompt refused: "+perr.Error(), http.StatusBadRequest)
+			return
+		}
+		err = editEntry(r.Context(), nbID, idx, prompt)
+	case http.MethodDelete:
+		err = deleteEntry(r.Context(), nbID, idx)
+	case http.MethodPost:
+		switch r.FormValue("action") {
+		case "move":
+			to, perr := strconv.Atoi(r.FormValue("to"))
+			if perr != nil {
+				http.Error(w, "bad to", http.StatusBadRequest)
+				return
+			}
+			err = moveEntry(r.Context(), nbID, idx, to)
+		case "pin":
+			err = pinEntry(r.Context(), nbID, idx, r.FormValue("pinned") == "1")
+		default:
+			http.Error(w, "bad action", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case errors.Is(err, errEntryNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errNotebookBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "entryHandler", "idx", idx, "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	broadcastNotebook(nbID, hubMsg{Type: "entries", Idx: idx})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"nb": nbID, "idx": idx})
+}
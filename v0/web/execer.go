@@ -0,0 +1,159 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Process execution for model runs. Runs, and the summaries and clean-ups
+// that call llm, start their command through execer, which is osExecer in
+// production. A fakeExecer replays canned output instead, so runs, their
+// streaming and what they persist can be exercised without gemini, claude
+// or aider installed: -fake-exec file.json serves with one, and tests
+// (server_test.go) install one with setExecer; their TestMain hands the
+// fake-process subcommand to RunFakeProcess, as main does.
+//
+// The fake still returns a real *exec.Cmd, so PTYs, process groups and
+// timeouts behave as they do for real models: the command is this binary
+// in its fake-process mode, which writes the canned output and exits with
+// the canned code.
+
+var fakeExecFile = flag.String("fake-exec", "", "JSON file of canned output to replay instead of running model commands, keyed by command name (for trying trybook without the model CLIs)")
+
+// FakeProcessCommand is the hidden subcommand a fakeExecer's processes run.
+const FakeProcessCommand = "fake-process"
+
+// Execer creates the commands model runs start.
+type Execer interface {
+	CommandContext(ctx context.Context, name string, arg ...string) *exec.Cmd
+}
+
+type osExecer struct{}
+
+func (osExecer) CommandContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, arg...)
+}
+
+var (
+	execerMu sync.Mutex
+	execer   Execer = osExecer{}
+)
+
+func currentExecer() Execer {
+	execerMu.Lock()
+	defer execerMu.Unlock()
+	return execer
+}
+
+// setExecer installs e for later runs and returns a func restoring the
+// previous one.
+func setExecer(e Execer) (restore func()) {
+	execerMu.Lock()
+	defer execerMu.Unlock()
+	prev := execer
+	execer = e
+	return func() {
+		execerMu.Lock()
+		defer execerMu.Unlock()
+		execer = prev
+	}
+}
+
+// fakeProcess is what a fake command does.
+type fakeProcess struct {
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	ExitCode  int    `json:"exit_code"`
+	DelayMS   int    `json:"delay_ms"`   // wait before writing anything
+	EchoStdin bool   `json:"echo_stdin"` // copy standard input to stdout after Stdout
+}
+
+// fakeCall records one command a fakeExecer created.
+type fakeCall struct {
+	Argv []string
+	cmd  *exec.Cmd
+}
+
+// Dir is the directory the command ran in, once the caller has set it.
+func (c fakeCall) Dir() string { return c.cmd.Dir }
+
+// fakeExecer replays canned processes, keyed by the base name of the
+// command (gemini, claude, docker, ...). "*" matches any other command;
+// without it an unknown command fails with exit code 127.
+type fakeExecer struct {
+	self  string // this binary
+	procs map[string]fakeProcess
+
+	mu    sync.Mutex
+	calls []fakeCall
+}
+
+func newFakeExecer(procs map[string]fakeProcess) (*fakeExecer, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &fakeExecer{self: self, procs: procs}, nil
+}
+
+// loadFakeExecer reads a -fake-exec file: an object from command name to
+// {"stdout", "stderr", "exit_code", "delay_ms", "echo_stdin"}.
+func loadFakeExecer(path string) (*fakeExecer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var procs map[string]fakeProcess
+	if err := json.Unmarshal(b, &procs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return newFakeExecer(procs)
+}
+
+func (f *fakeExecer) CommandContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	p, ok := f.procs[filepath.Base(name)]
+	if !ok {
+		p, ok = f.procs["*"]
+	}
+	if !ok {
+		p = fakeProcess{Stderr: "fake-exec: no canned output for " + name + "\n", ExitCode: 127}
+	}
+	spec, _ := json.Marshal(p)
+	cmd := exec.CommandContext(ctx, f.self, FakeProcessCommand, string(spec))
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeCall{Argv: append([]string{name}, arg...), cmd: cmd})
+	f.mu.Unlock()
+	return cmd
+}
+
+// Calls returns the commands created so far, oldest first.
+func (f *fakeExecer) Calls() []fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeCall(nil), f.calls...)
+}
+
+// RunFakeProcess is the fake-process subcommand: it acts out the JSON
+// fakeProcess in args[0] and returns the exit code.
+func RunFakeProcess(args []string) int {
+	var p fakeProcess
+	if len(args) != 1 || json.Unmarshal([]byte(args[0]), &p) != nil {
+		fmt.Fprintln(os.Stderr, "usage: trybook "+FakeProcessCommand+" <json>")
+		return 2
+	}
+	time.Sleep(time.Duration(p.DelayMS) * time.Millisecond)
+	_, _ = io.WriteString(os.Stdout, p.Stdout)
+	_, _ = io.WriteString(os.Stderr, p.Stderr)
+	if p.EchoStdin {
+		_, _ = io.Copy(os.Stdout, os.Stdin)
+	}
+	return p.ExitCode
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"trybook/runner"
+)
+
+// Fallback models. "fallback" on a model names the model to run instead
+// when it fails: its CLI is missing or cannot start, or it exits non-zero.
+// Fallbacks chain (gemini -> claude -> ollama) but may not loop. A model in
+// the chain that already answered the entry, or is running for it, is
+// passed over for the one after it. Timeouts and the Stop button do not
+// fall back, and neither do A/B lanes, the router or the tests.
+//
+// The failed run emits a "fallback" event naming the model queued in its
+// place, so the page shows that model's box and follows it. Both runs
+// record the link (runs.fallback_to on the failed one, runs.fallback_from
+// on its replacement), so the run history shows the chain of attempts.
+
+// validateFallbacks checks that each fallback names another model and that
+// no chain loops.
+func (c *config) validateFallbacks() error {
+	for name, mc := range c.Models {
+		if mc.Fallback == "" {
+			continue
+		}
+		if _, ok := c.Models[mc.Fallback]; !ok || mc.Fallback == "router" || name == "router" {
+			return fmt.Errorf("model %s: fallback %q is not a model that answers prompts", name, mc.Fallback)
+		}
+		seen := map[string]bool{name: true}
+		for m := mc.Fallback; m != ""; m = c.Models[m].Fallback {
+			if seen[m] {
+				return fmt.Errorf("model %s: fallbacks loop back to %s", name, m)
+			}
+			seen[m] = true
+		}
+	}
+	return nil
+}
+
+// nextFallback returns the model to run after model failed on an entry, or
+// "". The caller holds liveRuns locked.
+func nextFallback(ctx context.Context, cfg *config, nbID string, idx int, model string) string {
+	for m := cfg.Models[model].Fallback; m != ""; m = cfg.Models[m].Fallback {
+		if _, ok := cfg.registry.Get(m); !ok {
+			continue
+		}
+		if lr := liveRuns.Get(runner.Key(nbID, idx, m)); lr != nil && !lr.Finished() {
+			continue
+		}
+		var n int
+		if err := db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM entry_outputs WHERE notebook_id = ? AND idx = ? AND model = ? AND output != ''
+		`, nbID, idx, m).Scan(&n); err != nil || n > 0 {
+			continue
+		}
+		return m
+	}
+	return ""
+}
+
+// fallbackAfter returns then followed, if pr's model failed, by queueing
+// its fallback.
+func fallbackAfter(pr *preparedRun, then func(context.Context, *runner.Run, error)) func(context.Context, *runner.Run, error) {
+	if pr.model == "router" || pr.model == TestsModel || pr.lane || pr.cfg.Models[pr.model].Fallback == "" {
+		return then
+	}
+	return func(ctx context.Context, failedRun *runner.Run, err error) {
+		if then != nil {
+			then(ctx, failedRun, err)
+		}
+		if err == nil || ctx.Err() != nil || isRunTimeout(err) {
+			return
+		}
+		liveRuns.Lock()
+		defer liveRuns.Unlock()
+		next := nextFallback(ctx, pr.cfg, pr.nbID, pr.idx, pr.model)
+		if next == "" {
+			return
+		}
+		fpr, err := prepareRun(context.Background(), pr.cfg, pr.nbID, pr.idx, next)
+		if err != nil {
+			slog.ErrorContext(ctx, "fallback: prepare run", "fallback", next, "err", err)
+			return
+		}
+		fpr.fallbackFrom = pr.model
+		if _, err := enqueueRun(runner.Key(pr.nbID, pr.idx, next), fpr, fallbackAfter(fpr, testsAfter(fpr))); err != nil {
+			slog.ErrorContext(ctx, "fallback: enqueue", "fallback", next, "err", err)
+			return
+		}
+		if _, err := execDB(ctx, `
+			UPDATE runs SET fallback_to = ?
+			WHERE id = (SELECT MAX(id) FROM runs WHERE notebook_id = ? AND idx = ? AND model = ?)
+		`, next, pr.nbID, pr.idx, pr.model); err != nil {
+			slog.ErrorContext(ctx, "fallback: record", "err", err)
+		}
+		slog.InfoContext(ctx, "fallback: queued", "fallback", next)
+		failedRun.Emit("fallback", map[string]string{"model": next, "from": pr.model})
+	}
+}
+
+func recordRunFallbackFrom(ctx context.Context, runID int64, from string) error {
+	if runID == 0 || from == "" {
+		return nil
+	}
+	_, err := execDB(ctx, `UPDATE runs SET fallback_from = ? WHERE id = ?`, from, runID)
+	return err
+}
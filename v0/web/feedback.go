@@ -0,0 +1,244 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Per-output thumbs up/down. A rating belongs to the run that produced
+// the output, so rerunning an entry starts its boxes unrated again, and it
+// keeps the intent the entry was routed to. Ratings accumulate per repo and
+// are used to drop models from the fan-out once they are consistently
+// rated poorly there, to order the rest best-first, and to show the router
+// how earlier prompts in the repo were routed and rated (routingExamples).
+
+const (
+	feedbackMinRatings  = 5   // ratings needed before a model can be dropped
+	feedbackMaxDownRate = 0.7 // drop a model rated down at least this often
+
+	routingExamples      = 6   // rated prompts shown to the router
+	routingExamplePrompt = 200 // characters of each
+)
+
+const feedbackSchema = `
+	CREATE TABLE IF NOT EXISTS feedback (
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		model       TEXT NOT NULL,
+		rating      INTEGER NOT NULL,
+		comment     TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, idx, model),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);`
+
+// setFeedback rates run runID of model for the entry, recording the
+// entry's intent with it.
+func setFeedback(ctx context.Context, nbID string, idx int, model string, runID int64, rating int, comment string) error {
+	_, err := execDB(ctx, `
+		INSERT INTO feedback(notebook_id, idx, model, run_id, rating, comment, intent)
+		VALUES(?, ?, ?, ?, ?, ?, COALESCE((SELECT intent FROM notebook_entries WHERE notebook_id = ? AND idx = ?), ''))
+		ON CONFLICT(notebook_id, idx, model, run_id) DO UPDATE SET
+			rating = excluded.rating,
+			comment = excluded.comment,
+			intent = excluded.intent,
+			created_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, nbID, idx, model, runID, rating, comment, nbID, idx)
+	return err
+}
+
+// feedbackRun returns the run of model for the entry that a rating
+// belongs to: runID if it is one of them, or else the latest, or 0 if
+// none was recorded.
+func feedbackRun(ctx context.Context, nbID string, idx int, model string, runID int64) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(id), 0) FROM runs
+		WHERE notebook_id = ? AND idx = ? AND model = ? AND (? = 0 OR id = ?)
+	`, nbID, idx, model, runID, runID).Scan(&id)
+	if err == nil && id == 0 && runID != 0 {
+		return feedbackRun(ctx, nbID, idx, model, 0)
+	}
+	return id, err
+}
+
+// loadFeedback returns idx -> model -> rating of the latest run for a
+// notebook.
+func loadFeedback(ctx context.Context, nbID string) (map[int]map[string]int, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.idx, f.model, f.rating FROM feedback f
+		WHERE f.notebook_id = ? AND f.run_id = (
+			SELECT COALESCE(MAX(r.id), 0) FROM runs r
+			WHERE r.notebook_id = f.notebook_id AND r.idx = f.idx AND r.model = f.model
+		)
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int]map[string]int)
+	for rows.Next() {
+		var idx, rating int
+		var model string
+		if err := rows.Scan(&idx, &model, &rating); err != nil {
+			return nil, err
+		}
+		if out[idx] == nil {
+			out[idx] = make(map[string]int)
+		}
+		out[idx][model] = rating
+	}
+	return out, rows.Err()
+}
+
+type modelScore struct {
+	Up   int
+	Down int
+}
+
+func (s modelScore) total() int { return s.Up + s.Down }
+
+func (s modelScore) poor() bool {
+	return s.total() >= feedbackMinRatings && float64(s.Down)/float64(s.total()) >= feedbackMaxDownRate
+}
+
+func repoModelScores(ctx context.Context, host, org, repo string) (map[string]modelScore, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT f.model,
+			SUM(CASE WHEN f.rating > 0 THEN 1 ELSE 0 END),
+			SUM(CASE WHEN f.rating < 0 THEN 1 ELSE 0 END)
+		FROM feedback f JOIN notebooks n ON n.id = f.notebook_id
+		WHERE n.host = ? AND n.org = ? AND n.repo = ?
+		GROUP BY f.model
+	`, host, org, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]modelScore)
+	for rows.Next() {
+		var m string
+		var s modelScore
+		if err := rows.Scan(&m, &s.Up, &s.Down); err != nil {
+			return nil, err
+		}
+		out[m] = s
+	}
+	return out, rows.Err()
+}
+
+// repoIntentModels applies the repo's accumulated feedback to the configured
+// intent -> models mapping. An intent never ends up with no models.
+func repoIntentModels(ctx context.Context, cfg *config, host, org, repo string) map[string][]string {
+	scores, err := repoModelScores(ctx, host, org, repo)
+	if err != nil {
+		slog.ErrorContext(ctx, "repoIntentModels", "err", err)
+		return cfg.Intents
+	}
+	out := make(map[string][]string, len(cfg.Intents))
+	for intent, models := range cfg.Intents {
+		var keep []string
+		for _, m := range models {
+			if scores[m].poor() {
+				slog.InfoContext(ctx, "repoIntentModels: skipping poorly rated model", "repo", org+"/"+repo, "model", m, "intent", intent, "down", scores[m].Down, "total", scores[m].total())
+				continue
+			}
+			keep = append(keep, m)
+		}
+		if len(keep) == 0 {
+			keep = append(keep, models...)
+		}
+		sort.SliceStable(keep, func(i, j int) bool {
+			a, b := scores[keep[i]], scores[keep[j]]
+			return a.Up-a.Down > b.Up-b.Down
+		})
+		out[intent] = keep
+	}
+	return out
+}
+
+// withRoutingFeedback adds to the router's prompt how earlier prompts in
+// meta's repo were routed and how their answers were rated, so it leans
+// toward the intents that served the repo well.
+func withRoutingFeedback(ctx context.Context, meta notebookMeta, prompt string) string {
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.prompt, f.intent, SUM(f.rating)
+		FROM feedback f
+		JOIN notebooks n ON n.id = f.notebook_id
+		JOIN notebook_entries e ON e.notebook_id = f.notebook_id AND e.idx = f.idx
+		WHERE n.host = ? AND n.org = ? AND n.repo = ? AND f.intent != ''
+		GROUP BY f.notebook_id, f.idx, f.intent
+		HAVING SUM(f.rating) != 0
+		ORDER BY MAX(f.created_at) DESC
+		LIMIT ?
+	`, meta.Host, meta.Org, meta.Repo, routingExamples)
+	if err != nil {
+		slog.WarnContext(ctx, "router: load feedback", "err", err)
+		return prompt
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var p, intent string
+		var net int
+		if err := rows.Scan(&p, &intent, &net); err != nil {
+			slog.WarnContext(ctx, "router: load feedback", "err", err)
+			return prompt
+		}
+		p = strings.Join(strings.Fields(p), " ")
+		if len(p) > routingExamplePrompt {
+			p = p[:routingExamplePrompt] + "..."
+		}
+		verdict := "rated good"
+		if net < 0 {
+			verdict = "rated bad"
+		}
+		lines = append(lines, fmt.Sprintf("- %q was treated as %s, %s", p, intent, verdict))
+	}
+	if len(lines) == 0 {
+		return prompt
+	}
+	return prompt + "\n\nFor reference, how earlier prompts in this repository were treated and how the answers were rated:\n" + strings.Join(lines, "\n")
+}
+
+// POST /api/feedback
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	idx, err := strconv.Atoi(strings.TrimSpace(r.FormValue("idx")))
+	model := strings.TrimSpace(r.FormValue("model"))
+	rating, rerr := strconv.Atoi(strings.TrimSpace(r.FormValue("rating")))
+	if err != nil || rerr != nil || !isSafeToken(nbID) || !isSafeToken(model) || (rating != 1 && rating != -1) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	comment := strings.TrimSpace(r.FormValue("comment"))
+	if len(comment) > 2000 {
+		comment = comment[:2000]
+	}
+	runID, _ := strconv.ParseInt(r.FormValue("run"), 10, 64)
+	if runID, err = feedbackRun(r.Context(), nbID, idx, model, runID); err != nil {
+		slog.ErrorContext(r.Context(), "feedbackHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if err := setFeedback(r.Context(), nbID, idx, model, runID, rating, comment); err != nil {
+		slog.ErrorContext(r.Context(), "feedbackHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok"))
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// File view and answer links. GET /n/{id}/file?path=..&line=N&end=M
+// shows a worktree file with numbered lines, lines N to M highlighted; each
+// line has an #L<n> anchor. On the notebook page, file:line references in
+// the answers (main.go:142, internal/db.go:10-20) that name a tracked file
+// become links to it, and for github.com notebooks also to the file at the
+// notebook's commit on GitHub.
+
+type fileLine struct {
+	N    int
+	Text string
+	Hit  bool
+}
+
+type fileView struct {
+	NotebookID string
+	Org        string
+	Repo       string
+	Path       string
+	Line       int
+	End        int
+	Lines      []fileLine
+	GitHubURL  string // the file at the notebook's commit, on github.com notebooks
+	Message    string
+}
+
+// githubBlobURL links to rel at the notebook's commit on GitHub, at lines
+// line to end if line is set.
+func githubBlobURL(meta notebookMeta, rel string, line, end int) string {
+	u := fmt.Sprintf("https://github.com/%s/%s/blob/%s/%s", meta.Org, meta.Repo, meta.SHA, rel)
+	switch {
+	case line > 0 && end > line:
+		u += fmt.Sprintf("#L%d-L%d", line, end)
+	case line > 0:
+		u += fmt.Sprintf("#L%d", line)
+	}
+	return u
+}
+
+// GET /n/{id}/file?path=..[&line=N[&end=M]]
+func fileViewHandler(w http.ResponseWriter, r *http.Request, nbID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	if !isSafeToken(nbID) || rel == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := ensureWorktree(r.Context(), meta); err != nil {
+		slog.ErrorContext(r.Context(), "fileViewHandler", "err", err)
+		http.Error(w, "worktree unavailable", http.StatusInternalServerError)
+		return
+	}
+	line, _ := strconv.Atoi(r.URL.Query().Get("line"))
+	end, _ := strconv.Atoi(r.URL.Query().Get("end"))
+	if end < line {
+		end = line
+	}
+	v := fileView{NotebookID: nbID, Org: meta.Org, Repo: meta.Repo, Path: rel, Line: line, End: end}
+	if meta.Host == defaultHost && isCommitish(meta.SHA) {
+		v.GitHubURL = githubBlobURL(meta, rel, line, end)
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	if text, err := readWorktreeFile(dir, rel); err != nil {
+		v.Message = err.Error()
+	} else {
+		for i, l := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+			v.Lines = append(v.Lines, fileLine{N: i + 1, Text: l, Hit: line > 0 && i+1 >= line && i+1 <= end})
+		}
+	}
+	setHTMLHeaders(w)
+	_ = renderPage(w, "file", v)
+}
@@ -0,0 +1,163 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"trybook/gitops"
+)
+
+// Forking a notebook. "Fork from here" on an entry creates a new notebook
+// on the same repository whose worktree starts where the original stood
+// after that entry, with that entry and the ones before it copied (prompts,
+// outputs, ratings) along with the notebook's environment. Later entries
+// and uncommitted changes are not carried over. Both notebooks then go
+// their own ways on separate branches.
+
+// entryCommit returns the worktree HEAD recorded by the last run of entry
+// idx or, failing that, of the nearest entry before it; the notebook's
+// start commit if no run recorded one.
+func entryCommit(ctx context.Context, meta notebookMeta, idx int) (string, error) {
+	var head string
+	err := db.QueryRowContext(ctx, `
+		SELECT head_after FROM entry_outputs
+		WHERE notebook_id = ? AND idx <= ? AND head_after != ''
+		ORDER BY idx DESC, updated_at DESC
+		LIMIT 1
+	`, meta.ID, idx).Scan(&head)
+	if errors.Is(err, sql.ErrNoRows) {
+		return meta.SHA, nil
+	}
+	return head, err
+}
+
+// copyNotebookEnv copies the environment of notebook from to notebook to.
+// Secrets are sealed to their notebook, so they are re-encrypted.
+func copyNotebookEnv(ctx context.Context, from, to string) error {
+	rows, err := db.QueryContext(ctx, `SELECT name, value, secret FROM notebook_env WHERE notebook_id = ?`, from)
+	if err != nil {
+		return err
+	}
+	type envRow struct {
+		name, value string
+		secret      bool
+	}
+	var vars []envRow
+	for rows.Next() {
+		var v envRow
+		if err := rows.Scan(&v.name, &v.value, &v.secret); err != nil {
+			rows.Close()
+			return err
+		}
+		vars = append(vars, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, v := range vars {
+		value := v.value
+		if v.secret {
+			if value, err = openSecret(from, v.name, v.value); err != nil {
+				return fmt.Errorf("secret %s: %w", v.name, err)
+			}
+		}
+		if err := setNotebookEnv(ctx, to, v.name, value, v.secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forkNotebook creates the fork of nbID at entry idx and returns its ID.
+func forkNotebook(ctx context.Context, owner, nbID string, idx int) (string, error) {
+	a, err := exportNotebook(ctx, nbID)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errRunNotFound, err)
+	}
+	if idx < 0 || idx >= len(a.Entries) {
+		return "", fmt.Errorf("%w: no entry %d", errRunNotFound, idx)
+	}
+	meta, _, err := loadNotebook(ctx, nbID)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errRunNotFound, err)
+	}
+	commit, err := entryCommit(ctx, meta, idx)
+	if err != nil {
+		return "", err
+	}
+	forkID, err := createNotebookAt(ctx, owner, meta.Host, meta.Org, meta.Repo, meta.Subdir, commit)
+	if err != nil {
+		return "", err
+	}
+	fail := func(err error) (string, error) {
+		if _, derr := purgeNotebook(context.WithoutCancel(ctx), forkID); derr != nil {
+			slog.ErrorContext(ctx, "forkNotebook: clean up", "fork", forkID, "err", derr)
+		}
+		return "", err
+	}
+	// Diffs and pull requests of the fork cover the commits it inherited,
+	// so it starts where the original did, if that is still an ancestor.
+	start := commit
+	dir := repoDirPath(meta.Host, meta.Org, meta.Repo)
+	if exec.CommandContext(ctx, "git", "-C", dir, "merge-base", "--is-ancestor", meta.SHA, commit).Run() == nil {
+		start = meta.SHA
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE notebooks SET commit_sha = ?, forked_from = ?, forked_idx = ? WHERE id = ?
+	`, start, nbID, idx, forkID); err != nil {
+		return fail(err)
+	}
+	if err := importEntries(ctx, forkID, a.Entries[:idx+1]); err != nil {
+		return fail(fmt.Errorf("copy entries: %w", err))
+	}
+	if err := copyNotebookEnv(ctx, nbID, forkID); err != nil {
+		return fail(fmt.Errorf("copy environment: %w", err))
+	}
+	return forkID, nil
+}
+
+// forkOrigin returns the notebook nbID was forked from and the entry it
+// was forked at, or "" if it was not forked.
+func forkOrigin(ctx context.Context, nbID string) (string, int, error) {
+	var from string
+	var idx int
+	err := db.QueryRowContext(ctx, `SELECT forked_from, forked_idx FROM notebooks WHERE id = ?`, nbID).Scan(&from, &idx)
+	return from, idx, err
+}
+
+// POST /fork (nb, idx)
+func forkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	idx, err := strconv.Atoi(strings.TrimSpace(r.FormValue("idx")))
+	if err != nil || !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	forkID, err := forkNotebook(r.Context(), currentUser(r.Context()), nbID, idx)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "forkHandler", "idx", idx, "err", err)
+		switch msg, ok := gitops.ErrorMessage(err); {
+		case errors.Is(err, errRunNotFound):
+			http.Error(w, "not found", http.StatusNotFound)
+		case ok:
+			http.Error(w, msg, http.StatusConflict)
+		default:
+			http.Error(w, "fork failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	slog.InfoContext(r.Context(), "forkHandler: forked", "idx", idx, "fork", forkID)
+	http.Redirect(w, r, "/n/"+forkID, http.StatusSeeOther)
+}
@@ -0,0 +1,188 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Full-text search over notebooks. Two FTS5 tables index the prompts in
+// notebook_entries and the outputs in entry_outputs, as external content
+// keyed by rowid; triggers keep them in step with every insert, update and
+// delete. GET /search?q=.. lists the matching entries, grouped by notebook,
+// with the matched words highlighted. Each word of the query must appear,
+// as a prefix of a word, in the prompt or in one of the answers.
+
+const ftsSchema = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS entries_fts USING fts5(
+		prompt, content='notebook_entries', tokenize='porter unicode61'
+	);
+	CREATE VIRTUAL TABLE IF NOT EXISTS outputs_fts USING fts5(
+		output, content='entry_outputs', tokenize='porter unicode61'
+	);
+	CREATE TRIGGER IF NOT EXISTS entries_fts_insert AFTER INSERT ON notebook_entries BEGIN
+		INSERT INTO entries_fts(rowid, prompt) VALUES (new.rowid, new.prompt);
+	END;
+	CREATE TRIGGER IF NOT EXISTS entries_fts_delete AFTER DELETE ON notebook_entries BEGIN
+		INSERT INTO entries_fts(entries_fts, rowid, prompt) VALUES ('delete', old.rowid, old.prompt);
+	END;
+	CREATE TRIGGER IF NOT EXISTS entries_fts_update AFTER UPDATE OF prompt ON notebook_entries BEGIN
+		INSERT INTO entries_fts(entries_fts, rowid, prompt) VALUES ('delete', old.rowid, old.prompt);
+		INSERT INTO entries_fts(rowid, prompt) VALUES (new.rowid, new.prompt);
+	END;
+	CREATE TRIGGER IF NOT EXISTS outputs_fts_insert AFTER INSERT ON entry_outputs BEGIN
+		INSERT INTO outputs_fts(rowid, output) VALUES (new.rowid, new.output);
+	END;
+	CREATE TRIGGER IF NOT EXISTS outputs_fts_delete AFTER DELETE ON entry_outputs BEGIN
+		INSERT INTO outputs_fts(outputs_fts, rowid, output) VALUES ('delete', old.rowid, old.output);
+	END;
+	CREATE TRIGGER IF NOT EXISTS outputs_fts_update AFTER UPDATE OF output ON entry_outputs BEGIN
+		INSERT INTO outputs_fts(outputs_fts, rowid, output) VALUES ('delete', old.rowid, old.output);
+		INSERT INTO outputs_fts(rowid, output) VALUES (new.rowid, new.output);
+	END;
+	INSERT INTO entries_fts(entries_fts) VALUES ('rebuild');
+	INSERT INTO outputs_fts(outputs_fts) VALUES ('rebuild');`
+
+const (
+	ftsMaxResults = 100
+	// Snippet highlight markers; control characters that output text is
+	// unlikely to contain.
+	ftsHitStart = "\x01"
+	ftsHitEnd   = "\x02"
+)
+
+// ftsQuery turns what the user typed into an FTS5 query: every word,
+// quoted so punctuation can't be read as query syntax, as a prefix.
+func ftsQuery(q string) string {
+	var terms []string
+	for _, w := range strings.Fields(q) {
+		terms = append(terms, `"`+strings.ReplaceAll(w, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+type snippetPart struct {
+	Text string
+	Hit  bool
+}
+
+// splitSnippet splits a snippet at its highlight markers.
+func splitSnippet(s string) []snippetPart {
+	var parts []snippetPart
+	for s != "" {
+		i := strings.Index(s, ftsHitStart)
+		if i < 0 {
+			parts = append(parts, snippetPart{Text: s})
+			break
+		}
+		if i > 0 {
+			parts = append(parts, snippetPart{Text: s[:i]})
+		}
+		s = s[i+len(ftsHitStart):]
+		j := strings.Index(s, ftsHitEnd)
+		if j < 0 {
+			j = len(s)
+		}
+		parts = append(parts, snippetPart{Text: s[:j], Hit: true})
+		s = strings.TrimPrefix(s[j:], ftsHitEnd)
+	}
+	return parts
+}
+
+type searchHit struct {
+	Idx     int
+	Num     int    // Idx + 1, for display
+	Model   string // "" when the prompt matched
+	Snippet []snippetPart
+}
+
+type searchGroup struct {
+	ID    string
+	Repo  string
+	Title string
+	Hits  []searchHit
+}
+
+// searchNotebooks finds entries whose prompt or outputs match q, in the
+// notebooks user can see, grouped by notebook in order of their best match.
+func searchNotebooks(ctx context.Context, user, q string) ([]searchGroup, bool, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT n.id, n.host, n.org, n.repo, n.title, e.idx, '',
+			snippet(entries_fts, 0, char(1), char(2), '…', 16), bm25(entries_fts) AS score
+		FROM entries_fts
+		JOIN notebook_entries e ON e.rowid = entries_fts.rowid
+		JOIN notebooks n ON n.id = e.notebook_id
+		WHERE entries_fts MATCH ?1 AND (?2 = '' OR n.owner = '' OR n.owner = ?2) AND n.deleted_at = ''
+		UNION ALL
+		SELECT n.id, n.host, n.org, n.repo, n.title, o.idx, o.model,
+			snippet(outputs_fts, 0, char(1), char(2), '…', 16), bm25(outputs_fts)
+		FROM outputs_fts
+		JOIN entry_outputs o ON o.rowid = outputs_fts.rowid
+		JOIN notebooks n ON n.id = o.notebook_id
+		WHERE outputs_fts MATCH ?1 AND (?2 = '' OR n.owner = '' OR n.owner = ?2) AND n.deleted_at = ''
+		ORDER BY score
+		LIMIT ?3
+	`, ftsQuery(q), user, ftsMaxResults+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	var groups []searchGroup
+	pos := make(map[string]int)
+	n := 0
+	for rows.Next() {
+		var g searchGroup
+		var spec repoSpec
+		var h searchHit
+		var snippet string
+		var score float64
+		if err := rows.Scan(&g.ID, &spec.Host, &spec.Org, &spec.Repo, &g.Title, &h.Idx, &h.Model, &snippet, &score); err != nil {
+			return nil, false, err
+		}
+		if n++; n > ftsMaxResults {
+			return groups, true, rows.Err()
+		}
+		h.Num, h.Snippet = h.Idx+1, splitSnippet(snippet)
+		i, ok := pos[g.ID]
+		if !ok {
+			g.Repo = spec.String()
+			i = len(groups)
+			pos[g.ID] = i
+			groups = append(groups, g)
+		}
+		groups[i].Hits = append(groups[i].Hits, h)
+	}
+	return groups, false, rows.Err()
+}
+
+type searchView struct {
+	User      string
+	Query     string
+	Groups    []searchGroup
+	Truncated bool
+	Message   string
+}
+
+// GET /search?q=..
+func notebookSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v := searchView{User: currentUser(r.Context()), Query: strings.TrimSpace(r.URL.Query().Get("q"))}
+	if len(v.Query) > searchMaxQuery {
+		v.Message = "The search is too long."
+	} else if ftsQuery(v.Query) != "" {
+		groups, truncated, err := searchNotebooks(r.Context(), v.User, v.Query)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "notebookSearchHandler", "err", err)
+			v.Message = "Search failed."
+		} else if len(groups) == 0 {
+			v.Message = "No matches."
+		}
+		v.Groups, v.Truncated = groups, truncated
+	}
+	setHTMLHeaders(w)
+	_ = renderPage(w, "search", v)
+}
@@ -0,0 +1,298 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Worktree garbage collection, run with -gc or POST /admin/gc. A notebook
+// with no activity (entry edits or runs) for -gc-days loses its worktree
+// directory; its branch stays in the clone and the worktree is checked out
+// again when the notebook is next opened. Worktrees with uncommitted
+// changes are skipped. Worktrees and nb-* branches left behind by deleted
+// notebooks are removed, and git worktree prune runs in every clone.
+
+var (
+	gcOnce = flag.Bool("gc", false, "remove abandoned worktrees, print a report and exit")
+	gcDays = flag.Int("gc-days", 30, "days without activity before -gc or /admin/gc removes a notebook's worktree")
+)
+
+type gcReport struct {
+	DryRun           bool     `json:"dry_run,omitempty"`
+	RemovedWorktrees []string `json:"removed_worktrees"`
+	DeletedBranches  []string `json:"deleted_branches"`
+	Skipped          []string `json:"skipped,omitempty"`
+	Errors           []string `json:"errors,omitempty"`
+	ReclaimedBytes   int64    `json:"reclaimed_bytes"`
+}
+
+func (r *gcReport) errorf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	slog.Error("gc: " + msg)
+	r.Errors = append(r.Errors, msg)
+}
+
+func dirSize(dir string) int64 {
+	var n int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				n += info.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+func worktreeDirty(ctx context.Context, dir string) (bool, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil {
+		return false, err
+	}
+	return len(strings.TrimSpace(string(out))) > 0, nil
+}
+
+// removeWorktree removes dir from cloneDir's worktrees, adding its size to
+// the report.
+func (r *gcReport) removeWorktree(ctx context.Context, cloneDir, dir string) bool {
+	size := dirSize(dir)
+	if !r.DryRun {
+		cmd := exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "remove", "--force", dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			r.errorf("remove worktree %s: %v: %s", dir, err, strings.TrimSpace(string(out)))
+			return false
+		}
+	}
+	r.RemovedWorktrees = append(r.RemovedWorktrees, dir)
+	r.ReclaimedBytes += size
+	return true
+}
+
+// gcStaleNotebooks removes the worktrees of notebooks idle since cutoff.
+func gcStaleNotebooks(ctx context.Context, cutoff time.Time, r *gcReport) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, host, org, repo, worktree FROM (
+			SELECT n.id, n.host, n.org, n.repo, n.worktree, MAX(
+				n.created_at,
+				COALESCE((SELECT MAX(updated_at) FROM notebook_entries e WHERE e.notebook_id = n.id), ''),
+				COALESCE((SELECT MAX(started_at) FROM runs u WHERE u.notebook_id = n.id), '')
+			) AS active_at
+			FROM notebooks n
+			WHERE n.deleted_at = ''
+		) WHERE active_at < ?
+	`, cutoff.UTC().Format("2006-01-02T15:04:05Z"))
+	if err != nil {
+		return err
+	}
+	var stale []notebookMeta
+	for rows.Next() {
+		var m notebookMeta
+		if err := rows.Scan(&m.ID, &m.Host, &m.Org, &m.Repo, &m.Worktree); err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, m := range stale {
+		dir := worktreeDirPath(m.Host, m.Org, m.Repo, m.Worktree)
+		if !pathExists(dir) {
+			continue
+		}
+		if notebookBusy(m.ID) {
+			r.Skipped = append(r.Skipped, dir+": runs in progress")
+			continue
+		}
+		dirty, err := worktreeDirty(ctx, dir)
+		if err != nil {
+			r.errorf("status %s: %v", dir, err)
+			continue
+		}
+		if dirty {
+			r.Skipped = append(r.Skipped, dir+": uncommitted changes")
+			continue
+		}
+		r.removeWorktree(ctx, repoDirPath(m.Host, m.Org, m.Repo), dir)
+	}
+	return nil
+}
+
+func notebookExists(ctx context.Context, id string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM notebooks WHERE id = ?`, id).Scan(&n)
+	return n > 0, err
+}
+
+// gcClone prunes a clone's worktree list and removes the worktrees
+// (untouched since cutoff) and branches of notebooks that no longer exist.
+func gcClone(ctx context.Context, spec repoSpec, cutoff time.Time, r *gcReport) {
+	cloneDir := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	if !r.DryRun {
+		if out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "prune").CombinedOutput(); err != nil {
+			r.errorf("worktree prune %s: %v: %s", cloneDir, err, strings.TrimSpace(string(out)))
+		}
+	}
+	orphan := func(branch string) bool {
+		id, ok := strings.CutPrefix(branch, "nb-")
+		if !ok {
+			return false
+		}
+		id, _, _ = strings.Cut(id, "-") // an A/B lane: nb-<id>-<idx>-<model>
+		exists, err := notebookExists(ctx, id)
+		if err != nil {
+			r.errorf("look up notebook %s: %v", id, err)
+			return false
+		}
+		return !exists
+	}
+
+	out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "list", "--porcelain").Output()
+	if err != nil {
+		r.errorf("worktree list %s: %v", cloneDir, err)
+		return
+	}
+	checkedOut := make(map[string]bool)
+	// The first entry is the clone itself.
+	for i, block := range strings.Split(string(out), "\n\n") {
+		var dir, branch string
+		for _, l := range strings.Split(block, "\n") {
+			if v, ok := strings.CutPrefix(l, "worktree "); ok {
+				dir = v
+			} else if v, ok := strings.CutPrefix(l, "branch refs/heads/"); ok {
+				branch = v
+			}
+		}
+		if i == 0 || dir == "" || branch == "" {
+			continue
+		}
+		checkedOut[branch] = true
+		if !orphan(branch) {
+			continue
+		}
+		// A notebook being created has its worktree before its row.
+		if info, err := os.Stat(dir); err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if r.removeWorktree(ctx, cloneDir, dir) {
+			delete(checkedOut, branch)
+		}
+	}
+
+	out, err = exec.CommandContext(ctx, "git", "-C", cloneDir, "for-each-ref", "--format=%(refname:short)", "refs/heads/nb-*").Output()
+	if err != nil {
+		r.errorf("list branches %s: %v", cloneDir, err)
+		return
+	}
+	for _, branch := range strings.Fields(string(out)) {
+		if checkedOut[branch] || !orphan(branch) {
+			continue
+		}
+		if !r.DryRun {
+			if out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "branch", "-D", branch).CombinedOutput(); err != nil {
+				r.errorf("delete branch %s in %s: %v: %s", branch, cloneDir, err, strings.TrimSpace(string(out)))
+				continue
+			}
+		}
+		r.DeletedBranches = append(r.DeletedBranches, spec.String()+" "+branch)
+	}
+}
+
+// collectGarbage removes worktrees idle for more than days days.
+func collectGarbage(ctx context.Context, days int, dryRun bool) (*gcReport, error) {
+	r := &gcReport{DryRun: dryRun, RemovedWorktrees: []string{}, DeletedBranches: []string{}}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	if err := gcStaleNotebooks(ctx, cutoff, r); err != nil {
+		return r, fmt.Errorf("stale notebooks: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT host, org, repo FROM clones`)
+	if err != nil {
+		return r, err
+	}
+	var specs []repoSpec
+	for rows.Next() {
+		var s repoSpec
+		if err := rows.Scan(&s.Host, &s.Org, &s.Repo); err != nil {
+			rows.Close()
+			return r, err
+		}
+		specs = append(specs, s)
+	}
+	rows.Close()
+	for _, s := range specs {
+		if pathExists(repoDirPath(s.Host, s.Org, s.Repo)) {
+			gcClone(ctx, s, cutoff, r)
+		}
+	}
+	slog.InfoContext(ctx, "gc: done", "dry_run", r.DryRun, "worktrees", len(r.RemovedWorktrees), "branches", len(r.DeletedBranches), "bytes", r.ReclaimedBytes)
+	return r, nil
+}
+
+// ensureWorktree checks the notebook's branch out again if garbage
+// collection removed its worktree.
+func ensureWorktree(ctx context.Context, meta notebookMeta) error {
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	if pathExists(dir) {
+		return nil
+	}
+	cloneDir := repoDirPath(meta.Host, meta.Org, meta.Repo)
+	_ = exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "prune").Run()
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	if out, err := addWorktree(ctx, cloneDir, dir, meta.Subdir, dir, meta.Worktree); err != nil {
+		return fmt.Errorf("restore worktree: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	slog.InfoContext(ctx, "gc: restored worktree", "dir", dir)
+	return nil
+}
+
+// runGCOnce is -gc: collect garbage and print the report.
+func runGCOnce() {
+	rep, err := collectGarbage(context.Background(), *gcDays, false)
+	if err != nil {
+		fatal("gc", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(rep)
+}
+
+// POST /admin/gc[?days=N][&dry_run=1]
+func gcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	days := *gcDays
+	if s := r.FormValue("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "bad days", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	rep, err := collectGarbage(r.Context(), days, r.FormValue("dry_run") != "")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "gcHandler", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,186 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Git credentials. HTTPS remotes on github.com use a personal access token:
+// the signed-in user's own (saved at /settings), else GITHUB_TOKEN. The
+// token is handed to git as an extra HTTP header through the environment,
+// so it never appears in a command line, remote URL or .git/config. SSH
+// remotes (git@host:org/repo.git) use the server's ssh-agent
+// (SSH_AUTH_SOCK) and keys, shared by all users.
+//
+// A clone that needed a token is marked private (trybook.private in its
+// git config); opening it again requires credentials that can still read
+// the remote, so one user's token does not expose the repo to everyone.
+
+var errNoRepoAccess = errors.New("repository not found or no access (save a GitHub token in Settings, or set GITHUB_TOKEN)")
+
+// gitEnv is the environment for git commands that talk to a remote: never
+// prompt, and fail rather than wait on ssh passphrases or unknown hosts.
+func gitEnv() []string {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if os.Getenv("GIT_SSH_COMMAND") == "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -o BatchMode=yes -o StrictHostKeyChecking=accept-new")
+	}
+	return env
+}
+
+// gitAuthEnv is gitEnv plus token as the Authorization header for
+// https://host/.
+func gitAuthEnv(host, token string) []string {
+	basic := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + token))
+	return append(gitEnv(),
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.https://"+host+"/.extraheader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+basic,
+	)
+}
+
+func userGitHubToken(ctx context.Context, user string) string {
+	if user == "" {
+		return ""
+	}
+	var t string
+	err := db.QueryRowContext(ctx, `SELECT github_token FROM users WHERE name = ?`, user).Scan(&t)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.ErrorContext(ctx, "gitauth: load token", "user", user, "err", err)
+	}
+	return t
+}
+
+// gitToken returns the token to use for host on behalf of the request's
+// user, or "".
+func gitToken(ctx context.Context, host string) string {
+	if host != defaultHost {
+		return ""
+	}
+	if t := userGitHubToken(ctx, currentUser(ctx)); t != "" {
+		return t
+	}
+	return githubToken()
+}
+
+// remoteEnv returns the environment for reaching spec's remote as the
+// request's user.
+func remoteEnv(ctx context.Context, spec repoSpec) []string {
+	if t := gitToken(ctx, spec.Host); t != "" && strings.HasPrefix(spec.CloneURL, "https://") {
+		return gitAuthEnv(spec.Host, t)
+	}
+	return gitEnv()
+}
+
+func canReadRemote(ctx context.Context, remote string, env []string) bool {
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--exit-code", remote, "HEAD")
+	cmd.Env = env
+	return cmd.Run() == nil
+}
+
+// cloneEnv decides how to clone spec: anonymously if that works, else with
+// the user's token, in which case the clone is private.
+func cloneEnv(ctx context.Context, spec repoSpec) ([]string, bool) {
+	token := gitToken(ctx, spec.Host)
+	if token == "" || !strings.HasPrefix(spec.CloneURL, "https://") || canReadRemote(ctx, spec.CloneURL, gitEnv()) {
+		return gitEnv(), false
+	}
+	return gitAuthEnv(spec.Host, token), true
+}
+
+func markClonePrivate(ctx context.Context, dir string) error {
+	return exec.CommandContext(ctx, "git", "-C", dir, "config", "trybook.private", "true").Run()
+}
+
+func isClonePrivate(ctx context.Context, dir string) bool {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "config", "--get", "--bool", "trybook.private").Output()
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// checkCloneAccess lets the request's user use an existing clone only if
+// it is public or their credentials can read the remote.
+func checkCloneAccess(ctx context.Context, spec repoSpec, dir string) error {
+	if !isClonePrivate(ctx, dir) {
+		return nil
+	}
+	if gitToken(ctx, spec.Host) == "" || !canReadRemote(ctx, spec.CloneURL, remoteEnv(ctx, spec)) {
+		return errNoRepoAccess
+	}
+	return nil
+}
+
+type settingsView struct {
+	User     string
+	HasToken bool
+	Prefs    prefsView
+	Message  string
+	MsgClass string
+}
+
+// GET, POST /settings: the GitHub token (form=token, with sign-in) and
+// the preferences (form=prefs; see prefs.go).
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r.Context())
+	cfg := currentConfig()
+	msg, class := "", ""
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if r.FormValue("form") == "prefs" {
+			p, err := prefsFromForm(cfg, r)
+			if err != nil {
+				msg, class = err.Error(), "error"
+				break
+			}
+			if err := savePrefs(r.Context(), user, p); err != nil {
+				slog.ErrorContext(r.Context(), "settingsHandler", "err", err)
+				http.Error(w, "error", http.StatusInternalServerError)
+				return
+			}
+			msg = "Preferences saved."
+			break
+		}
+		if user == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		token := strings.TrimSpace(r.FormValue("github_token"))
+		if r.FormValue("clear") != "" {
+			token = ""
+		} else if token == "" {
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+			return
+		}
+		if _, err := db.ExecContext(r.Context(), `UPDATE users SET github_token = ? WHERE name = ?`, token, user); err != nil {
+			slog.ErrorContext(r.Context(), "settingsHandler", "err", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		msg = "Saved."
+		if token == "" {
+			msg = "Token removed."
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p, err := loadPrefs(r.Context(), user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "settingsHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	v := settingsView{User: user, Prefs: newPrefsView(cfg, p), Message: msg, MsgClass: class}
+	if user != "" {
+		v.HasToken = userGitHubToken(r.Context(), user) != ""
+	}
+	setHTMLHeaders(w)
+	_ = renderPage(w, "settings", v)
+}
@@ -0,0 +1,119 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Health checks. GET /healthz and GET /readyz report, as JSON, whether the
+// database answers, the data directory has space left, and git, the
+// sandbox engine and each model's command (the router's too) are on the
+// PATH. /healthz answers 200 while the server is up, whatever the checks
+// say, so it can serve as a liveness probe; /readyz answers 503 when a
+// required check fails. A missing model command only makes the status
+// "degraded": the other models still work.
+
+// healthMinFree is the free space under -dir below which the disk check
+// fails; clones and worktrees need room.
+const healthMinFree = 500 << 20
+
+type healthCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"` // ok, missing, fail
+	Required bool   `json:"required"`
+	Path     string `json:"path,omitempty"`       // the binary found
+	Free     uint64 `json:"free_bytes,omitempty"` // the disk check's free space
+	Error    string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"` // ok, degraded, fail
+	Checks []healthCheck `json:"checks"`
+}
+
+func checkBinary(name, bin string, required bool) healthCheck {
+	c := healthCheck{Name: name, Status: "ok", Required: required}
+	p, err := exec.LookPath(bin)
+	if err != nil {
+		c.Status, c.Error = "missing", err.Error()
+		return c
+	}
+	c.Path = p
+	return c
+}
+
+// checkHealth runs every check.
+func checkHealth(ctx context.Context, cfg *config) healthReport {
+	var cs []healthCheck
+
+	dbc := healthCheck{Name: "db", Status: "ok", Required: true}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var one int
+	if err := db.QueryRowContext(ctx, `SELECT 1`).Scan(&one); err != nil {
+		dbc.Status, dbc.Error = "fail", err.Error()
+	}
+	cs = append(cs, dbc)
+
+	disk := healthCheck{Name: "disk", Status: "ok", Required: true, Path: *appDir}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(*appDir, &st); err != nil {
+		disk.Status, disk.Error = "fail", err.Error()
+	} else {
+		disk.Free = st.Bavail * uint64(st.Bsize)
+		if disk.Free < healthMinFree {
+			disk.Status, disk.Error = "fail", "less than 500 MB free"
+		}
+	}
+	cs = append(cs, disk)
+
+	cs = append(cs, checkBinary("git", "git", true))
+	if cfg.Sandbox.Engine != "" {
+		cs = append(cs, checkBinary("sandbox", cfg.Sandbox.Engine, true))
+	}
+	_, fake := currentExecer().(*fakeExecer)
+	for _, m := range append([]string{"router"}, cfg.registry.Models()...) {
+		cmd := cfg.Models[m].Command
+		if len(cmd) == 0 || cfg.sandboxImage(m) != "" || fake || (m == "router" && cfg.Routing == routingLocal) {
+			// Sandboxed commands are in the image, not on the host;
+			// -fake-exec runs none.
+			continue
+		}
+		cs = append(cs, checkBinary("model:"+m, cmd[0], false))
+	}
+
+	rep := healthReport{Status: "ok", Checks: cs}
+	for _, c := range cs {
+		switch {
+		case c.Status == "ok":
+		case c.Required:
+			rep.Status = "fail"
+		case rep.Status == "ok":
+			rep.Status = "degraded"
+		}
+	}
+	return rep
+}
+
+// GET /healthz
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, checkHealth(r.Context(), currentConfig()), false)
+}
+
+// GET /readyz
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, checkHealth(r.Context(), currentConfig()), true)
+}
+
+func writeHealth(w http.ResponseWriter, rep healthReport, ready bool) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if ready && rep.Status == "fail" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(rep)
+}
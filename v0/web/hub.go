@@ -0,0 +1,208 @@
+package web
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"trybook/runner"
+)
+
+// Per-notebook broadcast of run output and status changes over WebSocket,
+// so every tab showing a notebook stays in sync, not just the one that
+// started the run. Messages are JSON:
+//
+//	{"type":"run","idx":0,"model":"claude","run":7,"id":3,"event":"chunk","data":...}
+//	{"type":"entry","idx":1}
+//	{"type":"deleted"}
+//
+// Run events mirror the SSE stream; run identifies the attempt and id the
+// event within it, so a client can drop duplicates. A client that
+// reconnects passes what it has seen, resume=<idx>/<model>/<run>/<id>,...,
+// and is only sent the events after those; otherwise it gets each live
+// run's retained events from the start.
+
+type hubMsg struct {
+	Type  string          `json:"type"`
+	Idx   int             `json:"idx"`
+	Model string          `json:"model,omitempty"`
+	Run   int64           `json:"run,omitempty"`
+	ID    int             `json:"id,omitempty"`
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type hubClient struct {
+	send chan []byte
+	done chan struct{} // closed when the hub drops the client
+}
+
+var (
+	hubMu sync.Mutex
+	hubs  = make(map[string]map[*hubClient]struct{}) // notebook id -> clients
+)
+
+func hubJoin(nbID string) *hubClient {
+	c := &hubClient{send: make(chan []byte, 256), done: make(chan struct{})}
+	hubMu.Lock()
+	if hubs[nbID] == nil {
+		hubs[nbID] = make(map[*hubClient]struct{})
+	}
+	hubs[nbID][c] = struct{}{}
+	hubMu.Unlock()
+	return c
+}
+
+func hubLeave(nbID string, c *hubClient) {
+	hubMu.Lock()
+	hubDropLocked(nbID, c)
+	hubMu.Unlock()
+}
+
+func hubDropLocked(nbID string, c *hubClient) {
+	if _, ok := hubs[nbID][c]; !ok {
+		return
+	}
+	delete(hubs[nbID], c)
+	if len(hubs[nbID]) == 0 {
+		delete(hubs, nbID)
+	}
+	close(c.done)
+}
+
+// broadcastNotebook sends msg to every client watching nbID. A client that
+// cannot keep up is disconnected; it reconnects and gets a fresh replay.
+func broadcastNotebook(nbID string, msg hubMsg) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	hubMu.Lock()
+	defer hubMu.Unlock()
+	for c := range hubs[nbID] {
+		select {
+		case c.send <- b:
+		default:
+			slog.Warn("hub: slow client dropped", "nb", nbID)
+			hubDropLocked(nbID, c)
+		}
+	}
+}
+
+func broadcastRunEvent(lr *runner.Run, ev runner.Event) {
+	broadcastNotebook(lr.NotebookID, hubMsg{
+		Type: "run", Idx: lr.Idx, Model: lr.Model, Run: lr.Seq,
+		ID: ev.ID, Event: ev.Name, Data: json.RawMessage(ev.Data),
+	})
+}
+
+type resumePoint struct {
+	run int64
+	id  int
+}
+
+// parseResume reads a resume parameter into idx/model -> last event seen.
+func parseResume(s string) map[string]resumePoint {
+	rp := make(map[string]resumePoint)
+	for _, item := range strings.Split(s, ",") {
+		f := strings.Split(item, "/")
+		if len(f) != 4 {
+			continue
+		}
+		run, err1 := strconv.ParseInt(f[2], 10, 64)
+		id, err2 := strconv.Atoi(f[3])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		rp[f[0]+"/"+f[1]] = resumePoint{run: run, id: id}
+	}
+	return rp
+}
+
+// replayLiveRuns queues the retained events of the notebook's runs for c,
+// after the points in resume for runs the client has seen. Called after
+// hubJoin, so events emitted meanwhile may arrive twice but never go
+// missing.
+func replayLiveRuns(nbID string, c *hubClient, resume map[string]resumePoint) {
+	liveRuns.Lock()
+	var lrs []*runner.Run
+	liveRuns.Notebook(nbID, func(_ string, lr *runner.Run) {
+		lrs = append(lrs, lr)
+	})
+	liveRuns.Unlock()
+	for _, lr := range lrs {
+		after := 0
+		if p, ok := resume[strconv.Itoa(lr.Idx)+"/"+lr.Model]; ok && p.run == lr.Seq {
+			after = p.id
+		}
+		evs, missed, _, _ := lr.Since(after)
+		evs = runner.CompactChunks(evs)
+		if missed > 0 {
+			tr := runner.Truncated(missed)
+			// The ID of the last dropped event, so it sorts before the rest.
+			tr.ID = after + missed
+			evs = append([]runner.Event{tr}, evs...)
+		}
+		for _, ev := range evs {
+			b, err := json.Marshal(hubMsg{
+				Type: "run", Idx: lr.Idx, Model: lr.Model, Run: lr.Seq,
+				ID: ev.ID, Event: ev.Name, Data: json.RawMessage(ev.Data),
+			})
+			if err != nil {
+				continue
+			}
+			select {
+			case c.send <- b:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
+
+// GET /ws/notebook?nb=..
+func notebookWSHandler(w http.ResponseWriter, r *http.Request) {
+	nbID := strings.TrimSpace(r.URL.Query().Get("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if _, _, err := loadNotebook(r.Context(), nbID); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	ws, err := upgradeWS(w, r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "notebookWSHandler", "err", err)
+		return
+	}
+	defer ws.Close()
+	c := hubJoin(nbID)
+	defer hubLeave(nbID, c)
+	go replayLiveRuns(nbID, c, parseResume(r.URL.Query().Get("resume")))
+
+	readErr := make(chan error, 1)
+	go func() { readErr <- ws.readLoop() }()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case b := <-c.send:
+			if err := ws.writeText(b); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := ws.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		case <-readErr:
+			return
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Ignore rules for model context. Files matched by them are never handed
+// to a model: they cannot be attached to a prompt, the attachment picker
+// does not list them, and a model with ignore_arg in the config (aider:
+// --aiderignore) gets the rules in a file so it leaves them out of its
+// own repository map and edits. The rules are gitignore patterns, later
+// ones winning, from:
+//
+//   - builtinIgnore, for files that usually hold secrets;
+//   - "ignore" in the config, for every repository;
+//   - "ignore" under the repository in the config's "repos";
+//   - .trybookignore at the top of the worktree, kept in the repository.
+
+const ignoreFile = ".trybookignore"
+
+var builtinIgnore = []string{
+	".env", ".env.*", "*.pem", "*.key", "*.p12", "*.pfx",
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519", ".netrc", ".npmrc", ".pypirc",
+}
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules is a compiled list of gitignore patterns.
+type ignoreRules struct {
+	lines []string // as given, for ignore_arg files
+	rules []ignoreRule
+}
+
+// parseIgnore compiles gitignore lines: blank lines and # comments are
+// skipped, ! negates, a trailing / matches directories only, and a pattern
+// with a / before its end is relative to the top of the worktree, one
+// without matches at any depth.
+func parseIgnore(lines []string) (*ignoreRules, error) {
+	ir := &ignoreRules{}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := ignoreRule{}
+		p := line
+		if strings.HasPrefix(p, "!") {
+			r.negate, p = true, p[1:]
+		} else if strings.HasPrefix(p, `\`) {
+			p = p[1:] // \! or \# starts a literal pattern
+		}
+		if strings.HasSuffix(p, "/") {
+			r.dirOnly, p = true, strings.TrimRight(p, "/")
+		}
+		anchored := strings.Contains(p, "/")
+		p = strings.TrimPrefix(p, "/")
+		if p == "" {
+			continue
+		}
+		re, err := globRegexp(p, anchored)
+		if err != nil {
+			return nil, fmt.Errorf("ignore pattern %q: %w", line, err)
+		}
+		r.re = re
+		ir.lines = append(ir.lines, line)
+		ir.rules = append(ir.rules, r)
+	}
+	return ir, nil
+}
+
+// globRegexp translates a gitignore glob into a regexp over slash-separated
+// paths.
+func globRegexp(p string, anchored bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	if !anchored {
+		b.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "/**") && i+3 == len(p):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(p[i+1:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unclosed [")
+			}
+			class := p[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(p):
+			i++
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// match reports whether the last rule that matches rel decides to ignore it.
+func (ir *ignoreRules) match(rel string, dir bool) (ignored, matched bool) {
+	for _, r := range ir.rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			ignored, matched = !r.negate, true
+		}
+	}
+	return ignored, matched
+}
+
+// Ignored reports whether rel, a slash-separated path in the worktree, is
+// kept from models, by a rule for it or for a directory above it.
+func (ir *ignoreRules) Ignored(rel string) bool {
+	if ir == nil {
+		return false
+	}
+	rel = path.Clean(strings.TrimPrefix(rel, "./"))
+	// As in git, a file under an ignored directory stays ignored whatever
+	// the rules say about the file itself.
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' {
+			if ignored, _ := ir.match(rel[:i], true); ignored {
+				return true
+			}
+		}
+	}
+	ignored, _ := ir.match(rel, false)
+	return ignored
+}
+
+// filter returns the paths in rels that are not ignored.
+func (ir *ignoreRules) filter(rels []string) []string {
+	out := rels[:0:0]
+	for _, rel := range rels {
+		if !ir.Ignored(rel) {
+			out = append(out, rel)
+		}
+	}
+	return out
+}
+
+// contextIgnore returns the rules for the notebook's repository, reading
+// .trybookignore from its worktree dir. A .trybookignore that does not
+// compile is reported and its rules are left out.
+func (c *config) contextIgnore(meta notebookMeta, dir string) (*ignoreRules, error) {
+	lines := append([]string(nil), builtinIgnore...)
+	lines = append(lines, c.Ignore...)
+	lines = append(lines, c.Repos[meta.repoSpec().String()].Ignore...)
+	base, err := parseIgnore(lines)
+	if err != nil {
+		return nil, err // validate catches this for the config's own
+	}
+	b, err := os.ReadFile(filepath.Join(dir, ignoreFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return base, nil
+		}
+		return base, err
+	}
+	all, err := parseIgnore(append(lines, strings.Split(string(b), "\n")...))
+	if err != nil {
+		return base, fmt.Errorf("%s: %w", ignoreFile, err)
+	}
+	return all, nil
+}
+
+// writeIgnoreFile writes the rules where a model run in the worktree dir
+// can read them, in the worktree's git directory (shared with a sandbox,
+// and never committed), and returns its path.
+func writeIgnoreFile(ctx context.Context, dir string, ir *ignoreRules) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--absolute-git-dir").Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse --absolute-git-dir: %w", err)
+	}
+	p := filepath.Join(strings.TrimSpace(string(out)), "trybook-ignore")
+	if err := os.WriteFile(p, []byte(strings.Join(ir.lines, "\n")+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	return p, nil
+}
@@ -0,0 +1,178 @@
+package web
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"trybook/runner"
+)
+
+// Deciding an entry's intent without the router. The router costs a model
+// call per prompt, so it only runs when nothing else decides:
+//
+//   - the intent picked with the Ask/Edit toggle when the prompt was sent
+//     (source "manual");
+//   - a decision recorded earlier for the same prompt, so re-runs do not
+//     route again (editing the prompt clears it);
+//   - a prompt that plainly asks something or orders a change, by its first
+//     word (source "heuristic");
+//   - when the router cannot run, because its command (llm by default) is
+//     not installed or its API key is not set, or routing is "local" in
+//     the config: a small local classifier that always decides (source
+//     "classifier"). Notebooks keep working offline this way, and routing
+//     with a model stays an enhancement for those who set it up.
+//
+// The source is stored in notebook_entries.intent_source next to the intent.
+
+const (
+	intentRouter     = "router"
+	intentManual     = "manual"
+	intentHeuristic  = "heuristic"
+	intentClassifier = "classifier"
+)
+
+// Values of config.Routing.
+const (
+	routingAuto  = "auto"
+	routingLocal = "local"
+	routingModel = "model"
+)
+
+var (
+	questionWords = []string{"why", "how", "what", "where", "when", "which", "who", "does", "is", "are", "can", "could", "should", "explain", "describe", "summarize"}
+	editWords     = []string{"add", "fix", "rename", "refactor", "implement", "remove", "delete", "replace", "update", "change", "move", "extract", "convert", "write"}
+)
+
+// heuristicIntent guesses the intent from the prompt's first word, or
+// returns "" if it is not obvious. A question mark at the end wins over an
+// imperative verb ("add a flag?" asks).
+func heuristicIntent(prompt string) string {
+	p := strings.ToLower(strings.TrimSpace(prompt))
+	word, _, _ := strings.Cut(p, " ")
+	word = strings.TrimRight(word, ",:?!.")
+	has := func(words []string) bool {
+		for _, w := range words {
+			if word == w {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has(questionWords) || strings.HasSuffix(p, "?"):
+		return "question"
+	case has(editWords):
+		return "edit"
+	}
+	return ""
+}
+
+// intentCues are the classifier's features: patterns anywhere in the
+// prompt, weighted towards an edit (positive) or a question (negative).
+var intentCues = []struct {
+	re     *regexp.Regexp
+	weight int
+}{
+	{regexp.MustCompile(`\?\s*$`), -4},
+	{regexp.MustCompile(`\b(why|how|what|where|when|which|who|whether)\b`), -2},
+	{regexp.MustCompile(`\b(explain|describe|summari[sz]e|understand|overview|walk me through|tell me|show me|list|find|compare|meaning|purpose|difference)\b`), -2},
+	{regexp.MustCompile(`\b(is there|are there|do we|does (it|this|the)|is (it|this|the))\b`), -2},
+	{regexp.MustCompile(`\b(add|fix|rename|refactor|implement|remove|delete|replace|update|change|move|extract|convert|write|create|make|bump|upgrade|migrate|port|split|merge|introduce|support|handle|optimi[sz]e|clean up|get rid of)\b`), 2},
+	{regexp.MustCompile(`\b(please|can you|could you|would you|let's|i want|i need|we need)\b`), 1},
+	{regexp.MustCompile(`\b(bug|typo|wrong|broken|crash(es)?|fails?|failing|error|panic)\b`), 1},
+	{regexp.MustCompile(`\b(tests?|function|method|endpoint|flag|option|field|column|file)\b`), 1},
+}
+
+// classifyIntent decides between question and edit from the cues in the
+// prompt. A tie is a question: answering changes nothing in the worktree.
+func classifyIntent(prompt string) string {
+	p := strings.ToLower(prompt)
+	score := 0
+	for _, c := range intentCues {
+		score += c.weight * min(len(c.re.FindAllStringIndex(p, -1)), 2)
+	}
+	if score > 0 {
+		return "edit"
+	}
+	return "question"
+}
+
+// routerAvailable reports whether the router model can run here: its
+// command is installed (or in its sandbox image, or faked) and the API
+// keys it needs are set.
+func routerAvailable(cfg *config) bool {
+	mc := cfg.Models["router"]
+	if len(mc.Command) == 0 {
+		return false
+	}
+	_, fake := currentExecer().(*fakeExecer)
+	if cfg.sandboxImage("router") == "" && !fake {
+		if _, err := exec.LookPath(mc.Command[0]); err != nil {
+			return false
+		}
+	}
+	for _, k := range mc.Env {
+		if apiKey(k) == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// localRouting reports whether entries are classified instead of routed.
+func localRouting(cfg *config) bool {
+	switch cfg.Routing {
+	case routingLocal:
+		return true
+	case routingModel:
+		return false
+	}
+	return !routerAvailable(cfg)
+}
+
+// presetIntent returns the entry's intent and where it came from if the
+// router need not run, else "".
+func presetIntent(ctx context.Context, cfg *config, nbID string, idx int) (intent, source string, err error) {
+	var prompt string
+	err = db.QueryRowContext(ctx, `
+		SELECT prompt, intent, intent_source FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, nbID, idx).Scan(&prompt, &intent, &source)
+	if err != nil {
+		return "", "", err
+	}
+	if _, ok := cfg.Intents[intent]; ok && intent != "" {
+		if source == "" {
+			source = intentRouter // recorded before sources were
+		}
+		return intent, source, nil
+	}
+	intent, source = heuristicIntent(prompt), intentHeuristic
+	if intent == "" && localRouting(cfg) {
+		intent, source = classifyIntent(prompt), intentClassifier
+	}
+	if _, ok := cfg.Intents[intent]; !ok || intent == "" {
+		return "", "", nil
+	}
+	if err := setNotebookEntryIntent(ctx, nbID, idx, intent, source); err != nil {
+		return "", "", err
+	}
+	return intent, source, nil
+}
+
+// publishRouted stands in for a router run whose decision is already known:
+// it registers a finished live run under the router's key carrying the
+// same events, so the page and other tabs follow it like a real one. held
+// says the models wait for the user to confirm the edit (see dryrun.go).
+// The caller holds liveRuns locked.
+func publishRouted(nbID string, idx int, intent, source string, models []string, held bool) {
+	key := runner.Key(nbID, idx, "router")
+	lr := newEntryRun(func() {}, nbID, idx, "router")
+	liveRuns.Set(key, lr)
+	lr.Emit("chunk", intent+"\n")
+	lr.Emit("routed", map[string]any{"models": models, "intent": intent, "source": source, "held": held})
+	lr.Emit("done", struct{}{})
+	lr.Finish()
+	liveRuns.Retire(key, lr)
+}
@@ -0,0 +1,144 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Starting from a GitHub issue or pull request. Pasting
+// https://github.com/org/repo/issues/12 or .../pull/34 into the /try box
+// clones org/repo as for any other URL and always creates a new notebook,
+// whose prompt box starts out holding the issue's title and body, fetched
+// from the GitHub API as the user. For a pull request the worktree starts
+// at the PR's head commit (git fetch origin pull/34/head), so its changes
+// are there to try; the notebook still gets its own nb-... branch. The
+// notebook page links back to the issue.
+
+const issueBodyMax = 16 << 10 // bytes of the issue body put in the prompt
+
+// issueRef returns the issue or pull request number of a github.com web
+// path such as /org/repo/issues/12 or /org/repo/pull/34/files, or 0.
+func issueRef(host, p string) (n int, pull bool) {
+	if host != defaultHost {
+		return 0, false
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) < 4 || (parts[2] != "issues" && parts[2] != "pull") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(parts[3])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, parts[2] == "pull"
+}
+
+type githubIssue struct {
+	Number      int       `json:"number"`
+	Title       string    `json:"title"`
+	Body        string    `json:"body"`
+	HTMLURL     string    `json:"html_url"`
+	PullRequest *struct{} `json:"pull_request"` // set for pull requests
+}
+
+// fetchIssue gets spec's issue or pull request; GitHub serves both under
+// /issues.
+func fetchIssue(ctx context.Context, spec repoSpec) (githubIssue, error) {
+	var is githubIssue
+	path := fmt.Sprintf("/repos/%s/%s/issues/%d", spec.Org, spec.Repo, spec.Issue)
+	_, err := githubAPI(ctx, gitToken(ctx, spec.Host), http.MethodGet, path, nil, &is)
+	return is, err
+}
+
+// label names the issue for the notebook header, e.g. "issue #12".
+func (is githubIssue) label() string {
+	if is.PullRequest != nil {
+		return fmt.Sprintf("pull request #%d", is.Number)
+	}
+	return fmt.Sprintf("issue #%d", is.Number)
+}
+
+// draft is the first prompt for the issue: its title and body.
+func (is githubIssue) draft() string {
+	body := strings.TrimSpace(strings.ReplaceAll(is.Body, "\r\n", "\n"))
+	body = truncate(body, issueBodyMax)
+	label := is.label()
+	d := strings.ToUpper(label[:1]) + label[1:] + ": " + strings.TrimSpace(is.Title)
+	if body != "" {
+		d += "\n\n" + body
+	}
+	return d
+}
+
+// fetchPullHead fetches the head of spec's pull request into the clone as
+// refs/trybook/pull/N and returns its commit.
+func fetchPullHead(ctx context.Context, spec repoSpec) (string, error) {
+	dir := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	ref := fmt.Sprintf("refs/trybook/pull/%d", spec.Issue)
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "fetch", "--quiet", "origin", fmt.Sprintf("+pull/%d/head:%s", spec.Issue, ref))
+	cmd.Env = remoteEnv(ctx, spec)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git fetch pull/%d/head: %v\n%s", spec.Issue, err, strings.TrimSpace(string(out)))
+	}
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--verify", ref+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse %s: %w", ref, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// fillNotebookFor makes the worktree of notebook id, created by a /try of
+// spec: on the clone's HEAD, or for an issue or pull request as described
+// above. An issue GitHub will not return leaves the prompt empty; a pull
+// request whose head cannot be fetched fails.
+func fillNotebookFor(ctx context.Context, id string, spec repoSpec) error {
+	if spec.Issue == 0 {
+		return fillNotebook(ctx, id, spec, "")
+	}
+	is, err := fetchIssue(ctx, spec)
+	if err != nil {
+		slog.WarnContext(ctx, "fillNotebookFor: fetch issue", "repo", spec.String(), "issue", spec.Issue, "err", err)
+		is = githubIssue{Number: spec.Issue, HTMLURL: fmt.Sprintf("https://github.com/%s/%s/issues/%d", spec.Org, spec.Repo, spec.Issue)}
+		if spec.Pull {
+			is.PullRequest = &struct{}{}
+			is.HTMLURL = fmt.Sprintf("https://github.com/%s/%s/pull/%d", spec.Org, spec.Repo, spec.Issue)
+		}
+	}
+	var commit string
+	if is.PullRequest != nil {
+		if commit, err = fetchPullHead(ctx, spec); err != nil {
+			return err
+		}
+	}
+	if err := fillNotebook(ctx, id, spec, commit); err != nil {
+		return err
+	}
+	draft := ""
+	if is.Title != "" {
+		draft = is.draft()
+	}
+	if _, err := execDB(ctx, `UPDATE notebooks SET source_url = ?, source_label = ?, draft = ? WHERE id = ?`,
+		is.HTMLURL, is.label(), draft, id); err != nil {
+		slog.ErrorContext(ctx, "fillNotebookFor: save source", "nb", id, "err", err)
+	}
+	return nil
+}
+
+// notebookSource is the issue or pull request a notebook was started
+// from, if any, and the prompt it started with.
+type notebookSource struct {
+	URL   string
+	Label string
+	Draft string
+}
+
+func loadNotebookSource(ctx context.Context, nbID string) (notebookSource, error) {
+	var s notebookSource
+	err := db.QueryRowContext(ctx, `SELECT source_url, source_label, draft FROM notebooks WHERE id = ?`, nbID).Scan(&s.URL, &s.Label, &s.Draft)
+	return s, err
+}
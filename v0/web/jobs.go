@@ -0,0 +1,317 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"trybook/runner"
+)
+
+// Background jobs. Runs are executed by the server, not by the request that
+// asked for them: each one is recorded in the jobs table, queued, and
+// started by a dispatcher as soon as quotas.max_concurrent_runs allows.
+// Closing the tab doesn't stop anything; the page re-attaches through the
+// live run's event log (see sse.go).
+//
+// The queue is FIFO within a priority: routers first, since they are quick
+// and decide what else runs, then question models, then edits and tests.
+// Queued jobs get a "position" event whenever their place changes.
+//
+// Statuses: queued, running, done, failed, canceled, interrupted (the
+// server stopped while the job was queued or running).
+
+const jobsSchema = `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		model       TEXT NOT NULL,
+		status      TEXT NOT NULL DEFAULT 'queued',
+		error       TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		started_at  TEXT,
+		finished_at TEXT,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS jobs_status ON jobs(status);`
+
+type job struct {
+	id  int64
+	key string
+	pr  *preparedRun
+	lr  *runner.Run
+	ctx context.Context
+	// then runs after the model exits and before the done event, so
+	// follow-up jobs it enqueues are attachable by the time clients see done.
+	then func(ctx context.Context, lr *runner.Run, err error)
+	pos  int // last queue position announced
+}
+
+func jobPriority(j *job) int {
+	switch {
+	case j.pr.model == "router":
+		return 0
+	case j.pr.model == TestsModel || editsWorktree(j.pr.runner):
+		return 2
+	}
+	return 1
+}
+
+var (
+	queueMu   sync.Mutex
+	jobQueue  []*job
+	queueWake = make(chan struct{}, 1)
+)
+
+func wakeJobQueue() {
+	select {
+	case queueWake <- struct{}{}:
+	default:
+	}
+}
+
+// markInterruptedJobs closes out jobs left behind by a previous process,
+// which has no processes left running. Their runs are finished as
+// interrupted and their entries flagged (notebook_entries.interrupted), so
+// the page shows them as interrupted with a Re-run button instead of
+// thinking forever. Running the entry again clears the flag.
+func markInterruptedJobs() {
+	n, err := notebooks.MarkInterrupted(context.Background())
+	if err != nil {
+		slog.Error("jobs: mark interrupted", "err", err)
+		return
+	}
+	if n.Jobs+n.Runs+n.Entries > 0 {
+		slog.Warn("jobs: interrupted by restart", "jobs", n.Jobs, "runs", n.Runs, "entries", n.Entries)
+	}
+}
+
+func setJobStatus(id int64, status, errMsg string) {
+	if err := notebooks.SetJobStatus(context.Background(), id, status, errMsg); err != nil {
+		slog.Error("jobs: set status", "job", id, "status", status, "err", err)
+	}
+}
+
+// enqueueRun records a job for pr, registers its live run under key and
+// queues it. The caller holds liveRuns locked.
+func enqueueRun(key string, pr *preparedRun, then func(context.Context, *runner.Run, error)) (*runner.Run, error) {
+	id, err := notebooks.CreateJob(context.Background(), pr.nbID, pr.idx, pr.model)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	lr := newEntryRun(cancel, pr.nbID, pr.idx, pr.model)
+	liveRuns.Set(key, lr)
+	lr.Emit("queued", map[string]any{"model": pr.model, "idx": pr.idx, "job": id})
+	// A job canceled while queued should leave the queue right away.
+	context.AfterFunc(ctx, wakeJobQueue)
+	queueMu.Lock()
+	jobQueue = append(jobQueue, &job{id: id, key: key, pr: pr, lr: lr, ctx: ctx, then: then})
+	queueMu.Unlock()
+	wakeJobQueue()
+	return lr, nil
+}
+
+// runJobQueue starts queued jobs in order as run slots free up.
+func runJobQueue(ctx context.Context) {
+	for {
+		queueMu.Lock()
+		sort.SliceStable(jobQueue, func(a, b int) bool {
+			return jobPriority(jobQueue[a]) < jobPriority(jobQueue[b])
+		})
+		var keep []*job
+		var start []*job
+		blocked := false
+		for _, j := range jobQueue {
+			switch {
+			case j.ctx.Err() != nil:
+				go finishJob(j, "canceled", context.Canceled)
+			case blocked:
+				keep = append(keep, j)
+			case acquireRunSlot(j.pr.cfg) != nil:
+				blocked = true
+				keep = append(keep, j)
+			default:
+				start = append(start, j)
+			}
+		}
+		jobQueue = keep
+		var moved []*job
+		for i, j := range keep {
+			if j.pos != i+1 {
+				j.pos = i + 1
+				moved = append(moved, j)
+			}
+		}
+		queueMu.Unlock()
+		for _, j := range moved {
+			j.lr.Emit("position", map[string]int{"position": j.pos})
+		}
+		for _, j := range start {
+			go runJob(j)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-queueWake:
+		}
+	}
+}
+
+func runJob(j *job) {
+	defer releaseRunSlot()
+	setJobStatus(j.id, "running", "")
+	j.lr.Emit("started", map[string]any{"model": j.pr.model, "idx": j.pr.idx, "started_at": time.Now().UnixMilli()})
+	cw := &chunkWriter{lr: j.lr}
+	ew := &chunkWriter{lr: j.lr, name: "stderr"}
+	ctx := withLogAttrs(j.ctx, "job", j.id)
+	code, err := j.pr.execute(ctx, cw, ew)
+	cw.flush()
+	ew.flush()
+	if j.then != nil {
+		j.then(ctx, j.lr, err)
+	}
+	if isRunTimeout(err) && j.ctx.Err() == nil {
+		j.lr.Emit("timeout", map[string]string{"message": err.Error()})
+	}
+	if j.pr.result != nil {
+		j.lr.Emit("result", j.pr.result)
+	}
+	j.lr.Emit("exit-code", map[string]int{"code": code})
+	switch {
+	case j.ctx.Err() != nil:
+		finishJob(j, "canceled", context.Canceled)
+	case isRunTimeout(err):
+		finishJob(j, "timed_out", err)
+	case err != nil:
+		finishJob(j, "failed", err)
+	default:
+		finishJob(j, "done", nil)
+	}
+}
+
+// finishJob records the outcome and closes the live run's event log.
+func finishJob(j *job, status string, err error) {
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+		j.lr.Emit("error", map[string]string{"message": msg})
+	}
+	setJobStatus(j.id, status, msg)
+	j.lr.Emit("done", struct{}{})
+	j.lr.Finish()
+	j.lr.Cancel()
+	liveRuns.Retire(j.key, j.lr)
+}
+
+// enqueueEntry queues the router for an entry; when it finishes, the models
+// for the chosen intent are queued and announced with a "routed" event. If
+// the intent is already known (see intent.go) the router is skipped and the
+// models are queued at once. Edits the user did not choose are held for
+// confirmation instead (see dryrun.go).
+func enqueueEntry(ctx context.Context, cfg *config, nbID string, idx int) error {
+	intent, source, err := presetIntent(ctx, cfg, nbID, idx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRunNotFound, err)
+	}
+	if err := notebooks.ClearInterrupted(ctx, nbID, idx); err != nil {
+		slog.ErrorContext(ctx, "jobs: clear interrupted", "nb", nbID, "idx", idx, "err", err)
+	}
+	if intent != "" {
+		meta, _, err := loadNotebook(ctx, nbID)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errRunNotFound, err)
+		}
+		liveRuns.Lock()
+		defer liveRuns.Unlock()
+		if lr := liveRuns.Get(runner.Key(nbID, idx, "router")); lr != nil && !lr.Finished() {
+			return nil // already running
+		}
+		models := withEditModel(cfg, intentModelsFor(cfg, meta, intent), notebooks.EditModel(ctx, nbID, idx))
+		slog.InfoContext(ctx, "jobs: skipping the router", "nb", nbID, "idx", idx, "intent", intent, "source", source)
+		if holdsEdit(ctx, cfg, nbID, idx, source, models) {
+			if err := setEntryConfirm(ctx, nbID, idx, confirmPending); err != nil {
+				return err
+			}
+			publishRouted(nbID, idx, intent, source, models, true)
+			return nil
+		}
+		enqueueModels(cfg, nbID, idx, models)
+		publishRouted(nbID, idx, intent, source, models, false)
+		return nil
+	}
+	pr, err := prepareRun(ctx, cfg, nbID, idx, "router")
+	if err != nil {
+		return err
+	}
+	liveRuns.Lock()
+	defer liveRuns.Unlock()
+	key := runner.Key(nbID, idx, "router")
+	if lr := liveRuns.Get(key); lr != nil && !lr.Finished() {
+		return nil // already running
+	}
+	_, err = enqueueRun(key, pr, func(ctx context.Context, routerRun *runner.Run, _ error) {
+		// A failed router still falls back to the question models.
+		if ctx.Err() != nil {
+			return
+		}
+		models := routedModels(pr)
+		if holdsEdit(ctx, pr.cfg, nbID, idx, intentRouter, models) {
+			if err := setEntryConfirm(ctx, nbID, idx, confirmPending); err != nil {
+				slog.ErrorContext(ctx, "jobs: hold edit", "nb", nbID, "idx", idx, "err", err)
+			}
+			routerRun.Emit("routed", map[string]any{"models": models, "held": true})
+			return
+		}
+		liveRuns.Lock()
+		enqueueModels(pr.cfg, nbID, idx, models)
+		liveRuns.Unlock()
+		routerRun.Emit("routed", map[string]any{"models": models})
+	})
+	return err
+}
+
+// enqueueModels queues a run of each model for an entry. The caller holds
+// liveRuns locked.
+func enqueueModels(cfg *config, nbID string, idx int, models []string) {
+	for _, m := range models {
+		mpr, err := prepareRun(context.Background(), cfg, nbID, idx, m)
+		if err != nil {
+			slog.Error("jobs: prepare run", "nb", nbID, "idx", idx, "model", m, "err", err)
+			continue
+		}
+		if _, err := enqueueRun(runner.Key(nbID, idx, m), mpr, fallbackAfter(mpr, testsAfter(mpr))); err != nil {
+			slog.Error("jobs: enqueue", "nb", nbID, "idx", idx, "model", m, "err", err)
+		}
+	}
+}
+
+// routedModels returns the models for the intent the router just recorded.
+func routedModels(pr *preparedRun) []string {
+	intent, err := notebooks.Intent(context.Background(), pr.nbID, pr.idx)
+	if err != nil {
+		slog.Error("jobs: load intent", "nb", pr.nbID, "idx", pr.idx, "err", err)
+	}
+	if intent == "" {
+		intent = "question"
+	}
+	return withEditModel(pr.cfg, intentModelsFor(pr.cfg, pr.meta, intent), notebooks.EditModel(context.Background(), pr.nbID, pr.idx))
+}
+
+// intentModelsFor returns the models to run for intent in meta's repo,
+// questions with the models the notebook's owner prefers if they picked any.
+func intentModelsFor(cfg *config, meta notebookMeta, intent string) []string {
+	if intent == "question" {
+		if ms := ownerPrefs(context.Background(), meta.ID).questionModels(cfg); len(ms) > 0 {
+			return ms
+		}
+	}
+	if ms, ok := repoIntentModels(context.Background(), cfg, meta.Host, meta.Org, meta.Repo)[intent]; ok {
+		return ms
+	}
+	return cfg.intentModels(intent)
+}
@@ -0,0 +1,346 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"trybook/gitops"
+	"trybook/runner"
+)
+
+// A/B edits. A prompt sent with "A/B edits" runs each of its editing models
+// (aider, apply_diff models) in a worktree of its own, a lane, on branch
+// <notebook branch>-<idx>-<model> started from the notebook's HEAD. The
+// entry shows what each lane changed and the diff between two lanes'
+// results; keeping a lane (POST /api/lanes/keep) merges its branch into
+// the notebook's and removes every lane of the entry. Lane runs queue no
+// tests; keeping one does.
+
+const lanesSchema = `
+	CREATE TABLE IF NOT EXISTS entry_lanes (
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		model       TEXT NOT NULL,
+		worktree    TEXT NOT NULL,
+		base        TEXT NOT NULL,
+		status      TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, idx, model),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);`
+
+const (
+	laneOpen    = ""
+	laneKept    = "kept"
+	laneDropped = "dropped"
+)
+
+var errLaneNotFound = errors.New("no open lane for that model")
+
+type lane struct {
+	Model    string
+	Worktree string // also the branch
+	Base     string // notebook HEAD the lane started from
+	Status   string // laneOpen, laneKept or laneDropped
+}
+
+func setEntryLanes(ctx context.Context, nbID string, idx int, on bool) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE notebook_entries SET lanes = ? WHERE notebook_id = ? AND idx = ?
+	`, on, nbID, idx)
+	return err
+}
+
+// loadLanes returns idx -> lanes for a notebook, by model.
+func loadLanes(ctx context.Context, nbID string) (map[int][]lane, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT idx, model, worktree, base, status FROM entry_lanes WHERE notebook_id = ? ORDER BY idx, model
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int][]lane)
+	for rows.Next() {
+		var idx int
+		var l lane
+		if err := rows.Scan(&idx, &l.Model, &l.Worktree, &l.Base, &l.Status); err != nil {
+			return nil, err
+		}
+		out[idx] = append(out[idx], l)
+	}
+	return out, rows.Err()
+}
+
+// laneModels reports whether some intent runs two or more models that edit
+// the worktree, which is when A/B edits are worth offering.
+func laneModels(cfg *config, intents map[string][]string) bool {
+	for _, models := range intents {
+		n := 0
+		for _, m := range models {
+			if rn, ok := cfg.registry.Get(m); ok && editsWorktree(rn) {
+				n++
+			}
+		}
+		if n >= 2 {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareLane gives model its own worktree for entry idx, started from the
+// notebook's HEAD; a lane left by an earlier run is reset. It returns the
+// lane's directory.
+func prepareLane(ctx context.Context, meta notebookMeta, idx int, model string) (string, error) {
+	base, err := gitHead(ctx, worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree))
+	if err != nil {
+		return "", err
+	}
+	name := meta.Worktree + "-" + strconv.Itoa(idx) + "-" + model
+	var prev, status string
+	err = db.QueryRowContext(ctx, `
+		SELECT worktree, status FROM entry_lanes WHERE notebook_id = ? AND idx = ? AND model = ?
+	`, meta.ID, idx, model).Scan(&prev, &status)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if err == nil && status == laneOpen {
+		name = prev // the entry may have moved up since
+	}
+	cloneDir := repoDirPath(meta.Host, meta.Org, meta.Repo)
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, name)
+	if pathExists(dir) {
+		for _, args := range [][]string{{"reset", "--quiet", "--hard", base}, {"clean", "-fdq"}} {
+			if out, err := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+				return "", fmt.Errorf("reset lane %s: %v\n%s", name, err, strings.TrimSpace(string(out)))
+			}
+		}
+	} else {
+		_ = exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "prune").Run()
+		if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+			return "", err
+		}
+		if out, err := addWorktree(ctx, cloneDir, dir, meta.Subdir, "--quiet", "-B", name, dir, base); err != nil {
+			return "", fmt.Errorf("add lane %s: %v\n%s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO entry_lanes(notebook_id, idx, model, worktree, base) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(notebook_id, idx, model) DO UPDATE SET
+			worktree = excluded.worktree, base = excluded.base, status = '',
+			created_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, meta.ID, idx, model, name, base); err != nil {
+		return "", err
+	}
+	slog.InfoContext(ctx, "lanes: ready", "nb", meta.ID, "idx", idx, "model", model, "branch", name, "base", base)
+	return dir, nil
+}
+
+// removeLane deletes an open lane's worktree and branch.
+func removeLane(ctx context.Context, meta notebookMeta, l lane) error {
+	cloneDir := repoDirPath(meta.Host, meta.Org, meta.Repo)
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, l.Worktree)
+	if pathExists(dir) {
+		if out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "remove", "--force", dir).CombinedOutput(); err != nil {
+			return fmt.Errorf("remove lane %s: %v\n%s", l.Worktree, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if gitops.BranchExists(ctx, cloneDir, l.Worktree) {
+		if out, err := exec.CommandContext(ctx, "git", "-C", cloneDir, "branch", "-D", l.Worktree).CombinedOutput(); err != nil {
+			return fmt.Errorf("delete branch %s: %v\n%s", l.Worktree, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// removeOpenLanes removes the worktrees of the open lanes of entry idx, or
+// of every entry if idx < 0, for an entry or notebook being deleted.
+func removeOpenLanes(ctx context.Context, meta notebookMeta, idx int) []string {
+	lanes, err := loadLanes(ctx, meta.ID)
+	if err != nil {
+		return []string{fmt.Sprintf("load lanes: %v", err)}
+	}
+	var warnings []string
+	for i, ls := range lanes {
+		if idx >= 0 && i != idx {
+			continue
+		}
+		for _, l := range ls {
+			if l.Status != laneOpen {
+				continue
+			}
+			if err := removeLane(ctx, meta, l); err != nil {
+				slog.ErrorContext(ctx, "lanes: remove", "nb", meta.ID, "branch", l.Worktree, "err", err)
+				warnings = append(warnings, err.Error())
+			}
+		}
+	}
+	return warnings
+}
+
+// openLane returns entry idx's open lane for model.
+func openLane(ctx context.Context, nbID string, idx int, model string) (lane, error) {
+	lanes, err := loadLanes(ctx, nbID)
+	if err != nil {
+		return lane{}, err
+	}
+	for _, l := range lanes[idx] {
+		if l.Model == model && l.Status == laneOpen {
+			return l, nil
+		}
+	}
+	return lane{}, errLaneNotFound
+}
+
+// keepLane merges model's lane into the notebook's branch and removes all
+// of the entry's lanes. A merge that does not go through is aborted.
+func keepLane(ctx context.Context, meta notebookMeta, idx int, model string) error {
+	if notebookBusy(meta.ID) {
+		return errNotebookBusy
+	}
+	lanes, err := loadLanes(ctx, meta.ID)
+	if err != nil {
+		return err
+	}
+	var kept *lane
+	for i, l := range lanes[idx] {
+		if l.Model == model && l.Status == laneOpen {
+			kept = &lanes[idx][i]
+		}
+	}
+	if kept == nil {
+		return errLaneNotFound
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	cmd := exec.CommandContext(ctx, "git", append(append([]string{"-C", dir}, gitIdentity...),
+		"merge", "--no-edit", "--autostash", "-m", "Keep "+model+"'s edits for entry "+strconv.Itoa(idx+1), kept.Worktree)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = exec.CommandContext(ctx, "git", "-C", dir, "merge", "--abort").Run()
+		return &laneMergeError{fmt.Sprintf("merging %s failed and was aborted:\n%s", kept.Worktree, strings.TrimSpace(string(out)))}
+	}
+	for _, l := range lanes[idx] {
+		if l.Status != laneOpen {
+			continue
+		}
+		if err := removeLane(ctx, meta, l); err != nil {
+			slog.ErrorContext(ctx, "lanes: remove", "nb", meta.ID, "branch", l.Worktree, "err", err)
+		}
+		status := laneDropped
+		if l.Model == model {
+			status = laneKept
+		}
+		if _, err := db.ExecContext(ctx, `
+			UPDATE entry_lanes SET status = ? WHERE notebook_id = ? AND idx = ? AND model = ?
+		`, status, meta.ID, idx, l.Model); err != nil {
+			return err
+		}
+	}
+	slog.InfoContext(ctx, "lanes: kept", "nb", meta.ID, "idx", idx, "model", model)
+	return nil
+}
+
+type laneMergeError struct{ msg string }
+
+func (e *laneMergeError) Error() string { return e.msg }
+
+// POST /api/lanes/keep?nb=..&idx=..&model=..
+func keepLaneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	idx, err := strconv.Atoi(r.FormValue("idx"))
+	model := strings.TrimSpace(r.FormValue("model"))
+	if !isSafeToken(nbID) || err != nil || idx < 0 || !isSafeToken(model) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var me *laneMergeError
+	err = keepLane(r.Context(), meta, idx, model)
+	switch {
+	case errors.Is(err, errLaneNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errNotebookBusy), errors.As(err, &me):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "keepLaneHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	cfg := currentConfig()
+	if repoTestCommand(r.Context(), cfg, meta.Host, meta.Org, meta.Repo) != "" {
+		if tpr, err := prepareRun(r.Context(), cfg, nbID, idx, TestsModel); err != nil {
+			slog.ErrorContext(r.Context(), "keepLaneHandler: prepare tests", "err", err)
+		} else {
+			liveRuns.Lock()
+			if _, err := enqueueRun(runner.Key(nbID, idx, TestsModel), tpr, nil); err != nil {
+				slog.ErrorContext(r.Context(), "keepLaneHandler: enqueue tests", "err", err)
+			}
+			liveRuns.Unlock()
+		}
+	}
+	broadcastNotebook(nbID, hubMsg{Type: "entries", Idx: idx})
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// GET /api/lanes/diff?nb=..&idx=..&a=..&b=..: how lane b's result differs
+// from lane a's.
+func laneDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	nbID := strings.TrimSpace(q.Get("nb"))
+	idx, err := strconv.Atoi(q.Get("idx"))
+	if !isSafeToken(nbID) || err != nil || !isSafeToken(q.Get("a")) || !isSafeToken(q.Get("b")) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var heads [2]string
+	for i, m := range []string{q.Get("a"), q.Get("b")} {
+		l, err := openLane(r.Context(), nbID, idx, m)
+		if err != nil {
+			http.Error(w, m+": "+errLaneNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		if heads[i], err = gitHead(r.Context(), worktreeDirPath(meta.Host, meta.Org, meta.Repo, l.Worktree)); err != nil {
+			slog.ErrorContext(r.Context(), "laneDiffHandler", "err", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	}
+	res, err := gitDiff(r.Context(), worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree), heads[0], heads[1])
+	if err != nil {
+		slog.ErrorContext(r.Context(), "laneDiffHandler", "err", err)
+		http.Error(w, "diff failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
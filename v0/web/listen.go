@@ -0,0 +1,198 @@
+package web
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Listening as a service. -listen takes a TCP address (":8080",
+// "127.0.0.1:8080") or a unix socket ("unix:/run/trybook/trybook.sock"),
+// for running behind a proxy on the same host; without it the server
+// listens on port $PORT. A TCP address without a host gets -bind's,
+// 127.0.0.1 unless told otherwise, so a server nobody configured is not
+// reachable from other machines; -bind 0.0.0.0 listens on every
+// interface, and startup warns when that happens with no sign-in or
+// -allow-ips in front of it. Under systemd socket activation
+// (LISTEN_FDS) the socket systemd passes wins over both. -pidfile writes
+// the process id for init scripts, and refuses to start while the process
+// it names is still running. With NOTIFY_SOCKET set (Type=notify), systemd
+// hears when the server is ready and when it is stopping.
+
+var (
+	listenAddr = flag.String("listen", "", `address to listen on: host:port, :port (on -bind) or unix:/path/to/socket (default ":$PORT")`)
+	bindHost   = flag.String("bind", "127.0.0.1", "interface address for a -listen or $PORT without a host; 0.0.0.0 or :: for every interface")
+	listenMode = flag.String("listen-mode", "0660", "permissions of a -listen unix socket, in octal")
+	pidFile    = flag.String("pidfile", "", "write the process id to this file while running")
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes.
+const sdListenFDsStart = 3
+
+// listenAddress is what -listen or $PORT asks for, with -bind as the host
+// of a TCP address that has none.
+func listenAddress() string {
+	addr := *listenAddr
+	if addr == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		addr = ":" + port
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		return addr
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		return net.JoinHostPort(*bindHost, port)
+	}
+	return addr
+}
+
+// warnExposed warns when ln takes connections from other machines and
+// nothing but the network keeps strangers from running models.
+func warnExposed(ln net.Listener) {
+	a, ok := ln.Addr().(*net.TCPAddr)
+	if !ok || a.IP.IsLoopback() || authEnabled() {
+		return
+	}
+	if len(allowedNets) == 0 {
+		slog.Warn("listen: reachable from other machines with no sign-in and no -allow-ips; anyone who can connect can run models and change code. Use -bind 127.0.0.1, set TRYBOOK_TOKEN or GitHub sign-in, or list clients in -allow-ips", "addr", a.String())
+		return
+	}
+	slog.Warn("listen: reachable from other machines with no sign-in; only -allow-ips keeps others out", "addr", a.String(), "allow_ips", *allowIPs)
+}
+
+// listen returns the server's listener and a description of it for logs.
+func listen() (net.Listener, string, error) {
+	if ln, err := systemdListener(); ln != nil || err != nil {
+		return ln, "systemd socket", err
+	}
+	addr := listenAddress()
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		ln, err := net.Listen("tcp", addr)
+		return ln, addr, err
+	}
+	if path == "" {
+		return nil, "", fmt.Errorf("-listen unix: needs a socket path")
+	}
+	mode, err := strconv.ParseUint(*listenMode, 8, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("-listen-mode %q: %w", *listenMode, err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, "", err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, "", err
+	}
+	return ln, addr, nil
+}
+
+// removeStaleSocket removes a socket left at path by a server that did not
+// shut down, and fails if a server is still listening there.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("%s: another server is listening", path)
+	}
+	return os.Remove(path)
+}
+
+// systemdListener returns the socket systemd passed, if it passed one to
+// this process.
+func systemdListener() (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil, nil
+	}
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	// Children (model CLIs) must not think the sockets are theirs.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		slog.Warn("listen: systemd passed several sockets; using the first", "count", n)
+	}
+	syscall.CloseOnExec(sdListenFDsStart)
+	f := os.NewFile(sdListenFDsStart, "systemd-socket")
+	defer f.Close() // FileListener dups it
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket: %w", err)
+	}
+	return ln, nil
+}
+
+// sdNotify tells systemd about the service's state ("READY=1",
+// "STOPPING=1") when it runs as Type=notify; otherwise it does nothing.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // abstract namespace
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("listen: sd_notify", "err", err)
+		return
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		slog.Warn("listen: sd_notify", "err", err)
+	}
+}
+
+// writePIDFile writes the process id to -pidfile, if set, and returns a
+// func that removes it.
+func writePIDFile() (func(), error) {
+	if *pidFile == "" {
+		return func() {}, nil
+	}
+	if b, err := os.ReadFile(*pidFile); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("%s: trybook is already running as process %d", *pidFile, pid)
+		}
+	}
+	if err := os.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := os.Remove(*pidFile); err != nil {
+			slog.Warn("listen: remove pid file", "err", err)
+		}
+	}, nil
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Repositories on the server. /try also takes the path of a git repository
+// on the server's disk (/home/me/src/myproject, or file:///home/me/...),
+// for code that is not on a git host. It is cloned from file://<path> like
+// any remote, so notebooks see what is committed there and the clone
+// refresher picks up new commits; the checkout itself is never touched.
+// Such clones have the host "local" and the repository's parent directory
+// as their org (local/home/me/src/myproject). A path inside a repository
+// scopes the notebook to that directory, as a tree URL does.
+//
+// When sign-in is enabled, a repository must be under one of the
+// directories in the config's "local_repos"; without sign-in any
+// directory the server can read is allowed unless local_repos is set.
+
+const localRepoTimeout = 10 * time.Second
+
+// parseLocalRepo returns the spec for the repository at path, which is
+// absolute or a file:// URL.
+func parseLocalRepo(s string) (repoSpec, error) {
+	path := s
+	if strings.HasPrefix(s, "file://") {
+		u, err := url.Parse(s)
+		if err != nil || (u.Host != "" && u.Host != "localhost") {
+			return repoSpec{}, fmt.Errorf("invalid file URL; use file:///path/to/repo")
+		}
+		path = u.Path
+	}
+	if !filepath.IsAbs(path) {
+		return repoSpec{}, fmt.Errorf("a repository path must be absolute")
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return repoSpec{}, fmt.Errorf("%s: no such directory", path)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return repoSpec{}, fmt.Errorf("%s is not a directory", path)
+	}
+	if err := checkLocalRepoAllowed(dir); err != nil {
+		return repoSpec{}, err
+	}
+	top, err := localRepoRoot(dir)
+	if err != nil {
+		return repoSpec{}, fmt.Errorf("%s is not a git repository", path)
+	}
+	if top != dir {
+		if err := checkLocalRepoAllowed(top); err != nil {
+			return repoSpec{}, err
+		}
+	}
+	parts := strings.Split(strings.TrimPrefix(top, "/"), "/")
+	if len(parts) < 2 {
+		return repoSpec{}, fmt.Errorf("%s: a repository at the top of the filesystem cannot be opened", top)
+	}
+	for _, seg := range parts {
+		if !isSafeToken(seg) || seg == "." || seg == ".." {
+			return repoSpec{}, fmt.Errorf("%s: directory names may only have letters, digits, '-', '_' and '.'", top)
+		}
+	}
+	spec := repoSpec{
+		Host:     localHost,
+		Org:      strings.Join(parts[:len(parts)-1], "/"),
+		Repo:     strings.TrimSuffix(parts[len(parts)-1], ".git"),
+		CloneURL: "file://" + top,
+	}
+	if spec.Repo == "" || !isSafeToken(spec.Repo) {
+		return repoSpec{}, fmt.Errorf("%s: invalid repository name", top)
+	}
+	if rel, err := filepath.Rel(top, dir); err == nil && rel != "." {
+		if spec.Subdir, err = cleanSubdir(filepath.ToSlash(rel)); err != nil {
+			return repoSpec{}, err
+		}
+	}
+	return spec, nil
+}
+
+// localRepoRoot returns the top of the repository dir is in: its working
+// tree, or dir itself for a bare repository.
+func localRepoRoot(dir string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), localRepoTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--is-bare-repository").Output()
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(out)) == "true" {
+		return dir, nil
+	}
+	out, err = exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(strings.TrimSpace(string(out)))
+}
+
+// checkLocalRepoAllowed refuses directories outside local_repos.
+func checkLocalRepoAllowed(dir string) error {
+	roots := currentConfig().LocalRepos
+	if len(roots) == 0 {
+		if authEnabled() {
+			return fmt.Errorf("opening repositories on the server needs \"local_repos\" in the config")
+		}
+		return nil
+	}
+	for _, root := range roots {
+		if r, err := filepath.EvalSymlinks(root); err == nil {
+			root = r
+		}
+		if dir == root || strings.HasPrefix(dir, strings.TrimSuffix(root, "/")+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not under a directory in \"local_repos\"", dir)
+}
@@ -0,0 +1,174 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Structured logging with log/slog. Every request gets an ID (taken from
+// X-Request-ID if the client sent one, echoed back in the response) and one
+// "request" line when it ends, with its status and duration. Attributes
+// attached to a context with withLogAttrs (request_id, nb, and for runs
+// idx, model, job and run_id) are added to every record logged with it, so
+// everything that happened during one run can be found with a single grep.
+
+var (
+	logLevel = flag.String("log-level", "info", "minimum level logged: debug, info, warn or error")
+	logJSON  = flag.Bool("log-json", false, "log JSON objects, one per line, instead of key=value text")
+)
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns ctx with attrs (key-value pairs, as for slog) added
+// to the ones logged with it.
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]any)
+	return context.WithValue(ctx, logAttrsKey{}, append(prev[:len(prev):len(prev)], args...))
+}
+
+// ctxHandler adds the context's attributes to each record.
+type ctxHandler struct {
+	slog.Handler
+}
+
+func (h ctxHandler) Handle(ctx context.Context, r slog.Record) error {
+	if args, ok := ctx.Value(logAttrsKey{}).([]any); ok {
+		r.Add(args...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ctxHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ctxHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ctxHandler) WithGroup(name string) slog.Handler {
+	return ctxHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogging installs the default logger from -log-level and -log-json.
+// Output from the standard log package goes through it at level info.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("-log-level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if *logJSON {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(ctxHandler{h}))
+	return nil
+}
+
+// fatal logs an error and exits, for startup failures.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// statusRecorder remembers a response's status and size. It passes
+// Flush and Hijack through for the SSE and WebSocket handlers.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func newRequestID() string {
+	id, err := randomHex(8)
+	if err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return id
+}
+
+// logRequests wraps the whole mux: it assigns the request ID and logs each
+// request when it ends.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 || !isSafeToken(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := withLogAttrs(r.Context(), "request_id", id)
+		if nb := requestNotebookID(r); nb != "" && isSafeToken(nb) {
+			ctx = withLogAttrs(ctx, "nb", nb)
+		}
+		r = r.WithContext(ctx)
+		slog.DebugContext(ctx, "request started", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case r.URL.Path == "/healthz", r.URL.Path == "/readyz":
+			level = slog.LevelDebug
+		}
+		attrs := []any{"method", r.Method, "path", r.URL.Path, "status", rec.status, "bytes", rec.bytes, "duration", time.Since(start).Round(time.Millisecond), "remote", r.RemoteAddr}
+		if r.URL.RawQuery != "" {
+			attrs = append(attrs, "query", r.URL.RawQuery)
+		}
+		slog.Log(ctx, level, "request", attrs...)
+	})
+}
+
+// stdLogWriter lets http.Server report its own errors through slog.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	slog.Warn("http: " + strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+func serverErrorLog() *log.Logger { return log.New(stdLogWriter{}, "", 0) }
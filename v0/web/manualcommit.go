@@ -0,0 +1,202 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Committing changes made by hand. Files edited in the worktree outside a
+// run, in the terminal or with an editor on the server, stay uncommitted:
+// runs only commit what they change themselves. "Commit my changes" stages
+// everything, asks the cheap summary model for a commit message from the
+// diff (falling back to one naming the files), commits on the notebook's
+// branch and records the commit in manual_commits, so the timeline shows
+// it as the user's rather than as not from a run.
+
+const manualCommitsSchema = `
+	CREATE TABLE IF NOT EXISTS manual_commits (
+		notebook_id TEXT NOT NULL,
+		sha         TEXT NOT NULL,
+		generated   INTEGER NOT NULL DEFAULT 0, -- the message came from the model
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, sha)
+	);`
+
+const (
+	commitDiffChars  = 12000 // of the staged diff given to the model
+	commitMessageMax = 2000
+)
+
+var errNothingToCommit = errors.New("there are no uncommitted changes")
+
+type manualCommit struct {
+	SHA       string `json:"sha"`
+	Short     string `json:"short"`
+	Subject   string `json:"subject"`
+	Generated bool   `json:"generated"` // false when the message names the files instead
+}
+
+// commitManualChanges commits everything uncommitted in the notebook's
+// worktree.
+func commitManualChanges(ctx context.Context, meta notebookMeta) (manualCommit, error) {
+	if notebookBusy(meta.ID) {
+		return manualCommit{}, errNotebookBusy
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	git := func(args ...string) (string, error) {
+		out, err := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...).Output()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %w", args[0], err)
+		}
+		return string(out), nil
+	}
+	if _, err := git("add", "--all"); err != nil {
+		return manualCommit{}, err
+	}
+	names, err := git("diff", "--cached", "--name-only")
+	if err != nil {
+		return manualCommit{}, err
+	}
+	files := strings.Fields(names)
+	if len(files) == 0 {
+		return manualCommit{}, errNothingToCommit
+	}
+	stat, err := git("diff", "--cached", "--stat")
+	if err != nil {
+		return manualCommit{}, err
+	}
+	diff, err := git("diff", "--cached")
+	if err != nil {
+		return manualCommit{}, err
+	}
+
+	message, generated := fallbackCommitMessage(files), false
+	mctx, cancel := context.WithTimeout(ctx, time.Minute)
+	reply, err := askCheapModel(mctx, *summaryModel, commitMessagePrompt(stat, diff))
+	cancel()
+	if err != nil {
+		slog.WarnContext(ctx, "commitManualChanges: no message from the model", "err", err)
+	} else if m := parseCommitMessage(reply); m != "" {
+		message, generated = m, true
+	}
+
+	commit := exec.CommandContext(ctx, "git", append(append([]string{"-C", dir}, gitIdentity...), "commit", "--quiet", "-m", message)...)
+	if out, err := commit.CombinedOutput(); err != nil {
+		_ = exec.CommandContext(ctx, "git", "-C", dir, "reset", "--quiet").Run()
+		return manualCommit{}, fmt.Errorf("git commit: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	head, err := gitHead(ctx, dir)
+	if err != nil {
+		return manualCommit{}, err
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO manual_commits(notebook_id, sha, generated) VALUES (?, ?, ?)
+	`, meta.ID, head, generated); err != nil {
+		return manualCommit{}, err
+	}
+	subject, _, _ := strings.Cut(message, "\n")
+	return manualCommit{SHA: head, Short: head[:min(7, len(head))], Subject: subject, Generated: generated}, nil
+}
+
+// commitMessagePrompt asks for a commit message for the staged diff.
+func commitMessagePrompt(stat, diff string) string {
+	return strings.Join([]string{
+		"Write a git commit message for the change below.",
+		"Reply with the message only: a subject line of at most 72 characters in the imperative mood,",
+		"then, if the change needs it, a blank line and a short body. No quotes or code fences.",
+		"",
+		strings.TrimRight(stat, "\n"),
+		"",
+		truncate(diff, commitDiffChars),
+	}, "\n")
+}
+
+// parseCommitMessage tidies the model's reply into a commit message.
+func parseCommitMessage(reply string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(reply), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			continue
+		}
+		lines = append(lines, strings.TrimRight(line, " \t"))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	lines[0] = strings.Trim(strings.TrimPrefix(strings.TrimSpace(lines[0]), "Subject:"), "\"'` ")
+	if lines[0] == "" {
+		return ""
+	}
+	return truncate(strings.TrimSpace(strings.Join(lines, "\n")), commitMessageMax)
+}
+
+// fallbackCommitMessage names the changed files.
+func fallbackCommitMessage(files []string) string {
+	switch len(files) {
+	case 1:
+		return "Update " + files[0]
+	case 2:
+		return "Update " + files[0] + " and " + files[1]
+	}
+	return fmt.Sprintf("Update %s and %d other files", files[0], len(files)-1)
+}
+
+// manualCommitSHAs returns the commits made with commitManualChanges on
+// the notebook.
+func manualCommitSHAs(ctx context.Context, nbID string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT sha FROM manual_commits WHERE notebook_id = ?`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]bool)
+	for rows.Next() {
+		var sha string
+		if err := rows.Scan(&sha); err != nil {
+			return nil, err
+		}
+		out[sha] = true
+	}
+	return out, rows.Err()
+}
+
+// POST /api/commit (nb)
+func manualCommitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	c, err := commitManualChanges(ctx, meta)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "manualCommitHandler", "err", err)
+		switch {
+		case errors.Is(err, errNotebookBusy), errors.Is(err, errNothingToCommit):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, "commit failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	slog.InfoContext(r.Context(), "manualCommitHandler: committed", "nb", nbID, "sha", c.SHA, "generated", c.Generated)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(c)
+}
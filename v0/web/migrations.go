@@ -0,0 +1,398 @@
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// Schema migrations. The schema_version table records every migration
+// applied to the database; on startup the ones after the current version
+// run in order, each in its own transaction, and any error stops the
+// server. To change the schema, append a migration; never edit one that
+// has shipped.
+//
+// Databases from before this framework already have some of these columns
+// and tables, so the early migrations use IF NOT EXISTS and addColumn,
+// which skip what is already there.
+
+type migration struct {
+	name string
+	up   func(tx *sql.Tx) error
+}
+
+// migrations[i] brings the schema to version i+1.
+var migrations = []migration{
+	{"initial schema", execAll(baseSchema, feedbackSchema)},
+	{"entry intent and claude output", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "notebook_entries", "output_claude", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "notebook_entries", "intent", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"entry output heads", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "entry_outputs", "head_before", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "entry_outputs", "head_after", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"git hosts", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "notebooks", "host", `TEXT NOT NULL DEFAULT 'github.com'`); err != nil {
+			return err
+		}
+		return migrateClonesHost(tx)
+	}},
+	// Outputs used to live in per-model columns; copy them over once.
+	{"per-model outputs", execAll(`
+		INSERT OR IGNORE INTO entry_outputs(notebook_id, idx, model, output)
+		SELECT notebook_id, idx, CASE WHEN intent = 'edit' THEN 'aider' ELSE 'gemini' END, output
+		FROM notebook_entries WHERE output != '';
+		INSERT OR IGNORE INTO entry_outputs(notebook_id, idx, model, output)
+		SELECT notebook_id, idx, 'claude', output_claude
+		FROM notebook_entries WHERE output_claude != '';`)},
+	{"run history", execAll(runsSchema)},
+	{"users and notebook owners", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(authSchema); err != nil {
+			return err
+		}
+		return addColumn(tx, "notebooks", "owner", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"jobs", execAll(jobsSchema)},
+	{"pull request urls", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebooks", "pr_url", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"run stats", execAll(runStatsSchema)},
+	{"entry test results", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebook_entries", "tests", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"user github tokens", func(tx *sql.Tx) error {
+		return addColumn(tx, "users", "github_token", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"notebook environment", execAll(notebookEnvSchema)},
+	{"entry intent sources", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebook_entries", "intent_source", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"notebook forks", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "notebooks", "forked_from", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "notebooks", "forked_idx", `INTEGER NOT NULL DEFAULT -1`)
+	}},
+	{"run heads", func(tx *sql.Tx) error {
+		for _, c := range []struct{ table, column string }{
+			{"runs", "head_before"},
+			{"runs", "head_after"},
+			{"notebook_entries", "head"},
+		} {
+			if err := addColumn(tx, c.table, c.column, `TEXT NOT NULL DEFAULT ''`); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"stale entries", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebook_entries", "stale", `INTEGER NOT NULL DEFAULT 0`)
+	}},
+	{"model preferences", execAll(preferencesSchema)},
+	{"notebook summaries", func(tx *sql.Tx) error {
+		for _, c := range []string{"title", "summary", "summarized_at"} {
+			if err := addColumn(tx, "notebooks", c, `TEXT NOT NULL DEFAULT ''`); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"full-text search", execAll(ftsSchema)},
+	{"api keys", execAll(apiKeysSchema)},
+	{"run timeouts", func(tx *sql.Tx) error {
+		return addColumn(tx, "runs", "timed_out", `INTEGER NOT NULL DEFAULT 0`)
+	}},
+	{"notebook archiving", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebooks", "archived_at", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"entry attachments", execAll(attachmentsSchema)},
+	{"entry lanes", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "notebook_entries", "lanes", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+		return execAll(lanesSchema)(tx)
+	}},
+	{"entry edit model", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebook_entries", "edit_model", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"prompt metadata", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "notebook_entries", "prompt_tokens", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "notebook_entries", "prompt_lang", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return backfillPromptInfo(tx)
+	}},
+	{"interrupted runs", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "runs", "interrupted", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+		return addColumn(tx, "notebook_entries", "interrupted", `INTEGER NOT NULL DEFAULT 0`)
+	}},
+	{"repo profiles", execAll(repoProfilesSchema)},
+	{"batches", execAll(batchSchema)},
+	{"disk usage", execAll(diskUsageSchema)},
+	{"run stderr", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "runs", "stderr", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "entry_outputs", "stderr", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"notebook subdir", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebooks", "subdir", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"manual commits", execAll(manualCommitsSchema)},
+	{"prompt templates", execAll(promptTemplatesSchema)},
+	{"entry pins", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebook_entries", "pinned", `INTEGER NOT NULL DEFAULT 0`)
+	}},
+	{"pipelines", execAll(pipelinesSchema)},
+	{"notebook source", func(tx *sql.Tx) error {
+		for _, c := range []string{"source_url", "source_label", "draft"} {
+			if err := addColumn(tx, "notebooks", c, `TEXT NOT NULL DEFAULT ''`); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"model params", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "notebook_entries", "params", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "runs", "params", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"backups", execAll(backupsSchema)},
+	{"citations", execAll(citationsSchema)},
+	{"run fallbacks", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "runs", "fallback_from", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "runs", "fallback_to", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"trash", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebooks", "deleted_at", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"run results", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "runs", "result_commits", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "runs", "result_files", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "runs", "result_cost_usd", `REAL NOT NULL DEFAULT 0`)
+	}},
+	{"notebook tags", execAll(tagsSchema)},
+	{"notebook status", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "notebooks", "status", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "notebooks", "status_message", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"user prefs", execAll(prefsSchema)},
+	{"run commands", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "runs", "argv", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if err := addColumn(tx, "runs", "work_dir", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		return addColumn(tx, "runs", "env_names", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"repo maps", execAll(repoMapsSchema)},
+	{"run durations", func(tx *sql.Tx) error {
+		return addColumn(tx, "runs", "duration_ms", `INTEGER`)
+	}},
+	{"dry runs", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebook_entries", "dry_run", `INTEGER NOT NULL DEFAULT 0`)
+	}},
+	{"edit confirmation", func(tx *sql.Tx) error {
+		return addColumn(tx, "notebook_entries", "edit_confirm", `TEXT NOT NULL DEFAULT ''`)
+	}},
+	{"feedback per run", migrateFeedbackRuns},
+}
+
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, q := range stmts {
+			if _, err := tx.Exec(q); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column unless the table already has it.
+func addColumn(tx *sql.Tx, table, column, def string) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, def))
+	return err
+}
+
+func schemaVersion() (int, error) {
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version    INTEGER PRIMARY KEY,
+			name       TEXT NOT NULL,
+			applied_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now'))
+		)`); err != nil {
+		return 0, err
+	}
+	var v int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&v)
+	return v, err
+}
+
+// migrate applies the pending migrations.
+func migrate() error {
+	v, err := schemaVersion()
+	if err != nil {
+		return fmt.Errorf("schema version: %w", err)
+	}
+	if v > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this binary (%d)", v, len(migrations))
+	}
+	for i := v; i < len(migrations); i++ {
+		m := migrations[i]
+		if err := applyMigration(i+1, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", i+1, m.name, err)
+		}
+		slog.Info("db: migrated", "version", i+1, "migration", m.name)
+	}
+	return nil
+}
+
+func applyMigration(version int, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_version(version, name) VALUES(?, ?)`, version, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// baseSchema is the schema migration 1 creates.
+const baseSchema = `
+	CREATE TABLE IF NOT EXISTS clones (
+		host       TEXT NOT NULL DEFAULT 'github.com',
+		org        TEXT NOT NULL,
+		repo       TEXT NOT NULL,
+		clone_url  TEXT NOT NULL DEFAULT '',
+		branch     TEXT NOT NULL,
+		commit_sha TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		updated_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (host, org, repo)
+	);
+	CREATE TABLE IF NOT EXISTS notebooks (
+		id         TEXT PRIMARY KEY,
+		host       TEXT NOT NULL DEFAULT 'github.com',
+		org        TEXT NOT NULL,
+		repo       TEXT NOT NULL,
+		branch     TEXT NOT NULL,
+		worktree   TEXT NOT NULL,
+		commit_sha TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now'))
+	);
+	CREATE TABLE IF NOT EXISTS notebook_entries (
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		prompt      TEXT NOT NULL,
+		output      TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		updated_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, idx),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS entry_outputs (
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		model       TEXT NOT NULL,
+		output      TEXT NOT NULL DEFAULT '',
+		updated_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, idx, model),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);`
+
+// migrateClonesHost rebuilds a pre-host clones table, whose primary key was
+// (org, repo), so the same org/repo can be cloned from more than one host.
+func migrateClonesHost(tx *sql.Tx) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('clones') WHERE name = 'host'`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	for _, q := range []string{
+		`ALTER TABLE clones RENAME TO clones_old`,
+		`CREATE TABLE clones (
+			host       TEXT NOT NULL DEFAULT 'github.com',
+			org        TEXT NOT NULL,
+			repo       TEXT NOT NULL,
+			clone_url  TEXT NOT NULL DEFAULT '',
+			branch     TEXT NOT NULL,
+			commit_sha TEXT NOT NULL,
+			created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+			updated_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+			PRIMARY KEY (host, org, repo)
+		)`,
+		`INSERT INTO clones(host, org, repo, clone_url, branch, commit_sha, created_at, updated_at)
+		 SELECT 'github.com', org, repo, 'https://github.com/' || org || '/' || repo || '.git', branch, commit_sha, created_at, updated_at
+		 FROM clones_old`,
+		`DROP TABLE clones_old`,
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateFeedbackRuns rebuilds the feedback table, whose primary key was
+// (notebook_id, idx, model), to key ratings by run and record the intent
+// they were given under. Existing ratings go to the latest run of their
+// box.
+func migrateFeedbackRuns(tx *sql.Tx) error {
+	return execAll(
+		`ALTER TABLE feedback RENAME TO feedback_old`,
+		`CREATE TABLE feedback (
+			notebook_id TEXT NOT NULL,
+			idx         INTEGER NOT NULL,
+			model       TEXT NOT NULL,
+			run_id      INTEGER NOT NULL DEFAULT 0,
+			rating      INTEGER NOT NULL,
+			comment     TEXT NOT NULL DEFAULT '',
+			intent      TEXT NOT NULL DEFAULT '',
+			created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+			PRIMARY KEY (notebook_id, idx, model, run_id),
+			FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+		)`,
+		`INSERT INTO feedback(notebook_id, idx, model, run_id, rating, comment, intent, created_at)
+		SELECT f.notebook_id, f.idx, f.model,
+			COALESCE((SELECT MAX(r.id) FROM runs r WHERE r.notebook_id = f.notebook_id AND r.idx = f.idx AND r.model = f.model), 0),
+			f.rating, f.comment,
+			COALESCE((SELECT e.intent FROM notebook_entries e WHERE e.notebook_id = f.notebook_id AND e.idx = f.idx), ''),
+			f.created_at
+		FROM feedback_old f`,
+		`DROP TABLE feedback_old`,
+	)(tx)
+}
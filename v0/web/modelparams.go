@@ -0,0 +1,283 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"trybook/runner"
+)
+
+// Per-run model parameters. "params" on a model in the config names the
+// options the prompt form offers for each run, such as which model claude
+// or gemini uses, aider's editor model or a temperature:
+//
+//	"params": {
+//	  "model":       {"arg": "--model", "choices": ["sonnet", "opus"]},
+//	  "temperature": {"arg": "-o temperature", "min": 0, "max": 2}
+//	}
+//
+// A value picked replaces the one after arg in the command, or is added at
+// the end of it. The values are stored with the entry
+// (notebook_entries.params) so re-runs use them, and each run records the
+// values it ran with, those the command sets itself included (runs.params),
+// so an output can be reproduced.
+
+// paramConfig is one per-run option of a model.
+type paramConfig struct {
+	// Arg is the option the value follows, e.g. "--model"; several words
+	// ("-o temperature") are separate arguments.
+	Arg string `json:"arg"`
+	// Choices are the values offered. Without them the value is a number,
+	// between Min and Max if they are set.
+	Choices []string `json:"choices,omitempty"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+}
+
+func (pc paramConfig) validate() error {
+	if len(strings.Fields(pc.Arg)) == 0 {
+		return fmt.Errorf("empty arg")
+	}
+	for _, c := range pc.Choices {
+		if strings.TrimSpace(c) == "" || strings.Contains(c, "{prompt}") {
+			return fmt.Errorf("invalid choice %q", c)
+		}
+	}
+	if pc.Min != nil && pc.Max != nil && *pc.Min > *pc.Max {
+		return fmt.Errorf("min is above max")
+	}
+	return nil
+}
+
+// check reports whether v is a value the parameter accepts.
+func (pc paramConfig) check(v string) error {
+	if len(pc.Choices) > 0 {
+		for _, c := range pc.Choices {
+			if v == c {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(pc.Choices, ", "))
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("%q is not a number", v)
+	}
+	if pc.Min != nil && f < *pc.Min || pc.Max != nil && f > *pc.Max {
+		return fmt.Errorf("%s is out of range", v)
+	}
+	return nil
+}
+
+func floatPtr(f float64) *float64 { return &f }
+
+// modelParams holds the values picked for an entry: model -> name -> value.
+type modelParams map[string]map[string]string
+
+// paramsFromForm reads the prompt form's param.<model>.<name> fields; empty
+// ones keep the command's default.
+func paramsFromForm(cfg *config, r *http.Request) (modelParams, error) {
+	p := modelParams{}
+	for key, vs := range r.Form {
+		rest, ok := strings.CutPrefix(key, "param.")
+		if !ok || len(vs) == 0 || strings.TrimSpace(vs[0]) == "" {
+			continue
+		}
+		dot := strings.LastIndex(rest, ".") // model names may have dots, parameter names not
+		if dot < 0 {
+			return nil, fmt.Errorf("bad parameter %q", key)
+		}
+		model, name := rest[:dot], rest[dot+1:]
+		pc, ok := cfg.Models[model].Params[name]
+		if !ok {
+			return nil, fmt.Errorf("%s has no parameter %q", model, name)
+		}
+		v := strings.TrimSpace(vs[0])
+		if err := pc.check(v); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", model, name, err)
+		}
+		if p[model] == nil {
+			p[model] = map[string]string{}
+		}
+		p[model][name] = v
+	}
+	return p, nil
+}
+
+func setEntryParams(ctx context.Context, nbID string, idx int, p modelParams) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = execDB(ctx, `
+		UPDATE notebook_entries SET params = ? WHERE notebook_id = ? AND idx = ?
+	`, string(b), nbID, idx)
+	return err
+}
+
+// entryParams returns the values picked for model on an entry. Values the
+// config no longer accepts are left out.
+func entryParams(ctx context.Context, cfg *config, nbID string, idx int, model string) map[string]string {
+	var s string
+	_ = db.QueryRowContext(ctx, `
+		SELECT params FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, nbID, idx).Scan(&s)
+	var p modelParams
+	if s == "" || json.Unmarshal([]byte(s), &p) != nil {
+		return nil
+	}
+	out := map[string]string{}
+	for name, v := range p[model] {
+		if pc, ok := cfg.Models[model].Params[name]; ok && pc.check(v) == nil {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+// argIndex returns where the words of opt start in argv, or -1.
+func argIndex(argv, opt []string) int {
+	for i := 0; i+len(opt) <= len(argv); i++ {
+		match := true
+		for j, w := range opt {
+			if argv[i+j] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+// commandValue returns the value after arg in cmd, or "".
+func commandValue(cmd []string, arg string) string {
+	opt := strings.Fields(arg)
+	if i := argIndex(cmd, opt); i >= 0 && i+len(opt) < len(cmd) && !strings.Contains(cmd[i+len(opt)], "{prompt}") {
+		return cmd[i+len(opt)]
+	}
+	return ""
+}
+
+// applyParams returns cmd with the values set: each replaces the value
+// after its option, or is added at the end with it.
+func applyParams(cmd []string, params map[string]paramConfig, vals map[string]string) []string {
+	out := append([]string(nil), cmd...)
+	names := make([]string, 0, len(vals))
+	for name := range vals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pc, ok := params[name]
+		if !ok || vals[name] == "" {
+			continue
+		}
+		opt := strings.Fields(pc.Arg)
+		if i := argIndex(out, opt); i >= 0 && i+len(opt) < len(out) && !strings.Contains(out[i+len(opt)], "{prompt}") {
+			out[i+len(opt)] = vals[name]
+		} else {
+			out = append(append(out, opt...), vals[name])
+		}
+	}
+	return out
+}
+
+// paramRunner is implemented by runners with per-run parameters.
+type paramRunner interface {
+	// WithParams returns the runner with the values set on its command.
+	WithParams(vals map[string]string) runner.Runner
+	// ParamValues returns the value of each parameter its command sets.
+	ParamValues() map[string]string
+}
+
+func withParams(rn runner.Runner, vals map[string]string) runner.Runner {
+	if p, ok := rn.(paramRunner); ok && len(vals) > 0 {
+		return p.WithParams(vals)
+	}
+	return rn
+}
+
+func paramValues(rn runner.Runner) map[string]string {
+	if p, ok := rn.(paramRunner); ok {
+		return p.ParamValues()
+	}
+	return nil
+}
+
+// formatParams shows values as "model=opus temperature=0.2".
+func formatParams(vals map[string]string) string {
+	parts := make([]string, 0, len(vals))
+	for name, v := range vals {
+		parts = append(parts, name+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func recordRunParams(ctx context.Context, runID int64, vals map[string]string) error {
+	if runID == 0 || len(vals) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(vals)
+	if err != nil {
+		return err
+	}
+	_, err = execDB(ctx, `UPDATE runs SET params = ? WHERE id = ?`, string(b), runID)
+	return err
+}
+
+// paramField is a parameter in the prompt form's "Model options".
+type paramField struct {
+	Model, Name string
+	Default     string // what the command sets, if anything
+	Choices     []string
+	Min, Max    *float64
+}
+
+// paramFields returns the parameters of models, in their order.
+func paramFields(cfg *config, models []string) []paramField {
+	var out []paramField
+	for _, m := range models {
+		mc := cfg.Models[m]
+		names := make([]string, 0, len(mc.Params))
+		for name := range mc.Params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pc := mc.Params[name]
+			out = append(out, paramField{Model: m, Name: name, Default: commandValue(mc.Command, pc.Arg), Choices: pc.Choices, Min: pc.Min, Max: pc.Max})
+		}
+	}
+	return out
+}
+
+// formModels returns the models a prompt on the notebook can run, in
+// display order: those of its intents and the installed edit tools.
+func formModels(cfg *config, intents map[string][]string) []string {
+	use := map[string]bool{}
+	for _, ms := range intents {
+		for _, m := range ms {
+			use[m] = true
+		}
+	}
+	for _, t := range editTools(cfg) {
+		use[t.Name] = use[t.Name] || t.Installed
+	}
+	var out []string
+	for _, m := range cfg.registry.Models() {
+		if use[m] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
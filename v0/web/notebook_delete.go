@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"trybook/runner"
+)
+
+// Purging a notebook removes its worktree and branch from the clone and
+// its rows from the database. If the worktree cannot be removed the
+// notebook is kept so the purge can be retried. Deleting a notebook from
+// the index only moves it to the trash (trash.go), which purges it later.
+
+var errNotebookNotFound = errors.New("notebook not found")
+
+// loadNotebookMeta is loadNotebook without the entries, and finds notebooks
+// in the trash too.
+func loadNotebookMeta(ctx context.Context, id string) (notebookMeta, error) {
+	var m notebookMeta
+	err := db.QueryRowContext(ctx, `
+		SELECT id, host, org, repo, branch, worktree, commit_sha, subdir, status, status_message
+		FROM notebooks WHERE id = ?
+	`, id).Scan(&m.ID, &m.Host, &m.Org, &m.Repo, &m.Branch, &m.Worktree, &m.SHA, &m.Subdir, &m.Status, &m.StatusMessage)
+	return m, err
+}
+
+func purgeNotebook(ctx context.Context, id string) ([]string, error) {
+	meta, err := loadNotebookMeta(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotebookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	stopPipelines(id)
+	cancelLiveRuns(id)
+	cancelClone(id)
+
+	warnings := removeOpenLanes(ctx, meta, -1)
+	cloneDir := repoDirPath(meta.Host, meta.Org, meta.Repo)
+	wtDir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	if pathExists(wtDir) {
+		cmd := exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "remove", "--force", wtDir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("remove worktree %s: %v\n%s", wtDir, err, strings.TrimSpace(string(out)))
+		}
+	} else {
+		warnings = append(warnings, "worktree directory was already gone: "+wtDir)
+		cmd := exec.CommandContext(ctx, "git", "-C", cloneDir, "worktree", "prune")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			warnings = append(warnings, fmt.Sprintf("git worktree prune: %v: %s", err, strings.TrimSpace(string(out))))
+		}
+	}
+	cmd := exec.CommandContext(ctx, "git", "-C", cloneDir, "branch", "-D", meta.Worktree)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		warnings = append(warnings, fmt.Sprintf("delete branch %s: %v: %s", meta.Worktree, err, strings.TrimSpace(string(out))))
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return warnings, err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		`DELETE FROM feedback WHERE notebook_id = ?`,
+		`DELETE FROM preferences WHERE notebook_id = ?`,
+		`DELETE FROM attachments WHERE notebook_id = ?`,
+		`DELETE FROM entry_lanes WHERE notebook_id = ?`,
+		`DELETE FROM runs WHERE notebook_id = ?`,
+		`DELETE FROM jobs WHERE notebook_id = ?`,
+		`DELETE FROM run_stats WHERE notebook_id = ?`,
+		`DELETE FROM entry_outputs WHERE notebook_id = ?`,
+		`DELETE FROM citations WHERE notebook_id = ?`,
+		`DELETE FROM notebook_env WHERE notebook_id = ?`,
+		`DELETE FROM notebook_tags WHERE notebook_id = ?`,
+		`DELETE FROM pipeline_steps WHERE pipeline_id IN (SELECT id FROM pipelines WHERE notebook_id = ?)`,
+		`DELETE FROM pipelines WHERE notebook_id = ?`,
+		`DELETE FROM notebook_entries WHERE notebook_id = ?`,
+		`DELETE FROM notebooks WHERE id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, id); err != nil {
+			return warnings, fmt.Errorf("delete rows: %w", err)
+		}
+	}
+	return warnings, tx.Commit()
+}
+
+// cancelLiveRuns stops any server-side runs for the notebook.
+func cancelLiveRuns(nbID string) {
+	liveRuns.Lock()
+	defer liveRuns.Unlock()
+	liveRuns.Notebook(nbID, func(_ string, lr *runner.Run) {
+		lr.Cancel()
+	})
+}
+
+// DELETE /n/{id} moves the notebook to the trash.
+func deleteNotebookHandler(w http.ResponseWriter, r *http.Request, id string) {
+	err := trashNotebook(r.Context(), id)
+	if errors.Is(err, errNotebookNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleteNotebookHandler", "err", err)
+		http.Error(w, "delete failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "deleteNotebookHandler: moved to the trash", "nb", id)
+	broadcastNotebook(id, hubMsg{Type: "deleted"})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"deleted": id, "trashed": true, "purge_at": time.Now().Add(trashRetention()).UTC().Format(time.RFC3339)})
+}
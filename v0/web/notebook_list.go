@@ -0,0 +1,205 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The index page's notebook list. Old experiments can be archived, which
+// only hides them: POST /api/archive?nb=..&archived=1 (0 restores) sets
+// notebooks.archived_at. The index lists the active notebooks, or with
+// ?archived=1 the archived ones, notebooksPerPage at a time (?page=N).
+// Archived notebooks still open, run and turn up in search.
+
+const (
+	notebooksPerPage = 50
+	APINotebooksMax  = 1000 // largest /api/notebooks?limit=
+)
+
+// countNotebooks returns how many active and archived notebooks user sees,
+// of those tagged tag unless it is "", and how many are in their trash.
+func countNotebooks(ctx context.Context, user, tag string) (active, archived, trashed int, err error) {
+	err = db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(deleted_at = '' AND archived_at = '' AND tagged), 0),
+			COALESCE(SUM(deleted_at = '' AND archived_at != '' AND tagged), 0),
+			COALESCE(SUM(deleted_at != ''), 0)
+		FROM (
+			SELECT deleted_at, archived_at,
+				?2 = '' OR id IN (SELECT notebook_id FROM notebook_tags WHERE tag = ?2) AS tagged
+			FROM notebooks
+			WHERE ?1 = '' OR owner = '' OR owner = ?1
+		)
+	`, user, tag).Scan(&active, &archived, &trashed)
+	return active, archived, trashed, err
+}
+
+func setNotebookArchived(ctx context.Context, id string, archived bool) error {
+	res, err := db.ExecContext(ctx, `
+		UPDATE notebooks SET archived_at = CASE WHEN ? THEN strftime('%Y-%m-%dT%H:%M:%SZ','now') ELSE '' END
+		WHERE id = ?
+	`, archived, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotebookNotFound
+	}
+	return nil
+}
+
+// notebookListPage describes the page of the list the index shows.
+type notebookListPage struct {
+	Archived         bool   // listing the archived notebooks
+	Tag              string // listing only the notebooks with this tag
+	Tags             []tagCount
+	ActiveCount      int
+	ArchivedCount    int
+	TrashCount       int
+	Page, Pages      int
+	First, Last      int // 1-based positions of the notebooks shown
+	Total            int // in the list being shown
+	PrevURL, NextURL string
+}
+
+func notebookListURL(archived bool, tag string, page int) string {
+	v := url.Values{}
+	if archived {
+		v.Set("archived", "1")
+	}
+	if tag != "" {
+		v.Set("tag", tag)
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	if len(v) == 0 {
+		return "/"
+	}
+	return "/?" + v.Encode()
+}
+
+// loadNotebookPage returns page (1-based, clamped) of user's active or
+// archived notebooks, those tagged tag if it is not "".
+func loadNotebookPage(ctx context.Context, user string, archived bool, tag string, page int) ([]nbListItem, notebookListPage, error) {
+	p := notebookListPage{Archived: archived, Tag: tag}
+	var err error
+	if p.ActiveCount, p.ArchivedCount, p.TrashCount, err = countNotebooks(ctx, user, tag); err != nil {
+		return nil, p, err
+	}
+	if p.Tags, err = userTags(ctx, user); err != nil {
+		return nil, p, err
+	}
+	p.Total = p.ActiveCount
+	if archived {
+		p.Total = p.ArchivedCount
+	}
+	p.Pages = max(1, (p.Total+notebooksPerPage-1)/notebooksPerPage)
+	p.Page = min(max(page, 1), p.Pages)
+	offset := (p.Page - 1) * notebooksPerPage
+	nbs, err := listNotebooks(ctx, user, archived, tag, offset, notebooksPerPage)
+	if err != nil {
+		return nil, p, err
+	}
+	if len(nbs) > 0 {
+		p.First, p.Last = offset+1, offset+len(nbs)
+	}
+	if p.Page > 1 {
+		p.PrevURL = notebookListURL(archived, tag, p.Page-1)
+	}
+	if p.Page < p.Pages {
+		p.NextURL = notebookListURL(archived, tag, p.Page+1)
+	}
+	return nbs, p, nil
+}
+
+// POST /api/archive?nb=..&archived=1|0
+func archiveNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	archived := r.FormValue("archived") != "0"
+	err := setNotebookArchived(r.Context(), nbID, archived)
+	if errors.Is(err, errNotebookNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "archiveNotebookHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "archiveNotebookHandler", "nb", nbID, "archived", archived)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// APINotebook is one row of GET /api/notebooks.
+type APINotebook struct {
+	ID        string   `json:"id"`
+	Repo      string   `json:"repo"`
+	Branch    string   `json:"branch"`
+	Commit    string   `json:"commit"`
+	CreatedAt string   `json:"created_at"`
+	Title     string   `json:"title,omitempty"`
+	Summary   string   `json:"summary,omitempty"`
+	Tags      []string `json:"tags"`
+	Status    string   `json:"status,omitempty"`
+	StatusMsg string   `json:"status_message,omitempty"`
+}
+
+// GET /api/notebooks[?archived=1&tag=T&offset=N&limit=N]: the notebooks the
+// index page lists, newest first, 100 unless limit says otherwise.
+// X-Total-Count is the size of the whole list.
+func notebooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	archived := q.Get("archived") == "1"
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	limit, offset = min(limit, APINotebooksMax), max(offset, 0)
+	tag := q.Get("tag")
+	active, archivedCount, _, err := countNotebooks(r.Context(), currentUser(r.Context()), tag)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "notebooksHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	total := active
+	if archived {
+		total = archivedCount
+	}
+	nbs, err := listNotebooks(r.Context(), currentUser(r.Context()), archived, tag, offset, limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "notebooksHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	out := make([]APINotebook, 0, len(nbs))
+	for _, nb := range nbs {
+		if nb.Tags == nil {
+			nb.Tags = []string{}
+		}
+		out = append(out, APINotebook{ID: nb.ID, Repo: repoSpec{Host: nb.Host, Org: nb.Org, Repo: nb.Repo}.String(), Branch: nb.Branch, Commit: nb.CommitShort, CreatedAt: nb.CreatedAt, Title: nb.Title, Summary: nb.Summary, Tags: nb.Tags, Status: nb.Status, StatusMsg: nb.StatusMessage})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,272 @@
+package web
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Per-notebook environment variables, edited at /n/{id}/settings and added
+// to the environment of the notebook's model and test commands (over the
+// server's own). Secret values are encrypted with AES-GCM before they are
+// stored; the key comes from TRYBOOK_SECRET_KEY, else from secret.key in
+// the data directory, which is created on first use. Secrets are never
+// shown again once saved.
+
+const notebookEnvSchema = `
+	CREATE TABLE IF NOT EXISTS notebook_env (
+		notebook_id TEXT NOT NULL,
+		name        TEXT NOT NULL,
+		value       TEXT NOT NULL,
+		secret      INTEGER NOT NULL DEFAULT 0,
+		updated_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, name),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);`
+
+var envNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sealedPrefix marks an encrypted value, so the format can change later.
+const sealedPrefix = "v1:"
+
+var (
+	secretKeyOnce sync.Once
+	secretKeyAEAD cipher.AEAD
+	secretKeyErr  error
+)
+
+func secretKeyPath() string { return filepath.Join(*appDir, "secret.key") }
+
+// loadSecretKey returns the key for notebook secrets, creating the key file
+// if there is neither one nor TRYBOOK_SECRET_KEY.
+func loadSecretKey() ([]byte, error) {
+	if s := os.Getenv("TRYBOOK_SECRET_KEY"); s != "" {
+		sum := sha256.Sum256([]byte(s))
+		return sum[:], nil
+	}
+	key, err := os.ReadFile(secretKeyPath())
+	if err == nil {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%s: want 32 bytes, have %d", secretKeyPath(), len(key))
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	// O_EXCL: a concurrent first use must not replace a key already in use.
+	f, err := os.OpenFile(secretKeyPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return nil, err
+	}
+	slog.Warn("notebook env: created a secret key; back it up with the database, secrets cannot be read without it", "path", secretKeyPath())
+	return key, f.Close()
+}
+
+func secretAEAD() (cipher.AEAD, error) {
+	secretKeyOnce.Do(func() {
+		key, err := loadSecretKey()
+		if err != nil {
+			secretKeyErr = err
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			secretKeyErr = err
+			return
+		}
+		secretKeyAEAD, secretKeyErr = cipher.NewGCM(block)
+	})
+	return secretKeyAEAD, secretKeyErr
+}
+
+// sealSecret encrypts value; the notebook and name are authenticated too,
+// so a stored secret cannot be moved to another variable.
+func sealSecret(nbID, name, value string) (string, error) {
+	aead, err := secretAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(nbID+"/"+name))
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openSecret(nbID, name, stored string) (string, error) {
+	aead, err := secretAEAD()
+	if err != nil {
+		return "", err
+	}
+	enc, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return "", errors.New("unknown secret format")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed secret")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(nbID+"/"+name))
+	if err != nil {
+		return "", errors.New("cannot decrypt (wrong secret key?)")
+	}
+	return string(plain), nil
+}
+
+type envVar struct {
+	Name   string
+	Value  string // "" for secrets
+	Secret bool
+}
+
+// listNotebookEnv returns the notebook's variables without secret values.
+func listNotebookEnv(ctx context.Context, nbID string) ([]envVar, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT name, value, secret FROM notebook_env WHERE notebook_id = ? ORDER BY name
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var vars []envVar
+	for rows.Next() {
+		var v envVar
+		if err := rows.Scan(&v.Name, &v.Value, &v.Secret); err != nil {
+			return nil, err
+		}
+		if v.Secret {
+			v.Value = ""
+		}
+		vars = append(vars, v)
+	}
+	return vars, rows.Err()
+}
+
+// notebookEnv returns the notebook's variables as NAME=value pairs, with
+// secrets decrypted, for a command's environment.
+func notebookEnv(ctx context.Context, nbID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT name, value, secret FROM notebook_env WHERE notebook_id = ? ORDER BY name
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var env []string
+	for rows.Next() {
+		var name, value string
+		var secret bool
+		if err := rows.Scan(&name, &value, &secret); err != nil {
+			return nil, err
+		}
+		if secret {
+			if value, err = openSecret(nbID, name, value); err != nil {
+				return nil, fmt.Errorf("secret %s: %w", name, err)
+			}
+		}
+		env = append(env, name+"="+value)
+	}
+	return env, rows.Err()
+}
+
+func setNotebookEnv(ctx context.Context, nbID, name, value string, secret bool) error {
+	if secret {
+		var err error
+		if value, err = sealSecret(nbID, name, value); err != nil {
+			return err
+		}
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO notebook_env(notebook_id, name, value, secret) VALUES (?, ?, ?, ?)
+		ON CONFLICT(notebook_id, name) DO UPDATE SET
+			value = excluded.value,
+			secret = excluded.secret,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, nbID, name, value, secret)
+	return err
+}
+
+type notebookSettingsView struct {
+	NotebookID string
+	Org, Repo  string
+	Vars       []envVar
+	Message    string
+}
+
+// GET, POST /n/{id}/settings
+func notebookSettingsHandler(w http.ResponseWriter, r *http.Request, nbID string) {
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var org, repo string
+	if err := db.QueryRowContext(r.Context(), `SELECT org, repo FROM notebooks WHERE id = ?`, nbID).Scan(&org, &repo); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	msg := ""
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		name := strings.TrimSpace(r.FormValue("name"))
+		if !envNameRE.MatchString(name) {
+			http.Error(w, "bad variable name", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch r.FormValue("action") {
+		case "set":
+			value := r.FormValue("value")
+			if strings.ContainsRune(value, 0) {
+				http.Error(w, "bad value", http.StatusBadRequest)
+				return
+			}
+			err = setNotebookEnv(r.Context(), nbID, name, value, r.FormValue("secret") != "")
+			msg = name + " saved."
+		case "delete":
+			_, err = db.ExecContext(r.Context(), `DELETE FROM notebook_env WHERE notebook_id = ? AND name = ?`, nbID, name)
+			msg = name + " removed."
+		default:
+			http.Error(w, "bad action", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "notebookSettingsHandler", "err", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	vars, err := listNotebookEnv(r.Context(), nbID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "notebookSettingsHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	setHTMLHeaders(w)
+	_ = renderPage(w, "notebook-settings", notebookSettingsView{NotebookID: nbID, Org: org, Repo: repo, Vars: vars, Message: msg})
+}
@@ -0,0 +1,180 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Run notifications. When a model run finishes (run.done), fails
+// (run.error) or times out (run.timeout), every webhook that wants the
+// event gets a JSON POST describing the run. With notify.ntfy_url set, the
+// event also goes to that ntfy topic, which the ntfy apps turn into a
+// desktop or phone notification; notify.min_seconds keeps quick answers
+// from pinging. notify.base_url makes links back to the notebook.
+
+type webhookConfig struct {
+	URL string `json:"url"`
+	// Events filters which events are delivered; empty means all.
+	Events []string `json:"events,omitempty"`
+}
+
+type notifyConfig struct {
+	// NtfyURL is an ntfy topic, e.g. https://ntfy.sh/my-trybook-runs.
+	NtfyURL string `json:"ntfy_url,omitempty"`
+	// NtfyTokenEnv names the variable (or saved API key) holding an ntfy
+	// access token, for protected topics.
+	NtfyTokenEnv string `json:"ntfy_token_env,omitempty"`
+	// Events filters what goes to ntfy; empty means all.
+	Events []string `json:"events,omitempty"`
+	// MinSeconds skips ntfy for runs shorter than this.
+	MinSeconds int `json:"min_seconds,omitempty"`
+	// BaseURL is where trybook is reached, e.g. https://try.example.com;
+	// it makes the notebook links in webhooks and notifications.
+	BaseURL string `json:"base_url,omitempty"`
+}
+
+func (n notifyConfig) validate() error {
+	for _, u := range []string{n.NtfyURL, n.BaseURL} {
+		if u == "" {
+			continue
+		}
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("invalid URL %q", u)
+		}
+	}
+	if n.MinSeconds < 0 {
+		return fmt.Errorf("min_seconds must be >= 0")
+	}
+	return nil
+}
+
+type runEvent struct {
+	Event      string `json:"event"` // run.done, run.error, run.timeout
+	NotebookID string `json:"notebook_id"`
+	Idx        int    `json:"idx"`
+	Model      string `json:"model"`
+	RunID      int64  `json:"run_id,omitempty"`
+	Repo       string `json:"repo,omitempty"`
+	Prompt     string `json:"prompt,omitempty"` // the first 200 characters
+	ExitCode   int    `json:"exit_code"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	// Duration is how long the run took, in seconds.
+	Duration float64 `json:"duration_seconds"`
+	URL      string  `json:"url,omitempty"` // the notebook, with notify.base_url
+	Error    string  `json:"error,omitempty"`
+	Time     string  `json:"time"`
+
+	started time.Time
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (c *config) notify(ev runEvent) {
+	ev.Time = time.Now().UTC().Format(time.RFC3339)
+	if !ev.started.IsZero() {
+		ev.Duration = math.Round(time.Since(ev.started).Seconds()*10) / 10
+	}
+	if p := entryPrompt(ev.NotebookID, ev.Idx); len([]rune(p)) > 200 {
+		ev.Prompt = string([]rune(p)[:200])
+	} else {
+		ev.Prompt = p
+	}
+	if c.Notify.BaseURL != "" {
+		ev.URL = fmt.Sprintf("%s/n/%s#entry-%d", strings.TrimSuffix(c.Notify.BaseURL, "/"), ev.NotebookID, ev.Idx)
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	for _, wh := range c.Webhooks {
+		if !wantsEvent(wh.Events, ev.Event) {
+			continue
+		}
+		go func(u string) {
+			resp, err := webhookClient.Post(u, "application/json", bytes.NewReader(body))
+			if err != nil {
+				slog.Warn("webhook: post failed", "url", u, "err", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				slog.Warn("webhook: post failed", "url", u, "status", resp.Status)
+			}
+		}(wh.URL)
+	}
+	n := c.Notify
+	if n.NtfyURL != "" && wantsEvent(n.Events, ev.Event) && ev.Duration >= float64(n.MinSeconds) {
+		go sendNtfy(n, ev)
+	}
+}
+
+func wantsEvent(events []string, event string) bool {
+	if len(events) == 0 {
+		return true
+	}
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// entryPrompt returns an entry's prompt, or "" if it is gone.
+func entryPrompt(nbID string, idx int) string {
+	var p string
+	_ = db.QueryRow(`
+		SELECT prompt FROM notebook_entries WHERE notebook_id = ? AND idx = ?
+	`, nbID, idx).Scan(&p)
+	return p
+}
+
+// sendNtfy publishes ev to the ntfy topic, using ntfy's header API.
+func sendNtfy(n notifyConfig, ev runEvent) {
+	title, tag, prio := ev.Model+" finished", "white_check_mark", "default"
+	switch ev.Event {
+	case "run.error":
+		title, tag, prio = fmt.Sprintf("%s failed (exit %d)", ev.Model, ev.ExitCode), "x", "high"
+	case "run.timeout":
+		title, tag, prio = ev.Model+" timed out", "hourglass", "high"
+	}
+	msg := ev.Prompt
+	if ev.Repo != "" {
+		msg = ev.Repo + ": " + msg
+	}
+	msg += fmt.Sprintf(" (%.0fs)", ev.Duration)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.NtfyURL, strings.NewReader(msg))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Title", title)
+	req.Header.Set("Tags", tag)
+	req.Header.Set("Priority", prio)
+	if ev.URL != "" {
+		req.Header.Set("Click", ev.URL)
+	}
+	if n.NtfyTokenEnv != "" {
+		if tok := apiKey(n.NtfyTokenEnv); tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		slog.Warn("notify: ntfy failed", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("notify: ntfy failed", "status", resp.Status)
+	}
+}
@@ -0,0 +1,23 @@
+package web
+
+import (
+	"net/http"
+
+	"trybook/client"
+)
+
+// The API description. client/openapi.json documents the endpoints other
+// tools use to open notebooks, add prompts and follow or stop runs; the
+// client package is generated from it and embeds it as client.Spec. GET
+// /api/openapi.json serves it, without sign-in, so tools can fetch it
+// before they have a session.
+
+// GET /api/openapi.json
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(client.Spec)
+}
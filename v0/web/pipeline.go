@@ -0,0 +1,632 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"trybook/runner"
+)
+
+// Pipelines. A pipeline is a short list of steps run one after another on
+// a notebook by the server, such as "edit with aider", "run the tests",
+// "ask claude why they failed". Each step is an ordinary entry, so its
+// output is recorded, shown and re-runnable like any other:
+//
+//   - edit: a prompt with the edit intent, by the step's model if it names
+//     one (as the "Edit with" picker would);
+//   - tests: the repository's test command, on the previous step's entry
+//     (the tests box under the edit), or on an entry of its own if it
+//     comes first. When the edit already ran the tests after itself, that
+//     result is used instead of running them again;
+//   - question: a prompt with the question intent, answered by the step's
+//     model, or by the intent's models if it names none.
+//
+// A step after a tests step gets the test output attached as a snippet,
+// since the tests box is not part of the conversation context. Each step
+// has a condition on the step before it: "ok" (the default) runs it only
+// if that step succeeded, "failed" only if it failed, "always" either way.
+// A step whose condition does not hold is skipped, and the next one looks
+// at the last step that ran.
+//
+// POST /pipeline starts one; POST /pipeline/stop stops it as a unit: the
+// current step's runs are canceled and the steps after it are not started.
+// Stopping one of its runs from the entry does the same.
+
+const (
+	pipelineMaxSteps = 8
+	// pipelinePoll is how often a pipeline looks whether its step is done.
+	pipelinePoll = 500 * time.Millisecond
+)
+
+const pipelinesSchema = `
+	CREATE TABLE IF NOT EXISTS pipelines (
+		id          TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		status      TEXT NOT NULL DEFAULT 'running',
+		error       TEXT NOT NULL DEFAULT '',
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		finished_at TEXT,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS pipelines_notebook ON pipelines(notebook_id);
+	CREATE TABLE IF NOT EXISTS pipeline_steps (
+		pipeline_id TEXT NOT NULL,
+		pos         INTEGER NOT NULL,
+		kind        TEXT NOT NULL,
+		prompt      TEXT NOT NULL DEFAULT '',
+		model       TEXT NOT NULL DEFAULT '',
+		run_if      TEXT NOT NULL DEFAULT 'ok',
+		idx         INTEGER NOT NULL DEFAULT -1,
+		status      TEXT NOT NULL DEFAULT 'pending',
+		error       TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (pipeline_id, pos),
+		FOREIGN KEY (pipeline_id) REFERENCES pipelines(id) ON DELETE CASCADE
+	);`
+
+// Step kinds.
+const (
+	stepEdit     = "edit"
+	stepTests    = "tests"
+	stepQuestion = "question"
+)
+
+// Step conditions on the step that ran before.
+const (
+	runIfOK     = "ok"
+	runIfFailed = "failed"
+	runIfAlways = "always"
+)
+
+type pipelineStep struct {
+	Pos    int
+	Kind   string
+	Prompt string
+	Model  string
+	RunIf  string
+	Idx    int    // the step's entry; -1 until it starts
+	Status string // pending, running, done, failed, skipped, canceled
+	Error  string
+
+	since int64 // the last job before the step started
+}
+
+type pipeline struct {
+	ID         string
+	NotebookID string
+	Status     string // running, done, failed, canceled, interrupted
+	Error      string
+	CreatedAt  string
+	Steps      []pipelineStep
+}
+
+var (
+	pipelinesMu sync.Mutex
+	// livePipelines holds the cancel funcs of the running pipelines by id.
+	livePipelines = make(map[string]context.CancelFunc)
+)
+
+// parsePipelineSteps reads the form's steps: step_kind, step_prompt,
+// step_model and step_if, repeated once per step in order. Rows without a
+// kind are ignored.
+func parsePipelineSteps(cfg *config, r *http.Request) ([]pipelineStep, error) {
+	kinds := r.Form["step_kind"]
+	field := func(name string, i int) string {
+		if vs := r.Form[name]; i < len(vs) {
+			return strings.TrimSpace(vs[i])
+		}
+		return ""
+	}
+	var steps []pipelineStep
+	for i, kind := range kinds {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		n := len(steps) + 1
+		s := pipelineStep{Pos: len(steps), Kind: kind, Model: field("step_model", i), RunIf: field("step_if", i), Idx: -1, Status: "pending"}
+		switch s.RunIf {
+		case "":
+			s.RunIf = runIfOK
+		case runIfOK, runIfFailed, runIfAlways:
+		default:
+			return nil, fmt.Errorf("step %d: unknown condition %q", n, s.RunIf)
+		}
+		switch kind {
+		case stepEdit, stepQuestion:
+			p, _, err := checkPrompt(field("step_prompt", i), true)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: %v", n, err)
+			}
+			s.Prompt = p
+		case stepTests:
+			if s.Model != "" {
+				return nil, fmt.Errorf("step %d: a tests step runs the repository's test command, not a model", n)
+			}
+		default:
+			return nil, fmt.Errorf("step %d: unknown kind %q", n, kind)
+		}
+		switch {
+		case s.Model == "":
+		case kind == stepEdit && !isEditTool(cfg, s.Model):
+			return nil, fmt.Errorf("step %d: %s is not a model that edits", n, s.Model)
+		case kind == stepQuestion:
+			if _, ok := cfg.registry.Get(s.Model); !ok || s.Model == "router" {
+				return nil, fmt.Errorf("step %d: unknown model %s", n, s.Model)
+			}
+		}
+		steps = append(steps, s)
+	}
+	switch {
+	case len(steps) == 0:
+		return nil, errors.New("add at least one step")
+	case len(steps) > pipelineMaxSteps:
+		return nil, fmt.Errorf("at most %d steps per pipeline", pipelineMaxSteps)
+	}
+	return steps, nil
+}
+
+// POST /pipeline
+func pipelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	cfg := currentConfig()
+	steps, err := parsePipelineSteps(cfg, r)
+	if err != nil {
+		http.Error(w, "Cannot start the pipeline: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	for _, s := range steps {
+		if s.Kind == stepTests && repoTestCommand(r.Context(), cfg, meta.Host, meta.Org, meta.Repo) == "" {
+			http.Error(w, "Cannot start the pipeline: the repository has no test command; set repos.<repo>.test_command in the config.", http.StatusBadRequest)
+			return
+		}
+	}
+	id := genNotebookID()
+	pipelinesMu.Lock()
+	defer pipelinesMu.Unlock()
+	if running, err := runningPipeline(r.Context(), nbID); err != nil {
+		slog.ErrorContext(r.Context(), "pipelineHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	} else if running != "" {
+		http.Error(w, "a pipeline is already running on this notebook", http.StatusConflict)
+		return
+	}
+	err = inTx(r.Context(), func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(r.Context(), `
+			INSERT INTO pipelines(id, notebook_id) VALUES(?, ?)
+		`, id, nbID); err != nil {
+			return err
+		}
+		for _, s := range steps {
+			if _, err := tx.ExecContext(r.Context(), `
+				INSERT INTO pipeline_steps(pipeline_id, pos, kind, prompt, model, run_if) VALUES(?, ?, ?, ?, ?, ?)
+			`, id, s.Pos, s.Kind, s.Prompt, s.Model, s.RunIf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "pipelineHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	livePipelines[id] = cancel
+	slog.InfoContext(r.Context(), "pipeline: started", "pipeline", id, "nb", nbID, "steps", len(steps))
+	go runPipeline(ctx, cfg, id, nbID, steps)
+	http.Redirect(w, r, "/n/"+nbID+"#pipeline-"+id, http.StatusSeeOther)
+}
+
+// POST /pipeline/stop?id=...
+func pipelineStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimSpace(r.FormValue("id"))
+	if !isSafeToken(id) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	// The pipeline's notebook is in no form field, so requireAuth cannot
+	// check its owner; only its owner may stop it.
+	var nbID string
+	err := db.QueryRowContext(r.Context(), `SELECT notebook_id FROM pipelines WHERE id = ?`, id).Scan(&nbID)
+	if err != nil || (authEnabled() && !canAccessNotebook(r.Context(), currentUser(r.Context()), nbID)) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	pipelinesMu.Lock()
+	cancel := livePipelines[id]
+	pipelinesMu.Unlock()
+	if cancel == nil {
+		http.Error(w, "the pipeline is not running", http.StatusConflict)
+		return
+	}
+	cancel()
+	slog.InfoContext(r.Context(), "pipeline: stopped", "pipeline", id, "nb", nbID)
+	http.Redirect(w, r, "/n/"+nbID+"#pipeline-"+id, http.StatusSeeOther)
+}
+
+// runningPipeline returns the id of the notebook's running pipeline, or "".
+func runningPipeline(ctx context.Context, nbID string) (string, error) {
+	var id string
+	err := db.QueryRowContext(ctx, `
+		SELECT id FROM pipelines WHERE notebook_id = ? AND status = 'running' LIMIT 1
+	`, nbID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+// stopPipelines cancels the notebook's running pipelines.
+func stopPipelines(nbID string) {
+	rows, err := db.Query(`SELECT id FROM pipelines WHERE notebook_id = ? AND status = 'running'`, nbID)
+	if err != nil {
+		slog.Error("pipeline: stop", "nb", nbID, "err", err)
+		return
+	}
+	defer rows.Close()
+	pipelinesMu.Lock()
+	defer pipelinesMu.Unlock()
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil && livePipelines[id] != nil {
+			livePipelines[id]()
+		}
+	}
+}
+
+// runPipeline runs the steps in order, recording each one's entry and
+// outcome, until they are done or ctx is canceled.
+func runPipeline(ctx context.Context, cfg *config, id, nbID string, steps []pipelineStep) {
+	ctx = withLogAttrs(ctx, "pipeline", id)
+	dbCtx := context.WithoutCancel(ctx)
+	status, errText := "done", ""
+	defer func() {
+		pipelinesMu.Lock()
+		delete(livePipelines, id)
+		pipelinesMu.Unlock()
+		if _, err := execDB(dbCtx, `
+			UPDATE pipelines SET status = ?, error = ?, finished_at = strftime('%Y-%m-%dT%H:%M:%SZ','now') WHERE id = ?
+		`, status, errText, id); err != nil {
+			slog.ErrorContext(ctx, "pipeline: record", "err", err)
+		}
+		broadcastNotebook(nbID, hubMsg{Type: "pipeline"})
+		slog.InfoContext(ctx, "pipeline: finished", "status", status)
+	}()
+	setStep := func(s *pipelineStep) { recordStep(dbCtx, id, s) }
+	var last *pipelineStep // the last step that ran
+	for i := range steps {
+		s := &steps[i]
+		if ctx.Err() != nil {
+			s.Status = "canceled"
+			setStep(s)
+			continue
+		}
+		lastOK := last == nil || last.Status == "done"
+		if (s.RunIf == runIfOK && !lastOK) || (s.RunIf == runIfFailed && lastOK) {
+			s.Status = "skipped"
+			setStep(s)
+			continue
+		}
+		s.Status = "running"
+		setStep(s)
+		err := runPipelineStep(ctx, cfg, id, nbID, s, last)
+		switch {
+		case ctx.Err() != nil || errors.Is(err, context.Canceled):
+			s.Status = "canceled"
+		case errors.Is(err, errStepFailed):
+			s.Status = "failed"
+		case err != nil:
+			// The step could not start; there is nothing for the next
+			// step to look at.
+			s.Status, s.Error = "failed", err.Error()
+			setStep(s)
+			status, errText = "failed", fmt.Sprintf("step %d: %v", s.Pos+1, err)
+			for j := i + 1; j < len(steps); j++ {
+				steps[j].Status = "canceled"
+				setStep(&steps[j])
+			}
+			return
+		default:
+			s.Status = "done"
+		}
+		setStep(s)
+		if s.Status == "canceled" {
+			status = "canceled"
+			stopPipelineContext(id)
+		}
+		last = s
+	}
+}
+
+func recordStep(ctx context.Context, id string, s *pipelineStep) {
+	if _, err := execDB(ctx, `
+		UPDATE pipeline_steps SET idx = ?, status = ?, error = ? WHERE pipeline_id = ? AND pos = ?
+	`, s.Idx, s.Status, s.Error, id, s.Pos); err != nil {
+		slog.ErrorContext(ctx, "pipeline: record step", "pos", s.Pos, "err", err)
+	}
+}
+
+// stopPipelineContext cancels a pipeline from within, as when one of its
+// runs was stopped from the entry.
+func stopPipelineContext(id string) {
+	pipelinesMu.Lock()
+	defer pipelinesMu.Unlock()
+	if cancel := livePipelines[id]; cancel != nil {
+		cancel()
+	}
+}
+
+// errStepFailed is a step that ran and did not succeed: a model failed or
+// the tests did not pass.
+var errStepFailed = errors.New("step failed")
+
+// runPipelineStep starts a step's runs, waits for them and returns nil if
+// all of them succeeded, errStepFailed if one did not, or why the step
+// could not start. prev is the step that ran before, or nil.
+func runPipelineStep(ctx context.Context, cfg *config, id, nbID string, s *pipelineStep, prev *pipelineStep) error {
+	since, err := lastJobID(ctx)
+	if err != nil {
+		return err
+	}
+	if s.Kind == stepTests {
+		if prev == nil || prev.Idx < 0 {
+			if s.Idx, err = appendNotebookEntry(ctx, nbID, "Run the tests"); err != nil {
+				return err
+			}
+			broadcastNotebook(nbID, hubMsg{Type: "entry", Idx: s.Idx})
+		} else {
+			s.Idx = prev.Idx
+			// The edit's own test run, queued after it, already counts.
+			if prev.Kind == stepEdit && prev.Status == "done" {
+				if ok, ran, err := stepOutcome(ctx, nbID, s.Idx, prev.since, true); err == nil && ran {
+					return okOrFailed(ok)
+				}
+			}
+		}
+		tpr, err := prepareRun(ctx, cfg, nbID, s.Idx, TestsModel)
+		if err != nil {
+			return err
+		}
+		liveRuns.Lock()
+		_, err = enqueueRun(runner.Key(nbID, s.Idx, TestsModel), tpr, nil)
+		liveRuns.Unlock()
+		if err != nil {
+			return err
+		}
+	} else {
+		if s.Idx, err = appendNotebookEntry(ctx, nbID, s.Prompt); err != nil {
+			return err
+		}
+		if prev != nil && prev.Kind == stepTests {
+			if err := attachTestOutput(ctx, nbID, prev.Idx, s.Idx); err != nil {
+				slog.WarnContext(ctx, "pipeline: attach test output", "err", err)
+			}
+		}
+		if err := setNotebookEntryIntent(ctx, nbID, s.Idx, s.Kind, intentManual); err != nil {
+			return err
+		}
+		if s.Kind == stepEdit && s.Model != "" {
+			if err := setEntryEditModel(ctx, nbID, s.Idx, s.Model); err != nil {
+				return err
+			}
+		}
+		broadcastNotebook(nbID, hubMsg{Type: "entry", Idx: s.Idx})
+		if s.Kind == stepQuestion && s.Model != "" {
+			liveRuns.Lock()
+			enqueueModels(cfg, nbID, s.Idx, []string{s.Model})
+			publishRouted(nbID, s.Idx, s.Kind, intentManual, []string{s.Model}, false)
+			liveRuns.Unlock()
+		} else if err := enqueueEntry(ctx, cfg, nbID, s.Idx); err != nil {
+			return err
+		}
+	}
+	s.since = since
+	recordStep(context.WithoutCancel(ctx), id, s)
+	if err := waitEntryRuns(ctx, nbID, s.Idx); err != nil {
+		return err
+	}
+	ok, ran, err := stepOutcome(context.WithoutCancel(ctx), nbID, s.Idx, since, s.Kind == stepTests)
+	switch {
+	case err != nil:
+		return err
+	case !ran:
+		return errors.New("nothing ran")
+	}
+	return okOrFailed(ok)
+}
+
+func okOrFailed(ok bool) error {
+	if ok {
+		return nil
+	}
+	return errStepFailed
+}
+
+func lastJobID(ctx context.Context) (int64, error) {
+	var id int64
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM jobs`).Scan(&id)
+	return id, err
+}
+
+// stepOutcome looks at the jobs for an entry after job since: the test
+// runs if tests, the others if not. ran is false if there were none; ok
+// is whether all of them finished successfully. A canceled job is
+// reported as context.Canceled.
+func stepOutcome(ctx context.Context, nbID string, idx int, since int64, tests bool) (ok, ran bool, err error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT status FROM jobs WHERE notebook_id = ? AND idx = ? AND id > ? AND (model = ?) = ?
+	`, nbID, idx, since, TestsModel, tests)
+	if err != nil {
+		return false, false, err
+	}
+	defer rows.Close()
+	ok = true
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			return false, false, err
+		}
+		ran = true
+		switch status {
+		case "canceled":
+			return false, true, context.Canceled
+		case "done":
+		default:
+			ok = false
+		}
+	}
+	return ok && ran, ran, rows.Err()
+}
+
+// waitEntryRuns waits until no run of the entry is queued or running. If
+// ctx is canceled first, the entry's runs are stopped.
+func waitEntryRuns(ctx context.Context, nbID string, idx int) error {
+	prefix := runner.Key(nbID, idx, "")
+	busy := func(cancel bool) bool {
+		liveRuns.Lock()
+		defer liveRuns.Unlock()
+		b := false
+		liveRuns.Each(func(key string, lr *runner.Run) {
+			if strings.HasPrefix(key, prefix) && !lr.Finished() {
+				if cancel {
+					lr.Cancel()
+				}
+				b = true
+			}
+		})
+		return b
+	}
+	t := time.NewTicker(pipelinePoll)
+	defer t.Stop()
+	for busy(false) {
+		select {
+		case <-ctx.Done():
+			busy(true)
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// attachTestOutput attaches the test output of entry from to entry to as a
+// snippet, keeping its end if it is long.
+func attachTestOutput(ctx context.Context, nbID string, from, to int) error {
+	var out string
+	err := db.QueryRowContext(ctx, `
+		SELECT output FROM entry_outputs WHERE notebook_id = ? AND idx = ? AND model = ?
+	`, nbID, from, TestsModel).Scan(&out)
+	if errors.Is(err, sql.ErrNoRows) || strings.TrimSpace(out) == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(out) > attachMaxBytes {
+		out = out[len(out)-attachMaxBytes:]
+	}
+	return saveAttachments(ctx, nbID, to, []attachment{{Kind: attachSnippet, Name: "test output", Content: out}})
+}
+
+// loadPipelines returns the notebook's latest pipelines, newest first.
+func loadPipelines(ctx context.Context, nbID string, limit int) ([]pipeline, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, status, error, created_at FROM pipelines
+		WHERE notebook_id = ? ORDER BY created_at DESC, rowid DESC LIMIT ?
+	`, nbID, limit)
+	if err != nil {
+		return nil, err
+	}
+	var ps []pipeline
+	for rows.Next() {
+		p := pipeline{NotebookID: nbID}
+		if err := rows.Scan(&p.ID, &p.Status, &p.Error, &p.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range ps {
+		srows, err := db.QueryContext(ctx, `
+			SELECT pos, kind, prompt, model, run_if, idx, status, error FROM pipeline_steps
+			WHERE pipeline_id = ? ORDER BY pos
+		`, ps[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for srows.Next() {
+			var s pipelineStep
+			if err := srows.Scan(&s.Pos, &s.Kind, &s.Prompt, &s.Model, &s.RunIf, &s.Idx, &s.Status, &s.Error); err != nil {
+				srows.Close()
+				return nil, err
+			}
+			ps[i].Steps = append(ps[i].Steps, s)
+		}
+		srows.Close()
+		if err := srows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// markInterruptedPipelines closes out pipelines a previous process was
+// running; their current runs were interrupted with it.
+func markInterruptedPipelines() {
+	err := inTx(context.Background(), func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`
+			UPDATE pipeline_steps SET status = 'canceled'
+			WHERE status IN ('pending', 'running')
+			  AND pipeline_id IN (SELECT id FROM pipelines WHERE status = 'running')
+		`); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`
+			UPDATE pipelines SET status = 'interrupted', finished_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+			WHERE status = 'running'
+		`)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			slog.Warn("pipeline: interrupted by restart", "pipelines", n)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("pipeline: mark interrupted", "err", err)
+	}
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Only the owner of a pipeline's notebook may stop it.
+func TestPipelineStopOwner(t *testing.T) {
+	c := newTestClient(t)
+	nbID := c.newNotebook()
+	const pipelineID = "stop-owner"
+	if _, err := db.Exec(`UPDATE notebooks SET owner = 'alice' WHERE id = ?`, nbID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO pipelines(id, notebook_id) VALUES(?, ?)`, pipelineID, nbID); err != nil {
+		t.Fatal(err)
+	}
+	stopped := false
+	pipelinesMu.Lock()
+	livePipelines[pipelineID] = func() { stopped = true }
+	pipelinesMu.Unlock()
+	t.Cleanup(func() {
+		pipelinesMu.Lock()
+		delete(livePipelines, pipelineID)
+		pipelinesMu.Unlock()
+	})
+	t.Setenv("TRYBOOK_TOKEN", "secret")
+
+	for _, tc := range []struct {
+		user string
+		want int
+	}{
+		{"mallory", http.StatusNotFound},
+		{"alice", http.StatusSeeOther},
+	} {
+		form := url.Values{"id": {pipelineID}}
+		r := httptest.NewRequest(http.MethodPost, "/pipeline/stop", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), userCtxKey{}, tc.user))
+		w := httptest.NewRecorder()
+		pipelineStopHandler(w, r)
+		if w.Code != tc.want || stopped != (tc.want == http.StatusSeeOther) {
+			t.Errorf("%s stopping alice's pipeline: %d, stopped %v", tc.user, w.Code, stopped)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Preferences. Each user keeps defaults in user_prefs, set on /settings
+// (with sign-in off, the server's one user has them, under ""): the models
+// that answer questions, in place of the config's "question" intent; the
+// tool the prompt form picks for edits; the notebook page's theme; and
+// whether outputs start expanded. The notebook page applies them when it
+// is rendered, and the job queue runs a notebook's questions with its
+// owner's models. Models that leave the config are ignored.
+
+const prefsSchema = `
+	CREATE TABLE IF NOT EXISTS user_prefs (
+		user            TEXT PRIMARY KEY,
+		question_models TEXT NOT NULL DEFAULT '', -- space-separated
+		edit_model      TEXT NOT NULL DEFAULT '',
+		theme           TEXT NOT NULL DEFAULT '',
+		expand_outputs  INTEGER NOT NULL DEFAULT 0,
+		updated_at      TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now'))
+	);`
+
+// themes are the notebook page's themes; "" is the light one.
+var themes = []string{"", "dark", "system"}
+
+type userPrefs struct {
+	QuestionModels []string
+	EditModel      string
+	Theme          string
+	ExpandOutputs  bool
+}
+
+func loadPrefs(ctx context.Context, user string) (userPrefs, error) {
+	var p userPrefs
+	var models string
+	err := db.QueryRowContext(ctx, `
+		SELECT question_models, edit_model, theme, expand_outputs FROM user_prefs WHERE user = ?
+	`, user).Scan(&models, &p.EditModel, &p.Theme, &p.ExpandOutputs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, nil
+	}
+	p.QuestionModels = strings.Fields(models)
+	return p, err
+}
+
+func savePrefs(ctx context.Context, user string, p userPrefs) error {
+	_, err := execDB(ctx, `
+		INSERT INTO user_prefs(user, question_models, edit_model, theme, expand_outputs) VALUES(?, ?, ?, ?, ?)
+		ON CONFLICT(user) DO UPDATE SET
+			question_models = excluded.question_models,
+			edit_model = excluded.edit_model,
+			theme = excluded.theme,
+			expand_outputs = excluded.expand_outputs,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, user, strings.Join(p.QuestionModels, " "), p.EditModel, p.Theme, p.ExpandOutputs)
+	return err
+}
+
+// ownerPrefs returns the preferences of the owner of notebook nbID, or
+// none if they cannot be read.
+func ownerPrefs(ctx context.Context, nbID string) userPrefs {
+	var owner string
+	if err := db.QueryRowContext(ctx, `SELECT owner FROM notebooks WHERE id = ?`, nbID).Scan(&owner); err != nil {
+		slog.ErrorContext(ctx, "ownerPrefs", "nb", nbID, "err", err)
+		return userPrefs{}
+	}
+	p, err := loadPrefs(ctx, owner)
+	if err != nil {
+		slog.ErrorContext(ctx, "ownerPrefs", "nb", nbID, "err", err)
+	}
+	return p
+}
+
+// isQuestionModel reports whether model answers without editing, so it can
+// be picked for questions.
+func isQuestionModel(cfg *config, model string) bool {
+	rn, ok := cfg.registry.Get(model)
+	return ok && model != "router" && model != TestsModel && !editsWorktree(rn)
+}
+
+// questionModels returns the models p picks for questions that cfg still
+// has; none means the config's.
+func (p userPrefs) questionModels(cfg *config) []string {
+	var out []string
+	for _, m := range p.QuestionModels {
+		if isQuestionModel(cfg, m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// apply puts p's question models into intents, the models the notebook
+// page shows for each intent.
+func (p userPrefs) apply(cfg *config, intents map[string][]string) map[string][]string {
+	ms := p.questionModels(cfg)
+	if len(ms) == 0 {
+		return intents
+	}
+	out := make(map[string][]string, len(intents))
+	for k, v := range intents {
+		out[k] = v
+	}
+	out["question"] = ms
+	return out
+}
+
+// prefsFromForm reads the preferences form of /settings.
+func prefsFromForm(cfg *config, r *http.Request) (userPrefs, error) {
+	p := userPrefs{
+		EditModel:     strings.TrimSpace(r.FormValue("edit_model")),
+		Theme:         r.FormValue("theme"),
+		ExpandOutputs: r.FormValue("expand_outputs") == "1",
+	}
+	for _, m := range r.Form["question_model"] {
+		if !isQuestionModel(cfg, m) {
+			return p, fmt.Errorf("%s cannot answer questions", m)
+		}
+		p.QuestionModels = append(p.QuestionModels, m)
+	}
+	if p.EditModel != "" && !isEditTool(cfg, p.EditModel) {
+		return p, fmt.Errorf("unknown edit tool: %s", p.EditModel)
+	}
+	if !slices.Contains(themes, p.Theme) {
+		return p, fmt.Errorf("unknown theme: %s", p.Theme)
+	}
+	return p, nil
+}
+
+// prefChoice is a model the preferences form offers.
+type prefChoice struct {
+	Name     string
+	Selected bool
+}
+
+// prefsView is the preferences part of the settings page.
+type prefsView struct {
+	Question []prefChoice // models that can answer questions
+	Default  []string     // the config's question models
+	Edit     []prefChoice // edit tools
+	Theme    string
+	Expand   bool
+}
+
+func newPrefsView(cfg *config, p userPrefs) prefsView {
+	v := prefsView{Default: cfg.intentModels("question"), Theme: p.Theme, Expand: p.ExpandOutputs}
+	for _, m := range cfg.registry.Models() {
+		if isQuestionModel(cfg, m) {
+			v.Question = append(v.Question, prefChoice{Name: m, Selected: slices.Contains(p.QuestionModels, m)})
+		}
+	}
+	for _, t := range editTools(cfg) {
+		v.Edit = append(v.Edit, prefChoice{Name: t.Name, Selected: t.Name == p.EditModel})
+	}
+	return v
+}
+
+// requestPrefs returns the preferences of the request's user, or none if
+// they cannot be read.
+func requestPrefs(r *http.Request) userPrefs {
+	p, err := loadPrefs(r.Context(), currentUser(r.Context()))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "requestPrefs", "err", err)
+	}
+	return p
+}
@@ -0,0 +1,191 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Model CLIs spawn their own subprocesses (aider runs git and python, claude
+// runs tools). Every run is started in its own process group so that a
+// cancel or timeout takes down the whole tree, not just the direct child:
+// the group gets SIGTERM, and SIGKILL if anything is left after stopGrace.
+
+// stopGrace is how long a canceled run's processes get to exit cleanly.
+const stopGrace = 3 * time.Second
+
+type procGroup struct {
+	Name    string
+	Key     string // live run key (see liveKey); empty for helper commands
+	Started time.Time
+	Done    bool // leader has been waited on; any survivors are leaks
+}
+
+var (
+	procMu     sync.Mutex
+	procGroups = make(map[int]*procGroup) // pgid -> group
+)
+
+// superviseCmd configures cmd to run in its own process group and to kill
+// that group when its context is canceled. Commands that already request a
+// new session (pty.Start does) are left alone: a session leader is also the
+// leader of a fresh process group.
+func superviseCmd(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !cmd.SysProcAttr.Setsid {
+		cmd.SysProcAttr.Setpgid = true
+	}
+	cmd.Cancel = func() error {
+		if cmd.Process == nil {
+			return nil
+		}
+		return terminateProcGroup(cmd.Process.Pid)
+	}
+	// Grandchildren may hold stdout/stderr open after the leader dies.
+	cmd.WaitDelay = 5 * time.Second
+}
+
+// trackProcGroup records a started command's process group under the live
+// run key it belongs to.
+func trackProcGroup(cmd *exec.Cmd, name, key string) {
+	if cmd.Process == nil {
+		return
+	}
+	procMu.Lock()
+	procGroups[cmd.Process.Pid] = &procGroup{Name: name, Key: key, Started: time.Now()}
+	procMu.Unlock()
+}
+
+// runProcGroups returns the running process groups of the live runs that
+// match.
+func runProcGroups(match func(key string) bool) []int {
+	procMu.Lock()
+	defer procMu.Unlock()
+	var pgids []int
+	for pgid, g := range procGroups {
+		if !g.Done && g.Key != "" && match(g.Key) {
+			pgids = append(pgids, pgid)
+		}
+	}
+	return pgids
+}
+
+// finishProcGroup is called after cmd.Wait returns. Anything still alive in
+// the group at this point has outlived its parent; report it and kill it.
+func finishProcGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	pgid := cmd.Process.Pid
+	procMu.Lock()
+	g := procGroups[pgid]
+	if g != nil {
+		g.Done = true
+	}
+	procMu.Unlock()
+	if g != nil {
+		reapProcGroup(pgid, g)
+	}
+}
+
+func procGroupAlive(pgid int) bool {
+	err := syscall.Kill(-pgid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func killProcGroup(pgid int) error {
+	err := syscall.Kill(-pgid, syscall.SIGKILL)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// terminateProcGroup sends the group SIGTERM and, if it has not exited
+// after stopGrace, SIGKILL. It does not wait.
+func terminateProcGroup(pgid int) error {
+	err := syscall.Kill(-pgid, syscall.SIGTERM)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	go func() {
+		if !waitProcGroupGone(pgid, stopGrace) {
+			slog.Warn("reaper: group ignored SIGTERM; killing", "pgid", pgid)
+			_ = killProcGroup(pgid)
+		}
+	}()
+	return err
+}
+
+// waitProcGroupGone polls until the group is empty or d elapses. Killed
+// processes take a moment to exit, so a group that was just signaled
+// should not be reported as leaked.
+func waitProcGroupGone(pgid int, d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for procGroupAlive(pgid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+func reapProcGroup(pgid int, g *procGroup) {
+	if !waitProcGroupGone(pgid, time.Second) {
+		slog.Warn("reaper: leaked processes; killing", "pgid", pgid, "model", g.Name, "age", time.Since(g.Started).Round(time.Second))
+		if err := killProcGroup(pgid); err != nil {
+			slog.Error("reaper: kill group", "pgid", pgid, "err", err)
+		}
+		if !waitProcGroupGone(pgid, time.Second) {
+			return // retried by the next sweep
+		}
+	}
+	procMu.Lock()
+	delete(procGroups, pgid)
+	procMu.Unlock()
+}
+
+// runReaper periodically sweeps finished process groups until ctx is done.
+// Groups that survive SIGKILL (e.g. stuck in uninterruptible sleep) are
+// reported on every sweep until they disappear.
+func runReaper(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		procMu.Lock()
+		done := make(map[int]*procGroup)
+		for pgid, g := range procGroups {
+			if g.Done {
+				done[pgid] = g
+			}
+		}
+		procMu.Unlock()
+		for pgid, g := range done {
+			reapProcGroup(pgid, g)
+		}
+	}
+}
+
+// killAllProcGroups kills every tracked group; used on shutdown so runs
+// don't outlive the server.
+func killAllProcGroups() {
+	procMu.Lock()
+	defer procMu.Unlock()
+	for pgid, g := range procGroups {
+		slog.Info("reaper: killing group on shutdown", "pgid", pgid, "model", g.Name)
+		_ = killProcGroup(pgid)
+		delete(procGroups, pgid)
+	}
+}
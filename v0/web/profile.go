@@ -0,0 +1,233 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Repo profiles. When a repository is cloned (and again each time a
+// notebook is started from it), trybook looks at its top-level build files
+// (go.mod, Cargo.toml, package.json, requirements.txt, pyproject.toml,
+// Makefile) and records the languages, a build command, a test command
+// and setup hints in repo_profiles. The notebook page shows them, and the
+// detected test command runs after edits for repos without a configured
+// test_command, unless repos.<repo>.auto_tests is false.
+
+const repoProfilesSchema = `
+	CREATE TABLE IF NOT EXISTS repo_profiles (
+		host          TEXT NOT NULL,
+		org           TEXT NOT NULL,
+		repo          TEXT NOT NULL,
+		languages     TEXT NOT NULL DEFAULT '',
+		build_command TEXT NOT NULL DEFAULT '',
+		test_command  TEXT NOT NULL DEFAULT '',
+		hints         TEXT NOT NULL DEFAULT '',
+		commit_sha    TEXT NOT NULL DEFAULT '',
+		detected_at   TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (host, org, repo)
+	);`
+
+type repoProfile struct {
+	Languages    []string
+	BuildCommand string
+	TestCommand  string
+	Hints        []string // setup steps worth knowing, e.g. installing dependencies
+}
+
+// npmNoTest is the test script npm init writes.
+const npmNoTest = `echo "Error: no test specified" && exit 1`
+
+var makeTargetRE = regexp.MustCompile(`^([A-Za-z][\w.-]*)\s*:([^=]|$)`)
+
+// detectRepoProfile looks at dir's top-level build files. The first file
+// that names a command wins: a Makefile's targets, then the languages' own
+// tools.
+func detectRepoProfile(dir string) repoProfile {
+	var p repoProfile
+	has := func(name string) bool {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		return err == nil && !fi.IsDir()
+	}
+	lang := func(l string) {
+		for _, have := range p.Languages {
+			if have == l {
+				return
+			}
+		}
+		p.Languages = append(p.Languages, l)
+	}
+	commands := func(build, test string) {
+		if p.BuildCommand == "" {
+			p.BuildCommand = build
+		}
+		if p.TestCommand == "" {
+			p.TestCommand = test
+		}
+	}
+
+	if has("Makefile") {
+		targets := makeTargets(filepath.Join(dir, "Makefile"))
+		switch {
+		case targets["build"]:
+			commands("make build", "")
+		case targets["all"]:
+			commands("make", "")
+		}
+		if targets["test"] {
+			commands("", "make test")
+		}
+	}
+	if has("go.mod") {
+		lang("go")
+		commands("go build ./...", "go test ./...")
+	}
+	if has("Cargo.toml") {
+		lang("rust")
+		commands("cargo build", "cargo test")
+	}
+	if has("package.json") {
+		lang("javascript")
+		if has("tsconfig.json") {
+			lang("typescript")
+		}
+		pm := "npm"
+		switch {
+		case has("pnpm-lock.yaml"):
+			pm = "pnpm"
+		case has("yarn.lock"):
+			pm = "yarn"
+		}
+		var pkg struct {
+			Scripts map[string]string `json:"scripts"`
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, "package.json")); err == nil {
+			_ = json.Unmarshal(b, &pkg)
+		}
+		build, test := "", ""
+		if pkg.Scripts["build"] != "" {
+			build = pm + " run build"
+		}
+		if t := pkg.Scripts["test"]; t != "" && t != npmNoTest {
+			test = pm + " test"
+		}
+		commands(build, test)
+		if _, err := os.Stat(filepath.Join(dir, "node_modules")); err != nil {
+			p.Hints = append(p.Hints, pm+" install, to fetch the dependencies")
+		}
+	}
+	if has("requirements.txt") || has("pyproject.toml") || has("setup.py") {
+		lang("python")
+		test := "python -m unittest"
+		if mentions(dir, "pytest", "requirements.txt", "requirements-dev.txt", "pyproject.toml", "setup.cfg", "tox.ini") || has("pytest.ini") || has("conftest.py") {
+			test = "python -m pytest"
+		}
+		commands("", test)
+		switch {
+		case has("requirements.txt"):
+			p.Hints = append(p.Hints, "pip install -r requirements.txt, to fetch the dependencies")
+		default:
+			p.Hints = append(p.Hints, "pip install -e ., to install the package and its dependencies")
+		}
+	}
+	if has("Makefile") && len(p.Languages) == 0 {
+		lang("make")
+	}
+	return p
+}
+
+// makeTargets returns the targets defined in a Makefile.
+func makeTargets(path string) map[string]bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	targets := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if m := makeTargetRE.FindStringSubmatch(sc.Text()); m != nil {
+			targets[m[1]] = true
+		}
+	}
+	return targets
+}
+
+// mentions reports whether any of dir's files contains word.
+func mentions(dir, word string, files ...string) bool {
+	for _, name := range files {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err == nil && strings.Contains(string(b), word) {
+			return true
+		}
+	}
+	return false
+}
+
+// updateRepoProfile detects the profile of spec's clone and stores it.
+func updateRepoProfile(ctx context.Context, spec repoSpec) (repoProfile, error) {
+	dir := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	_, sha, err := currentBranchAndCommit(ctx, dir)
+	if err != nil {
+		return repoProfile{}, err
+	}
+	p := detectRepoProfile(dir)
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO repo_profiles(host, org, repo, languages, build_command, test_command, hints, commit_sha)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(host, org, repo) DO UPDATE SET
+			languages = excluded.languages,
+			build_command = excluded.build_command,
+			test_command = excluded.test_command,
+			hints = excluded.hints,
+			commit_sha = excluded.commit_sha,
+			detected_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, spec.Host, spec.Org, spec.Repo, strings.Join(p.Languages, ","), p.BuildCommand, p.TestCommand, strings.Join(p.Hints, "\n"), sha)
+	return p, err
+}
+
+// loadRepoProfile returns the stored profile of a repository, detecting it
+// first if there is none yet, as for repos cloned before profiles existed.
+func loadRepoProfile(ctx context.Context, host, org, repo string) (repoProfile, error) {
+	var langs, hints string
+	var p repoProfile
+	err := db.QueryRowContext(ctx, `
+		SELECT languages, build_command, test_command, hints FROM repo_profiles
+		WHERE host = ? AND org = ? AND repo = ?
+	`, host, org, repo).Scan(&langs, &p.BuildCommand, &p.TestCommand, &hints)
+	if errors.Is(err, sql.ErrNoRows) {
+		return updateRepoProfile(ctx, repoSpec{Host: host, Org: org, Repo: repo})
+	}
+	if err != nil {
+		return p, err
+	}
+	if langs != "" {
+		p.Languages = strings.Split(langs, ",")
+	}
+	if hints != "" {
+		p.Hints = strings.Split(hints, "\n")
+	}
+	return p, nil
+}
+
+// repoTestCommand returns the command to run after edits in a repository:
+// the configured test_command, else the detected one unless auto_tests is
+// off. It is "" when there is none.
+func repoTestCommand(ctx context.Context, cfg *config, host, org, repo string) string {
+	if cmd := cfg.testCommand(host, org, repo); cmd != "" {
+		return cmd
+	}
+	if !cfg.autoTests(host, org, repo) {
+		return ""
+	}
+	p, err := loadRepoProfile(ctx, host, org, repo)
+	if err != nil {
+		return ""
+	}
+	return p.TestCommand
+}
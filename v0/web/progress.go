@@ -0,0 +1,63 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Saving output while a run is still going. A run's output used to reach
+// the database only when its process exited, so a crash or restart lost
+// all of it. saveProgress copies the output so far into the entry's
+// output for the model (entry_outputs) and the run's row every
+// outputFlushInterval, or sooner after outputFlushBytes more, so the
+// partial answer survives and a page loaded mid-run shows it. The run's
+// end writes the final output over it as before.
+
+const (
+	outputFlushInterval = 3 * time.Second
+	outputFlushBytes    = 16 << 10
+	outputFlushPoll     = 500 * time.Millisecond
+)
+
+// saveProgress saves out and errOut, written under mu, with save every
+// outputFlushInterval while they grow, until the returned stop is called.
+// stop waits for a save in progress, so the run's final write comes last;
+// calling it again does nothing.
+func saveProgress(ctx context.Context, mu *sync.Mutex, out, errOut *bytes.Buffer, save func(output, stderr string) error) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(outputFlushPoll)
+		defer t.Stop()
+		saved, last := 0, time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			mu.Lock()
+			n := out.Len() + errOut.Len()
+			if n == saved || (n-saved < outputFlushBytes && time.Since(last) < outputFlushInterval) {
+				mu.Unlock()
+				continue
+			}
+			output, stderr := out.String(), errOut.String()
+			mu.Unlock()
+			if err := save(output, stderr); err != nil {
+				slog.WarnContext(ctx, "run: save progress", "err", err)
+			}
+			saved, last = n, time.Now()
+		}
+	}()
+	return func() {
+		once.Do(func() { close(done) })
+		wg.Wait()
+	}
+}
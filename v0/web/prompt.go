@@ -0,0 +1,155 @@
+package web
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Prompt checks and metadata. Prompts are trimmed and their line ends
+// normalized before they are stored, and refused past promptMaxChars. A
+// prompt that looks like a whole file pasted by accident (more than
+// promptPasteChars over more than promptPasteLines) goes to every model of
+// its intent, so it is only taken on a second send with "Send anyway"
+// (large=1); attaching the file is usually what was meant. Each entry
+// keeps a token estimate and a guess at the prompt's language
+// (notebook_entries.prompt_tokens and prompt_lang).
+
+const (
+	promptMaxChars   = 100000
+	promptPasteChars = 20000
+	promptPasteLines = 300
+	// promptWarnTokens is where the prompt box starts warning, counting
+	// the prompt once per model it goes to.
+	promptWarnTokens = 20000
+)
+
+// promptInfo describes a prompt.
+type promptInfo struct {
+	Chars  int
+	Lines  int
+	Tokens int    // estimated, at about four characters a token
+	Lang   string // "text" for prose, else the code's language; see guessLanguage
+}
+
+// cleanPrompt trims a prompt and normalizes its line ends.
+func cleanPrompt(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.TrimSpace(s)
+}
+
+func inspectPrompt(p string) promptInfo {
+	n := utf8.RuneCountInString(p)
+	return promptInfo{
+		Chars:  n,
+		Lines:  strings.Count(p, "\n") + 1,
+		Tokens: (n + 3) / 4,
+		Lang:   guessLanguage(p),
+	}
+}
+
+// pasted reports whether the prompt looks like a pasted file.
+func (pi promptInfo) pasted() bool {
+	return pi.Chars > promptPasteChars && pi.Lines > promptPasteLines
+}
+
+var (
+	errPromptEmpty  = errors.New("empty prompt")
+	errPromptPasted = errors.New("it looks like a pasted file, and would go to every model")
+)
+
+// checkPrompt cleans p and says why it cannot be sent, if it cannot; the
+// error is meant for the user. large confirms a prompt that looks pasted.
+func checkPrompt(p string, large bool) (string, promptInfo, error) {
+	p = cleanPrompt(p)
+	pi := inspectPrompt(p)
+	switch {
+	case p == "":
+		return p, pi, errPromptEmpty
+	case strings.ContainsRune(p, 0):
+		return p, pi, errors.New("it contains binary data")
+	case pi.Chars > promptMaxChars:
+		return p, pi, fmt.Errorf("it is %d characters long and the limit is %d; attach large files instead of pasting them", pi.Chars, promptMaxChars)
+	case pi.pasted() && !large:
+		return p, pi, fmt.Errorf("%w (%d lines, about %d tokens); attach the file instead, or tick Send anyway", errPromptPasted, pi.Lines, pi.Tokens)
+	}
+	return p, pi, nil
+}
+
+var (
+	fenceRE = regexp.MustCompile("(?m)^```([A-Za-z0-9_+#-]+)")
+	// langRE holds, per language, lines that mark code in it. The language
+	// with the most matching lines wins.
+	langRE = []struct {
+		lang string
+		re   *regexp.Regexp
+	}{
+		{"go", regexp.MustCompile(`(?m)^\s*(package \w+$|func (\(\w+ \*?\w+\) )?\w+\(|import \($|\w+ := |if err != nil \{)`)},
+		{"python", regexp.MustCompile(`(?m)^\s*(def \w+\(.*\):$|class \w+(\(.*\))?:$|from [\w.]+ import |import \w+$|elif |self\.\w+ = )`)},
+		{"javascript", regexp.MustCompile(`(?m)^\s*(const \w+ = |let \w+ = |function \w+\(|module\.exports|require\(|export (default |const |function ))|=> \{$`)},
+		{"typescript", regexp.MustCompile(`(?m)^\s*(interface \w+ \{|type \w+ = |export interface |\w+: (string|number|boolean)[;,]$)`)},
+		{"rust", regexp.MustCompile(`(?m)^\s*(fn \w+\(|let mut |impl\b|use \w+::|pub (fn|struct|enum) )`)},
+		{"java", regexp.MustCompile(`(?m)^\s*(public (static |final )*(class|void|int|String) |private \w+ \w+;|@Override$|System\.out\.)`)},
+		{"c", regexp.MustCompile(`(?m)^\s*(#include [<"]|int main\(|#define \w+|typedef struct)`)},
+		{"shell", regexp.MustCompile(`(?m)^(#!/bin/(ba)?sh|\$ \w+|export \w+=|\s*(fi|done|esac)$)`)},
+		{"sql", regexp.MustCompile(`(?mi)^\s*(select .+ from |insert into |create table |update \w+ set )`)},
+		{"html", regexp.MustCompile(`(?m)^\s*</?(html|div|span|body|head|script|p|ul|li|a)[ >]`)},
+		{"diff", regexp.MustCompile(`(?m)^(diff --git |@@ -\d+|\+\+\+ b/|--- a/)`)},
+	}
+)
+
+// guessLanguage names the language of the code in p: the first fenced
+// block's info string, else the language whose telltale lines are most
+// common. Prose is "text".
+func guessLanguage(p string) string {
+	if m := fenceRE.FindStringSubmatch(p); m != nil {
+		return strings.ToLower(m[1])
+	}
+	best, bestN := "text", 1 // a single stray match is not enough
+	for _, l := range langRE {
+		if n := len(l.re.FindAllStringIndex(p, 50)); n > bestN {
+			best, bestN = l.lang, n
+		}
+	}
+	return best
+}
+
+// backfillPromptInfo fills in prompt_tokens and prompt_lang for entries
+// written before they existed.
+func backfillPromptInfo(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT notebook_id, idx, prompt FROM notebook_entries`)
+	if err != nil {
+		return err
+	}
+	type row struct {
+		nb     string
+		idx    int
+		prompt string
+	}
+	var rs []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.nb, &r.idx, &r.prompt); err != nil {
+			rows.Close()
+			return err
+		}
+		rs = append(rs, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		pi := inspectPrompt(r.prompt)
+		if _, err := tx.Exec(`
+			UPDATE notebook_entries SET prompt_tokens = ?, prompt_lang = ? WHERE notebook_id = ? AND idx = ?
+		`, pi.Tokens, pi.Lang, r.nb, r.idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Prompt templates. The notebook page offers starter prompts in a menu
+// above the prompt box: built-in ones, some only for repositories whose
+// profile (see profile.go) has their language, and the user's own, kept in
+// prompt_templates and managed at /settings/templates. Picking one fills
+// the prompt box; placeholders such as {function} are selected in turn,
+// with Tab, for the user to type over.
+
+const promptTemplatesSchema = `
+	CREATE TABLE IF NOT EXISTS prompt_templates (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		owner      TEXT NOT NULL DEFAULT '',
+		name       TEXT NOT NULL,
+		body       TEXT NOT NULL,
+		languages  TEXT NOT NULL DEFAULT '', -- comma-separated profile languages; empty for any repo
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now'))
+	);
+	CREATE INDEX IF NOT EXISTS prompt_templates_owner ON prompt_templates(owner, name);`
+
+const (
+	maxTemplateName  = 100
+	maxTemplateBody  = 8000
+	maxUserTemplates = 200
+)
+
+type promptTemplate struct {
+	ID        int64 // 0 for built-ins
+	Name      string
+	Body      string
+	Languages []string // repo profile languages it is offered for; empty for any
+}
+
+var builtinTemplates = []promptTemplate{
+	{Name: "Explain the architecture", Body: "Explain the architecture of this repository: its main components, how they depend on each other, and how a request or command flows through them."},
+	{Name: "Find the entry point", Body: "Where is the entry point of this program, and what happens from startup until it is ready to do its work?"},
+	{Name: "Explain a file", Body: "Explain what {path} does and how the rest of the code uses it."},
+	{Name: "Find where something happens", Body: "Where in the code does {behavior} happen? List the files and functions involved."},
+	{Name: "Add a unit test", Body: "Add a unit test for {function} covering {case}, following the style of the existing tests."},
+	{Name: "Fix a bug", Body: "{symptom} when {steps}. Find the cause and fix it."},
+	{Name: "Add a table-driven Go test", Body: "Add a table-driven test for {function} in its package's _test.go file, covering {cases}.", Languages: []string{"go"}},
+	{Name: "Map the Go packages", Body: "List the packages in this Go module, what each is for, and which of the module's packages it imports.", Languages: []string{"go"}},
+	{Name: "Add a test with the project's runner", Body: "Add a test for {function} with the test framework package.json already uses, covering {cases}.", Languages: []string{"javascript", "typescript"}},
+	{Name: "Add a pytest test", Body: "Add a pytest test for {function} next to the existing tests, covering {cases}.", Languages: []string{"python"}},
+	{Name: "Add a Rust unit test", Body: "Add a #[test] for {function} in the tests module of its file, covering {cases}.", Languages: []string{"rust"}},
+}
+
+// offered reports whether t is for a repository with languages.
+func (t promptTemplate) offered(languages []string) bool {
+	if len(t.Languages) == 0 {
+		return true
+	}
+	for _, want := range t.Languages {
+		for _, l := range languages {
+			if l == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// templatesFor returns the built-in and the user's templates offered for
+// a repository with languages.
+func templatesFor(ctx context.Context, user string, languages []string) (builtin, own []promptTemplate, err error) {
+	for _, t := range builtinTemplates {
+		if t.offered(languages) {
+			builtin = append(builtin, t)
+		}
+	}
+	all, err := loadPromptTemplates(ctx, user)
+	for _, t := range all {
+		if t.offered(languages) {
+			own = append(own, t)
+		}
+	}
+	return builtin, own, err
+}
+
+// loadPromptTemplates returns the templates user saved, by name.
+func loadPromptTemplates(ctx context.Context, user string) ([]promptTemplate, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, body, languages FROM prompt_templates
+		WHERE owner = ? ORDER BY name COLLATE NOCASE, id
+	`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []promptTemplate
+	for rows.Next() {
+		var t promptTemplate
+		var langs string
+		if err := rows.Scan(&t.ID, &t.Name, &t.Body, &langs); err != nil {
+			return nil, err
+		}
+		t.Languages = splitLanguages(langs)
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// splitLanguages parses a comma- or space-separated language list.
+func splitLanguages(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+var (
+	errBadTemplate      = errors.New("a template needs a name of at most 100 characters and a prompt of at most 8000")
+	errTooManyTemplates = errors.New("you have too many templates; delete some first")
+)
+
+func addPromptTemplate(ctx context.Context, owner, name, body, languages string) error {
+	name, body = strings.TrimSpace(name), strings.TrimSpace(body)
+	if name == "" || body == "" || utf8.RuneCountInString(name) > maxTemplateName || len(body) > maxTemplateBody {
+		return errBadTemplate
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM prompt_templates WHERE owner = ?`, owner).Scan(&n); err != nil {
+		return err
+	}
+	if n >= maxUserTemplates {
+		return errTooManyTemplates
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO prompt_templates(owner, name, body, languages) VALUES (?, ?, ?, ?)
+	`, owner, name, body, strings.Join(splitLanguages(languages), ","))
+	return err
+}
+
+func deletePromptTemplate(ctx context.Context, owner string, id int64) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM prompt_templates WHERE id = ? AND owner = ?`, id, owner)
+	return err
+}
+
+type promptTemplatesView struct {
+	User     string
+	Builtin  []promptTemplate
+	Own      []promptTemplate
+	Message  string
+	MsgClass string
+	Draft    promptTemplate // the form's values after an error
+}
+
+// GET, POST /settings/templates (action add: name, body, languages;
+// action delete: id)
+func promptTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r.Context())
+	v := promptTemplatesView{User: user, Builtin: builtinTemplates}
+	switch r.Method {
+	case http.MethodGet:
+		if body := r.URL.Query().Get("body"); len(body) <= maxTemplateBody {
+			v.Draft.Body = body // "Save as template" from a notebook
+		}
+	case http.MethodPost:
+		var err error
+		switch r.FormValue("action") {
+		case "add":
+			err = addPromptTemplate(r.Context(), user, r.FormValue("name"), r.FormValue("body"), r.FormValue("languages"))
+			v.Message = "Template saved."
+			if err != nil {
+				v.Draft = promptTemplate{Name: r.FormValue("name"), Body: r.FormValue("body"), Languages: splitLanguages(r.FormValue("languages"))}
+			}
+		case "delete":
+			id, perr := strconv.ParseInt(r.FormValue("id"), 10, 64)
+			if perr != nil {
+				http.Error(w, "bad id", http.StatusBadRequest)
+				return
+			}
+			err = deletePromptTemplate(r.Context(), user, id)
+			v.Message = "Template deleted."
+		default:
+			http.Error(w, "bad action", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "promptTemplatesHandler", "err", err)
+			v.Message, v.MsgClass = "The template could not be saved.", "error"
+			if errors.Is(err, errBadTemplate) || errors.Is(err, errTooManyTemplates) {
+				v.Message = err.Error()
+			}
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	own, err := loadPromptTemplates(r.Context(), user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "promptTemplatesHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	v.Own = own
+	setHTMLHeaders(w)
+	_ = renderPage(w, "templates", v)
+}
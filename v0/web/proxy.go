@@ -0,0 +1,200 @@
+package web
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Running behind a reverse proxy. -base-path serves Trybook under a path
+// prefix such as /trybook: requests outside it are not found, the prefix
+// is stripped before routing, and redirects, cookies and the pages' links
+// (the templates' {{base}}) get it back. -trusted-proxies lists the
+// addresses of proxies whose X-Forwarded-For, -Proto and -Host headers are
+// believed, so that logs and rate limits see the client's address, cookies
+// are Secure when the client used HTTPS, and the same-origin checks
+// compare against the host the browser asked for. Those headers from any
+// other address are ignored.
+
+var (
+	basePathFlag   = flag.String("base-path", "", "path prefix Trybook is served under behind a reverse proxy, such as /trybook")
+	trustedProxies = flag.String("trusted-proxies", "", "comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers are trusted")
+)
+
+// basePath is -base-path without a trailing slash: "" or "/prefix".
+var basePath string
+
+var trustedNets []netip.Prefix
+
+// setupProxy checks -base-path and -trusted-proxies.
+func setupProxy() error {
+	p := strings.TrimRight(strings.TrimSpace(*basePathFlag), "/")
+	if p != "" {
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		for _, seg := range strings.Split(p[1:], "/") {
+			if !isSafeToken(seg) || seg == "." || seg == ".." {
+				return fmt.Errorf("-base-path: invalid path %q", *basePathFlag)
+			}
+		}
+	}
+	basePath = p
+	var err error
+	trustedNets, err = parseNets("-trusted-proxies", *trustedProxies)
+	return err
+}
+
+// parseNets reads a comma-separated list of addresses and CIDR ranges,
+// the value of flag name.
+func parseNets(name, list string) ([]netip.Prefix, error) {
+	var nets []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		pfx, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, fmt.Errorf("%s: %q is not an address or CIDR range", name, s)
+			}
+			pfx = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		nets = append(nets, pfx.Masked())
+	}
+	return nets, nil
+}
+
+// inNets reports whether s is an address in one of nets.
+func inNets(nets []netip.Prefix, s string) bool {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func trustedProxy(s string) bool {
+	return inNets(trustedNets, s)
+}
+
+// clientAddr returns the first address in X-Forwarded-For, read from the
+// right, that is not a trusted proxy's: the one the last trusted proxy
+// was connected from. Addresses further left were added by the client
+// itself or by proxies nobody vouches for.
+func clientAddr(forwarded []string) string {
+	var hops []string
+	for _, h := range forwarded {
+		for _, a := range strings.Split(h, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				hops = append(hops, a)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if _, err := netip.ParseAddr(hops[i]); err != nil {
+			return "" // not an address; believe none of it
+		}
+		if i == 0 || !trustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	return ""
+}
+
+// isHTTPS reports whether the client reached Trybook over HTTPS, directly
+// or through a trusted proxy.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.URL.Scheme == "https"
+}
+
+// cookiePath returns the cookie path for p, a path within Trybook.
+func cookiePath(p string) string {
+	if basePath == "" {
+		return p
+	}
+	return basePath + strings.TrimSuffix(p, "/") + "/"
+}
+
+// baseRedirects puts the base path back in front of the Location of
+// redirects within the site.
+type baseRedirects struct {
+	*statusRecorder
+}
+
+func (b baseRedirects) fixLocation() {
+	if b.status != 0 {
+		return // already sent
+	}
+	h := b.Header()
+	if loc := h.Get("Location"); strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		h.Set("Location", basePath+loc)
+	}
+}
+
+func (b baseRedirects) WriteHeader(code int) {
+	b.fixLocation()
+	b.statusRecorder.WriteHeader(code)
+}
+
+func (b baseRedirects) Write(p []byte) (int, error) {
+	b.fixLocation()
+	return b.statusRecorder.Write(p)
+}
+
+// behindProxy wraps the whole handler, outside logRequests: it applies the
+// forwarded headers from trusted proxies and strips the base path.
+func behindProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(trustedNets) > 0 {
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			if trustedProxy(host) {
+				r = r.Clone(r.Context())
+				if a := clientAddr(r.Header.Values("X-Forwarded-For")); a != "" {
+					r.RemoteAddr = net.JoinHostPort(a, "0")
+				}
+				proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+				if p := strings.ToLower(strings.TrimSpace(proto)); p == "https" || p == "http" {
+					r.URL.Scheme = p
+				}
+				if h, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ","); strings.TrimSpace(h) != "" {
+					r.Host = strings.TrimSpace(h)
+				}
+			}
+		}
+		if basePath == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		rest, ok := strings.CutPrefix(r.URL.Path, basePath+"/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/" + rest
+		r2.URL.RawPath = ""
+		if raw, ok := strings.CutPrefix(r.URL.RawPath, basePath+"/"); ok {
+			r2.URL.RawPath = "/" + raw
+		}
+		next.ServeHTTP(baseRedirects{&statusRecorder{ResponseWriter: w}}, r2)
+	})
+}
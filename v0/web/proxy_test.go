@@ -0,0 +1,78 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withTrustedProxies sets -trusted-proxies for the rest of the test.
+func withTrustedProxies(t *testing.T, list string) {
+	t.Helper()
+	nets, err := parseNets("-trusted-proxies", list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := trustedNets
+	trustedNets = nets
+	t.Cleanup(func() { trustedNets = old })
+}
+
+func TestClientAddr(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8, 192.0.2.1")
+	for _, tc := range []struct {
+		name      string
+		forwarded []string
+		want      string
+	}{
+		{"no header", nil, ""},
+		{"one hop", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"client spoofs its left", []string{"1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"trusted hops are skipped", []string{"203.0.113.7, 10.1.2.3, 192.0.2.1"}, "203.0.113.7"},
+		{"spoof behind trusted hops", []string{"1.2.3.4, 203.0.113.7, 10.1.2.3"}, "203.0.113.7"},
+		{"spoof of a trusted address", []string{"10.9.9.9, 203.0.113.7"}, "203.0.113.7"},
+		{"hops over several headers", []string{"1.2.3.4", "203.0.113.7", "10.1.2.3"}, "203.0.113.7"},
+		{"all trusted", []string{"10.1.1.1, 10.2.2.2"}, "10.1.1.1"},
+		{"ipv6", []string{"2001:db8::1, 10.1.2.3"}, "2001:db8::1"},
+		{"garbage after the client", []string{"203.0.113.7, nonsense"}, ""},
+		{"empty entries", []string{" , 203.0.113.7,"}, "203.0.113.7"},
+	} {
+		if got := clientAddr(tc.forwarded); got != tc.want {
+			t.Errorf("%s: clientAddr(%q) = %q, want %q", tc.name, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestBehindProxy(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	var got *http.Request
+	h := behindProxy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+	for _, tc := range []struct {
+		name, remote, forwarded, proto, host string
+		wantRemote, wantScheme, wantHost     string
+	}{
+		{"untrusted peer is believed about nothing", "203.0.113.7:5000", "1.2.3.4", "https", "evil.example",
+			"203.0.113.7:5000", "", "example.com"},
+		{"trusted proxy", "10.0.0.2:5000", "203.0.113.7", "https", "try.example.com",
+			"203.0.113.7:0", "https", "try.example.com"},
+		{"multi-hop chain", "10.0.0.2:5000", "1.2.3.4, 203.0.113.7, 10.3.3.3", "https, http", "try.example.com, inner",
+			"203.0.113.7:0", "https", "try.example.com"},
+		{"trusted proxy without headers", "10.0.0.2:5000", "", "", "",
+			"10.0.0.2:5000", "", "example.com"},
+		{"bad proto is ignored", "10.0.0.2:5000", "203.0.113.7", "gopher", "",
+			"203.0.113.7:0", "", "example.com"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range map[string]string{"X-Forwarded-For": tc.forwarded, "X-Forwarded-Proto": tc.proto, "X-Forwarded-Host": tc.host} {
+			if v != "" {
+				r.Header.Set(k, v)
+			}
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got.RemoteAddr != tc.wantRemote || got.URL.Scheme != tc.wantScheme || got.Host != tc.wantHost {
+			t.Errorf("%s: remote %q, scheme %q, host %q; want %q, %q, %q", tc.name,
+				got.RemoteAddr, got.URL.Scheme, got.Host, tc.wantRemote, tc.wantScheme, tc.wantHost)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Pushing a notebook's branch and opening a pull request on GitHub. The
+// token comes from GITHUB_TOKEN and needs push access to the repository and
+// permission to create pull requests. The PR URL is stored on the notebook;
+// pushing again later updates the same PR.
+
+var errNoCommits = errors.New("no commits to push")
+
+func githubToken() string { return os.Getenv("GITHUB_TOKEN") }
+
+func pushNotebookBranch(ctx context.Context, meta notebookMeta, token string) error {
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	head, err := gitHead(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if head == meta.SHA {
+		return errNoCommits
+	}
+	remote := fmt.Sprintf("https://github.com/%s/%s.git", meta.Org, meta.Repo)
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "push", remote, "HEAD:refs/heads/"+meta.Branch)
+	cmd.Env = gitAuthEnv(defaultHost, token)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git push: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// baseBranch is the branch the repository was cloned at.
+func baseBranch(ctx context.Context, meta notebookMeta) (string, error) {
+	var b string
+	err := db.QueryRowContext(ctx, `
+		SELECT branch FROM clones WHERE host = ? AND org = ? AND repo = ?
+	`, meta.Host, meta.Org, meta.Repo).Scan(&b)
+	return b, err
+}
+
+// prDescription builds a title and body from the notebook's prompts.
+func prDescription(entries []entry) (string, string) {
+	title := "Changes from Trybook"
+	var body strings.Builder
+	body.WriteString("Prompts from this Trybook session:\n\n")
+	for i, e := range entries {
+		p := strings.TrimSpace(e.Prompt)
+		if i == 0 && p != "" {
+			title = strings.SplitN(p, "\n", 2)[0]
+			if len(title) > 72 {
+				title = title[:69] + "..."
+			}
+		}
+		fmt.Fprintf(&body, "%d. %s\n", i+1, strings.ReplaceAll(p, "\n", "\n   "))
+	}
+	return title, body.String()
+}
+
+func githubAPI(ctx context.Context, token, method, path string, in, out any) (int, error) {
+	var rd io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.github.com"+path, rd)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("github %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	if out != nil {
+		return resp.StatusCode, json.Unmarshal(b, out)
+	}
+	return resp.StatusCode, nil
+}
+
+// openPullRequest creates the PR, or finds the open one for the branch if
+// GitHub says it already exists.
+func openPullRequest(ctx context.Context, meta notebookMeta, entries []entry, token string) (string, error) {
+	base, err := baseBranch(ctx, meta)
+	if err != nil {
+		return "", fmt.Errorf("base branch: %w", err)
+	}
+	title, body := prDescription(entries)
+	var pr struct {
+		HTMLURL string `json:"html_url"`
+	}
+	code, err := githubAPI(ctx, token, http.MethodPost, fmt.Sprintf("/repos/%s/%s/pulls", meta.Org, meta.Repo), map[string]string{
+		"title": title,
+		"head":  meta.Branch,
+		"base":  base,
+		"body":  body,
+	}, &pr)
+	if err == nil {
+		return pr.HTMLURL, nil
+	}
+	if code != http.StatusUnprocessableEntity {
+		return "", err
+	}
+	var open []struct {
+		HTMLURL string `json:"html_url"`
+	}
+	q := url.Values{"head": {meta.Org + ":" + meta.Branch}, "state": {"open"}}
+	if _, lerr := githubAPI(ctx, token, http.MethodGet, fmt.Sprintf("/repos/%s/%s/pulls?%s", meta.Org, meta.Repo, q.Encode()), nil, &open); lerr != nil || len(open) == 0 {
+		return "", err
+	}
+	return open[0].HTMLURL, nil
+}
+
+func loadPRURL(ctx context.Context, nbID string) (string, error) {
+	var u string
+	err := db.QueryRowContext(ctx, `SELECT pr_url FROM notebooks WHERE id = ?`, nbID).Scan(&u)
+	return u, err
+}
+
+// POST /api/pr?nb=..
+func pullRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, entries, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if meta.Host != defaultHost {
+		http.Error(w, "pull requests are only supported for github.com repositories", http.StatusBadRequest)
+		return
+	}
+	token := gitToken(r.Context(), defaultHost)
+	if token == "" {
+		http.Error(w, "no GitHub token: add one in Settings or set GITHUB_TOKEN on the server", http.StatusServiceUnavailable)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	if err := pushNotebookBranch(ctx, meta, token); err != nil {
+		slog.ErrorContext(r.Context(), "pullRequestHandler", "err", err)
+		if errors.Is(err, errNoCommits) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	prURL, err := loadPRURL(ctx, nbID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "pullRequestHandler: load pr_url", "err", err)
+	}
+	if prURL == "" {
+		if prURL, err = openPullRequest(ctx, meta, entries, token); err != nil {
+			slog.ErrorContext(r.Context(), "pullRequestHandler", "err", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE notebooks SET pr_url = ? WHERE id = ?`, prURL, nbID); err != nil {
+			slog.ErrorContext(r.Context(), "pullRequestHandler: save pr_url", "err", err)
+		}
+	}
+	slog.InfoContext(r.Context(), "pullRequestHandler: pushed", "pr", prURL)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]string{"url": prURL})
+}
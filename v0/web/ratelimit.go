@@ -0,0 +1,117 @@
+package web
+
+import (
+	"flag"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limiting of the requests that cost something: creating notebooks
+// (which clones), starting runs, pull requests, upstream updates and
+// sign-ins. Each signed-in user, or each client address when nobody is
+// signed in, has a token bucket of -rate-limit requests per minute that
+// allows bursts of up to -rate-burst. Requests over the limit get 429 with
+// Retry-After.
+
+var (
+	rateLimit = flag.Int("rate-limit", 30, "requests per minute per user or address to endpoints that clone, run or sign in (0 disables)")
+	rateBurst = flag.Int("rate-burst", 10, "requests allowed at once before -rate-limit applies")
+)
+
+// limitedPaths are the endpoints rate limited on every method but GET;
+// GET /events/run is limited only when it starts a run.
+var limitedPaths = map[string]bool{
+	"/try":           true,
+	"/prompt":        true,
+	"/rerun":         true,
+	"/fork":          true,
+	"/rollback":      true,
+	"/import":        true,
+	"/login":         true,
+	"/api/pr":        true,
+	"/api/upstream":  true,
+	"/api/unshallow": true,
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	bucketsMu sync.Mutex
+	buckets   = make(map[string]*bucket)
+)
+
+// takeToken takes a token from key's bucket, or returns how long until
+// one is available.
+func takeToken(key string, now time.Time) (bool, time.Duration) {
+	perSec := float64(*rateLimit) / 60
+	burst := float64(max(*rateBurst, 1))
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	b := buckets[key]
+	if b == nil {
+		if len(buckets) > 10000 {
+			pruneBuckets(now, perSec, burst)
+		}
+		b = &bucket{tokens: burst, last: now}
+		buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*perSec)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / perSec * float64(time.Second))
+}
+
+// pruneBuckets forgets buckets that have refilled; they start full anyway.
+// The caller holds bucketsMu.
+func pruneBuckets(now time.Time, perSec, burst float64) {
+	for k, b := range buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*perSec >= burst {
+			delete(buckets, k)
+		}
+	}
+}
+
+// rateKey is the signed-in user, else the client's address.
+func rateKey(r *http.Request) string {
+	if u := currentUser(r.Context()); u != "" {
+		return "user:" + u
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// limitRate wraps the mux inside requireAuth, so it knows the user.
+func limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limited := limitedPaths[r.URL.Path] && r.Method != http.MethodGet
+		if r.URL.Path == "/events/run" && r.URL.Query().Get("attach") != "1" {
+			limited = true
+		}
+		if *rateLimit <= 0 || !limited {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := rateKey(r)
+		if ok, wait := takeToken(key, time.Now()); !ok {
+			slog.WarnContext(r.Context(), "rate limit exceeded", "key", key, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests; try again shortly", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,397 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"trybook/runner"
+)
+
+// Repo maps. Models that answer without editing (claude, gemini) start
+// with no idea of the repository's layout, so their prompts are prefixed
+// with a map of it: the files at the worktree's HEAD, under the notebook's
+// directory, each with the symbols it exports. Go is read with go/parser;
+// Python, JavaScript, TypeScript and Rust by their declarations' first
+// lines. Ignored files (see ignore.go) are left out. A map is built once
+// per commit and kept in repo_maps; the prompt gets at most
+// repo_map.max_chars of it (default 8000; 0 turns maps off), symbols
+// dropped first. Models that edit have their own ways to look around and
+// get none, unless their "repo_map" in the config is true; false turns it
+// off for a model that answers.
+
+const repoMapsSchema = `
+	CREATE TABLE IF NOT EXISTS repo_maps (
+		host       TEXT NOT NULL,
+		org        TEXT NOT NULL,
+		repo       TEXT NOT NULL,
+		commit_sha TEXT NOT NULL,
+		subdir     TEXT NOT NULL DEFAULT '',
+		rules      TEXT NOT NULL DEFAULT '', -- hash of the ignore rules it was built with
+		map        TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (host, org, repo, commit_sha, subdir, rules)
+	);`
+
+type repoMapConfig struct {
+	// MaxChars caps the map in a prompt; 0 leaves maps out.
+	MaxChars int `json:"max_chars"`
+}
+
+const (
+	defaultRepoMapChars = 8000
+	// repoMapMaxFiles caps the files a map lists.
+	repoMapMaxFiles = 5000
+	// repoMapMaxFileBytes: larger files are listed but not read.
+	repoMapMaxFileBytes = 256 << 10
+	// repoMapMaxSymbols caps the symbols listed per file.
+	repoMapMaxSymbols = 30
+	// repoMapsKept is how many maps are kept per repository, newest first.
+	repoMapsKept = 20
+)
+
+// repoMapChars returns how much of the map model's prompts get; 0 means
+// none.
+func (c *config) repoMapChars(model string, rn runner.Runner) int {
+	if mc, ok := c.Models[model]; ok && mc.RepoMap != nil {
+		if !*mc.RepoMap {
+			return 0
+		}
+	} else if editsWorktree(rn) {
+		return 0
+	}
+	if c.RepoMap == nil {
+		return defaultRepoMapChars
+	}
+	return c.RepoMap.MaxChars
+}
+
+// repoMapFile is a file of the map and the symbols it exports.
+type repoMapFile struct {
+	Path    string
+	Symbols []string
+}
+
+// withRepoMap returns prompt prefixed with the map of the worktree dir,
+// cut to maxChars, or prompt unchanged if there is none.
+func withRepoMap(ctx context.Context, meta notebookMeta, dir string, ignore *ignoreRules, maxChars int, prompt string) (string, error) {
+	if maxChars <= 0 {
+		return prompt, nil
+	}
+	head, err := gitHead(ctx, dir)
+	if err != nil {
+		return prompt, err
+	}
+	m, err := loadRepoMap(ctx, meta, dir, head, ignore)
+	if err != nil || m == "" {
+		return prompt, err
+	}
+	return "Repository map (files at " + shortSHA(head) + ", with their exported symbols):\n\n" +
+		cutRepoMap(m, maxChars) + "\n\n" + prompt, nil
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+// loadRepoMap returns the stored map for commit head, building and storing
+// it first if there is none.
+func loadRepoMap(ctx context.Context, meta notebookMeta, dir, head string, ignore *ignoreRules) (string, error) {
+	rules := ignoreHash(ignore)
+	var m string
+	err := db.QueryRowContext(ctx, `
+		SELECT map FROM repo_maps WHERE host = ? AND org = ? AND repo = ? AND commit_sha = ? AND subdir = ? AND rules = ?
+	`, meta.Host, meta.Org, meta.Repo, head, meta.Subdir, rules).Scan(&m)
+	if err == nil {
+		return m, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	files, err := buildRepoMap(ctx, dir, head, meta.Subdir, ignore)
+	if err != nil {
+		return "", err
+	}
+	m = formatRepoMap(files)
+	err = inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO repo_maps(host, org, repo, commit_sha, subdir, rules, map) VALUES(?, ?, ?, ?, ?, ?, ?)
+		`, meta.Host, meta.Org, meta.Repo, head, meta.Subdir, rules, m); err != nil {
+			return err
+		}
+		// Each commit a notebook makes gets a map; drop the old ones.
+		_, err := tx.ExecContext(ctx, `
+			DELETE FROM repo_maps WHERE host = ?1 AND org = ?2 AND repo = ?3 AND rowid NOT IN (
+				SELECT rowid FROM repo_maps WHERE host = ?1 AND org = ?2 AND repo = ?3
+				ORDER BY created_at DESC, rowid DESC LIMIT ?4)
+		`, meta.Host, meta.Org, meta.Repo, repoMapsKept)
+		return err
+	})
+	return m, err
+}
+
+func ignoreHash(ir *ignoreRules) string {
+	if ir == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(ir.lines, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// buildRepoMap lists the files of commit head under subdir that ignore
+// lets through, reading the symbols of those in languages it knows.
+func buildRepoMap(ctx context.Context, dir, head, subdir string, ignore *ignoreRules) ([]repoMapFile, error) {
+	args := []string{"-C", dir, "ls-tree", "-r", "-z", "--long", head}
+	if subdir != "" {
+		args = append(args, "--", subdir)
+	}
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-tree: %w", err)
+	}
+	var files []repoMapFile
+	var read []int // indexes into files of those to read
+	var blobs []string
+	for _, rec := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <object> SP* <size> TAB <path>
+		meta, p, ok := strings.Cut(rec, "\t")
+		fs := strings.Fields(meta)
+		if !ok || len(fs) != 4 || fs[1] != "blob" || ignore.Ignored(p) {
+			continue
+		}
+		if len(files) == repoMapMaxFiles {
+			break
+		}
+		files = append(files, repoMapFile{Path: p})
+		if size, err := strconv.Atoi(fs[3]); err == nil && size <= repoMapMaxFileBytes && symbolReader(p) != nil {
+			read = append(read, len(files)-1)
+			blobs = append(blobs, fs[2])
+		}
+	}
+	if len(blobs) == 0 {
+		return files, nil
+	}
+	contents, err := catBlobs(ctx, dir, blobs)
+	if err != nil {
+		return nil, err
+	}
+	for k, i := range read {
+		syms := symbolReader(files[i].Path)(contents[k])
+		if len(syms) > repoMapMaxSymbols {
+			syms = append(syms[:repoMapMaxSymbols], "...")
+		}
+		files[i].Symbols = syms
+	}
+	return files, nil
+}
+
+// catBlobs returns the contents of the blobs, in order, from one git
+// cat-file --batch.
+func catBlobs(ctx context.Context, dir string, blobs []string) ([][]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(strings.Join(blobs, "\n") + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("git cat-file: %w", err)
+	}
+	br := bufio.NewReader(stdout)
+	out := make([][]byte, 0, len(blobs))
+	for range blobs {
+		// <object> SP <type> SP <size> LF <contents> LF
+		line, err := br.ReadString('\n')
+		if err != nil {
+			_ = cmd.Wait()
+			return nil, fmt.Errorf("git cat-file: %w", err)
+		}
+		fs := strings.Fields(line)
+		if len(fs) != 3 {
+			out = append(out, nil) // missing
+			continue
+		}
+		n, _ := strconv.Atoi(fs[2])
+		b := make([]byte, n+1)
+		if _, err := io.ReadFull(br, b); err != nil {
+			_ = cmd.Wait()
+			return nil, fmt.Errorf("git cat-file: %w", err)
+		}
+		out = append(out, b[:n])
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("git cat-file: %w", err)
+	}
+	return out, nil
+}
+
+// symbolReader returns the function that lists the exported symbols of
+// the file p, or nil for a language it does not know.
+func symbolReader(p string) func([]byte) []string {
+	switch ext := path.Ext(p); {
+	case ext == ".go" && !strings.HasSuffix(p, "_test.go"):
+		return goSymbols
+	case ext == ".py":
+		return lineSymbols(pySymbolRE)
+	case ext == ".js" || ext == ".mjs" || ext == ".jsx" || ext == ".ts" || ext == ".tsx":
+		if strings.HasSuffix(p, ".min.js") || strings.HasSuffix(p, ".d.ts") {
+			return nil
+		}
+		return lineSymbols(jsSymbolRE)
+	case ext == ".rs":
+		return lineSymbols(rustSymbolRE)
+	}
+	return nil
+}
+
+// goSymbols lists a Go file's exported declarations: "func Name",
+// "func (T) Name", "type Name" and const and var names.
+func goSymbols(src []byte) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() {
+				continue
+			}
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				recv := receiverName(d.Recv.List[0].Type)
+				if !ast.IsExported(recv) {
+					continue
+				}
+				out = append(out, "func ("+recv+") "+d.Name.Name)
+				continue
+			}
+			out = append(out, "func "+d.Name.Name)
+		case *ast.GenDecl:
+			for _, s := range d.Specs {
+				switch s := s.(type) {
+				case *ast.TypeSpec:
+					if s.Name.IsExported() {
+						out = append(out, "type "+s.Name.Name)
+					}
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						if n.IsExported() {
+							out = append(out, d.Tok.String()+" "+n.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// receiverName returns the type name of a method's receiver.
+func receiverName(e ast.Expr) string {
+	for {
+		switch t := e.(type) {
+		case *ast.StarExpr:
+			e = t.X
+		case *ast.IndexExpr:
+			e = t.X
+		case *ast.IndexListExpr:
+			e = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+var (
+	pySymbolRE   = regexp.MustCompile(`^(?:async\s+)?(def|class)\s+([A-Za-z]\w*)`)
+	jsSymbolRE   = regexp.MustCompile(`^export\s+(?:default\s+)?(?:declare\s+)?(?:abstract\s+)?(?:async\s+)?(function\*?|class|const|let|var|interface|type|enum)\s+([A-Za-z_$][\w$]*)`)
+	rustSymbolRE = regexp.MustCompile(`^\s*pub\s+(?:async\s+)?(?:unsafe\s+)?(fn|struct|enum|trait|type|const|static|mod)\s+([A-Za-z_]\w*)`)
+)
+
+// lineSymbols lists the declarations re matches at the start of a line,
+// as "<keyword> <name>".
+func lineSymbols(re *regexp.Regexp) func([]byte) []string {
+	return func(src []byte) []string {
+		var out []string
+		for _, line := range bytes.Split(src, []byte("\n")) {
+			if m := re.FindSubmatch(line); m != nil {
+				out = append(out, string(m[1])+" "+string(m[2]))
+			}
+		}
+		return out
+	}
+}
+
+// formatRepoMap writes one line per file, sorted by path, followed by its
+// symbols: "path: func A, type B".
+func formatRepoMap(files []repoMapFile) string {
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	var b strings.Builder
+	for _, f := range files {
+		b.WriteString(f.Path)
+		if len(f.Symbols) > 0 {
+			b.WriteString(": ")
+			b.WriteString(strings.Join(f.Symbols, ", "))
+		}
+		b.WriteByte('\n')
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// cutRepoMap fits a map into maxChars: the symbols of the last files go
+// first, and then the files at the end, which a note counts.
+func cutRepoMap(m string, maxChars int) string {
+	if len(m) <= maxChars {
+		return m
+	}
+	lines := strings.Split(m, "\n")
+	paths := 0
+	for _, l := range lines {
+		p, _, _ := strings.Cut(l, ": ")
+		paths += len(p) + 1
+	}
+	// Keep each file's symbols while the rest of the files still fit.
+	budget := maxChars - paths
+	for i, l := range lines {
+		p, syms, ok := strings.Cut(l, ": ")
+		if !ok {
+			continue
+		}
+		if budget >= len(syms)+2 {
+			budget -= len(syms) + 2
+			continue
+		}
+		lines[i] = p
+	}
+	var b strings.Builder
+	for i, l := range lines {
+		if b.Len()+len(l)+1 > maxChars-40 && i < len(lines)-1 {
+			fmt.Fprintf(&b, "... and %d more files", len(lines)-i)
+			return b.String()
+		}
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
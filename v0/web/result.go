@@ -0,0 +1,138 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"trybook/runner"
+)
+
+// Run results. A model with "result" in the config has its CLI's closing
+// report read after each run; "aider" picks out the commits aider made
+// ("Commit 1a2b3c4 fix: ..."), the files it edited ("Applied edit to
+// path") and the session's cost ("Cost: $0.01 message, $0.12 session.").
+// They are stored on the run (runs.result_commits, result_files and
+// result_cost_usd), and the output box shows them as a line above the raw
+// output: "2 commits, 5 files, $0.12". A live run sends the same as a
+// "result" event before it finishes.
+
+// resultRunner is implemented by runners whose output ends in a report
+// that can be summarized.
+type resultRunner interface {
+	ResultFormat() string
+}
+
+func resultFormat(rn runner.Runner) string {
+	r, ok := rn.(resultRunner)
+	if !ok {
+		return ""
+	}
+	return r.ResultFormat()
+}
+
+var resultFormats = map[string]func(output string) runResult{
+	"aider": parseAiderResult,
+}
+
+type runResult struct {
+	Commits []string `json:"commits"`
+	Files   []string `json:"files"`
+	CostUSD float64  `json:"cost_usd"`
+	Summary string   `json:"summary"`
+}
+
+func (r runResult) IsZero() bool {
+	return len(r.Commits) == 0 && len(r.Files) == 0 && r.CostUSD == 0
+}
+
+// summarize sets Summary from the rest.
+func (r *runResult) summarize() {
+	var parts []string
+	if n := len(r.Commits); n > 0 {
+		parts = append(parts, plural(n, "commit"))
+	}
+	if n := len(r.Files); n > 0 {
+		parts = append(parts, plural(n, "file"))
+	}
+	if r.CostUSD > 0 {
+		parts = append(parts, fmt.Sprintf("$%.2f", r.CostUSD))
+	}
+	r.Summary = strings.Join(parts, ", ")
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+var (
+	// ansiRE matches the terminal escapes a PTY run's output may carry.
+	ansiRE        = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+	aiderCommitRE = regexp.MustCompile(`(?m)^Commit ([0-9a-f]{7,40})\b`)
+	aiderEditRE   = regexp.MustCompile(`(?m)^Applied edit to (.+?)\s*$`)
+	aiderCostRE   = regexp.MustCompile(`Cost: \$([\d.,]+) message, \$([\d.,]+) session`)
+)
+
+func parseAiderResult(output string) runResult {
+	output = strings.ReplaceAll(ansiRE.ReplaceAllString(output, ""), "\r", "")
+	var r runResult
+	seen := map[string]bool{}
+	for _, m := range aiderCommitRE.FindAllStringSubmatch(output, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			r.Commits = append(r.Commits, m[1])
+		}
+	}
+	seen = map[string]bool{}
+	for _, m := range aiderEditRE.FindAllStringSubmatch(output, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			r.Files = append(r.Files, m[1])
+		}
+	}
+	// The session total of the last message covers the whole run.
+	if ms := aiderCostRE.FindAllStringSubmatch(output, -1); len(ms) > 0 {
+		if f, ok := parseAmount(ms[len(ms)-1][2]); ok {
+			r.CostUSD = f
+		}
+	}
+	r.summarize()
+	return r
+}
+
+// recordResult reads the run's report, if its runner has one, into the
+// run's row and pr.result.
+func (pr *preparedRun) recordResult(ctx context.Context, runID int64, output string) {
+	parse := resultFormats[resultFormat(pr.runner)]
+	if parse == nil || runID == 0 {
+		return
+	}
+	r := parse(output)
+	if r.IsZero() {
+		return
+	}
+	pr.result = &r
+	if _, err := execDB(ctx, `
+		UPDATE runs SET result_commits = ?, result_files = ?, result_cost_usd = ? WHERE id = ?
+	`, strings.Join(r.Commits, " "), strings.Join(r.Files, "\n"), r.CostUSD, runID); err != nil {
+		slog.ErrorContext(ctx, "run: record result", "err", err)
+	}
+}
+
+// scanResult rebuilds a run's result from its columns.
+func scanResult(commits, files string, cost float64) *runResult {
+	r := runResult{Commits: strings.Fields(commits), CostUSD: cost}
+	if files != "" {
+		r.Files = strings.Split(files, "\n")
+	}
+	if r.IsZero() {
+		return nil
+	}
+	r.summarize()
+	return &r
+}
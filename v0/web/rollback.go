@@ -0,0 +1,89 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Rolling a notebook back. "Roll back to here" on an entry resets the
+// worktree to the HEAD recorded after that entry's run (git reset --hard,
+// then git clean -fd for untracked files runs left behind) and marks the
+// later entries stale: their outputs describe changes the worktree no
+// longer has, until they are run again. The abandoned commits can still
+// be found in the branch's reflog.
+
+var errRollbackRewritten = errors.New("that entry's commit predates the last update from upstream")
+
+// rollbackNotebook resets the worktree to entry idx and returns the new HEAD.
+func rollbackNotebook(ctx context.Context, meta notebookMeta, idx, entries int) (string, error) {
+	if idx < 0 || idx >= entries {
+		return "", fmt.Errorf("%w: no entry %d", errRunNotFound, idx)
+	}
+	if notebookBusy(meta.ID) {
+		return "", errNotebookBusy
+	}
+	commit, err := entryCommit(ctx, meta, idx)
+	if err != nil {
+		return "", err
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	// Diffs, the timeline and pull requests start at the notebook's start
+	// commit; a commit a rebase has since replaced does not descend from it.
+	if exec.CommandContext(ctx, "git", "-C", dir, "merge-base", "--is-ancestor", meta.SHA, commit).Run() != nil {
+		return "", errRollbackRewritten
+	}
+	old, err := gitHead(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+	for _, args := range [][]string{{"reset", "--hard", commit}, {"clean", "-fd"}} {
+		if out, err := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("git %s: %v\n%s", args[0], err, strings.TrimSpace(string(out)))
+		}
+	}
+	slog.InfoContext(ctx, "rollback: reset worktree", "idx", idx, "from", old, "to", commit)
+	if _, err := db.ExecContext(ctx, `
+		UPDATE notebook_entries SET stale = (idx > ?) WHERE notebook_id = ?
+	`, idx, meta.ID); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// POST /rollback (nb, idx)
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	idx, err := strconv.Atoi(strings.TrimSpace(r.FormValue("idx")))
+	if err != nil || !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, es, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if _, err := rollbackNotebook(r.Context(), meta, idx, len(es)); err != nil {
+		slog.ErrorContext(r.Context(), "rollbackHandler", "idx", idx, "err", err)
+		switch {
+		case errors.Is(err, errRunNotFound):
+			http.Error(w, "not found", http.StatusNotFound)
+		case errors.Is(err, errNotebookBusy), errors.Is(err, errRollbackRewritten):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, "rollback failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/n/%s#entry-%d", nbID, idx), http.StatusSeeOther)
+}
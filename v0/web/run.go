@@ -0,0 +1,373 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+
+	"trybook/runner"
+)
+
+// A single model invocation for one notebook entry, started by the run
+// queue and followed over the SSE endpoint.
+
+var (
+	errRunBadRequest = errors.New("bad request")
+	errRunNotFound   = errors.New("not found")
+)
+
+type preparedRun struct {
+	cfg     *config // snapshot; a reload mid-run does not affect this run
+	runner  runner.Runner
+	meta    notebookMeta
+	nbID    string
+	idx     int
+	model   string
+	prompt  string
+	env     []string    // the notebook's variables, NAME=value
+	files   []string    // attached worktree files, passed with the runner's file argument
+	ignore  string      // file of the ignore rules, passed with the runner's ignore argument
+	sandbox *sandboxRun // nil when the run happens on the host
+	dir     string      // the notebook's worktree, the run's A/B lane or its dry run's scratch worktree
+	lane    bool
+	dryRun  bool
+	// fallbackFrom is the model whose failure this run stands in for.
+	fallbackFrom string
+	// result is what execute read from the CLI's report, if anything.
+	result *runResult
+}
+
+func prepareRun(ctx context.Context, cfg *config, nbID string, idx int, model string) (*preparedRun, error) {
+	if !isSafeToken(nbID) || idx < 0 {
+		return nil, errRunBadRequest
+	}
+	meta, es, err := loadNotebook(ctx, nbID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errRunNotFound, err)
+	}
+	if err := ensureWorktree(ctx, meta); err != nil {
+		return nil, err
+	}
+	rn, ok := cfg.registry.Get(model)
+	if model == TestsModel {
+		cmd := repoTestCommand(ctx, cfg, meta.Host, meta.Org, meta.Repo)
+		rn, ok = testRunner{command: cmd}, cmd != ""
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown model %q", errRunBadRequest, model)
+	}
+	prompt, err := notebooks.Prompt(ctx, nbID, idx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: load prompt: %v", errRunBadRequest, err)
+	}
+	var files []string
+	var ignore *ignoreRules
+	if model != "router" && model != TestsModel {
+		rn = withParams(rn, entryParams(ctx, cfg, nbID, idx, model))
+		wtDir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+		if ignore, err = cfg.contextIgnore(meta, wtDir); err != nil {
+			slog.WarnContext(ctx, "run: ignore rules", "nb", nbID, "err", err)
+		}
+		if idx < len(es) {
+			prompt, files = withAttachments(ctx, wtDir, prompt, es[idx].Attachments, fileArg(rn), ignore)
+		}
+	}
+	if prompt, err = withContext(ctx, cfg, nbID, idx, model, prompt); err != nil {
+		return nil, fmt.Errorf("load context: %w", err)
+	}
+	if model == "router" {
+		prompt = withRoutingFeedback(ctx, meta, prompt)
+	}
+	dryRun := model != "router" && model != TestsModel && idx < len(es) && es[idx].DryRun && editsWorktree(rn)
+	if dryRun {
+		prompt = dryRunPrompt + prompt
+	}
+	if model != "router" && model != TestsModel {
+		wtDir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+		if prompt, err = withRepoMap(ctx, meta, wtDir, ignore, cfg.repoMapChars(model, rn), prompt); err != nil {
+			// The run goes on without it.
+			slog.WarnContext(ctx, "run: repo map", "nb", nbID, "err", err)
+		}
+	}
+	env, err := notebookEnv(ctx, nbID)
+	if err != nil {
+		return nil, fmt.Errorf("load environment: %w", err)
+	}
+	dir, lane := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree), false
+	if dryRun {
+		if dir, err = prepareDryRun(ctx, meta, idx, model); err != nil {
+			return nil, fmt.Errorf("prepare dry run: %w", err)
+		}
+	} else if model != "router" && model != TestsModel && idx < len(es) && es[idx].ABEdits && editsWorktree(rn) {
+		if dir, err = prepareLane(ctx, meta, idx, model); err != nil {
+			return nil, fmt.Errorf("prepare lane: %w", err)
+		}
+		lane = true
+	}
+	var ignorePath string
+	if ignore != nil && ignoreArg(rn) != "" {
+		if ignorePath, err = writeIgnoreFile(ctx, dir, ignore); err != nil {
+			return nil, fmt.Errorf("write ignore rules: %w", err)
+		}
+	}
+	var sb *sandboxRun
+	if cfg.Sandbox.Engine != "" && (model == TestsModel || cfg.sandboxImage(model) != "") {
+		if sb, err = prepareSandbox(ctx, cfg, cfg.sandboxImage(model)); err != nil {
+			return nil, err
+		}
+	}
+	return &preparedRun{cfg: cfg, runner: rn, meta: meta, nbID: nbID, idx: idx, model: model, prompt: prompt, env: env, files: files, ignore: ignorePath, sandbox: sb, dir: dir, lane: lane, dryRun: dryRun}, nil
+}
+
+// execute runs the model, copying its standard output to out and standard
+// error to errOut (both to out for PTY models), and persists the result:
+// the output, and standard error apart from it.
+// It returns the process exit code (-1 if it never started or was killed by
+// a signal) and any start/wait error.
+func (pr *preparedRun) execute(ctx context.Context, out, errOut io.Writer) (int, error) {
+	ctx = withLogAttrs(ctx, "nb", pr.nbID, "idx", pr.idx, "model", pr.model)
+	// Persist even if the run itself was canceled (Stop button).
+	dbCtx := context.WithoutCancel(ctx)
+	model := pr.model
+	runLimit, idleLimit := pr.cfg.runTimeouts(model)
+	var lastOutput atomic.Int64
+	lastOutput.Store(time.Now().UnixNano())
+	runCtx, stopWatch := watchRun(ctx, runLimit, idleLimit, &lastOutput)
+	defer stopWatch()
+	argv := pr.runner.Command(pr.prompt)
+	for _, f := range pr.files {
+		argv = append(argv, fileArg(pr.runner), f)
+	}
+	if pr.ignore != "" {
+		argv = append(argv, ignoreArg(pr.runner), pr.ignore)
+	}
+	stdin := pr.runner.Stdin(pr.prompt)
+	// Models start in the directory the notebook is scoped to; the test
+	// command, like the repo profile it comes from, is for the whole tree.
+	// Git state is read from the worktree's top either way.
+	dir, workDir := pr.dir, pr.dir
+	if model != TestsModel {
+		workDir = pr.meta.workDir(dir)
+	}
+	usePTY := usesPTY(pr.runner)
+	if pr.sandbox != nil {
+		gitDir := filepath.Join(repoDirPath(pr.meta.Host, pr.meta.Org, pr.meta.Repo), ".git")
+		argv = pr.sandbox.command(argv, []string{workDir, dir, gitDir}, pr.envNames(), usePTY, stdin != nil)
+		defer pr.sandbox.remove(dbCtx)
+	}
+	cmd := currentExecer().CommandContext(runCtx, argv[0], argv[1:]...)
+	cmd.Stdin = stdin
+	cmd.Dir = workDir
+	// Ensure API keys are available to the child process; the notebook's
+	// own variables come last so they win.
+	cmd.Env = append(pr.runner.Env(), pr.env...)
+
+	// Standard error is stored apart, so error text stays out of the
+	// answer; a PTY merges the two and all of it lands in buf.
+	var buf, errBuf bytes.Buffer
+	var bufMu sync.Mutex
+	active, unregister := registerRun(pr)
+	defer unregister()
+	act := activityWriter{active.counter(&buf), &lastOutput}
+	mw := lockedWriter{&bufMu, io.MultiWriter(act, out)}
+	var stdout io.Writer = mw
+	flushStdout := func() {}
+	if outputFormat(pr.runner) == formatClaudeStreamJSON {
+		sink, _ := out.(eventSink)
+		cs := newClaudeStreamWriter(mw, sink)
+		stdout, flushStdout = cs, func() { _ = cs.flush() }
+	}
+	// For PTY models we stream via the terminal, so don’t attach Stdout/Stderr here
+	if !usePTY {
+		cmd.Stdout = stdout
+		cmd.Stderr = lockedWriter{&bufMu, io.MultiWriter(activityWriter{active.counter(&errBuf), &lastOutput}, errOut)}
+	} else {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	}
+	superviseCmd(cmd)
+
+	// Remember HEAD so commits made by the run can be diffed later.
+	headBefore, _ := gitHead(dbCtx, dir)
+
+	var runID int64
+	record := func(int, string, string, bool) {}
+	if model != "router" {
+		runID, record = recordRun(dbCtx, pr.nbID, pr.idx, model)
+		ctx, dbCtx = withLogAttrs(ctx, "run_id", runID), withLogAttrs(dbCtx, "run_id", runID)
+		if err := recordRunParams(dbCtx, runID, paramValues(pr.runner)); err != nil {
+			slog.ErrorContext(ctx, "run: record params", "err", err)
+		}
+		if err := recordRunFallbackFrom(dbCtx, runID, pr.fallbackFrom); err != nil {
+			slog.ErrorContext(ctx, "run: record fallback", "err", err)
+		}
+		if err := recordRunCommand(dbCtx, runID, argv, workDir, pr.envNames()); err != nil {
+			slog.ErrorContext(ctx, "run: record command", "err", err)
+		}
+	}
+	// Usage is recorded for failed runs too; they cost money all the same.
+	defer func() { recordUsage(dbCtx, pr.runner, runID, pr.nbID, pr.idx, model, buf.String()) }()
+	defer func() { pr.recordResult(dbCtx, runID, buf.String()) }()
+	stopProgress := func() {}
+	if model != "router" {
+		stopProgress = saveProgress(ctx, &bufMu, &buf, &errBuf, func(output, stderr string) error {
+			return notebooks.SaveProgress(dbCtx, runID, pr.nbID, pr.idx, model, output, stderr)
+		})
+		defer stopProgress()
+	}
+
+	ev := runEvent{Event: "run.done", NotebookID: pr.nbID, Idx: pr.idx, Model: model, RunID: runID,
+		Repo: pr.meta.repoSpec().String(), started: time.Now()}
+	fail := func(err error) (int, error) {
+		record(exitCode(err), buf.String(), errBuf.String(), isRunTimeout(err))
+		ev.Event, ev.Error, ev.ExitCode = "run.error", err.Error(), exitCode(err)
+		if isRunTimeout(err) {
+			ev.Event, ev.TimedOut = "run.timeout", true
+		}
+		pr.cfg.notify(ev)
+		return exitCode(err), err
+	}
+
+	start := time.Now()
+	slog.InfoContext(ctx, "run: started", "dir", cmd.Dir, "pty", usePTY)
+	if usePTY {
+		pt, err := pty.Start(cmd)
+		if err != nil {
+			slog.ErrorContext(ctx, "run: start", "err", err)
+			return fail(fmt.Errorf("failed to start %s: %w", model, err))
+		}
+		defer pt.Close()
+		trackProcGroup(cmd, model, runner.Key(pr.nbID, pr.idx, model))
+		active.pid.Store(int64(cmd.Process.Pid))
+
+		// Stop the process group if the run is canceled. Closing the
+		// terminal would SIGHUP it at once, so that waits out the grace
+		// period in case something outside the group holds it open.
+		stop := context.AfterFunc(runCtx, func() {
+			if cmd.Process != nil {
+				_ = terminateProcGroup(cmd.Process.Pid)
+			}
+			time.AfterFunc(stopGrace+time.Second, func() { _ = pt.Close() })
+		})
+		defer stop()
+
+		// Stream PTY output to the writer and buffer
+		if _, err := io.Copy(mw, pt); err != nil {
+			slog.WarnContext(ctx, "run: PTY copy", "err", err)
+		}
+	} else {
+		if err := cmd.Start(); err != nil {
+			slog.ErrorContext(ctx, "run: start", "err", err)
+			return fail(fmt.Errorf("failed to start %s: %w", model, err))
+		}
+		trackProcGroup(cmd, model, runner.Key(pr.nbID, pr.idx, model))
+		active.pid.Store(int64(cmd.Process.Pid))
+	}
+	err := cmd.Wait()
+	finishProcGroup(cmd)
+	flushStdout()
+	stopProgress()
+	// A timeout, unlike the Stop button, leaves ctx itself alive.
+	if cause := context.Cause(runCtx); isRunTimeout(cause) && ctx.Err() == nil {
+		err = cause
+	}
+	if pr.dryRun {
+		pr.reportDryRun(dbCtx, headBefore, mw)
+	} else if err == nil && appliesDiff(pr.runner) {
+		err = pr.applyOutput(dbCtx, dir, buf.String(), mw)
+	}
+	if agentEdits(pr.runner) && !pr.dryRun {
+		if cerr := pr.commitEdits(dbCtx, dir, mw); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if model == TestsModel {
+		status := "pass"
+		if err != nil {
+			status = "fail"
+		}
+		if perr := notebooks.SetTests(dbCtx, pr.nbID, pr.idx, status); perr != nil {
+			slog.ErrorContext(ctx, "run: persist test result", "err", perr)
+		}
+	}
+	if model == "router" {
+		if err == nil {
+			pr.recordIntent(dbCtx, buf.String())
+		}
+	} else if perr := notebooks.SetOutput(dbCtx, pr.nbID, pr.idx, model, buf.String()); perr != nil {
+		slog.ErrorContext(ctx, "run: persist output", "err", perr)
+	} else {
+		if perr := notebooks.SetOutputStderr(dbCtx, pr.nbID, pr.idx, model, errBuf.String()); perr != nil {
+			slog.ErrorContext(ctx, "run: persist stderr", "err", perr)
+		}
+		headAfter, _ := gitHead(dbCtx, dir)
+		if pr.dryRun {
+			headAfter = headBefore // whatever it committed went with the scratch worktree
+		}
+		if perr := notebooks.SetOutputHeads(dbCtx, pr.nbID, pr.idx, model, headBefore, headAfter); perr != nil {
+			slog.ErrorContext(ctx, "run: persist heads", "err", perr)
+		}
+		if perr := notebooks.SetRunHeads(dbCtx, runID, pr.nbID, pr.idx, headBefore, headAfter); perr != nil {
+			slog.ErrorContext(ctx, "run: persist run heads", "err", perr)
+		}
+		if err == nil && model != TestsModel && !editsWorktree(pr.runner) {
+			pr.recordCitations(dbCtx, dir, buf.String())
+		}
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "run: failed", "exit_code", exitCode(err), "duration", time.Since(start).Round(time.Millisecond), "output_bytes", buf.Len(), "stderr_bytes", errBuf.Len(), "err", err)
+		return fail(err)
+	}
+	slog.InfoContext(ctx, "run: done", "duration", time.Since(start).Round(time.Millisecond), "output_bytes", buf.Len())
+	record(0, buf.String(), errBuf.String(), false)
+	if model != "router" {
+		pr.cfg.notify(ev)
+	}
+	return 0, nil
+}
+
+// envNames returns the variables a sandboxed run gets: the model's and the
+// notebook's.
+func (pr *preparedRun) envNames() []string {
+	names := append([]string(nil), pr.cfg.Models[pr.model].Env...)
+	for _, kv := range pr.env {
+		if k, _, ok := strings.Cut(kv, "="); ok {
+			names = append(names, k)
+		}
+	}
+	return names
+}
+
+// recordIntent parses the router's decision and persists it.
+func (pr *preparedRun) recordIntent(ctx context.Context, out string) {
+	s := strings.ToLower(strings.TrimSpace(out))
+	intent := ""
+	for name := range pr.cfg.Intents {
+		if strings.HasPrefix(s, name) {
+			intent = name
+			break
+		}
+	}
+	if err := setNotebookEntryIntent(ctx, pr.nbID, pr.idx, intent, intentRouter); err != nil {
+		slog.ErrorContext(ctx, "run: set intent error", "err", err)
+	}
+}
+
+func exitCode(err error) int {
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Run commands. Every run records how its process was started: the argv
+// after the prompt, files and sandbox were put in, the directory it ran
+// in, and the names (never the values) of the environment variables the
+// model and the notebook give it (runs.argv, work_dir and env_names). The
+// output box shows the latest run's under "Details", and GET /api/runs
+// returns them for every run of an entry, so a run can be repeated by
+// hand. Runs from before this have none.
+
+type runCommand struct {
+	Argv []string `json:"argv"`
+	Dir  string   `json:"dir"`
+	Env  []string `json:"env"` // variable names, sorted
+}
+
+// Line returns the argv as one shell-quoted line.
+func (c *runCommand) Line() string {
+	parts := make([]string, len(c.Argv))
+	for i, a := range c.Argv {
+		parts[i] = shellQuote(a)
+	}
+	return strings.Join(parts, " ")
+}
+
+var shellSafeRE = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+func shellQuote(s string) string {
+	if shellSafeRE.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// recordRunCommand stores how run runID was started.
+func recordRunCommand(ctx context.Context, runID int64, argv []string, dir string, env []string) error {
+	if runID == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(env))
+	seen := map[string]bool{}
+	for _, k := range env {
+		if k != "" && !seen[k] {
+			seen[k] = true
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	b, err := json.Marshal(argv)
+	if err != nil {
+		return err
+	}
+	_, err = execDB(ctx, `
+		UPDATE runs SET argv = ?, work_dir = ?, env_names = ? WHERE id = ?
+	`, string(b), dir, strings.Join(names, " "), runID)
+	return err
+}
+
+// scanCommand rebuilds a run's command from its columns.
+func scanCommand(argv, dir, env string) *runCommand {
+	c := runCommand{Dir: dir, Env: strings.Fields(env)}
+	if json.Unmarshal([]byte(argv), &c.Argv) != nil || len(c.Argv) == 0 {
+		return nil
+	}
+	if c.Env == nil {
+		c.Env = []string{}
+	}
+	return &c
+}
+
+// apiRun is a run as GET /api/runs returns it.
+type apiRun struct {
+	ID         int64       `json:"id"`
+	Model      string      `json:"model"`
+	StartedAt  string      `json:"started_at"`
+	FinishedAt string      `json:"finished_at,omitempty"`
+	ExitCode   *int        `json:"exit_code,omitempty"` // unset until it finishes
+	DurationMS int64       `json:"duration_ms,omitempty"`
+	Command    *runCommand `json:"command,omitempty"`
+}
+
+// GET /api/runs?nb=..&idx=N[&model=..] lists the runs of an entry, or of
+// one model's box, oldest first, with the command each ran.
+func runsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	nbID, model := strings.TrimSpace(q.Get("nb")), strings.TrimSpace(q.Get("model"))
+	idx, err := strconv.Atoi(q.Get("idx"))
+	if !isSafeToken(nbID) || (model != "" && !isSafeToken(model)) || err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if ok, err := notebookExists(r.Context(), nbID); err != nil || !ok {
+		http.Error(w, errNotebookNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	runs, err := loadRuns(r.Context(), nbID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "runsHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	out := []apiRun{}
+	for m, rs := range runs[idx] {
+		if model != "" && m != model {
+			continue
+		}
+		for _, rr := range rs {
+			a := apiRun{ID: rr.ID, Model: m, StartedAt: rr.StartedAt, FinishedAt: rr.FinishedAt, Command: rr.Command}
+			if rr.FinishedAt != "" {
+				code := rr.ExitCode
+				a.ExitCode, a.DurationMS = &code, rr.Elapsed.Milliseconds()
+			}
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(out)
+}
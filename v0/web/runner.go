@@ -0,0 +1,153 @@
+package web
+
+import (
+	"io"
+	"log/slog"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"trybook/runner"
+)
+
+// The config's models as runner.Runners. Beyond the methods of that
+// interface, a runner may implement the small interfaces below and in the
+// files that use them (appliesDiff, fileArg, ...), which cliRunner does
+// from its modelConfig.
+
+// ptyRunner is implemented by runners that need a terminal (aider).
+type ptyRunner interface {
+	PTY() bool
+}
+
+func usesPTY(rn runner.Runner) bool {
+	p, ok := rn.(ptyRunner)
+	return ok && p.PTY()
+}
+
+// cleaningRunner is implemented by runners whose output gets cleaned up
+// after a run (gemini).
+type cleaningRunner interface {
+	CleansOutput() bool
+}
+
+func cleansOutput(rn runner.Runner) bool {
+	c, ok := rn.(cleaningRunner)
+	return ok && c.CleansOutput()
+}
+
+// cliRunner is a runner.Runner defined by a modelConfig entry.
+type cliRunner struct {
+	name  string
+	mc    modelConfig
+	usage *usageParser // nil if the model has no usage config
+}
+
+func (c cliRunner) Name() string { return c.name }
+
+func (c cliRunner) PTY() bool { return c.mc.PTY }
+
+func (c cliRunner) AppliesDiff() bool { return c.mc.ApplyDiff }
+
+func (c cliRunner) FileArg() string { return c.mc.FileArg }
+
+func (c cliRunner) IgnoreArg() string { return c.mc.IgnoreArg }
+
+func (c cliRunner) OutputFormat() string { return c.mc.Format }
+
+func (c cliRunner) CleansOutput() bool { return c.mc.CleanOutput }
+
+func (c cliRunner) AgentEdits() bool { return c.mc.Edits }
+
+func (c cliRunner) ResultFormat() string { return c.mc.Result }
+
+func (c cliRunner) WithParams(vals map[string]string) runner.Runner {
+	c.mc.Command = applyParams(c.mc.Command, c.mc.Params, vals)
+	return c
+}
+
+func (c cliRunner) ParamValues() map[string]string {
+	vals := map[string]string{}
+	for name, pc := range c.mc.Params {
+		if v := commandValue(c.mc.Command, pc.Arg); v != "" {
+			vals[name] = v
+		}
+	}
+	return vals
+}
+
+func (c cliRunner) prompt(prompt string) string {
+	if c.mc.Prompt != "" {
+		return strings.ReplaceAll(c.mc.Prompt, "{prompt}", prompt)
+	}
+	if c.mc.ApplyDiff {
+		return strings.ReplaceAll(defaultDiffPrompt, "{prompt}", prompt)
+	}
+	return prompt
+}
+
+func (c cliRunner) Command(prompt string) []string {
+	prompt = c.prompt(prompt)
+	args := make([]string, len(c.mc.Command))
+	for i, a := range c.mc.Command {
+		args[i] = strings.ReplaceAll(a, "{prompt}", prompt)
+	}
+	return args
+}
+
+func (c cliRunner) Env() []string {
+	for _, k := range c.mc.Env {
+		if apiKey(k) == "" {
+			slog.Warn("runner: environment variable not set", "model", c.name, "var", k)
+		}
+	}
+	return modelEnv()
+}
+
+func (c cliRunner) ParseUsage(output string) (runUsage, bool) { return c.usage.parse(output) }
+
+func (c cliRunner) Stdin(prompt string) io.Reader {
+	if !c.mc.Stdin {
+		return nil
+	}
+	return strings.NewReader(c.prompt(prompt))
+}
+
+// newRunnerRegistry returns the runners of cfg's models. The router is not
+// one of the registry's Models.
+func newRunnerRegistry(cfg *config) *runner.Registry {
+	var runners []runner.Runner
+	var order []string
+	for name, mc := range cfg.Models {
+		up, err := compileUsage(mc.Usage)
+		if err != nil {
+			slog.Error("runner: usage", "model", name, "err", err) // rejected by validate
+		}
+		runners = append(runners, cliRunner{name: name, mc: mc, usage: up})
+		if name != "router" {
+			order = append(order, name)
+		}
+	}
+	if e := cfg.Sandbox.Engine; e != "" {
+		if _, err := exec.LookPath(e); err != nil {
+			slog.Warn("runner: sandbox engine not installed", "engine", e)
+		}
+	}
+	for intent, models := range cfg.Intents {
+		for _, m := range models {
+			if mc, ok := cfg.Models[m]; ok && len(mc.Command) > 0 && cfg.sandboxImage(m) == "" {
+				if _, err := exec.LookPath(mc.Command[0]); err != nil {
+					slog.Warn("runner: command not installed", "model", m, "command", mc.Command[0], "intent", intent)
+				}
+			}
+		}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := cfg.Models[order[i]], cfg.Models[order[j]]
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return order[i] < order[j]
+	})
+	return runner.NewRegistry(runners, order)
+}
@@ -0,0 +1,149 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Run history. entry_outputs holds the latest output per entry and model;
+// every attempt is also kept in runs so re-runs can be compared.
+
+const runsSchema = `
+	CREATE TABLE IF NOT EXISTS runs (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		notebook_id TEXT NOT NULL,
+		idx         INTEGER NOT NULL,
+		model       TEXT NOT NULL,
+		started_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		finished_at TEXT,
+		exit_code   INTEGER,
+		output      TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS runs_entry ON runs(notebook_id, idx, model);`
+
+type runRecord struct {
+	ID         int64
+	StartedAt  string
+	FinishedAt string // empty while running, or if the server died mid-run
+	ExitCode   int
+	TimedOut   bool // killed by a run or no-output timeout
+	// Interrupted means the server stopped during the run.
+	Interrupted bool
+	Output      string
+	Stderr      string // kept apart from Output; empty for PTY models
+	Params      string // the model parameters it ran with, e.g. "model=opus"
+	// FallbackFrom is the model that failed before this run took its
+	// place; FallbackTo the model that took this failed run's place.
+	FallbackFrom string
+	FallbackTo   string
+	Result       *runResult  // the CLI's report (see result.go), if it has one
+	Command      *runCommand // how it was started (see runcmd.go), if recorded
+	// Elapsed is how long the process ran; 0 if it has not finished.
+	Elapsed time.Duration
+}
+
+// Took returns how long the run took, as the page shows it, or "" if it
+// has not finished.
+func (rr runRecord) Took() string {
+	if rr.Elapsed <= 0 {
+		return ""
+	}
+	return formatElapsed(rr.Elapsed)
+}
+
+// formatElapsed writes d as "320ms", "4.2s", "42s", "3m05s" or "1h02m",
+// like the page's live timers.
+func formatElapsed(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	case d < 10*time.Second:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// loadRuns returns idx -> model -> runs, oldest first.
+func loadRuns(ctx context.Context, nbID string) (map[int]map[string][]runRecord, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, idx, model, started_at, finished_at, exit_code, timed_out, interrupted, output, stderr, params, fallback_from, fallback_to,
+			result_commits, result_files, result_cost_usd, argv, work_dir, env_names, duration_ms
+		FROM runs WHERE notebook_id = ?
+		ORDER BY id ASC
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[int]map[string][]runRecord)
+	for rows.Next() {
+		var rr runRecord
+		var idx int
+		var model string
+		var finished sql.NullString
+		var code sql.NullInt64
+		var params, commits, files, argv, workDir, envNames string
+		var cost float64
+		var ms sql.NullInt64
+		if err := rows.Scan(&rr.ID, &idx, &model, &rr.StartedAt, &finished, &code, &rr.TimedOut, &rr.Interrupted, &rr.Output, &rr.Stderr, &params, &rr.FallbackFrom, &rr.FallbackTo,
+			&commits, &files, &cost, &argv, &workDir, &envNames, &ms); err != nil {
+			return nil, err
+		}
+		rr.Result = scanResult(commits, files, cost)
+		rr.Command = scanCommand(argv, workDir, envNames)
+		var vals map[string]string
+		if json.Unmarshal([]byte(params), &vals) == nil {
+			rr.Params = formatParams(vals)
+		}
+		rr.FinishedAt = finished.String
+		rr.Elapsed = runElapsed(rr.StartedAt, rr.FinishedAt, ms)
+		rr.ExitCode = int(code.Int64)
+		if !code.Valid {
+			rr.ExitCode = -1
+		}
+		if out[idx] == nil {
+			out[idx] = make(map[string][]runRecord)
+		}
+		out[idx][model] = append(out[idx][model], rr)
+	}
+	return out, rows.Err()
+}
+
+// runElapsed returns a finished run's duration_ms, or for runs from before
+// it was kept, the time between its start and finish, to the second.
+func runElapsed(started, finished string, ms sql.NullInt64) time.Duration {
+	if ms.Valid {
+		return time.Duration(ms.Int64) * time.Millisecond
+	}
+	s, err1 := time.Parse(time.RFC3339, started)
+	f, err2 := time.Parse(time.RFC3339, finished)
+	if err1 != nil || err2 != nil || f.Before(s) {
+		return 0
+	}
+	return f.Sub(s)
+}
+
+// recordRun wraps a run's lifetime: it inserts the row and returns its id
+// and a func that completes it. Failures are logged; history is best effort.
+func recordRun(ctx context.Context, nbID string, idx int, model string) (int64, func(code int, output, stderr string, timedOut bool)) {
+	id, err := notebooks.StartRun(ctx, nbID, idx, model)
+	if err != nil {
+		slog.ErrorContext(ctx, "run: record start", "model", model, "err", err)
+		return 0, func(int, string, string, bool) {}
+	}
+	start := time.Now()
+	return id, func(code int, output, stderr string, timedOut bool) {
+		if err := notebooks.FinishRun(ctx, id, code, output, stderr, timedOut, time.Since(start)); err != nil {
+			slog.ErrorContext(ctx, "run: record end", "model", model, "err", err)
+		}
+	}
+}
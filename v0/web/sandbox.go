@@ -0,0 +1,289 @@
+package web
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sandboxed runs. With sandbox.engine set to docker or podman, model CLIs
+// and repo test commands run in a throwaway container instead of on the
+// host. Only the worktree and its clone's .git directory are mounted, at
+// the same paths, so git (and aider's commits) work as before; HOME is a
+// tmpfs. The container has CPU, memory and process limits, and sits on an
+// internal network whose only way out is an HTTPS proxy in trybook that
+// lets through the hosts in sandbox.allow_hosts (the model APIs).
+
+const defaultSandboxNetwork = "trybook-sandbox"
+
+var defaultAllowHosts = []string{"api.openai.com", "api.anthropic.com", "generativelanguage.googleapis.com"}
+
+var sandboxLimitRE = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[bkmgBKMG]?$`)
+
+func (s sandboxConfig) validate() error {
+	if s.Engine == "" {
+		return nil
+	}
+	if s.Engine != "docker" && s.Engine != "podman" {
+		return fmt.Errorf("unknown engine %q (docker or podman)", s.Engine)
+	}
+	if s.Network != "" && !isSafeToken(s.Network) {
+		return fmt.Errorf("invalid network %q", s.Network)
+	}
+	for _, v := range []string{s.CPUs, s.Memory} {
+		if v != "" && !sandboxLimitRE.MatchString(v) {
+			return fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	if s.PIDs < 0 {
+		return fmt.Errorf("pids must be >= 0")
+	}
+	for _, h := range s.AllowHosts {
+		if strings.TrimPrefix(h, "*.") == "" || strings.ContainsAny(h, ":/ ") {
+			return fmt.Errorf("invalid allow_hosts entry %q", h)
+		}
+	}
+	return nil
+}
+
+func (s sandboxConfig) network() string {
+	if s.Network == "" {
+		return defaultSandboxNetwork
+	}
+	return s.Network
+}
+
+func (s sandboxConfig) allows(host string) bool {
+	hosts := s.AllowHosts
+	if hosts == nil {
+		hosts = defaultAllowHosts
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxImage returns the image model runs in, or "" if it runs on the
+// host.
+func (c *config) sandboxImage(model string) string {
+	if c.Sandbox.Engine == "" {
+		return ""
+	}
+	if model == TestsModel {
+		return c.Sandbox.Image
+	}
+	mc := c.Models[model]
+	if mc.NoSandbox {
+		return ""
+	}
+	if mc.Image != "" {
+		return mc.Image
+	}
+	return c.Sandbox.Image
+}
+
+// sandboxRun is the container setup for one run.
+type sandboxRun struct {
+	cfg      sandboxConfig
+	image    string
+	proxyURL string // "" with network none
+	name     string // container name, set by command
+}
+
+// prepareSandbox gets the network and proxy ready for a run in image.
+func prepareSandbox(ctx context.Context, cfg *config, image string) (*sandboxRun, error) {
+	if image == "" {
+		return nil, errors.New("sandbox: no image for test commands; set sandbox.image")
+	}
+	sb := &sandboxRun{cfg: cfg.Sandbox, image: image}
+	if sb.cfg.network() == "none" {
+		return sb, nil
+	}
+	var err error
+	if sb.proxyURL, err = sandboxProxy(ctx, sb.cfg.Engine, sb.cfg.network()); err != nil {
+		return nil, fmt.Errorf("sandbox: %w", err)
+	}
+	return sb, nil
+}
+
+// command wraps argv in a container run. dirs are bind-mounted at the same
+// paths and the command starts in the first; env names variables passed on
+// from the engine's own environment, so values stay off the command line.
+func (sb *sandboxRun) command(argv, dirs, env []string, tty, stdin bool) []string {
+	sb.name = "trybook-" + genNotebookID()
+	c := []string{sb.cfg.Engine, "run", "--rm", "--name", sb.name,
+		"--cap-drop", "ALL", "--security-opt", "no-new-privileges",
+		"--cpus", cmp.Or(sb.cfg.CPUs, "2"), "--memory", cmp.Or(sb.cfg.Memory, "4g"),
+		"--pids-limit", strconv.Itoa(cmp.Or(sb.cfg.PIDs, 1024)),
+		"--network", sb.cfg.network(),
+		"--tmpfs", "/tmp:exec", "-e", "HOME=/tmp",
+	}
+	if sb.cfg.Engine == "podman" {
+		c = append(c, "--userns", "keep-id")
+	} else {
+		c = append(c, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()))
+	}
+	if stdin || tty {
+		c = append(c, "-i")
+	}
+	if tty {
+		c = append(c, "-t", "-e", "TERM")
+	}
+	for i, d := range dirs {
+		if abs, err := filepath.Abs(d); err == nil {
+			d = abs
+		}
+		if i == 0 {
+			c = append(c, "-w", d)
+		}
+		c = append(c, "-v", d+":"+d)
+	}
+	if sb.proxyURL != "" {
+		for _, k := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+			c = append(c, "-e", k+"="+sb.proxyURL)
+		}
+	}
+	for _, k := range env {
+		c = append(c, "-e", k)
+	}
+	c = append(c, sb.image)
+	return append(c, argv...)
+}
+
+// remove makes sure the container is gone; killing the engine's client on
+// a cancel or timeout leaves it running.
+func (sb *sandboxRun) remove(ctx context.Context) {
+	if sb.name == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	_ = exec.CommandContext(ctx, sb.cfg.Engine, "rm", "--force", sb.name).Run()
+}
+
+// The egress proxy. One listens on the gateway address of each sandbox
+// network, the only address an internal network can reach.
+
+var (
+	proxyMu sync.Mutex
+	proxies = make(map[string]string) // engine/network -> proxy URL
+)
+
+func sandboxProxy(ctx context.Context, engine, network string) (string, error) {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	key := engine + "/" + network
+	if u, ok := proxies[key]; ok {
+		return u, nil
+	}
+	gw, err := ensureSandboxNetwork(ctx, engine, network)
+	if err != nil {
+		return "", err
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(gw, "0"))
+	if err != nil {
+		return "", fmt.Errorf("proxy on network %s: %w", network, err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(egressProxyHandler), ReadHeaderTimeout: 30 * time.Second}
+	go func() { _ = srv.Serve(ln) }()
+	u := "http://" + ln.Addr().String()
+	proxies[key] = u
+	slog.InfoContext(ctx, "sandbox: proxy listening", "network", network, "url", u)
+	return u, nil
+}
+
+// ensureSandboxNetwork creates network as an internal network if needed
+// and returns its gateway address.
+func ensureSandboxNetwork(ctx context.Context, engine, network string) (string, error) {
+	out, err := exec.CommandContext(ctx, engine, "network", "inspect", network).Output()
+	if err != nil {
+		if cout, err := exec.CommandContext(ctx, engine, "network", "create", "--internal", network).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("create network %s: %v: %s", network, err, strings.TrimSpace(string(cout)))
+		}
+		slog.InfoContext(ctx, "sandbox: network created", "network", network)
+		if out, err = exec.CommandContext(ctx, engine, "network", "inspect", network).Output(); err != nil {
+			return "", fmt.Errorf("inspect network %s: %w", network, err)
+		}
+	}
+	// docker puts the gateway under IPAM.Config, podman under subnets.
+	var nets []struct {
+		Internal bool
+		IPAM     struct{ Config []struct{ Gateway string } }
+		Subnets  []struct{ Gateway string }
+	}
+	if err := json.Unmarshal(out, &nets); err != nil || len(nets) == 0 {
+		return "", fmt.Errorf("inspect network %s: unexpected output", network)
+	}
+	n := nets[0]
+	if !n.Internal {
+		slog.WarnContext(ctx, "sandbox: network is not internal; runs can bypass the proxy", "network", network)
+	}
+	for _, c := range n.IPAM.Config {
+		if ip := net.ParseIP(c.Gateway); ip != nil && ip.To4() != nil {
+			return c.Gateway, nil
+		}
+	}
+	for _, s := range n.Subnets {
+		if ip := net.ParseIP(s.Gateway); ip != nil && ip.To4() != nil {
+			return s.Gateway, nil
+		}
+	}
+	return "", fmt.Errorf("network %s has no IPv4 gateway", network)
+}
+
+// egressProxyHandler tunnels CONNECT requests to allowed hosts on port 443
+// and refuses everything else.
+func egressProxyHandler(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if r.Method != http.MethodConnect || err != nil || port != "443" || !currentConfig().Sandbox.allows(host) {
+		slog.WarnContext(r.Context(), "sandbox: blocked", "method", r.Method, "host", r.Host)
+		http.Error(w, "blocked by the trybook sandbox", http.StatusForbidden)
+		return
+	}
+	up, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer up.Close()
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	go func(r *bufio.Reader) {
+		_, _ = io.Copy(up, r)
+		if tc, ok := up.(*net.TCPConn); ok {
+			_ = tc.CloseWrite()
+		}
+	}(brw.Reader)
+	_, _ = io.Copy(conn, up)
+}
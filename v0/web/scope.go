@@ -0,0 +1,92 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"trybook/gitops"
+)
+
+// Monorepo scoping. Opening a directory's web URL on a known host
+// (https://github.com/org/mono/tree/main/services/foo) scopes the notebook
+// to that directory: its worktree is a sparse checkout of it (see
+// gitops.SparseCheckout) and models run with it as their working
+// directory. The ref in the URL is not used; the notebook starts at the
+// clone's HEAD like any other, and a ref containing "/" is not told apart
+// from the directory.
+
+// treeSubdir returns the directory a web URL path on host points at, or ""
+// for the repository itself or a file.
+func treeSubdir(host, p string) (string, error) {
+	p = strings.Trim(p, "/")
+	var rest []string
+	if i := strings.Index(p, "/-/"); i >= 0 { // GitLab: /group/repo/-/tree/main/dir
+		rest = strings.Split(p[i+len("/-/"):], "/")
+	} else if parts := strings.Split(p, "/"); len(parts) > 2 {
+		rest = parts[2:]
+	}
+	if len(rest) < 3 {
+		return "", nil
+	}
+	switch {
+	case host == "codeberg.org" && rest[0] == "src":
+		// /org/repo/src/branch/main/dir
+		rest = rest[1:]
+	case host == "bitbucket.org" && rest[0] == "src":
+	case host != "bitbucket.org" && rest[0] == "tree":
+	default:
+		return "", nil
+	}
+	if len(rest) < 3 {
+		return "", nil
+	}
+	return cleanSubdir(strings.Join(rest[2:], "/"))
+}
+
+// cleanSubdir checks a repository-relative directory, returning it
+// without redundant slashes.
+func cleanSubdir(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(s, "/") {
+		return "", fmt.Errorf("invalid directory %q", s)
+	}
+	s = path.Clean(s)
+	if s == "." {
+		return "", nil
+	}
+	for _, seg := range strings.Split(s, "/") {
+		if !isSafeToken(seg) || seg == ".." || seg == ".git" {
+			return "", fmt.Errorf("invalid directory %q", s)
+		}
+	}
+	return s, nil
+}
+
+// addWorktree runs git worktree add with args, which end with the new
+// worktree's directory wtDir and what to check out there. With a subdir it
+// checks out only that directory.
+func addWorktree(ctx context.Context, cloneDir, wtDir, subdir string, args ...string) ([]byte, error) {
+	if subdir != "" {
+		args = append([]string{"--no-checkout"}, args...)
+	}
+	out, err := exec.CommandContext(ctx, "git", append([]string{"-C", cloneDir, "worktree", "add"}, args...)...).CombinedOutput()
+	if err == nil && subdir != "" {
+		err = gitops.SparseCheckout(ctx, wtDir, subdir)
+	}
+	return out, err
+}
+
+// workDir is where runs in dir, the notebook's worktree or one of its
+// lanes, start: dir itself, or the directory the notebook is scoped to.
+func (m notebookMeta) workDir(dir string) string {
+	if m.Subdir == "" {
+		return dir
+	}
+	return filepath.Join(dir, filepath.FromSlash(m.Subdir))
+}
@@ -0,0 +1,160 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Searching a notebook's worktree. GET /n/{id}/search?q=.. runs ripgrep if
+// it is installed, else git grep, and returns the matching lines as JSON.
+// q is a literal string unless regex=1; case=0 ignores case.
+
+const (
+	searchMaxMatches = 200
+	searchMaxQuery   = 200
+	searchMaxLine    = 300 // characters of each matching line returned
+)
+
+type searchMatch struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type searchResult struct {
+	Query     string        `json:"query"`
+	Tool      string        `json:"tool"`
+	Matches   []searchMatch `json:"matches"`
+	Truncated bool          `json:"truncated,omitempty"`
+}
+
+// searchCommand builds the search for q; each output line is
+// path NUL line:text (rg) or path NUL line NUL text (git grep).
+func searchCommand(ctx context.Context, dir, q string, regex, ignoreCase bool) (*exec.Cmd, string) {
+	if rg, err := exec.LookPath("rg"); err == nil {
+		args := []string{"--line-number", "--null", "--no-heading", "--color", "never", "--max-count", "50", "--max-columns", "1000"}
+		if !regex {
+			args = append(args, "--fixed-strings")
+		}
+		if ignoreCase {
+			args = append(args, "--ignore-case")
+		}
+		args = append(args, "-e", q)
+		cmd := exec.CommandContext(ctx, rg, args...)
+		cmd.Dir = dir
+		return cmd, "rg"
+	}
+	args := []string{"-C", dir, "grep", "--line-number", "-z", "-I", "--untracked"}
+	if regex {
+		args = append(args, "--extended-regexp")
+	} else {
+		args = append(args, "--fixed-strings")
+	}
+	if ignoreCase {
+		args = append(args, "--ignore-case")
+	}
+	args = append(args, "-e", q, "--")
+	return exec.CommandContext(ctx, "git", args...), "git grep"
+}
+
+func parseSearchLine(l string) (searchMatch, bool) {
+	path, rest, ok := strings.Cut(l, "\x00")
+	if !ok {
+		return searchMatch{}, false
+	}
+	// git grep separates the line number with NUL too.
+	num, text, ok := strings.Cut(rest, "\x00")
+	if !ok {
+		num, text, ok = strings.Cut(rest, ":")
+	}
+	n, err := strconv.Atoi(num)
+	if !ok || err != nil {
+		return searchMatch{}, false
+	}
+	return searchMatch{Path: path, Line: n, Text: truncate(strings.TrimRight(text, "\r"), searchMaxLine)}, true
+}
+
+func searchWorktree(ctx context.Context, dir, q string, regex, ignoreCase bool) (searchResult, error) {
+	cmd, tool := searchCommand(ctx, dir, q, regex, ignoreCase)
+	res := searchResult{Query: q, Tool: tool, Matches: []searchMatch{}}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return res, err
+	}
+	if err := cmd.Start(); err != nil {
+		return res, err
+	}
+	sc := bufio.NewScanner(out)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		if len(res.Matches) == searchMaxMatches {
+			res.Truncated = true
+			break
+		}
+		if m, ok := parseSearchLine(sc.Text()); ok {
+			res.Matches = append(res.Matches, m)
+		}
+	}
+	if res.Truncated {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return res, nil
+	}
+	err = cmd.Wait()
+	// Both tools exit 1 when nothing matched.
+	var ee *exec.ExitError
+	if errors.As(err, &ee) && ee.ExitCode() == 1 && stderr.Len() == 0 {
+		err = nil
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return res, errors.New(msg)
+		}
+	}
+	return res, err
+}
+
+// GET /n/{id}/search?q=..[&regex=1][&case=0]
+func searchHandler(w http.ResponseWriter, r *http.Request, nbID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query().Get("q")
+	if !isSafeToken(nbID) || strings.TrimSpace(q) == "" || len(q) > searchMaxQuery {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := ensureWorktree(r.Context(), meta); err != nil {
+		slog.ErrorContext(r.Context(), "searchHandler", "err", err)
+		http.Error(w, "worktree unavailable", http.StatusInternalServerError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	res, err := searchWorktree(ctx, dir, q, r.URL.Query().Get("regex") == "1", r.URL.Query().Get("case") == "0")
+	if err != nil {
+		slog.WarnContext(r.Context(), "searchHandler", "tool", res.Tool, "err", err)
+		http.Error(w, "search failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,1611 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	_ "modernc.org/sqlite"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"trybook/gitops"
+	"trybook/store"
+)
+
+// Base app directory; clones live under <dir>/clone.
+func defaultAppDir() string {
+	if h, err := os.UserHomeDir(); err == nil && h != "" {
+		return filepath.Join(h, ".trybook")
+	}
+	// Fallback if home not found
+	return ".trybook"
+}
+
+var appDir = flag.String("dir", defaultAppDir(), "base directory for Trybook data")
+
+func cloneBaseDir() string {
+	return filepath.Join(*appDir, "clone")
+}
+
+func worktreeBaseDir() string {
+	return filepath.Join(*appDir, "worktree")
+}
+
+// trybook database lives under <dir>/trybook.db
+func dbPath() string {
+	return filepath.Join(*appDir, "trybook.db")
+}
+
+var db *sql.DB
+
+// notebooks is the store over db that runs and jobs record into.
+var notebooks *store.NotebookStore
+
+func initDB() error {
+	if err := os.MkdirAll(*appDir, 0o755); err != nil {
+		return fmt.Errorf("create app dir: %w", err)
+	}
+	var err error
+	db, err = sql.Open("sqlite", sqliteDSN(dbPath()))
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("ping db: %w", err)
+	}
+	notebooks = store.New(db)
+	if err := migrate(); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err := loadAPIKeys(context.Background()); err != nil {
+		return fmt.Errorf("load api keys: %w", err)
+	}
+	return nil
+}
+
+func currentBranchAndCommit(ctx context.Context, dir string) (string, string, error) {
+	bc := exec.CommandContext(ctx, "git", "rev-parse", "--abbrev-ref", "HEAD")
+	bc.Dir = dir
+	bOut, err := bc.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("get branch: %w", err)
+	}
+	branch := strings.TrimSpace(string(bOut))
+	cc := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cc.Dir = dir
+	cOut, err := cc.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("get commit: %w", err)
+	}
+	sha := strings.TrimSpace(string(cOut))
+	return branch, sha, nil
+}
+
+func genNotebookID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// createNotebook creates a notebook on the clone's HEAD, scoped to subdir
+// of the repository if it is not empty.
+func createNotebook(ctx context.Context, owner, host, org, repo, subdir string) (string, error) {
+	return createNotebookAt(ctx, owner, host, org, repo, subdir, "")
+}
+
+// createNotebookAt is createNotebook with the worktree started at commit
+// instead of the clone's HEAD (if commit is not empty).
+func createNotebookAt(ctx context.Context, owner, host, org, repo, subdir, commit string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(worktreeDirPath(host, org, repo, "nb-")), 0o755); err != nil {
+		return "", fmt.Errorf("create worktree parent dir: %w", err)
+	}
+	id, wtName, err := worktrees().AddScoped(ctx, host, org, repo, commit, subdir)
+	if err != nil {
+		return "", err
+	}
+
+	branch, sha, err := currentBranchAndCommit(ctx, worktreeDirPath(host, org, repo, wtName))
+	if err != nil {
+		worktrees().Remove(ctx, host, org, repo, wtName)
+		return "", err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO notebooks(id, owner, host, org, repo, subdir, branch, worktree, commit_sha)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, owner, host, org, repo, subdir, branch, wtName, sha)
+	if err != nil {
+		worktrees().Remove(ctx, host, org, repo, wtName)
+		return "", fmt.Errorf("insert notebook: %w", err)
+	}
+	return id, nil
+}
+
+type nbListItem struct {
+	ID          string
+	Host        string
+	Org         string
+	Repo        string
+	Branch      string
+	CommitShort string
+	CreatedAt   string
+	Usage       runUsage
+	Title       string // written by the summarizer once the notebook is idle
+	Summary     string
+	ArchivedAt  string // empty unless archived
+	Tags        []string
+
+	Status        string // see notebookMeta
+	StatusMessage string
+}
+
+// commitShort is the 7-character form of sha the notebook lists show.
+func commitShort(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// listNotebooks returns a page of the notebooks visible to user (all of
+// them when auth is disabled, user ""), newest first: the archived ones or
+// the others, only those tagged tag unless it is "".
+func listNotebooks(ctx context.Context, user string, archived bool, tag string, offset, limit int) ([]nbListItem, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, host, org, repo, branch, commit_sha, created_at, title, summary, archived_at, status, status_message
+		FROM notebooks
+		WHERE (?1 = '' OR owner = '' OR owner = ?1) AND (archived_at != '') = ?2 AND deleted_at = ''
+			AND (?5 = '' OR id IN (SELECT notebook_id FROM notebook_tags WHERE tag = ?5))
+		ORDER BY created_at DESC, id
+		LIMIT ?3 OFFSET ?4
+	`, user, archived, limit, offset, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []nbListItem
+	for rows.Next() {
+		var it nbListItem
+		var sha string
+		if err := rows.Scan(&it.ID, &it.Host, &it.Org, &it.Repo, &it.Branch, &sha, &it.CreatedAt, &it.Title, &it.Summary, &it.ArchivedAt, &it.Status, &it.StatusMessage); err != nil {
+			return nil, err
+		}
+		it.CommitShort = commitShort(sha)
+		out = append(out, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	ids := make([]string, len(out))
+	for i, it := range out {
+		ids[i] = it.ID
+	}
+	tags, err := loadTags(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range out {
+		out[i].Tags = tags[out[i].ID]
+	}
+	return out, nil
+}
+
+// repoNotebooks returns up to limit of the active notebooks visible to user
+// on a repository, newest first.
+func repoNotebooks(ctx context.Context, user string, spec repoSpec, limit int) ([]nbListItem, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, host, org, repo, branch, commit_sha, created_at, title, summary
+		FROM notebooks
+		WHERE (?1 = '' OR owner = '' OR owner = ?1) AND host = ?2 AND org = ?3 AND repo = ?4 AND subdir = ?5 AND archived_at = '' AND deleted_at = ''
+		ORDER BY created_at DESC, id
+		LIMIT ?6
+	`, user, spec.Host, spec.Org, spec.Repo, spec.Subdir, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []nbListItem
+	for rows.Next() {
+		var it nbListItem
+		var sha string
+		if err := rows.Scan(&it.ID, &it.Host, &it.Org, &it.Repo, &it.Branch, &sha, &it.CreatedAt, &it.Title, &it.Summary); err != nil {
+			return nil, err
+		}
+		it.CommitShort = commitShort(sha)
+		out = append(out, it)
+	}
+	return out, rows.Err()
+}
+
+type notebookMeta struct {
+	ID       string
+	Host     string
+	Org      string
+	Repo     string
+	Branch   string
+	SHA      string
+	Worktree string // new
+	Subdir   string // the directory the notebook is scoped to; empty for all of it
+
+	Status        string // nbCloning or nbCloneError until the worktree is ready
+	StatusMessage string // why cloning failed
+}
+
+func (m notebookMeta) repoSpec() repoSpec {
+	return repoSpec{Host: m.Host, Org: m.Org, Repo: m.Repo, Subdir: m.Subdir}
+}
+
+func loadNotebook(ctx context.Context, id string) (notebookMeta, []entry, error) {
+	var m notebookMeta
+	err := db.QueryRowContext(ctx, `
+		SELECT id, host, org, repo, branch, worktree, commit_sha, subdir, status, status_message
+		FROM notebooks WHERE id = ? AND deleted_at = ''
+	`, id).Scan(&m.ID, &m.Host, &m.Org, &m.Repo, &m.Branch, &m.Worktree, &m.SHA, &m.Subdir, &m.Status, &m.StatusMessage)
+	if err != nil {
+		return m, nil, err
+	}
+	ratings, err := loadFeedback(ctx, id)
+	if err != nil {
+		return m, nil, err
+	}
+	outputs, err := loadEntryOutputs(ctx, id)
+	if err != nil {
+		return m, nil, err
+	}
+	runs, err := loadRuns(ctx, id)
+	if err != nil {
+		return m, nil, err
+	}
+	usage, err := entryUsage(ctx, id)
+	if err != nil {
+		return m, nil, err
+	}
+	attachments, err := loadAttachments(ctx, id)
+	if err != nil {
+		return m, nil, err
+	}
+	lanes, err := loadLanes(ctx, id)
+	if err != nil {
+		return m, nil, err
+	}
+	citations, err := loadCitations(ctx, id)
+	if err != nil {
+		return m, nil, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT idx, prompt, intent, intent_source, tests, stale, interrupted, lanes, dry_run, edit_confirm, edit_model, prompt_tokens, prompt_lang, pinned
+		FROM notebook_entries
+		WHERE notebook_id = ?
+		ORDER BY idx ASC
+	`, id)
+	if err != nil {
+		return m, nil, err
+	}
+	defer rows.Close()
+	var es []entry
+	for rows.Next() {
+		var idx int
+		var e entry
+		if err := rows.Scan(&idx, &e.Prompt, &e.Intent, &e.IntentSource, &e.Tests, &e.Stale, &e.Interrupted, &e.ABEdits, &e.DryRun, &e.Confirm, &e.EditModel, &e.PromptTokens, &e.PromptLang, &e.Pinned); err != nil {
+			return m, nil, err
+		}
+		e.Outputs = outputs[idx]
+		e.Ratings = ratings[idx]
+		e.Runs = runs[idx]
+		e.Usage = usage[idx]
+		e.Attachments = attachments[idx]
+		e.Lanes = lanes[idx]
+		e.Citations = citations[idx]
+		for _, l := range e.Lanes {
+			switch l.Status {
+			case laneOpen:
+				e.OpenLanes = append(e.OpenLanes, l)
+			case laneKept:
+				e.KeptLane = l.Model
+			}
+		}
+		es = append(es, e)
+	}
+	return m, es, rows.Err()
+}
+
+func recordClone(ctx context.Context, spec repoSpec) error {
+	dir := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	branch, sha, err := currentBranchAndCommit(ctx, dir)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO clones(host, org, repo, clone_url, branch, commit_sha)
+		VALUES(?, ?, ?, ?, ?, ?)
+		ON CONFLICT(host, org, repo) DO UPDATE SET
+			clone_url = excluded.clone_url,
+			branch = excluded.branch,
+			commit_sha = excluded.commit_sha,
+			updated_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+	`, spec.Host, spec.Org, spec.Repo, spec.CloneURL, branch, sha)
+	if err != nil {
+		return err
+	}
+	_, err = updateRepoProfile(ctx, spec)
+	return err
+}
+
+type viewModel struct {
+	Title       string
+	Message     string
+	MsgClass    string
+	User        string // signed-in user; empty when auth is disabled
+	Admin       bool   // the user may use /admin/*
+	Host        string
+	Org         string
+	Repo        string
+	Subdir      string // the directory the notebook is scoped to
+	NotebookID  string
+	Branch      string
+	CommitShort string
+	Notebooks   []nbListItem
+	List        notebookListPage // which page of Notebooks is shown
+	TotalUsage  runUsage         // summed over every notebook the user can see
+	WinRates    []winRate        // how often each model's answer was preferred
+	Entries     []entry
+	PendingIdx  int  // index of the entry currently running; -1 if none
+	HasPending  bool // true if there is a pending entry to run
+
+	IntentModels map[string][]string       // router intent -> models to run
+	Preferences  map[int]map[string]string // idx -> "a/b" -> preferred model
+	PRURL        string                    // pull request opened from this notebook
+	CanPR        bool                      // notebook is on github.com
+	BlobURL      string                    // GitHub file URL prefix at the notebook's commit
+	Upstream     string                    // remote-tracking ref the notebook follows
+	Behind       int                       // commits on Upstream not in the worktree
+	Shallow      bool                      // the clone has only part of the history
+	ForkedFrom   string                    // notebook this one was forked from
+	ForkedEntry  int                       // 1-based entry of ForkedFrom it was forked at
+	Draft        string                    // prompt to show again after an error
+	DraftFiles   string                    // and its attached worktree paths
+	CSRF         string                    // for forms posted without scripts
+	CanLanes     bool                      // offer A/B edits: an intent has 2+ editing models
+	EditTools    []editTool                // models the prompt form can pick for an edit
+	EditConfirm  editConfirm               // what the form says before an edit runs
+	AskLarge     bool                      // the draft looks pasted; offer "Send anyway"
+	WarnTokens   int                       // prompt tokens × models past which the form warns
+	Terminal     bool                      // offer the worktree terminal
+	Transcribe   bool                      // offer dictating the prompt
+	Profile      repoProfile               // detected languages and commands
+	TestCommand  string                    // run after edits; from the config or Profile
+	Busy         bool                      // runs are queued or running on the notebook
+	Existing     []nbListItem              // the repo's open notebooks, shown before starting another
+	ExistingURL  string                    // the /try input they were found for
+	Templates    []promptTemplate          // built-in starter prompts offered for the repo
+	OwnTemplates []promptTemplate          // the user's own
+	Pipelines    []pipeline                // the notebook's latest pipelines
+	Worktree     worktreeStatus            // uncommitted changes in the worktree
+	Source       notebookSource            // the GitHub issue or PR the notebook was started from
+	ParamFields  []paramField              // per-run model parameters the prompt form offers
+	Cloning      bool                      // the worktree is still being made; the prompt box waits
+	CloneError   string                    // why making it failed
+	Prefs        userPrefs                 // the user's theme, default edit tool and output expansion
+}
+
+func setHTMLHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; script-src 'unsafe-inline' 'self'; connect-src 'self'; form-action 'self'; base-uri 'none'")
+}
+
+func isSafeToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r == '-' || r == '_' || r == '.' ||
+			(r >= 'a' && r <= 'z') ||
+			(r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+const (
+	defaultHost = gitops.DefaultHost
+	localHost   = gitops.LocalHost
+)
+
+// repoSpec identifies a repository on some git host.
+type repoSpec struct {
+	Host     string // e.g. github.com, gitlab.com
+	Org      string // may contain "/" for nested groups (GitLab)
+	Repo     string
+	CloneURL string
+	Subdir   string // directory of a tree URL to scope the notebook to
+	Issue    int    // GitHub issue or pull request to start from; see issue.go
+	Pull     bool   // Issue came from a pull/ URL
+}
+
+func (r repoSpec) String() string {
+	if r.Host == defaultHost {
+		return r.Org + "/" + r.Repo
+	}
+	return r.Host + "/" + r.Org + "/" + r.Repo
+}
+
+// parseRepoInput accepts org/repo (GitHub), https://host/org/repo[.git],
+// ssh://[user@]host/org/repo.git, scp-style user@host:org/repo.git and a
+// directory on the server (/path/to/repo or file:///path/to/repo; see
+// localrepo.go).
+func parseRepoInput(s string) (repoSpec, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return repoSpec{}, fmt.Errorf("empty input")
+	}
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, "file://") {
+		return parseLocalRepo(s)
+	}
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "ssh://") {
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return repoSpec{}, fmt.Errorf("invalid URL")
+		}
+		host := strings.ToLower(u.Host)
+		if !isSafeHost(host) || host == localHost {
+			return repoSpec{}, fmt.Errorf("invalid host %q", host)
+		}
+		org, repo, err := splitRepoPath(host, u.Path)
+		if err != nil {
+			return repoSpec{}, err
+		}
+		if host == defaultHost && !isGitHubName(org, repo) {
+			return repoSpec{}, fmt.Errorf("invalid org or repo")
+		}
+		spec := repoSpec{Host: host, Org: org, Repo: repo}
+		spec.Issue, spec.Pull = issueRef(host, u.Path)
+		if knownHosts[host] {
+			if spec.Subdir, err = treeSubdir(host, u.Path); err != nil {
+				return repoSpec{}, err
+			}
+		}
+		switch {
+		case u.Scheme == "ssh":
+			spec.CloneURL = s
+		case host == defaultHost:
+			spec.CloneURL = fmt.Sprintf("https://github.com/%s/%s.git", org, repo)
+		case strings.HasSuffix(strings.TrimRight(u.Path, "/"), ".git") || knownHosts[host]:
+			spec.CloneURL = u.Scheme + "://" + u.Host + "/" + org + "/" + repo + ".git"
+		default:
+			// Unknown host: clone exactly what was given, minus any query.
+			spec.CloneURL = u.Scheme + "://" + u.Host + "/" + strings.Trim(u.Path, "/")
+		}
+		return spec, nil
+	}
+	// scp-like syntax: git@host:org/repo.git
+	if at := strings.Index(s, "@"); at > 0 {
+		if colon := strings.Index(s[at:], ":"); colon > 0 {
+			host := strings.ToLower(s[at+1 : at+colon])
+			if !isSafeHost(host) || host == localHost {
+				return repoSpec{}, fmt.Errorf("invalid host %q", host)
+			}
+			org, repo, err := splitRepoPath(host, s[at+colon+1:])
+			if err != nil {
+				return repoSpec{}, err
+			}
+			if host == defaultHost && !isGitHubName(org, repo) {
+				return repoSpec{}, fmt.Errorf("invalid org or repo")
+			}
+			return repoSpec{Host: host, Org: org, Repo: repo, CloneURL: s}, nil
+		}
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return repoSpec{}, fmt.Errorf("input must be org/repo or a git URL")
+	}
+	org := strings.TrimSpace(parts[0])
+	repo := strings.TrimSpace(parts[1])
+	if !isGitHubName(org, repo) {
+		return repoSpec{}, fmt.Errorf("invalid org or repo")
+	}
+	return repoSpec{Host: defaultHost, Org: org, Repo: repo, CloneURL: fmt.Sprintf("https://github.com/%s/%s.git", org, repo)}, nil
+}
+
+// Hosts whose web URLs have a fixed org/repo prefix followed by browsing
+// paths (tree/, src/, ...).
+var knownHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+	"codeberg.org":  true,
+}
+
+func splitRepoPath(host, p string) (string, string, error) {
+	p = strings.Trim(p, "/")
+	if i := strings.Index(p, "/-/"); i >= 0 { // GitLab: /group/repo/-/tree/main
+		p = p[:i]
+	}
+	parts := strings.Split(p, "/")
+	switch host {
+	case "github.com", "bitbucket.org", "codeberg.org":
+		if len(parts) > 2 {
+			parts = parts[:2]
+		}
+	default:
+		// A segment ending in .git ends the repository path.
+		for i, seg := range parts {
+			if strings.HasSuffix(seg, ".git") {
+				parts = parts[:i+1]
+				break
+			}
+		}
+	}
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("URL must be like https://%s/org/repo", host)
+	}
+	repo := strings.TrimSuffix(parts[len(parts)-1], ".git")
+	for _, seg := range append(parts[:len(parts)-1:len(parts)-1], repo) {
+		if !isSafeToken(seg) || seg == "." || seg == ".." {
+			return "", "", fmt.Errorf("invalid org or repo")
+		}
+	}
+	return strings.Join(parts[:len(parts)-1], "/"), repo, nil
+}
+
+// isGitHubName reports whether org/repo can name a GitHub repository.
+// Owners are letters, digits and '-', not at the start, which also keeps
+// them apart from the directories of other hosts (see gitops.HostDir).
+func isGitHubName(org, repo string) bool {
+	if org == "" || strings.HasPrefix(org, "-") || !isSafeToken(repo) || repo == "." || repo == ".." {
+		return false
+	}
+	for _, r := range org {
+		if r == '-' ||
+			(r >= 'a' && r <= 'z') ||
+			(r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func isSafeHost(h string) bool {
+	if h == "" || strings.HasPrefix(h, ".") || strings.HasPrefix(h, "-") {
+		return false
+	}
+	for _, r := range h {
+		if r == '.' || r == '-' || r == ':' ||
+			(r >= 'a' && r <= 'z') ||
+			(r >= '0' && r <= '9') {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+func pathExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// partialCloneDir holds clones while git writes them; cloneRepo moves each
+// to its place once it is complete. Nothing else lives there, so whatever a
+// stopped server left behind can go.
+func partialCloneDir() string {
+	return filepath.Join(cloneBaseDir(), ".partial")
+}
+
+// ensureRepoCloned clones spec unless it is already cloned, writing git's
+// progress to progress if it is not nil.
+func ensureRepoCloned(ctx context.Context, spec repoSpec, progress io.Writer) error {
+	dest := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	slog.DebugContext(ctx, "ensureRepoCloned", "repo", spec.String(), "dest", dest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	if pathExists(filepath.Join(dest, ".git")) {
+		slog.DebugContext(ctx, "ensureRepoCloned: already cloned", "dest", dest)
+		return checkCloneAccess(ctx, spec, dest)
+	}
+	// Clones only ever appear there complete, so anything else in the way
+	// is not ours to delete; an empty directory is all that may go.
+	if pathExists(dest) {
+		if err := os.Remove(dest); err != nil {
+			slog.ErrorContext(ctx, "ensureRepoCloned: path in the way", "dest", dest, "err", err)
+			return fmt.Errorf("%s exists and is not a clone of %s", dest, spec)
+		}
+	}
+	return cloneRepo(ctx, spec, progress)
+}
+
+func cloneRepo(ctx context.Context, spec repoSpec, progress io.Writer) error {
+	start := time.Now()
+	slog.InfoContext(ctx, "cloneRepo", "repo", spec.String(), "url", spec.CloneURL)
+	if err := os.MkdirAll(partialCloneDir(), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(partialCloneDir(), "clone-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	dest := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	work := filepath.Join(tmp, spec.Repo)
+	src := spec.CloneURL
+	env, private := cloneEnv(ctx, spec)
+	opts := []string{"clone", "--single-branch"}
+	if depth := currentConfig().cloneDepth(spec); depth > 0 {
+		opts = append(opts, "--depth", strconv.Itoa(depth))
+	}
+	if progress != nil {
+		opts = append(opts, "--progress")
+	}
+	attempts := [][]string{
+		{"--branch", "main", src, work},
+		{"--branch", "master", src, work},
+		{src, work},
+	}
+	for i, rest := range attempts {
+		args := append(append([]string{"git"}, opts...), rest...)
+		slog.DebugContext(ctx, "cloneRepo: attempt", "attempt", i+1, "args", args)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = env
+		// One writer for both, so exec copies them in a single goroutine.
+		var out bytes.Buffer
+		var w io.Writer = &out
+		if progress != nil {
+			w = io.MultiWriter(&out, progress)
+		}
+		cmd.Stdout, cmd.Stderr = w, w
+		err := cmd.Run()
+		if err == nil {
+			// Another request may have put the same clone there first.
+			if err := os.Rename(work, dest); err != nil && !pathExists(filepath.Join(dest, ".git")) {
+				return fmt.Errorf("move clone into place: %w", err)
+			}
+			slog.InfoContext(ctx, "cloneRepo: cloned", "dest", dest, "private", private, "duration", time.Since(start).Round(time.Millisecond))
+			if private {
+				return markClonePrivate(ctx, dest)
+			}
+			return nil
+		}
+		_ = os.RemoveAll(work)
+		if i == len(attempts)-1 {
+			slog.ErrorContext(ctx, "cloneRepo: all attempts failed", "repo", spec.String())
+			return fmt.Errorf("git clone failed: %v\n%s", err, cloneErrorText(out.Bytes()))
+		}
+	}
+	return nil
+}
+
+func isLikelyGitHubURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if host == "github.com" || strings.HasSuffix(host, ".github.com") {
+		return true
+	}
+	return false
+}
+
+type outputBox struct {
+	Model  string
+	Output string
+	Rating int
+	RunID  int64 // the latest attempt, which Rating rates
+	PTY    bool
+	Edits  bool        // runs change the worktree; show their diff
+	Clean  bool        // the page asks for a cleaned-up output after a run
+	Hidden bool        // pending entry: the router decides which boxes to show
+	Runs   []runRecord // earlier attempts, newest first
+
+	DiffFrom, DiffTo string // commits made by the run, if any
+
+	TimedOut bool // the latest attempt was killed by a timeout
+	// Interrupted: the server stopped before the model finished.
+	Interrupted bool
+	Stderr      string     // the latest attempt's standard error
+	ExitCode    int        // of the latest attempt, if it finished
+	Failed      bool       // it exited non-zero, or never started
+	Params      string     // the model parameters it ran with
+	Citations   []citation // what the answer quoted from the worktree
+	// FallbackFrom and FallbackTo link the latest attempt to the model it
+	// stood in for, or the model that stood in for it.
+	FallbackFrom, FallbackTo string
+	Result                   *runResult  // the latest attempt's report
+	Command                  *runCommand // how the latest attempt was started
+	Took                     string      // how long the latest attempt ran, if it finished
+	Running                  string      // when the latest attempt started, while it runs
+}
+
+// withBoxes decides which output boxes each entry renders. A pending entry
+// gets a hidden box for every registered model; completed entries show the
+// models that produced output or were run, or the models for their intent.
+func withBoxes(cfg *config, es []entry, pendingIdx int) []entry {
+	for i := range es {
+		e := &es[i]
+		var models []string
+		if i == pendingIdx {
+			// The tests box is shown only if an edit queues a test run.
+			models = append(append([]string(nil), cfg.registry.Models()...), TestsModel)
+		} else {
+			for _, m := range cfg.registry.Models() {
+				// A model that never started has runs but no output.
+				if _, ok := e.Outputs[m]; ok || len(e.Runs[m]) > 0 {
+					models = append(models, m)
+				}
+			}
+			if _, ok := e.Outputs[TestsModel]; ok {
+				models = append(models, TestsModel)
+			}
+			var removed []string // models since dropped from the config
+			for m := range e.Outputs {
+				if _, ok := cfg.registry.Get(m); !ok && m != TestsModel {
+					removed = append(removed, m)
+				}
+			}
+			sort.Strings(removed)
+			models = append(models, removed...)
+			if len(models) == 0 && e.Confirm != confirmPending {
+				models = cfg.intentModels(e.Intent)
+			}
+		}
+		e.Boxes = make([]outputBox, 0, len(models))
+		for _, m := range models {
+			o := e.Outputs[m]
+			b := outputBox{Model: m, Output: o.Output, Stderr: o.Stderr, Rating: e.Ratings[m], Hidden: i == pendingIdx, Citations: e.Citations[m]}
+			// The latest attempt is the box itself; list the rest.
+			if rs := e.Runs[m]; len(rs) > 0 {
+				last := rs[len(rs)-1]
+				b.RunID = last.ID
+				b.TimedOut, b.Interrupted = last.TimedOut, last.Interrupted
+				b.Params = last.Params
+				b.FallbackFrom, b.FallbackTo = last.FallbackFrom, last.FallbackTo
+				b.Result = last.Result
+				b.Command = last.Command
+				b.Took = last.Took()
+				if last.FinishedAt == "" && !last.Interrupted {
+					b.Running = last.StartedAt
+				}
+				if last.FinishedAt != "" && !last.TimedOut && !last.Interrupted {
+					b.ExitCode, b.Failed = last.ExitCode, last.ExitCode != 0
+				}
+			}
+			// Queued when the server stopped: no run, no output.
+			b.Interrupted = b.Interrupted || e.Interrupted && o.Output == "" && !b.Hidden
+			if rs := e.Runs[m]; len(rs) > 1 {
+				for k := len(rs) - 2; k >= 0; k-- {
+					b.Runs = append(b.Runs, rs[k])
+				}
+			}
+			if o.HeadBefore != "" && o.HeadAfter != "" && o.HeadBefore != o.HeadAfter {
+				b.DiffFrom, b.DiffTo = o.HeadBefore, o.HeadAfter
+			}
+			if rn, ok := cfg.registry.Get(m); ok {
+				b.PTY = usesPTY(rn)
+				b.Edits = editsWorktree(rn)
+				b.Clean = cleansOutput(rn)
+			}
+			e.Boxes = append(e.Boxes, b)
+			if b.Output != "" && !b.Edits && !b.Hidden && m != TestsModel {
+				e.Comparable = append(e.Comparable, m)
+			}
+		}
+	}
+	return es
+}
+
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		slog.DebugContext(r.Context(), "indexHandler: non-GET; redirecting to /")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	setHTMLHeaders(w)
+	user := currentUser(r.Context())
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	tag, _ := normalizeTag(r.URL.Query().Get("tag"))
+	nbs, list, err := loadNotebookPage(r.Context(), user, r.URL.Query().Get("archived") == "1", tag, page)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "indexHandler: loadNotebookPage error", "err", err)
+	}
+	usage, err := notebookUsage(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "indexHandler: notebookUsage error", "err", err)
+	}
+	for i := range nbs {
+		nbs[i].Usage = usage[nbs[i].ID]
+	}
+	total, err := totalUsage(r.Context(), user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "indexHandler: totalUsage error", "err", err)
+	}
+	rates, err := modelWinRates(r.Context(), user, false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "indexHandler: modelWinRates error", "err", err)
+	}
+	_ = renderPage(w, "index", viewModel{Title: "Trybook", Notebooks: nbs, List: list, User: user, Admin: isAdmin(r.Context()), TotalUsage: total, WinRates: rates, CSRF: csrfToken(r)})
+}
+
+func tryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		slog.DebugContext(r.Context(), "tryHandler: non-POST; redirecting to /")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		slog.ErrorContext(r.Context(), "tryHandler: ParseForm error", "err", err)
+		setHTMLHeaders(w)
+		_ = renderPage(w, "index", viewModel{Title: "Trybook", Message: "Invalid form submission.", MsgClass: "error"})
+		return
+	}
+	input := strings.TrimSpace(r.FormValue("url"))
+	slog.DebugContext(r.Context(), "tryHandler", "input", input)
+	spec, err := parseRepoInput(input)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "tryHandler: parseRepoInput error", "err", err)
+		setHTMLHeaders(w)
+		_ = renderPage(w, "index", viewModel{Title: "Trybook", Message: err.Error(), MsgClass: "error"})
+		return
+	}
+	// reuse is "recent" to reopen the newest open notebook on the repo,
+	// "new" to start another regardless, and empty to ask first when there
+	// are open notebooks.
+	// An issue or pull request always gets a notebook of its own.
+	if reuse := r.FormValue("reuse"); reuse != "new" && spec.Issue == 0 {
+		user := currentUser(r.Context())
+		existing, err := repoNotebooks(r.Context(), user, spec, 10)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "tryHandler: repoNotebooks error", "err", err)
+		}
+		switch {
+		case len(existing) > 0 && reuse == "recent":
+			slog.InfoContext(r.Context(), "tryHandler: reopening notebook", "repo", spec.String(), "nb", existing[0].ID)
+			http.Redirect(w, r, "/n/"+existing[0].ID, http.StatusSeeOther)
+			return
+		case len(existing) > 0:
+			setHTMLHeaders(w)
+			_ = renderPage(w, "index", viewModel{Title: "Trybook", User: user, CSRF: csrfToken(r), Existing: existing, ExistingURL: input})
+			return
+		}
+	}
+	if err := os.MkdirAll(cloneBaseDir(), 0o755); err != nil {
+		slog.ErrorContext(r.Context(), "tryHandler: MkdirAll", "dir", cloneBaseDir(), "err", err)
+		setHTMLHeaders(w)
+		_ = renderPage(w, "index", viewModel{Title: "Trybook", Message: "Server cannot create clone dir.", MsgClass: "error"})
+		return
+	}
+	if err := os.MkdirAll(worktreeBaseDir(), 0o755); err != nil {
+		slog.ErrorContext(r.Context(), "tryHandler: MkdirAll", "dir", worktreeBaseDir(), "err", err)
+		setHTMLHeaders(w)
+		_ = renderPage(w, "index", viewModel{Title: "Trybook", Message: "Server cannot create worktree dir.", MsgClass: "error"})
+		return
+	}
+	if !pathExists(filepath.Join(repoDirPath(spec.Host, spec.Org, spec.Repo), ".git")) {
+		if err := checkRepoSize(r.Context(), spec, currentConfig().Quotas.MaxRepoSizeMB); err != nil {
+			slog.WarnContext(r.Context(), "tryHandler: checkRepoSize", "err", err)
+			setHTMLHeaders(w)
+			_ = renderPage(w, "index", viewModel{Title: "Trybook", Message: err.Error(), MsgClass: "error"})
+			return
+		}
+	}
+	// The notebook opens at once and follows the clone; see clone.go.
+	nbID, err := startClone(r.Context(), spec)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "tryHandler: startClone error", "err", err)
+		setHTMLHeaders(w)
+		_ = renderPage(w, "index", viewModel{Title: "Trybook", Message: "Failed to create notebook.", MsgClass: "error"})
+		return
+	}
+	slog.InfoContext(r.Context(), "tryHandler: notebook created", "repo", spec.String(), "nb", nbID)
+	http.Redirect(w, r, "/n/"+nbID, http.StatusSeeOther)
+}
+
+// GET /r/{org}/{repo} opens the newest notebook the user has for
+// github.com/{org}/{repo}, preferring active ones, or the index if there
+// is none.
+func repoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		slog.DebugContext(r.Context(), "repoHandler: non-GET; redirecting to /")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/r/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || !isSafeToken(parts[0]) || !isSafeToken(parts[1]) {
+		slog.DebugContext(r.Context(), "repoHandler: invalid path; redirecting", "path", r.URL.Path)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	var nbID string
+	err := db.QueryRowContext(r.Context(), `
+		SELECT id FROM notebooks
+		WHERE host = 'github.com' AND org = ?2 AND repo = ?3 AND (?1 = '' OR owner = '' OR owner = ?1) AND deleted_at = ''
+		ORDER BY archived_at != '', created_at DESC, id
+		LIMIT 1
+	`, currentUser(r.Context()), parts[0], parts[1]).Scan(&nbID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(r.Context(), "repoHandler", "err", err)
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/n/"+nbID, http.StatusSeeOther)
+}
+
+func notebookHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/n/")
+	if nb, idx, ok := strings.Cut(id, "/entries/"); ok {
+		entryHandler(w, r, nb, idx)
+		return
+	}
+	if nb, ok := strings.CutSuffix(id, "/search"); ok {
+		searchHandler(w, r, nb)
+		return
+	}
+	if nb, ok := strings.CutSuffix(id, "/settings"); ok {
+		notebookSettingsHandler(w, r, nb)
+		return
+	}
+	if nb, ok := strings.CutSuffix(id, "/file"); ok {
+		fileViewHandler(w, r, nb)
+		return
+	}
+	if nb, ok := strings.CutSuffix(id, "/files"); ok {
+		worktreeFilesHandler(w, r, nb)
+		return
+	}
+	if nb, ok := strings.CutSuffix(id, "/bundle"); ok {
+		bundleHandler(w, r, nb)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if !isSafeToken(id) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		deleteNotebookHandler(w, r, id)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if id == "" || !isSafeToken(id) {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	meta, entries, err := loadNotebook(r.Context(), id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "notebookHandler: load error", "err", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if meta.Status == "" {
+		if err := ensureWorktree(r.Context(), meta); err != nil {
+			slog.ErrorContext(r.Context(), "notebookHandler", "err", err)
+		}
+	}
+	prefs := requestPrefs(r)
+	pendingIdx := -1
+	if p := r.URL.Query().Get("pending"); p != "" {
+		// Only follow an entry the server is (or was recently) running; a
+		// stale ?pending= link must not look like a run in progress.
+		if i, err := strconv.Atoi(p); err == nil && hasLiveRun(id, i, "router") {
+			pendingIdx = i
+		}
+	}
+	vm := viewModel{
+		Title:       "Trybook - " + path.Join(meta.repoSpec().String(), meta.Subdir),
+		Host:        meta.Host,
+		Org:         meta.Org,
+		Repo:        meta.Repo,
+		Subdir:      meta.Subdir,
+		Branch:      meta.Branch,
+		CommitShort: commitShort(meta.SHA),
+		Entries:     withBoxes(currentConfig(), withHeld(currentConfig(), meta, entries), pendingIdx),
+		PendingIdx:  pendingIdx,
+		HasPending:  pendingIdx >= 0,
+		NotebookID:  meta.ID,
+		CSRF:        csrfToken(r),
+		Busy:        notebookBusy(meta.ID),
+
+		IntentModels: prefs.apply(currentConfig(), repoIntentModels(r.Context(), currentConfig(), meta.Host, meta.Org, meta.Repo)),
+		CanPR:        meta.Host == defaultHost,
+		Prefs:        prefs,
+	}
+	if meta.Status != "" {
+		// Nothing to show from the worktree yet; the page follows the clone.
+		vm.Cloning = meta.Status == nbCloning
+		vm.CloneError = meta.StatusMessage
+		setHTMLHeaders(w)
+		_ = renderPage(w, "notebook", vm)
+		return
+	}
+	vm.CanLanes = laneModels(currentConfig(), vm.IntentModels)
+	vm.EditTools = editTools(currentConfig())
+	vm.EditConfirm = newEditConfirm(currentConfig(), meta, vm.IntentModels, prefs)
+	vm.ParamFields = paramFields(currentConfig(), formModels(currentConfig(), vm.IntentModels))
+	vm.WarnTokens = promptWarnTokens
+	vm.Terminal = terminalEnabled(currentConfig())
+	vm.Transcribe = currentConfig().Transcribe.enabled()
+	if p, err := loadRepoProfile(r.Context(), meta.Host, meta.Org, meta.Repo); err != nil {
+		slog.WarnContext(r.Context(), "notebookHandler: repo profile", "err", err)
+	} else {
+		vm.Profile = p
+	}
+	if vm.Worktree, err = readWorktreeStatus(r.Context(), worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)); err != nil {
+		slog.WarnContext(r.Context(), "notebookHandler: worktree status", "err", err)
+	}
+	if vm.Pipelines, err = loadPipelines(r.Context(), meta.ID, 5); err != nil {
+		slog.WarnContext(r.Context(), "notebookHandler: pipelines", "err", err)
+	}
+	if vm.Source, err = loadNotebookSource(r.Context(), meta.ID); err != nil {
+		slog.WarnContext(r.Context(), "notebookHandler: source", "err", err)
+	} else if len(entries) == 0 && vm.Draft == "" {
+		vm.Draft = vm.Source.Draft
+	}
+	if vm.Templates, vm.OwnTemplates, err = templatesFor(r.Context(), currentUser(r.Context()), vm.Profile.Languages); err != nil {
+		slog.WarnContext(r.Context(), "notebookHandler: prompt templates", "err", err)
+	}
+	vm.TestCommand = repoTestCommand(r.Context(), currentConfig(), meta.Host, meta.Org, meta.Repo)
+	if vm.CanPR && isCommitish(meta.SHA) {
+		vm.BlobURL = githubBlobURL(meta, "", 0, 0)
+	}
+	if u, err := loadPRURL(r.Context(), meta.ID); err == nil {
+		vm.PRURL = u
+	}
+	if shallow, err := isShallow(r.Context(), repoDirPath(meta.Host, meta.Org, meta.Repo)); err == nil {
+		vm.Shallow = shallow
+	}
+	if prefs, err := loadPreferences(r.Context(), meta.ID); err == nil {
+		vm.Preferences = prefs
+	} else {
+		slog.ErrorContext(r.Context(), "notebookHandler: preferences", "err", err)
+	}
+	if n, ref, err := commitsBehind(r.Context(), meta); err == nil {
+		vm.Behind, vm.Upstream = n, ref
+	} else {
+		slog.ErrorContext(r.Context(), "notebookHandler", "err", err)
+	}
+	if from, idx, err := forkOrigin(r.Context(), meta.ID); err != nil {
+		slog.ErrorContext(r.Context(), "notebookHandler: fork origin", "err", err)
+	} else if ok, _ := notebookExists(r.Context(), from); from != "" && ok {
+		vm.ForkedFrom, vm.ForkedEntry = from, idx+1
+	}
+	setHTMLHeaders(w)
+	_ = renderPage(w, "notebook", vm)
+}
+
+func promptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		slog.DebugContext(r.Context(), "promptHandler: non-POST; redirecting to /")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		slog.ErrorContext(r.Context(), "promptHandler: ParseForm error", "err", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	if !isSafeToken(nbID) {
+		slog.WarnContext(r.Context(), "promptHandler: invalid notebook id", "nb", nbID)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	prompt, _, promptErr := checkPrompt(r.FormValue("prompt"), r.FormValue("large") == "1")
+	meta, entries, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	// fail shows the notebook again with msg, keeping what was typed.
+	fail := func(msg string) {
+		prefs := requestPrefs(r)
+		intentModels := prefs.apply(currentConfig(), repoIntentModels(r.Context(), currentConfig(), meta.Host, meta.Org, meta.Repo))
+		vm := viewModel{
+			Title:      "Trybook - " + meta.repoSpec().String(),
+			Host:       meta.Host,
+			Org:        meta.Org,
+			Repo:       meta.Repo,
+			Branch:     meta.Branch,
+			NotebookID: nbID,
+			Message:    msg,
+			MsgClass:   "error",
+			Entries:    withBoxes(currentConfig(), entries, -1),
+			PendingIdx: -1,
+			Draft:      prompt,
+			DraftFiles: r.FormValue("files"),
+			CSRF:       csrfToken(r),
+			CanLanes:   laneModels(currentConfig(), intentModels),
+			EditTools:  editTools(currentConfig()),
+			AskLarge:   errors.Is(promptErr, errPromptPasted),
+			WarnTokens: promptWarnTokens,
+			Prefs:      prefs,
+
+			ParamFields: paramFields(currentConfig(), formModels(currentConfig(), intentModels)),
+			EditConfirm: newEditConfirm(currentConfig(), meta, intentModels, prefs),
+		}
+		setHTMLHeaders(w)
+		_ = renderPage(w, "notebook", vm)
+	}
+	if meta.Status != "" {
+		fail("The repository is not cloned yet.")
+		return
+	}
+	if errors.Is(promptErr, errPromptEmpty) {
+		slog.DebugContext(r.Context(), "promptHandler: empty prompt")
+		fail("Please enter a prompt.")
+		return
+	}
+	if promptErr != nil {
+		slog.InfoContext(r.Context(), "promptHandler: prompt refused", "err", promptErr)
+		fail("Cannot send the prompt: " + promptErr.Error() + ".")
+		return
+	}
+	editModel := strings.TrimSpace(r.FormValue("edit_model"))
+	if editModel != "" && !isEditTool(currentConfig(), editModel) {
+		fail("Unknown edit tool: " + editModel)
+		return
+	}
+	params, err := paramsFromForm(currentConfig(), r)
+	if err != nil {
+		fail("Model options: " + err.Error())
+		return
+	}
+	wtDir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	ignore, err := currentConfig().contextIgnore(meta, wtDir)
+	if err != nil {
+		slog.WarnContext(r.Context(), "promptHandler: ignore rules", "err", err)
+	}
+	attachments, err := attachmentsFromForm(r, wtDir, ignore)
+	if err != nil {
+		slog.InfoContext(r.Context(), "promptHandler: attachments refused", "err", err)
+		fail("Cannot attach: " + err.Error())
+		return
+	}
+	idx, err := appendNotebookEntry(r.Context(), nbID, prompt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "promptHandler: appendNotebookEntry error", "err", err)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := saveAttachments(r.Context(), nbID, idx, attachments); err != nil {
+		slog.ErrorContext(r.Context(), "promptHandler: saveAttachments error", "err", err)
+	}
+	if len(params) > 0 {
+		if err := setEntryParams(r.Context(), nbID, idx, params); err != nil {
+			slog.ErrorContext(r.Context(), "promptHandler: set params", "err", err)
+		}
+	}
+	if editModel != "" {
+		if err := setEntryEditModel(r.Context(), nbID, idx, editModel); err != nil {
+			slog.ErrorContext(r.Context(), "promptHandler: set edit model", "err", err)
+		}
+	}
+	if r.FormValue("dry_run") == "1" {
+		if err := setEntryDryRun(r.Context(), nbID, idx, true); err != nil {
+			slog.ErrorContext(r.Context(), "promptHandler: set dry run", "err", err)
+		}
+	} else if editModel == "" && r.FormValue("lanes") == "1" {
+		if err := setEntryLanes(r.Context(), nbID, idx, true); err != nil {
+			slog.ErrorContext(r.Context(), "promptHandler: set lanes", "err", err)
+		}
+	}
+	// The Ask/Edit toggle overrides the router.
+	if intent := r.FormValue("intent"); intent != "" {
+		if err := setNotebookEntryIntent(r.Context(), nbID, idx, intent, intentManual); err != nil {
+			slog.ErrorContext(r.Context(), "promptHandler: set intent", "err", err)
+		}
+	}
+	broadcastNotebook(nbID, hubMsg{Type: "entry", Idx: idx})
+	// Runs belong to the server from here on; the page only follows them.
+	if err := enqueueEntry(r.Context(), currentConfig(), nbID, idx); err != nil {
+		slog.ErrorContext(r.Context(), "promptHandler: enqueueEntry error", "err", err)
+	}
+	http.Redirect(w, r, "/n/"+nbID+"?pending="+strconv.Itoa(idx)+"#pending", http.StatusSeeOther)
+	return
+}
+
+// POST /rerun: run an entry's prompt again
+func rerunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	idx, err := strconv.Atoi(strings.TrimSpace(r.FormValue("idx")))
+	if err != nil || !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	// "Run edit" on a dry run runs it for real; Confirm and Dry run on an
+	// edit held for confirmation run it as chosen.
+	confirm := r.FormValue("confirm")
+	if r.FormValue("apply") == "1" {
+		confirm = "run"
+	}
+	if confirm == "run" || confirm == "dry_run" {
+		if err := confirmEntry(r.Context(), nbID, idx, confirm == "dry_run"); err != nil {
+			slog.ErrorContext(r.Context(), "rerunHandler: confirm", "err", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := enqueueEntry(r.Context(), currentConfig(), nbID, idx); err != nil {
+		slog.ErrorContext(r.Context(), "rerunHandler: enqueueEntry error", "err", err)
+		if errors.Is(err, errRunNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+		return
+	}
+	http.Redirect(w, r, "/n/"+nbID+"?pending="+strconv.Itoa(idx)+"#pending", http.StatusSeeOther)
+}
+
+func nbHeadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.URL.Query().Get("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	st, err := readWorktreeStatus(r.Context(), worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "nbHeadHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// POST /api/summarize_final
+func summarizeFinalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	txt := strings.TrimSpace(r.FormValue("text"))
+	if len(txt) > 10000 {
+		txt = txt[len(txt)-10000:]
+	}
+	prompt := "Summarize the following answer in a single short sentence for the user. Be concise.\n\nAnswer:\n" + txt
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+	cmd := currentExecer().CommandContext(ctx, "llm", "--model", "gpt-5-nano", prompt)
+	superviseCmd(cmd)
+	cmd.Env = modelEnv()
+	if apiKey("OPENAI_API_KEY") == "" {
+		slog.WarnContext(r.Context(), "summarizeFinalHandler: OPENAI_API_KEY not set")
+	}
+	out, err := cmd.Output()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "summarizeFinalHandler: llm error", "err", err)
+		_, _ = w.Write([]byte("Summary unavailable"))
+		return
+	}
+	_, _ = w.Write([]byte(strings.TrimSpace(string(out))))
+}
+
+// POST /api/summarize
+func summarizeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	txt := strings.TrimSpace(r.FormValue("text"))
+	if len(txt) > 8000 {
+		txt = txt[len(txt)-8000:]
+	}
+	prompt := "What is this tool doing right now? Please respond in a single short sentence.\n\nTranscript:\n" + txt
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	cmd := currentExecer().CommandContext(ctx, "llm", "--model", "gpt-5-nano", prompt)
+	superviseCmd(cmd)
+	cmd.Env = modelEnv()
+	if apiKey("OPENAI_API_KEY") == "" {
+		slog.WarnContext(r.Context(), "summarizeHandler: OPENAI_API_KEY not set")
+	}
+	out, err := cmd.Output()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "summarizeHandler: llm error", "err", err)
+		_, _ = w.Write([]byte("working..."))
+		return
+	}
+	_, _ = w.Write([]byte(strings.TrimSpace(string(out))))
+}
+
+// POST /api/clean_gemini (nb, idx, model, text); cleans the output of any
+// model with clean_output set, gemini by default.
+func cleanGeminiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	idxStr := strings.TrimSpace(r.FormValue("idx"))
+	txt := strings.TrimSpace(r.FormValue("text"))
+	model := strings.TrimSpace(r.FormValue("model"))
+	if model == "" {
+		model = "gemini"
+	}
+	if !isSafeToken(model) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	// Cap input size to protect the summarizer
+	if len(txt) > 20000 {
+		txt = txt[len(txt)-20000:]
+	}
+
+	prompt := strings.Join([]string{
+		"You are given the raw output from a " + model + " run. Produce a cleaned version:",
+		"- Remove any 'thinking' or internal reasoning sections.",
+		"- Remove tool-use logs and tool invocation/error messages.",
+		"- Remove the data-collection disclaimer/warning at the top if present.",
+		"- Remove any trailing status markers like [done] at the end.",
+		"- Otherwise keep the content and formatting exactly as-is.",
+		"Return only the cleaned text.",
+		"",
+		"Raw output:",
+		txt,
+	}, "\n")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 12*time.Second)
+	defer cancel()
+	cmd := currentExecer().CommandContext(ctx, "llm", "--model", "gpt-5-nano", prompt)
+	superviseCmd(cmd)
+	cmd.Env = modelEnv()
+	if apiKey("OPENAI_API_KEY") == "" {
+		slog.WarnContext(r.Context(), "cleanGeminiHandler: OPENAI_API_KEY not set")
+	}
+	out, err := cmd.Output()
+	cleaned := strings.TrimSpace(string(out))
+	if cleaned == "" || err != nil {
+		if err != nil {
+			slog.ErrorContext(r.Context(), "cleanGeminiHandler: llm error", "err", err)
+		}
+		// Fall back to returning original text if cleaning failed
+		cleaned = strings.TrimSpace(txt)
+	}
+
+	// Optionally persist if nb/idx provided and valid
+	if nbID != "" && isSafeToken(nbID) && idxStr != "" {
+		if idx, err := strconv.Atoi(idxStr); err == nil {
+			if err := notebooks.SetOutput(r.Context(), nbID, idx, model, cleaned); err != nil {
+				slog.ErrorContext(r.Context(), "cleanGeminiHandler: persist error", "err", err)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(cleaned))
+}
+
+func newMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", indexHandler)
+	mux.HandleFunc("/try", tryHandler)
+	mux.HandleFunc("/events/clone", cloneEventsHandler)
+	mux.HandleFunc("/r/", repoHandler)
+	mux.HandleFunc("/n/", notebookHandler)
+	mux.HandleFunc("/search", notebookSearchHandler)
+	mux.HandleFunc("/prompt", promptHandler)
+	mux.HandleFunc("/rerun", rerunHandler)
+	mux.HandleFunc("/events/run", runEventsHandler)
+	mux.HandleFunc("/events/stop", runStopHandler)
+	mux.HandleFunc("/api/run/stop", runStopHandler)
+	mux.HandleFunc("/ws/notebook", notebookWSHandler)
+	mux.HandleFunc("/ws/terminal", terminalWSHandler)
+	mux.HandleFunc("/api/head", nbHeadHandler)
+	mux.HandleFunc("/api/diff", diffHandler)
+	mux.HandleFunc("/api/citations", citationsHandler)
+	mux.HandleFunc("/api/runs", runsHandler)
+	mux.HandleFunc("/api/transcribe", transcribeHandler)
+	mux.HandleFunc("/api/timeline", timelineHandler)
+	mux.HandleFunc("/api/pr", pullRequestHandler)
+	mux.HandleFunc("/api/export", exportHandler)
+	mux.HandleFunc("/api/notebooks", notebooksHandler)
+	mux.HandleFunc("/api/tags", tagsHandler)
+	mux.HandleFunc("/api/upstream", upstreamHandler)
+	mux.HandleFunc("/api/commit", manualCommitHandler)
+	mux.HandleFunc("/api/worktree", worktreeActionHandler)
+	mux.HandleFunc("/api/unshallow", unshallowHandler)
+	mux.HandleFunc("/api/archive", archiveNotebookHandler)
+	mux.HandleFunc("/api/lanes/keep", keepLaneHandler)
+	mux.HandleFunc("/api/lanes/diff", laneDiffHandler)
+	mux.HandleFunc("/import", importHandler)
+	mux.HandleFunc("/batch", batchHandler)
+	mux.HandleFunc("/batch/", batchPageHandler)
+	mux.HandleFunc("/pipeline", pipelineHandler)
+	mux.HandleFunc("/pipeline/stop", pipelineStopHandler)
+	mux.HandleFunc("/fork", forkHandler)
+	mux.HandleFunc("/rollback", rollbackHandler)
+	mux.HandleFunc("/api/summarize", summarizeHandler)
+	mux.HandleFunc("/api/summarize_final", summarizeFinalHandler)
+	mux.HandleFunc("/api/clean_gemini", cleanGeminiHandler)
+	mux.HandleFunc("/api/feedback", feedbackHandler)
+	mux.HandleFunc("/api/prefer", preferHandler)
+	mux.HandleFunc("/api/winrates", winRatesHandler)
+	mux.HandleFunc("/api/openapi.json", openAPIHandler)
+	mux.HandleFunc("/admin/reload", requireAdmin(reloadHandler))
+	mux.HandleFunc("/admin/gc", requireAdmin(gcHandler))
+	mux.HandleFunc("/admin/backup", requireAdmin(backupHandler))
+	mux.HandleFunc("/admin/disk", requireAdmin(diskHandler))
+	mux.HandleFunc("/admin/disk/", requireAdmin(diskHandler))
+	mux.HandleFunc("/admin/runs", requireAdmin(adminRunsHandler))
+	mux.HandleFunc("/admin/runs/", requireAdmin(adminRunsHandler))
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	mux.HandleFunc("/login", loginHandler)
+	mux.HandleFunc("/logout", logoutHandler)
+	mux.HandleFunc("/settings", settingsHandler)
+	mux.HandleFunc("/settings/keys", requireAdmin(apiKeysHandler))
+	mux.HandleFunc("/settings/templates", promptTemplatesHandler)
+	mux.HandleFunc("/trash", trashHandler)
+	mux.HandleFunc("/auth/github", githubLoginHandler)
+	mux.HandleFunc("/auth/github/callback", githubCallbackHandler)
+	return behindProxy(logRequests(allowClients(checkCSRF(requireAuth(limitRate(mux))))))
+}
+
+// serve runs the server; main has parsed its flags.
+func Serve() {
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := setupProxy(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := setupAllowlist(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *restoreFrom != "" {
+		if err := restoreBackup(context.Background(), *restoreFrom); err != nil {
+			fatal("restore", err)
+		}
+	}
+	if err := initDB(); err != nil {
+		fatal("initDB", err)
+	}
+	if err := reloadConfig(); err != nil {
+		fatal("config", err)
+	}
+	if err := loadTemplates(); err != nil {
+		fatal("templates", err)
+	}
+	if *fakeExecFile != "" {
+		f, err := loadFakeExecer(*fakeExecFile)
+		if err != nil {
+			fatal("fake-exec", err)
+		}
+		setExecer(f)
+		slog.Warn("fake-exec: model commands replay canned output", "file", *fakeExecFile)
+	}
+	if *gcOnce {
+		runGCOnce()
+		return
+	}
+	if !authEnabled() {
+		slog.Warn("authentication disabled; set TRYBOOK_TOKEN or GITHUB_CLIENT_ID/GITHUB_CLIENT_SECRET")
+	}
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go watchSIGHUP(hupCh)
+	defer closeDB()
+	removePIDFile, err := writePIDFile()
+	if err != nil {
+		fatal("pidfile", err)
+	}
+	defer removePIDFile()
+	ln, addr, err := listen()
+	if err != nil {
+		fatal("listen", err)
+	}
+	warnExposed(ln)
+	srv := &http.Server{
+		Handler:      newMux(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 0, // no write timeout; needed for streaming
+		IdleTimeout:  60 * time.Second,
+		ErrorLog:     serverErrorLog(),
+	}
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go runReaper(bgCtx, 30*time.Second)
+	go runCheckpoints(bgCtx, walCheckpointInterval)
+	relayoutRepos()
+	markInterruptedJobs()
+	markInterruptedBatches()
+	markInterruptedPipelines()
+	markInterruptedClones()
+	go runJobQueue(bgCtx)
+	go runCloneRefresher(bgCtx, *fetchInterval)
+	go runSummarizer(bgCtx, *summaryIdle)
+	go runBackups(bgCtx)
+	go runTrashPurge(bgCtx)
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("Trybook listening", "addr", addr)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+	}()
+	sdNotify("READY=1")
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-sigCh:
+		slog.Info("signal received; shutting down", "signal", sig.String())
+	case err := <-errCh:
+		slog.Error("server error; shutting down", "err", err)
+	}
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("graceful shutdown failed", "err", err)
+	}
+	killAllProcGroups()
+	slog.Info("bye")
+}
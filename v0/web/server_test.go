@@ -0,0 +1,660 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests run against a server on a temporary -dir, with model commands
+// faked (see execer.go). fakeExecer runs this test binary again in its
+// fake-process mode, so TestMain hands that subcommand on as main does.
+
+const testConfig = `{
+	"models": {
+		"router": {"command": ["llm", "{prompt}"]},
+		"echo": {"command": ["echo-model", "{prompt}"]},
+		"broken": {"command": ["broken-model", "{prompt}"]},
+		"editor": {"command": ["edit-model", "{prompt}"], "edits": true}
+	},
+	"intents": {"question": ["echo", "broken"], "edit": ["editor"]}
+}`
+
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == FakeProcessCommand {
+		os.Exit(RunFakeProcess(os.Args[2:]))
+	}
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "trybook-test-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	*appDir = dir
+	if err := setupTestServer(); err != nil {
+		fmt.Fprintln(os.Stderr, "setup:", err)
+		return 1
+	}
+	defer closeDB()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runJobQueue(ctx)
+	return m.Run()
+}
+
+func setupTestServer() error {
+	os.Unsetenv("TRYBOOK_TOKEN")
+	os.Unsetenv("GITHUB_CLIENT_ID")
+	*rateLimit = 0 // the tests open notebooks and send prompts in quick succession
+	if err := os.WriteFile(filepath.Join(*appDir, "config.json"), []byte(testConfig), 0o644); err != nil {
+		return err
+	}
+	if err := initDB(); err != nil {
+		return err
+	}
+	if err := reloadConfig(); err != nil {
+		return err
+	}
+	if err := loadTemplates(); err != nil {
+		return err
+	}
+	// A clone of github.com/acme/widget, so /try needs no network.
+	clone := repoDirPath(defaultHost, "acme", "widget")
+	if err := os.MkdirAll(clone, 0o755); err != nil {
+		return err
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=t", "-c", "user.email=t@t", "commit", "-q", "--allow-empty", "-m", "init"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", clone}, args...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %v\n%s", args[0], err, out)
+		}
+	}
+	return nil
+}
+
+// testClient talks to a test server the way the pages do, CSRF token
+// included.
+type testClient struct {
+	t    *testing.T
+	srv  *httptest.Server
+	hc   *http.Client
+	csrf string
+}
+
+func newTestClient(t *testing.T) *testClient {
+	t.Helper()
+	srv := httptest.NewServer(newMux())
+	t.Cleanup(srv.Close)
+	jar, _ := cookiejar.New(nil)
+	c := &testClient{t: t, srv: srv, hc: &http.Client{
+		Jar:           jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+	res, err := c.hc.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	u, _ := url.Parse(srv.URL)
+	for _, ck := range jar.Cookies(u) {
+		if ck.Name == "tb_csrf" {
+			c.csrf = ck.Value
+		}
+	}
+	if c.csrf == "" {
+		t.Fatal("no tb_csrf cookie")
+	}
+	return c
+}
+
+// post sends form and returns where the server redirected to.
+func (c *testClient) post(path string, form url.Values) *url.URL {
+	c.t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, c.srv.URL+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-CSRF-Token", c.csrf)
+	res, err := c.hc.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		c.t.Fatalf("POST %s: %s", path, res.Status)
+	}
+	loc, err := res.Location()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return loc
+}
+
+// newNotebook opens a notebook on acme/widget and waits for its worktree.
+func (c *testClient) newNotebook() string {
+	c.t.Helper()
+	loc := c.post("/try", url.Values{"url": {"acme/widget"}, "reuse": {"new"}})
+	id := strings.TrimPrefix(loc.Path, "/n/")
+	if !isSafeToken(id) {
+		c.t.Fatalf("/try redirected to %s", loc)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		meta, _, err := loadNotebook(context.Background(), id)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		switch {
+		case meta.Status == "":
+			return id
+		case meta.Status == nbCloneError:
+			c.t.Fatalf("worktree: %s", meta.StatusMessage)
+		case time.Now().After(deadline):
+			c.t.Fatal("worktree not ready")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// prompt adds an entry and returns its index.
+func (c *testClient) prompt(nbID, prompt string) int {
+	c.t.Helper()
+	loc := c.post("/prompt", url.Values{"nb": {nbID}, "prompt": {prompt}})
+	idx, err := strconv.Atoi(loc.Query().Get("pending"))
+	if err != nil {
+		c.t.Fatalf("/prompt redirected to %s", loc)
+	}
+	return idx
+}
+
+type testEvent struct{ name, data string }
+
+// events follows a run over /events/run until it finishes.
+func (c *testClient) events(nbID string, idx int, model string) []testEvent {
+	c.t.Helper()
+	q := url.Values{"nb": {nbID}, "idx": {strconv.Itoa(idx)}, "model": {model}, "attach": {"1"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, c.srv.URL+"/events/run?"+q.Encode(), nil)
+	res, err := c.hc.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		c.t.Fatalf("events %s: %s", model, res.Status)
+	}
+	var evs []testEvent
+	var ev testEvent
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			ev.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		case line == "" && ev.name != "":
+			if ev.name != "heartbeat" {
+				evs = append(evs, ev)
+			}
+			ev = testEvent{}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		c.t.Fatalf("events %s: %v", model, err)
+	}
+	if len(evs) == 0 || evs[len(evs)-1].name != "done" {
+		c.t.Fatalf("events %s: no done event in %v", model, evs)
+	}
+	return evs
+}
+
+// text joins the JSON strings of evs named name.
+func text(evs []testEvent, name string) string {
+	var b strings.Builder
+	for _, ev := range evs {
+		var s string
+		if ev.name == name && json.Unmarshal([]byte(ev.data), &s) == nil {
+			b.WriteString(s)
+		}
+	}
+	return b.String()
+}
+
+func find(evs []testEvent, name string) (testEvent, bool) {
+	for _, ev := range evs {
+		if ev.name == name {
+			return ev, true
+		}
+	}
+	return testEvent{}, false
+}
+
+func fakeModels(t *testing.T, procs map[string]fakeProcess) *fakeExecer {
+	t.Helper()
+	f, err := newFakeExecer(procs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(setExecer(f))
+	return f
+}
+
+func TestPromptRoutesAndRuns(t *testing.T) {
+	f := fakeModels(t, map[string]fakeProcess{
+		"llm":          {Stdout: "question\n"},
+		"echo-model":   {Stdout: "canned answer\n", Stderr: "warn: fake\n"},
+		"broken-model": {Stdout: "partial\n", Stderr: "boom\n", ExitCode: 3},
+	})
+	c := newTestClient(t)
+	nbID := c.newNotebook()
+	idx := c.prompt(nbID, "tell me about this repository")
+
+	router := c.events(nbID, idx, "router")
+	if got := text(router, "chunk"); got != "question\n" {
+		t.Errorf("router output = %q, want %q", got, "question\n")
+	}
+	ev, ok := find(router, "routed")
+	if !ok {
+		t.Fatalf("router events %v have no routed", router)
+	}
+	var routed struct{ Models []string }
+	if err := json.Unmarshal([]byte(ev.data), &routed); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(routed.Models, " ") != "echo broken" {
+		t.Errorf("routed models = %v, want [echo broken]", routed.Models)
+	}
+
+	echo := c.events(nbID, idx, "echo")
+	if got := text(echo, "chunk"); got != "canned answer\n" {
+		t.Errorf("echo output = %q", got)
+	}
+	if got := text(echo, "stderr"); got != "warn: fake\n" {
+		t.Errorf("echo stderr = %q", got)
+	}
+	broken := c.events(nbID, idx, "broken")
+	if ev, ok := find(broken, "exit-code"); !ok || ev.data != `{"code":3}` {
+		t.Errorf("broken exit-code event = %v", ev)
+	}
+
+	// The router was faked too, with the prompt in its arguments.
+	var sawRouter bool
+	for _, call := range f.Calls() {
+		if call.Argv[0] == "llm" {
+			sawRouter = strings.Contains(strings.Join(call.Argv, " "), "tell me about this repository")
+		}
+	}
+	if !sawRouter {
+		t.Error("the router's llm call did not go through the execer")
+	}
+
+	ctx := context.Background()
+	_, es, err := loadNotebook(ctx, nbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := es[idx]
+	if e.Intent != "question" || e.IntentSource != intentRouter {
+		t.Errorf("intent = %q from %q, want question from the router", e.Intent, e.IntentSource)
+	}
+	if out := e.Outputs["echo"]; out.Output != "canned answer\n" || out.Stderr != "warn: fake\n" {
+		t.Errorf("echo entry output = %+v", out)
+	}
+	if out := e.Outputs["broken"]; !strings.Contains(out.Output, "partial\n") || out.Stderr != "boom\n" {
+		t.Errorf("broken entry output = %+v", out)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT model, exit_code, output, stderr FROM runs WHERE notebook_id = ? AND idx = ? ORDER BY id
+	`, nbID, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	runs := map[string]string{}
+	for rows.Next() {
+		var model, output, stderr string
+		var code int
+		if err := rows.Scan(&model, &code, &output, &stderr); err != nil {
+			t.Fatal(err)
+		}
+		runs[model] = fmt.Sprintf("%d %q %q", code, output, stderr)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for model, want := range map[string]string{
+		"echo":   `0 "canned answer\n" "warn: fake\n"`,
+		"broken": `3 "partial\n" "boom\n"`,
+	} {
+		if runs[model] != want {
+			t.Errorf("runs row of %s = %s, want %s", model, runs[model], want)
+		}
+	}
+}
+
+func TestGuessedEditIsHeld(t *testing.T) {
+	f := fakeModels(t, map[string]fakeProcess{"*": {Stdout: "edited\n"}})
+	c := newTestClient(t)
+	nbID := c.newNotebook()
+	idx := c.prompt(nbID, "add a README")
+
+	router := c.events(nbID, idx, "router")
+	ev, ok := find(router, "routed")
+	if !ok || !strings.Contains(ev.data, `"held":true`) {
+		t.Fatalf("routed event = %v, want a held edit", ev)
+	}
+	if calls := f.Calls(); len(calls) != 0 {
+		t.Fatalf("held edit ran %v", calls)
+	}
+
+	c.post("/rerun", url.Values{"nb": {nbID}, "idx": {strconv.Itoa(idx)}, "confirm": {"run"}})
+	if got := text(c.events(nbID, idx, "editor"), "chunk"); !strings.HasPrefix(got, "edited\n") {
+		t.Errorf("confirmed edit output = %q", got)
+	}
+	_, es, err := loadNotebook(context.Background(), nbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es[idx].Confirm != confirmConfirmed {
+		t.Errorf("edit_confirm = %q after Confirm", es[idx].Confirm)
+	}
+}
+
+// A restart closes out what the previous process left queued or running.
+func TestMarkInterrupted(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+	nbID := c.newNotebook()
+	idx, err := appendNotebookEntry(ctx, nbID, "left running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobID, err := notebooks.CreateJob(ctx, nbID, idx, "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notebooks.SetJobStatus(ctx, jobID, "running", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := notebooks.StartRun(ctx, nbID, idx, "echo"); err != nil {
+		t.Fatal(err)
+	}
+
+	markInterruptedJobs()
+	var status string
+	if err := db.QueryRow(`SELECT status FROM jobs WHERE id = ?`, jobID).Scan(&status); err != nil || status != "interrupted" {
+		t.Errorf("job status = %q, %v", status, err)
+	}
+	runs, err := loadRuns(ctx, nbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs := runs[idx]["echo"]; len(rs) != 1 || !rs[0].Interrupted {
+		t.Errorf("runs = %+v, want one interrupted", rs)
+	}
+	_, es, err := loadNotebook(ctx, nbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !es[idx].Interrupted {
+		t.Error("entry not flagged interrupted")
+	}
+
+	if err := notebooks.ClearInterrupted(ctx, nbID, idx); err != nil {
+		t.Fatal(err)
+	}
+	if _, es, _ = loadNotebook(ctx, nbID); es[idx].Interrupted {
+		t.Error("ClearInterrupted left the flag")
+	}
+}
+
+// A rating belongs to the run it was given for, and rated prompts are
+// shown to the router for the repo's later prompts.
+func TestFeedbackPerRun(t *testing.T) {
+	fakeModels(t, map[string]fakeProcess{"llm": {Stdout: "question\n"}, "*": {Stdout: "answer\n"}})
+	c := newTestClient(t)
+	nbID := c.newNotebook()
+	idx := c.prompt(nbID, "where is the config loaded")
+	c.events(nbID, idx, "router")
+	c.events(nbID, idx, "echo")
+
+	form := url.Values{"nb": {nbID}, "idx": {strconv.Itoa(idx)}, "model": {"echo"}, "rating": {"1"}}
+	req, _ := http.NewRequest(http.MethodPost, c.srv.URL+"/api/feedback", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-CSRF-Token", c.csrf)
+	res, err := c.hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("POST /api/feedback: %s", res.Status)
+	}
+	ctx := context.Background()
+	meta, es, err := loadNotebook(ctx, nbID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es[idx].Ratings["echo"] != 1 {
+		t.Errorf("ratings = %v, want echo rated up", es[idx].Ratings)
+	}
+	if p := withRoutingFeedback(ctx, meta, "next"); !strings.Contains(p, `"where is the config loaded" was treated as question, rated good`) {
+		t.Errorf("router prompt = %q", p)
+	}
+
+	// A new run of echo starts unrated; the earlier rating stays with its run.
+	if _, err := notebooks.StartRun(ctx, nbID, idx, "echo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, es, _ = loadNotebook(ctx, nbID); es[idx].Ratings["echo"] != 0 {
+		t.Errorf("ratings after a re-run = %v, want echo unrated", es[idx].Ratings)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM feedback WHERE notebook_id = ? AND idx = ? AND run_id != 0`, nbID, idx).Scan(&n); err != nil || n != 1 {
+		t.Errorf("feedback rows with a run = %d, %v", n, err)
+	}
+}
+
+func TestParseRepoInput(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		spec    string // host/org/repo, or "" if in is rejected
+		repoDir string // relative to the clone directory
+	}{
+		{"acme/widget", "github.com/acme/widget", "acme/widget"},
+		{"https://github.com/acme/widget/tree/main/pkg", "github.com/acme/widget", "acme/widget"},
+		{"git@github.com:acme/widget.git", "github.com/acme/widget", "acme/widget"},
+		{"https://gitlab.com/acme/widget", "gitlab.com/acme/widget", "gitlab.com/acme/widget"},
+		{"https://gitlab.com/acme/widget/tools/-/tree/main", "gitlab.com/acme/widget/tools", "gitlab.com/acme%2Fwidget/tools"},
+		{"ssh://git@git.example.com:2222/a/b/c.git", "git.example.com:2222/a/b/c", "git.example.com_2222/a%2Fb/c"},
+		{"https://gitserver/acme/widget.git", "gitserver/acme/widget", "_gitserver/acme/widget"},
+		{"acme", "", ""},
+		{"_local/home", "", ""},
+		{"https://github.com/_local/home", "", ""},
+		{"git@github.com:_local/home.git", "", ""},
+		{"ac.me/widget", "", ""},
+		{"-acme/widget", "", ""},
+		{"acme/..", "", ""},
+		{"https://local/acme/widget", "", ""},
+		{"https://gitlab.com/acme/../widget", "", ""},
+	} {
+		spec, err := parseRepoInput(tc.in)
+		if tc.spec == "" {
+			if err == nil {
+				t.Errorf("parseRepoInput(%q) = %+v, want an error", tc.in, spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRepoInput(%q): %v", tc.in, err)
+			continue
+		}
+		if got := spec.Host + "/" + spec.Org + "/" + spec.Repo; got != tc.spec {
+			t.Errorf("parseRepoInput(%q) = %s, want %s", tc.in, got, tc.spec)
+		}
+		if got := repoDirPath(spec.Host, spec.Org, spec.Repo); got != filepath.Join(cloneBaseDir(), tc.repoDir) {
+			t.Errorf("repoDirPath(%q) = %s, want <clone>/%s", tc.in, got, tc.repoDir)
+		}
+	}
+}
+
+// ensureRepoCloned may clear an empty directory where a clone goes, but
+// never one with something in it.
+func TestEnsureRepoClonedKeepsStrangers(t *testing.T) {
+	ctx := context.Background()
+	src := "file://" + repoDirPath(defaultHost, "acme", "widget")
+	spec := repoSpec{Host: "git.example.com", Org: "acme", Repo: "keep", CloneURL: src}
+	dest := repoDirPath(spec.Host, spec.Org, spec.Repo)
+	if err := os.MkdirAll(filepath.Join(dest, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureRepoCloned(ctx, spec, nil); err == nil {
+		t.Error("ensureRepoCloned over a non-empty directory succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "data")); err != nil {
+		t.Errorf("ensureRepoCloned removed what was in its way: %v", err)
+	}
+
+	spec.Repo = "empty"
+	dest = repoDirPath(spec.Host, spec.Org, spec.Repo)
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureRepoCloned(ctx, spec, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, ".git")); err != nil {
+		t.Errorf("no clone at %s: %v", dest, err)
+	}
+	if des, _ := os.ReadDir(partialCloneDir()); len(des) != 0 {
+		t.Errorf("cloneRepo left %d partial clones", len(des))
+	}
+}
+
+// seedEntries gives notebook nbID n entries, "entry 0" to "entry n-1",
+// each with a run, a rating, an attachment and a pipeline step that all
+// name it, for checkEntryRows.
+func seedEntries(t *testing.T, nbID string, n int) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := db.Exec(`INSERT INTO pipelines(id, notebook_id) VALUES(?, ?)`, nbID, nbID); err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		name := "entry " + strconv.Itoa(i)
+		idx, err := appendNotebookEntry(ctx, nbID, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runID, err := notebooks.StartRun(ctx, nbID, idx, "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := setFeedback(ctx, nbID, idx, "echo", runID, 1, name); err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range []string{
+			`UPDATE runs SET output = ?3 WHERE notebook_id = ?1 AND idx = ?2`,
+			`INSERT INTO attachments(notebook_id, idx, pos, kind, name, content) VALUES(?1, ?2, 0, 'snippet', ?3, '')`,
+			`INSERT INTO pipeline_steps(pipeline_id, pos, kind, prompt, idx) VALUES(?1, ?2, 'edit', ?3, ?2)`,
+		} {
+			if _, err := db.Exec(q, nbID, idx, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// checkEntryRows checks that the rows seedEntries made follow their entry:
+// want[i] is the seeded entry now at idx i, and the steps of gone entries
+// point at no entry.
+func checkEntryRows(t *testing.T, nbID string, want []int, gone ...int) {
+	t.Helper()
+	wantIdx := map[string]int{}
+	for idx, i := range want {
+		wantIdx["entry "+strconv.Itoa(i)] = idx
+	}
+	for _, i := range gone {
+		wantIdx["entry "+strconv.Itoa(i)] = -1
+	}
+	for _, q := range []struct{ table, query string }{
+		{"notebook_entries", `SELECT idx, prompt FROM notebook_entries WHERE notebook_id = ?`},
+		{"runs", `SELECT idx, output FROM runs WHERE notebook_id = ?`},
+		{"feedback", `SELECT idx, comment FROM feedback WHERE notebook_id = ?`},
+		{"attachments", `SELECT idx, name FROM attachments WHERE notebook_id = ?`},
+		{"pipeline_steps", `SELECT idx, prompt FROM pipeline_steps WHERE pipeline_id = ?`},
+	} {
+		rows, err := db.Query(q.query, nbID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for rows.Next() {
+			var idx int
+			var name string
+			if err := rows.Scan(&idx, &name); err != nil {
+				t.Fatal(err)
+			}
+			n++
+			if w, ok := wantIdx[name]; !ok || w != idx {
+				t.Errorf("%s: %q is at idx %d", q.table, name, idx)
+			}
+		}
+		rows.Close()
+		wantN := len(want)
+		if q.table == "pipeline_steps" {
+			wantN += len(gone)
+		}
+		if n != wantN {
+			t.Errorf("%s: %d rows, want %d", q.table, n, wantN)
+		}
+	}
+}
+
+// Deleting an entry takes its rows in every table with it and renumbers
+// the rest of the entries' rows.
+func TestDeleteEntryRows(t *testing.T) {
+	c := newTestClient(t)
+	nbID := c.newNotebook()
+	seedEntries(t, nbID, 4)
+	if err := deleteEntry(context.Background(), nbID, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkEntryRows(t, nbID, []int{0, 2, 3}, 1)
+}
+
+// Moving an entry moves its rows in every table, and those of the entries
+// it passes.
+func TestMoveEntryRows(t *testing.T) {
+	c := newTestClient(t)
+	nbID := c.newNotebook()
+	seedEntries(t, nbID, 4)
+	ctx := context.Background()
+	if err := moveEntry(ctx, nbID, 0, 2); err != nil {
+		t.Fatal(err)
+	}
+	checkEntryRows(t, nbID, []int{1, 2, 0, 3})
+	if err := moveEntry(ctx, nbID, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkEntryRows(t, nbID, []int{1, 3, 2, 0})
+}
@@ -0,0 +1,70 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// Full history on demand. Clones are shallow by default (clone_depth in
+// the config), which is quick but leaves git log, blame and aider's repo
+// map with a single commit. "Fetch full history" on a notebook page runs
+// git fetch --unshallow in its clone; every notebook of that repository
+// sees the history, since their worktrees share the clone's objects.
+
+func isShallow(ctx context.Context, dir string) (bool, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--is-shallow-repository").Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(out)) == "true", nil
+}
+
+// unshallowClone fetches the rest of the history of the notebook's clone.
+func unshallowClone(ctx context.Context, meta notebookMeta) error {
+	dir := repoDirPath(meta.Host, meta.Org, meta.Repo)
+	mu := cloneLock(dir)
+	mu.Lock()
+	defer mu.Unlock()
+	shallow, err := isShallow(ctx, dir)
+	if err != nil || !shallow {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "fetch", "--quiet", "--unshallow", "origin")
+	cmd.Env = remoteEnv(ctx, cloneSpec(ctx, meta))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git fetch --unshallow: %v\n%s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// POST /api/unshallow?nb=..
+func unshallowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), *cloneTimeout)
+	defer cancel()
+	if err := unshallowClone(ctx, meta); err != nil {
+		slog.ErrorContext(r.Context(), "unshallowHandler", "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	slog.InfoContext(r.Context(), "unshallowHandler: full history fetched", "repo", meta.repoSpec().String())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok"))
+}
@@ -0,0 +1,88 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// SQLite under concurrent runs. The database is in WAL mode, so readers
+// never wait for the writer, and every transaction begins IMMEDIATE, so a
+// writer waits its turn (up to busy_timeout) when it starts rather than
+// failing when a read turns into a write. What still comes back
+// SQLITE_BUSY or SQLITE_LOCKED is retried a few times by the store
+// package, which execDB and inTx go through; statements that belong
+// together go through inTx. runCheckpoints keeps the WAL file from growing
+// while long reads hold off SQLite's own checkpoints, and closeDB runs
+// PRAGMA optimize on shutdown.
+
+const (
+	dbBusyTimeout         = 5 * time.Second
+	walCheckpointInterval = 5 * time.Minute
+)
+
+// sqliteDSN returns the data source name for the database file at path.
+// Foreign keys stay off: the schemas declare them, but deletes clean up
+// after themselves and nothing relies on the cascades.
+func sqliteDSN(path string) string {
+	return "file:" + path +
+		"?_pragma=busy_timeout(" + strconv.FormatInt(dbBusyTimeout.Milliseconds(), 10) + ")" +
+		"&_pragma=journal_mode(WAL)" +
+		"&_pragma=synchronous(NORMAL)" + // durable enough with WAL, and faster
+		"&_txlock=immediate"
+}
+
+// execDB is db.ExecContext, retried while the database is busy.
+func execDB(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return notebooks.Exec(ctx, query, args...)
+}
+
+// inTx runs fn in a transaction and commits it, or rolls it back if fn
+// fails (see store.NotebookStore.InTx).
+func inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return notebooks.InTx(ctx, fn)
+}
+
+// runCheckpoints checkpoints the WAL every interval, truncating the file
+// when no reader is still using it.
+func runCheckpoints(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		checkpointWAL(ctx)
+	}
+}
+
+func checkpointWAL(ctx context.Context) {
+	var busy, logPages, moved int
+	err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logPages, &moved)
+	if err != nil {
+		slog.WarnContext(ctx, "sqlite: checkpoint", "err", err)
+		return
+	}
+	slog.DebugContext(ctx, "sqlite: checkpoint", "busy", busy == 1, "wal_pages", logPages, "checkpointed", moved)
+}
+
+// closeDB lets SQLite update its query planner statistics, checkpoints
+// the WAL and closes the database.
+func closeDB() {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, `PRAGMA optimize`); err != nil {
+		slog.Warn("sqlite: optimize", "err", err)
+	}
+	checkpointWAL(ctx)
+	if err := db.Close(); err != nil {
+		slog.Warn("sqlite: close", "err", err)
+	}
+}
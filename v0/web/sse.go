@@ -0,0 +1,293 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"trybook/runner"
+)
+
+// Server-Sent Events streaming for runs. A run started over SSE is owned by
+// the server, not the request: its events are kept in memory so a client
+// that reconnects (EventSource does this automatically, sending
+// Last-Event-ID) resumes where it left off instead of losing output. The
+// events form a ring buffer of up to runner.MaxBytes of data per run; a
+// client that reconnects after the oldest events it missed were dropped
+// gets a truncated event saying how many, then the rest.
+//
+// Events: queued, position, started, chunk, stderr, tool, tool_result,
+// exit-code, error, done, truncated, and for the router, routed (the
+// models it queued). After an edit, tests says the test command was
+// queued; after a failure, fallback names the model queued in its place
+// (see fallback.go). A model whose CLI reports what it did sends result
+// before exit-code (see result.go). Data is JSON; see streamjson.go for
+// stderr and tools.
+//
+// Proxies drop connections that stay silent too long, and some hold back
+// a response until enough of it has arrived. So a stream starts with 2 KB
+// of comment padding, and while nothing else is sent it gets a heartbeat
+// every heartbeat_seconds (see config.go): a comment line with a
+// heartbeat event saying how long the run has been quiet. Heartbeats have
+// no ID and are not kept. The page uses them to tell a quiet run from a
+// dead connection, which it replaces.
+
+// chunkWriter turns process output into chunk events, holding back an
+// incomplete trailing UTF-8 sequence until the rest of it arrives.
+type chunkWriter struct {
+	lr      *runner.Run
+	name    string // event name; "chunk" if empty
+	pending []byte
+}
+
+func (cw *chunkWriter) emit(s string) {
+	name := cw.name
+	if name == "" {
+		name = "chunk"
+	}
+	cw.lr.Emit(name, s)
+}
+
+// event sends a structured event, after any text written so far.
+func (cw *chunkWriter) event(name string, v any) {
+	cw.flush()
+	cw.lr.Emit(name, v)
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	b := append(cw.pending, p...)
+	n := len(b)
+	for i := 1; i <= utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				n = len(b) - i
+			}
+			break
+		}
+	}
+	if n > 0 {
+		cw.emit(string(b[:n]))
+	}
+	cw.pending = append([]byte(nil), b[n:]...)
+	return len(p), nil
+}
+
+func (cw *chunkWriter) flush() {
+	if len(cw.pending) > 0 {
+		cw.emit(string(cw.pending))
+		cw.pending = nil
+	}
+}
+
+// liveRuns holds the server's runs by entry and model.
+var liveRuns = runner.NewLive()
+
+// newEntryRun returns a run of model for an entry whose events also go to
+// the notebook's hub.
+func newEntryRun(cancel context.CancelFunc, nbID string, idx int, model string) *runner.Run {
+	lr := runner.NewRun(cancel)
+	lr.NotebookID, lr.Idx, lr.Model, lr.Seq = nbID, idx, model, runner.NextSeq()
+	lr.OnEvent = broadcastRunEvent
+	return lr
+}
+
+func hasLiveRun(nbID string, idx int, model string) bool {
+	return liveRuns.Has(runner.Key(nbID, idx, model))
+}
+
+func parseRunParams(r *http.Request) (string, int, string, error) {
+	q := r.URL.Query()
+	nbID := strings.TrimSpace(q.Get("nb"))
+	idx, err := strconv.Atoi(strings.TrimSpace(q.Get("idx")))
+	model := strings.TrimSpace(q.Get("model"))
+	if err != nil || !isSafeToken(nbID) || !isSafeToken(model) {
+		return "", 0, "", errRunBadRequest
+	}
+	return nbID, idx, model, nil
+}
+
+func writeSSE(w http.ResponseWriter, ev runner.Event) {
+	if ev.ID > 0 {
+		fmt.Fprintf(w, "id: %d\n", ev.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+}
+
+// ssePadding is sent first, to get past proxies that buffer the start of
+// a response.
+var ssePadding = ":" + strings.Repeat(" ", 2048) + "\n\n"
+
+// writeHeartbeat sends a heartbeat: a comment for proxies, and an event
+// without an ID for the page, with the interval and how long lr has been
+// quiet, in seconds.
+func writeHeartbeat(w http.ResponseWriter, lr *runner.Run, every time.Duration) {
+	fmt.Fprintf(w, ": heartbeat\nevent: heartbeat\ndata: {\"interval\":%d,\"quiet\":%d}\n\n",
+		int(every/time.Second), int(lr.Quiet()/time.Second))
+}
+
+// GET /events/run?nb=..&idx=..&model=..[&attach=1]
+//
+// With attach=1 the request only follows an existing run (204 if there is
+// none); otherwise a new run is queued unless one is already in progress.
+func runEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID, idx, model, err := parseRunParams(r)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	lastID := 0
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		lastID, _ = strconv.Atoi(s)
+	} else if s := r.URL.Query().Get("last"); s != "" {
+		lastID, _ = strconv.Atoi(s)
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	attach := r.URL.Query().Get("attach") == "1"
+
+	key := runner.Key(nbID, idx, model)
+	liveRuns.Lock()
+	lr := liveRuns.Get(key)
+	// A fresh connection (no last event id) attaches to a run in progress
+	// but starts a new one if the previous run already finished.
+	if lr == nil || (lastID == 0 && !attach && lr.Finished()) {
+		if lastID > 0 || attach {
+			liveRuns.Unlock()
+			// 204 tells EventSource to stop reconnecting.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// Starting a run changes things, so it needs the CSRF token
+		// (a csrf query parameter) like a POST.
+		if !validCSRF(r) {
+			liveRuns.Unlock()
+			http.Error(w, "invalid or missing CSRF token", http.StatusForbidden)
+			return
+		}
+		pr, err := prepareRun(r.Context(), currentConfig(), nbID, idx, model)
+		if err != nil {
+			liveRuns.Unlock()
+			slog.ErrorContext(r.Context(), "runEventsHandler", "err", err)
+			if errors.Is(err, errRunNotFound) {
+				http.Error(w, "not found", http.StatusNotFound)
+			} else {
+				http.Error(w, "bad request", http.StatusBadRequest)
+			}
+			return
+		}
+		lr, err = enqueueRun(key, pr, fallbackAfter(pr, nil))
+		if err != nil {
+			liveRuns.Unlock()
+			slog.ErrorContext(r.Context(), "runEventsHandler: enqueue", "err", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+	}
+	liveRuns.Unlock()
+	streamEvents(w, f, r, lr, lastID)
+}
+
+// streamEvents sends lr's events after lastID until it finishes or the
+// client goes away.
+func streamEvents(w http.ResponseWriter, f http.Flusher, r *http.Request, lr *runner.Run, lastID int) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache, no-transform")
+	w.Header().Set("X-Accel-Buffering", "no")
+	_, _ = w.Write([]byte(ssePadding + "retry: 2000\n\n"))
+	f.Flush()
+
+	// The heartbeat ticker restarts whenever events are sent.
+	var hb *time.Ticker
+	var tick <-chan time.Time
+	every := currentConfig().heartbeat()
+	if every > 0 {
+		hb = time.NewTicker(every)
+		defer hb.Stop()
+		tick = hb.C
+	}
+	for {
+		evs, missed, done, changed := lr.Since(lastID)
+		if missed > 0 {
+			writeSSE(w, runner.Truncated(missed))
+		}
+		for _, ev := range evs {
+			writeSSE(w, ev)
+			lastID = ev.ID
+		}
+		if len(evs) > 0 {
+			f.Flush()
+			if hb != nil {
+				hb.Reset(every)
+			}
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-tick:
+			writeHeartbeat(w, lr, every)
+			f.Flush()
+		case <-r.Context().Done():
+			return // the run keeps going; the client may reconnect
+		}
+	}
+}
+
+// POST /api/run/stop?nb=..&idx=..[&model=..] (also /events/stop)
+//
+// Without a model, every run for the entry is stopped, including ones the
+// router has queued but the page has not attached to yet. Running ones get
+// SIGTERM on their whole process group, then SIGKILL after stopGrace. The
+// reply lists the process groups that were signaled.
+func runStopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	nbID := strings.TrimSpace(q.Get("nb"))
+	idx, err := strconv.Atoi(strings.TrimSpace(q.Get("idx")))
+	model := strings.TrimSpace(q.Get("model"))
+	if err != nil || !isSafeToken(nbID) || (model != "" && !isSafeToken(model)) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	prefix := runner.Key(nbID, idx, "")
+	match := func(key string) bool {
+		return key == runner.Key(nbID, idx, model) || (model == "" && strings.HasPrefix(key, prefix))
+	}
+	pgids := runProcGroups(match)
+	stopped := 0
+	liveRuns.Lock()
+	liveRuns.Each(func(key string, lr *runner.Run) {
+		if match(key) {
+			lr.Cancel() // the run's process group is terminated via its context
+			stopped++
+		}
+	})
+	liveRuns.Unlock()
+	if stopped == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "runStopHandler: stopped", "runs", stopped, "pgids", pgids)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"stopped": stopped, "process_groups": pgids})
+}
@@ -0,0 +1,243 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"trybook/runner"
+)
+
+// Structured run output. Besides chunk events (stdout), a run's event log
+// carries stderr events for what the model printed on standard error (not
+// available for PTY models, whose terminal merges the two), and, for models
+// with "format": "claude-stream-json", tool and tool_result events decoded
+// from claude --output-format stream-json. The decoded text, not the raw
+// JSON, is what streams as chunks and is stored as the output.
+
+const formatClaudeStreamJSON = "claude-stream-json"
+
+// formatRunner is implemented by runners whose stdout needs decoding.
+type formatRunner interface {
+	OutputFormat() string
+}
+
+func outputFormat(rn runner.Runner) string {
+	if f, ok := rn.(formatRunner); ok {
+		return f.OutputFormat()
+	}
+	return ""
+}
+
+// eventSink is implemented by output writers that can carry events other
+// than text (chunkWriter); plain writers just get the text.
+type eventSink interface {
+	event(name string, v any)
+}
+
+// lockedWriter serializes writes shared by the stdout and stderr copiers.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// toolSummaryChars caps the one-line description of a tool call.
+const toolSummaryChars = 200
+
+// claudeStreamWriter decodes claude's stream-json output, one JSON object
+// per line. Lines that are not JSON pass through unchanged.
+type claudeStreamWriter struct {
+	w       io.Writer
+	sink    eventSink // nil if w cannot carry events
+	line    []byte
+	wrote   bool // some assistant text was written
+	pending bool // the last text written did not end in a newline
+}
+
+func newClaudeStreamWriter(w io.Writer, sink eventSink) *claudeStreamWriter {
+	return &claudeStreamWriter{w: w, sink: sink}
+}
+
+func (c *claudeStreamWriter) Write(p []byte) (int, error) {
+	c.line = append(c.line, p...)
+	for {
+		i := bytes.IndexByte(c.line, '\n')
+		if i < 0 {
+			break
+		}
+		if err := c.handle(c.line[:i]); err != nil {
+			return len(p), err
+		}
+		c.line = c.line[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush handles a final line without a trailing newline and ends the text
+// with one.
+func (c *claudeStreamWriter) flush() error {
+	if len(c.line) > 0 {
+		if err := c.handle(c.line); err != nil {
+			return err
+		}
+		c.line = nil
+	}
+	if c.pending {
+		return c.text("\n")
+	}
+	return nil
+}
+
+type claudeStreamMsg struct {
+	Type    string `json:"type"`
+	Message struct {
+		Content []claudeContent `json:"content"`
+	} `json:"message"`
+	// type "result"
+	Result  string `json:"result"`
+	IsError bool   `json:"is_error"`
+}
+
+type claudeContent struct {
+	Type  string          `json:"type"`
+	Text  string          `json:"text"`
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+	// type "tool_result"
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+	IsError   bool            `json:"is_error"`
+}
+
+func (c *claudeStreamWriter) text(s string) error {
+	if s == "" {
+		return nil
+	}
+	c.pending = !strings.HasSuffix(s, "\n")
+	_, err := io.WriteString(c.w, s)
+	return err
+}
+
+// ownLine writes s on a line of its own.
+func (c *claudeStreamWriter) ownLine(s string) error {
+	if c.pending {
+		s = "\n" + s
+	}
+	return c.text(s + "\n")
+}
+
+func (c *claudeStreamWriter) handle(line []byte) error {
+	t := bytes.TrimSpace(line)
+	var m claudeStreamMsg
+	if len(t) == 0 || t[0] != '{' || json.Unmarshal(t, &m) != nil {
+		return c.text(string(line) + "\n")
+	}
+	switch m.Type {
+	case "assistant":
+		for _, b := range m.Message.Content {
+			switch b.Type {
+			case "text":
+				if c.wrote && !c.pending {
+					// Separate text from successive messages.
+					if err := c.text("\n"); err != nil {
+						return err
+					}
+				}
+				c.wrote = true
+				if err := c.text(b.Text); err != nil {
+					return err
+				}
+			case "tool_use":
+				summary := toolSummary(b.Input)
+				if c.sink != nil {
+					c.sink.event("tool", map[string]string{"id": b.ID, "name": b.Name, "summary": summary})
+				}
+				if err := c.ownLine(fmt.Sprintf("[tool: %s %s]", b.Name, summary)); err != nil {
+					return err
+				}
+			}
+		}
+	case "user":
+		for _, b := range m.Message.Content {
+			if b.Type != "tool_result" {
+				continue
+			}
+			if c.sink != nil {
+				c.sink.event("tool_result", map[string]any{"id": b.ToolUseID, "is_error": b.IsError})
+			}
+			if b.IsError {
+				if err := c.ownLine("[tool error: " + truncate(firstLine(toolResultText(b.Content)), toolSummaryChars) + "]"); err != nil {
+					return err
+				}
+			}
+		}
+	case "result":
+		// The result repeats the last message; show it only if nothing
+		// else was, e.g. when claude failed before answering.
+		if !c.wrote || m.IsError {
+			return c.ownLine(m.Result)
+		}
+	}
+	return nil
+}
+
+// toolSummary renders a tool call's input on one line: the command, path
+// or pattern if there is one, else the JSON.
+func toolSummary(input json.RawMessage) string {
+	var fields map[string]any
+	if json.Unmarshal(input, &fields) == nil {
+		for _, k := range []string{"command", "file_path", "path", "pattern", "url", "query", "description"} {
+			if s, ok := fields[k].(string); ok && s != "" {
+				return truncate(firstLine(s), toolSummaryChars)
+			}
+		}
+	}
+	return truncate(string(input), toolSummaryChars)
+}
+
+// toolResultText returns a tool result's text, which is either a string or
+// a list of content blocks.
+func toolResultText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var blocks []claudeContent
+	if json.Unmarshal(raw, &blocks) == nil {
+		var parts []string
+		for _, b := range blocks {
+			parts = append(parts, b.Text)
+		}
+		return strings.Join(parts, "\n")
+	}
+	return string(raw)
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + " ..."
+	}
+	return s
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,215 @@
+package web
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notebook summaries. Once a notebook has been idle (no entry edits or
+// runs) for -summary-idle, a background summarizer asks a cheap model,
+// through the llm CLI, for a short title and a one-paragraph summary of its
+// prompts and answers. They are stored on the notebook and shown on the
+// index page. New activity makes the summary out of date, and the notebook
+// is summarized again when it next goes idle.
+
+var (
+	summaryIdle  = flag.Duration("summary-idle", 30*time.Minute, "idle time after which a notebook is summarized for the index page (0 disables)")
+	summaryModel = flag.String("summary-model", "gpt-5-nano", "llm model that writes notebook titles and summaries")
+)
+
+const (
+	summaryScanInterval = time.Minute
+	summaryBatch        = 5     // notebooks summarized per scan
+	summaryOutputChars  = 1500  // of each answer given to the model
+	summaryPromptChars  = 12000 // of the whole transcript
+)
+
+var (
+	summaryFailMu sync.Mutex
+	// summaryFailed holds notebook -> activity time of a failed attempt, so
+	// a notebook is not retried until something changes.
+	summaryFailed = make(map[string]string)
+)
+
+type idleNotebook struct {
+	meta     notebookMeta
+	activeAt string
+}
+
+// idleNotebooks returns notebooks with entries, idle since cutoff, whose
+// summary predates their last activity.
+func idleNotebooks(ctx context.Context, cutoff time.Time) ([]idleNotebook, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, host, org, repo, active_at FROM (
+			SELECT n.id, n.host, n.org, n.repo, n.summarized_at, MAX(
+				n.created_at,
+				COALESCE((SELECT MAX(updated_at) FROM notebook_entries e WHERE e.notebook_id = n.id), ''),
+				COALESCE((SELECT MAX(started_at) FROM runs u WHERE u.notebook_id = n.id), '')
+			) AS active_at
+			FROM notebooks n
+			WHERE n.deleted_at = '' AND EXISTS (SELECT 1 FROM notebook_entries e WHERE e.notebook_id = n.id)
+		) WHERE active_at < ? AND summarized_at < active_at
+		ORDER BY active_at DESC
+	`, cutoff.UTC().Format("2006-01-02T15:04:05Z"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []idleNotebook
+	for rows.Next() {
+		var n idleNotebook
+		if err := rows.Scan(&n.meta.ID, &n.meta.Host, &n.meta.Org, &n.meta.Repo, &n.activeAt); err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+// summaryPrompt asks for a title and summary of the notebook's entries.
+func summaryPrompt(meta notebookMeta, es []entry) string {
+	var b strings.Builder
+	for i, e := range es {
+		if b.Len() > summaryPromptChars {
+			fmt.Fprintf(&b, "(%d more entries)\n", len(es)-i)
+			break
+		}
+		fmt.Fprintf(&b, "## Entry %d\nPrompt: %s\n", i+1, truncate(e.Prompt, summaryOutputChars))
+		models := make([]string, 0, len(e.Outputs))
+		for m := range e.Outputs {
+			models = append(models, m)
+		}
+		sort.Strings(models)
+		for _, m := range models {
+			if out := strings.TrimSpace(e.Outputs[m].Output); out != "" && m != TestsModel {
+				fmt.Fprintf(&b, "Answer from %s:\n%s\n", m, truncate(out, summaryOutputChars))
+			}
+		}
+		if e.Tests != "" {
+			fmt.Fprintf(&b, "Tests: %s\n", e.Tests)
+		}
+		b.WriteString("\n")
+	}
+	return strings.Join([]string{
+		"Below is a notebook of prompts to coding assistants about the repository " + meta.repoSpec().String() + ", with their answers.",
+		"Reply with exactly two lines and nothing else:",
+		"Title: <a title of at most eight words saying what the notebook was about>",
+		"Summary: <one paragraph on what was asked, what was found or changed, and how it ended>",
+		"",
+		b.String(),
+	}, "\n")
+}
+
+// parseSummary splits the model's reply into title and summary.
+func parseSummary(reply string) (title, summary string) {
+	var rest []string
+	for _, line := range strings.Split(strings.TrimSpace(reply), "\n") {
+		line = strings.TrimSpace(line)
+		if v, ok := strings.CutPrefix(line, "Title:"); ok && title == "" {
+			title = strings.TrimSpace(v)
+		} else if v, ok := strings.CutPrefix(line, "Summary:"); ok {
+			rest = append(rest, strings.TrimSpace(v))
+		} else if line != "" {
+			rest = append(rest, line)
+		}
+	}
+	summary = strings.Join(rest, " ")
+	if title == "" && len(rest) > 0 {
+		// No title line: the first line is the best guess.
+		title, summary = rest[0], strings.Join(rest[1:], " ")
+	}
+	title = strings.Trim(title, `"*# `)
+	return truncate(title, 100), truncate(summary, 1000)
+}
+
+// askCheapModel runs prompt through the llm CLI.
+func askCheapModel(ctx context.Context, model, prompt string) (string, error) {
+	cmd := currentExecer().CommandContext(ctx, "llm", "--model", model, prompt)
+	superviseCmd(cmd)
+	cmd.Env = modelEnv()
+	if apiKey("OPENAI_API_KEY") == "" {
+		slog.WarnContext(ctx, "summarizer: OPENAI_API_KEY not set")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("llm: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// summarizeNotebook writes and stores the notebook's title and summary.
+func summarizeNotebook(ctx context.Context, nbID string) error {
+	meta, es, err := loadNotebook(ctx, nbID)
+	if err != nil {
+		return err
+	}
+	reply, err := askCheapModel(ctx, *summaryModel, summaryPrompt(meta, es))
+	if err != nil {
+		return err
+	}
+	title, summary := parseSummary(reply)
+	if title == "" {
+		return fmt.Errorf("empty reply")
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE notebooks SET title = ?, summary = ?, summarized_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+		WHERE id = ?
+	`, title, summary, nbID)
+	return err
+}
+
+// summarizeIdleNotebooks summarizes a batch of idle notebooks.
+func summarizeIdleNotebooks(ctx context.Context, idle time.Duration) {
+	nbs, err := idleNotebooks(ctx, time.Now().Add(-idle))
+	if err != nil {
+		slog.ErrorContext(ctx, "summarizer: list notebooks", "err", err)
+		return
+	}
+	done := 0
+	for _, n := range nbs {
+		if ctx.Err() != nil || done == summaryBatch {
+			return
+		}
+		summaryFailMu.Lock()
+		failed := summaryFailed[n.meta.ID] == n.activeAt
+		summaryFailMu.Unlock()
+		if failed || notebookBusy(n.meta.ID) {
+			continue
+		}
+		done++
+		sctx, cancel := context.WithTimeout(ctx, time.Minute)
+		err := summarizeNotebook(sctx, n.meta.ID)
+		cancel()
+		summaryFailMu.Lock()
+		if err != nil {
+			slog.ErrorContext(ctx, "summarizer", "nb", n.meta.ID, "err", err)
+			summaryFailed[n.meta.ID] = n.activeAt
+		} else {
+			slog.InfoContext(ctx, "summarizer: summarized", "nb", n.meta.ID)
+			delete(summaryFailed, n.meta.ID)
+		}
+		summaryFailMu.Unlock()
+	}
+}
+
+func runSummarizer(ctx context.Context, idle time.Duration) {
+	if idle <= 0 {
+		return
+	}
+	t := time.NewTicker(summaryScanInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		summarizeIdleNotebooks(ctx, idle)
+	}
+}
@@ -0,0 +1,201 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Notebook tags. A notebook can carry short labels ("bug-hunt", "perf",
+// "client-x"), kept in notebook_tags. The index shows them as chips on
+// each notebook, where they are added and removed, and above the list as
+// filters: ?tag=perf lists only the notebooks tagged perf. /api/notebooks
+// returns each notebook's tags and takes the same tag filter, and
+// /api/tags lists and changes them.
+
+const tagsSchema = `
+	CREATE TABLE IF NOT EXISTS notebook_tags (
+		notebook_id TEXT NOT NULL,
+		tag         TEXT NOT NULL,
+		created_at  TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		PRIMARY KEY (notebook_id, tag),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS notebook_tags_tag ON notebook_tags(tag);`
+
+const (
+	maxTagLen          = 40
+	maxTagsPerNotebook = 20
+)
+
+var (
+	errBadTag      = errors.New("tags are up to 40 letters, digits, '-', '_' or '.'")
+	errTooManyTags = fmt.Errorf("a notebook can have at most %d tags", maxTagsPerNotebook)
+)
+
+// normalizeTag lowercases a tag and checks it, turning spaces into '-'.
+func normalizeTag(s string) (string, error) {
+	s = strings.ToLower(strings.Join(strings.Fields(s), "-"))
+	if len(s) > maxTagLen || !isSafeToken(s) || strings.Trim(s, ".") == "" {
+		return "", errBadTag
+	}
+	return s, nil
+}
+
+func addNotebookTag(ctx context.Context, nbID, tag string) error {
+	return inTx(ctx, func(tx *sql.Tx) error {
+		var n int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM notebook_tags WHERE notebook_id = ? AND tag != ?`, nbID, tag).Scan(&n); err != nil {
+			return err
+		}
+		if n >= maxTagsPerNotebook {
+			return errTooManyTags
+		}
+		_, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO notebook_tags(notebook_id, tag) VALUES(?, ?)`, nbID, tag)
+		return err
+	})
+}
+
+func removeNotebookTag(ctx context.Context, nbID, tag string) error {
+	_, err := execDB(ctx, `DELETE FROM notebook_tags WHERE notebook_id = ? AND tag = ?`, nbID, tag)
+	return err
+}
+
+// notebookTags returns the tags of one notebook, sorted.
+func notebookTags(ctx context.Context, nbID string) ([]string, error) {
+	m, err := loadTags(ctx, []string{nbID})
+	return m[nbID], err
+}
+
+// loadTags returns the sorted tags of the notebooks in ids.
+func loadTags(ctx context.Context, ids []string) (map[string][]string, error) {
+	out := make(map[string][]string)
+	if len(ids) == 0 {
+		return out, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT notebook_id, tag FROM notebook_tags
+		WHERE notebook_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		ORDER BY tag
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, err
+		}
+		out[id] = append(out[id], tag)
+	}
+	return out, rows.Err()
+}
+
+// tagCount is a tag and how many of the user's notebooks have it.
+type tagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// userTags returns the tags on the notebooks user sees, outside the trash,
+// most used first.
+func userTags(ctx context.Context, user string) ([]tagCount, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.tag, COUNT(*) FROM notebook_tags t JOIN notebooks n ON n.id = t.notebook_id
+		WHERE (?1 = '' OR n.owner = '' OR n.owner = ?1) AND n.deleted_at = ''
+		GROUP BY t.tag
+	`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []tagCount
+	for rows.Next() {
+		var tc tagCount
+		if err := rows.Scan(&tc.Tag, &tc.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, tc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Tag < out[j].Tag
+	})
+	return out, rows.Err()
+}
+
+// GET /api/tags lists the user's tags with counts; POST /api/tags
+// (nb, tag, remove=1 to take it off) tags a notebook and returns its tags.
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tags, err := userTags(r.Context(), currentUser(r.Context()))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "tagsHandler", "err", err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		if tags == nil {
+			tags = []tagCount{}
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(tags)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if ok, err := notebookExists(r.Context(), nbID); err != nil || !ok {
+		http.Error(w, errNotebookNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	tag, err := normalizeTag(r.FormValue("tag"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("remove") == "1" {
+		err = removeNotebookTag(r.Context(), nbID, tag)
+	} else {
+		err = addNotebookTag(r.Context(), nbID, tag)
+	}
+	if errors.Is(err, errTooManyTags) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "tagsHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	tags, err := notebookTags(r.Context(), nbID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "tagsHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"nb": nbID, "tags": tags})
+}
@@ -0,0 +1,94 @@
+package web
+
+import (
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// HTML pages. Each page in templates/ fills the title, head and body blocks
+// of layout.html. The templates are built into the binary; -template-dir
+// names a directory whose files of the same names are used instead, so the
+// UI can be customized without recompiling. Overrides are read at startup
+// and again whenever the config is reloaded.
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+var templateDir = flag.String("template-dir", "", "directory with templates overriding the built-in ones (layout.html, notebook.html, ...)")
+
+var pageNames = []string{"index", "notebook", "login", "settings", "notebook-settings", "search", "keys", "file", "batch", "disk", "templates", "trash", "runs"}
+
+// templateFuncs are the functions pages can call: base is -base-path, to
+// put in front of the site's own URLs ("{{base}}/n/...").
+var templateFuncs = template.FuncMap{
+	"base": func() string { return basePath },
+}
+
+var pagesPtr atomic.Pointer[map[string]*template.Template]
+
+// templateFile reads name from -template-dir if it is there, else from the
+// built-in templates.
+func templateFile(name string) (string, error) {
+	if *templateDir != "" {
+		b, err := os.ReadFile(filepath.Join(*templateDir, name))
+		if err == nil {
+			return string(b), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	b, err := embeddedTemplates.ReadFile("templates/" + name)
+	return string(b), err
+}
+
+// loadTemplates parses every page with the layout and swaps them in. On
+// error the previous templates stay active.
+func loadTemplates() error {
+	layout, err := templateFile("layout.html")
+	if err != nil {
+		return err
+	}
+	pages := make(map[string]*template.Template, len(pageNames))
+	for _, name := range pageNames {
+		src, err := templateFile(name + ".html")
+		if err != nil {
+			return err
+		}
+		t, err := template.New(name).Funcs(templateFuncs).Parse(layout)
+		if err != nil {
+			return fmt.Errorf("layout.html: %w", err)
+		}
+		if _, err := t.Parse(src); err != nil {
+			return fmt.Errorf("%s.html: %w", name, err)
+		}
+		pages[name] = t
+	}
+	pagesPtr.Store(&pages)
+	if *templateDir != "" {
+		slog.Info("templates: loaded", "dir", *templateDir)
+	}
+	return nil
+}
+
+// renderPage executes the named page with data.
+func renderPage(w io.Writer, name string, data any) error {
+	t := (*pagesPtr.Load())[name]
+	if t == nil {
+		return fmt.Errorf("no page %q", name)
+	}
+	if err := t.ExecuteTemplate(w, "layout", data); err != nil {
+		slog.Error("renderPage", "page", name, "err", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// Worktree terminal. With "terminal": true in the config, the notebook page
+// has a Terminal panel: a shell on a PTY in the notebook's worktree, over
+// GET /ws/terminal?nb=... It is a shell as trybook's user, so it is only
+// offered when auth is enabled too, which limits it to the notebook's
+// owner; with a sandbox configured the shell runs in a container like the
+// models do. The client sends JSON messages, {"type": "input", "data": ...}
+// and {"type": "resize", "cols": .., "rows": ..}; the shell's output comes
+// back as binary frames. The shell is stopped when the socket closes or
+// after terminalIdle without input.
+
+const (
+	terminalIdle = 30 * time.Minute
+	terminalMax  = 8 // open terminals across all notebooks
+)
+
+var openTerminals atomic.Int64
+
+// terminalEnabled reports whether the worktree terminal may be used.
+func terminalEnabled(cfg *config) bool {
+	return cfg.Terminal && authEnabled()
+}
+
+type terminalMsg struct {
+	Type string `json:"type"` // input, resize
+	Data string `json:"data,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
+// GET /ws/terminal?nb=..
+func terminalWSHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	if !terminalEnabled(cfg) {
+		http.Error(w, "the terminal is disabled; set \"terminal\": true and enable auth", http.StatusForbidden)
+		return
+	}
+	nbID := strings.TrimSpace(r.URL.Query().Get("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := ensureWorktree(r.Context(), meta); err != nil {
+		slog.ErrorContext(r.Context(), "terminalWSHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	env, err := notebookEnv(r.Context(), nbID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "terminalWSHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	if openTerminals.Add(1) > terminalMax {
+		openTerminals.Add(-1)
+		http.Error(w, "too many open terminals", http.StatusTooManyRequests)
+		return
+	}
+	defer openTerminals.Add(-1)
+
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	argv := []string{"sh", "-i"}
+	if sh := os.Getenv("SHELL"); sh != "" && cfg.Sandbox.Engine == "" {
+		argv = []string{sh, "-i"}
+	}
+	// Not tied to the request: the hijacked connection outlives it.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	if cfg.Sandbox.Engine != "" {
+		sb, err := prepareSandbox(ctx, cfg, cfg.Sandbox.Image)
+		if err != nil {
+			slog.ErrorContext(ctx, "terminalWSHandler", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var names []string
+		for _, kv := range env {
+			k, _, _ := strings.Cut(kv, "=")
+			names = append(names, k)
+		}
+		gitDir := filepath.Join(repoDirPath(meta.Host, meta.Org, meta.Repo), ".git")
+		argv = sb.command(argv, []string{meta.workDir(dir), dir, gitDir}, names, true, true)
+		defer sb.remove(context.WithoutCancel(ctx))
+	}
+
+	ws, err := upgradeWS(w, r)
+	if err != nil {
+		slog.ErrorContext(ctx, "terminalWSHandler", "err", err)
+		return
+	}
+	defer ws.Close()
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = meta.workDir(dir)
+	cmd.Env = append(append(os.Environ(), "TERM=dumb", "PS1=$ "), env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	superviseCmd(cmd)
+	pt, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: 120, Rows: 32})
+	if err != nil {
+		slog.ErrorContext(ctx, "terminalWSHandler: start", "err", err)
+		_ = ws.writeFrame(wsOpBinary, []byte("[trybook: cannot start a shell: "+err.Error()+"]\r\n"))
+		return
+	}
+	defer pt.Close()
+	trackProcGroup(cmd, "terminal", "terminal/"+nbID)
+	slog.InfoContext(ctx, "terminal: opened", "nb", nbID, "dir", dir)
+	start := time.Now()
+	defer func() {
+		slog.InfoContext(ctx, "terminal: closed", "nb", nbID, "duration", time.Since(start).Round(time.Second))
+	}()
+
+	// Shell output to the browser; the shell exiting ends the session.
+	go func() {
+		defer cancel()
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := pt.Read(buf)
+			if n > 0 {
+				if werr := ws.writeFrame(wsOpBinary, buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// Browser input to the shell; the socket closing ends the session.
+	input := make(chan struct{}, 1)
+	go func() {
+		defer cancel()
+		for {
+			_, p, err := ws.readMessage()
+			if err != nil {
+				return
+			}
+			var m terminalMsg
+			if json.Unmarshal(p, &m) != nil {
+				continue
+			}
+			switch m.Type {
+			case "input":
+				if _, err := pt.Write([]byte(m.Data)); err != nil {
+					return
+				}
+				select {
+				case input <- struct{}{}:
+				default:
+				}
+			case "resize":
+				if m.Cols > 0 && m.Rows > 0 && m.Cols < 1000 && m.Rows < 1000 {
+					_ = pty.Setsize(pt, &pty.Winsize{Cols: uint16(m.Cols), Rows: uint16(m.Rows)})
+				}
+			}
+		}
+	}()
+	idle := time.NewTimer(terminalIdle)
+	defer idle.Stop()
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			_ = ws.writeFrame(wsOpClose, nil)
+			waitTerminal(cmd)
+			return
+		case <-input:
+			idle.Reset(terminalIdle)
+		case <-idle.C:
+			_ = ws.writeFrame(wsOpBinary, []byte("\r\n[trybook: closed after 30 minutes without input]\r\n"))
+			cancel()
+		case <-ping.C:
+			if err := ws.writeFrame(wsOpPing, nil); err != nil {
+				cancel()
+			}
+		}
+	}
+}
+
+// waitTerminal stops the shell's process group, if it is still running,
+// and reaps it. An interactive shell ignores SIGTERM, so it gets a hangup
+// first, as if its terminal had closed.
+func waitTerminal(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGHUP)
+		_ = terminateProcGroup(cmd.Process.Pid)
+	}
+	_ = cmd.Wait()
+	finishProcGroup(cmd)
+}
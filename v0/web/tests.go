@@ -0,0 +1,63 @@
+package web
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+
+	"trybook/runner"
+)
+
+// Post-edit tests. A repo can configure a shell command (repos.<repo>.
+// test_command in the config) that is run in the worktree after each
+// successful edit, by aider or an applied diff; without one, the test
+// command detected in its repo profile is used. It shows up as a "tests"
+// box on the entry and its pass/fail is stored in notebook_entries.tests.
+
+const TestsModel = "tests"
+
+// testRunner runs a repo's test command through the shell.
+type testRunner struct {
+	command string
+}
+
+func (t testRunner) Name() string { return TestsModel }
+
+func (t testRunner) Command(string) []string { return []string{"sh", "-c", t.command} }
+
+func (t testRunner) Env() []string { return os.Environ() }
+
+func (t testRunner) Stdin(string) io.Reader { return nil }
+
+// testsAfter returns a job hook for an edit run that queues the repo's test
+// command once the edit succeeds, or nil if there is nothing to run. The
+// edit's live run gets a "tests" event so attached pages can follow along.
+// Runs in an A/B lane get none; keeping the lane queues the tests.
+func testsAfter(pr *preparedRun) func(context.Context, *runner.Run, error) {
+	if !editsWorktree(pr.runner) || pr.lane || pr.dryRun || repoTestCommand(context.Background(), pr.cfg, pr.meta.Host, pr.meta.Org, pr.meta.Repo) == "" {
+		return nil
+	}
+	return func(ctx context.Context, editRun *runner.Run, err error) {
+		if ctx.Err() != nil || err != nil {
+			return
+		}
+		tpr, err := prepareRun(context.Background(), pr.cfg, pr.nbID, pr.idx, TestsModel)
+		if err != nil {
+			slog.ErrorContext(ctx, "tests: prepare run", "err", err)
+			return
+		}
+		liveRuns.Lock()
+		key := runner.Key(pr.nbID, pr.idx, TestsModel)
+		// Another edit on this entry may have queued a test run already.
+		if lr := liveRuns.Get(key); lr == nil || lr.Finished() {
+			if _, err := enqueueRun(key, tpr, nil); err != nil {
+				liveRuns.Unlock()
+				slog.ErrorContext(ctx, "tests: enqueue", "err", err)
+				return
+			}
+		}
+		liveRuns.Unlock()
+		editRun.Emit("tests", map[string]any{"model": TestsModel})
+	}
+}
@@ -0,0 +1,168 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// The commit timeline of a notebook: the commits on its worktree branch
+// since the start commit, newest first, each attributed to the entry and
+// model whose run made it. Every run records HEAD before and after it (in
+// runs, and the latest in notebook_entries.head); a commit belongs to the
+// first run whose before..after range contains it. Commits made with
+// "Commit my changes" are marked manual. Commits no run made, such as
+// upstream merges or rebased copies, have no entry.
+
+const maxTimelineCommits = 200
+
+type timelineCommit struct {
+	SHA     string `json:"sha"`
+	Short   string `json:"short"`
+	Subject string `json:"subject"`
+	Author  string `json:"author"`
+	Date    string `json:"date"`
+	Idx     int    `json:"idx"` // -1 if no run made it
+	Model   string `json:"model,omitempty"`
+	Manual  bool   `json:"manual,omitempty"` // committed from the user's own changes
+}
+
+type timeline struct {
+	Start     string           `json:"start"`
+	Head      string           `json:"head"`
+	Commits   []timelineCommit `json:"commits"`
+	Truncated bool             `json:"truncated,omitempty"`
+}
+
+type headRange struct {
+	idx           int
+	model         string
+	before, after string
+}
+
+// runHeadRanges returns the HEAD ranges of the notebook's runs that moved
+// HEAD, oldest first, followed by those only entry_outputs recorded (runs
+// from before runs kept heads).
+func runHeadRanges(ctx context.Context, nbID string) ([]headRange, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT 0 AS legacy, id, idx, model, head_before, head_after FROM runs
+		WHERE notebook_id = ? AND head_before != '' AND head_after != '' AND head_before != head_after
+		UNION ALL
+		SELECT 1, 0, idx, model, head_before, head_after FROM entry_outputs
+		WHERE notebook_id = ? AND head_before != '' AND head_after != '' AND head_before != head_after
+		ORDER BY legacy, id
+	`, nbID, nbID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []headRange
+	for rows.Next() {
+		var h headRange
+		var legacy, id int64
+		if err := rows.Scan(&legacy, &id, &h.idx, &h.model, &h.before, &h.after); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// notebookTimeline lists the commits of the notebook's worktree since its
+// start commit.
+func notebookTimeline(ctx context.Context, meta notebookMeta) (timeline, error) {
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	head, err := gitHead(ctx, dir)
+	if err != nil {
+		return timeline{}, err
+	}
+	t := timeline{Start: meta.SHA, Head: head, Commits: []timelineCommit{}}
+
+	// git log --format=... -n <max+1> <start>..HEAD
+	args := []string{"log", "--format=%H%x1f%h%x1f%s%x1f%an%x1f%aI", fmt.Sprintf("-n%d", maxTimelineCommits+1)}
+	if isCommitish(meta.SHA) {
+		args = append(args, meta.SHA+"..HEAD")
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return t, fmt.Errorf("git log: %w", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		f := strings.Split(line, "\x1f")
+		if len(f) != 5 {
+			continue
+		}
+		if len(t.Commits) == maxTimelineCommits {
+			t.Truncated = true
+			break
+		}
+		t.Commits = append(t.Commits, timelineCommit{SHA: f[0], Short: f[1], Subject: f[2], Author: f[3], Date: f[4], Idx: -1})
+	}
+
+	manual, err := manualCommitSHAs(ctx, meta.ID)
+	if err != nil {
+		return t, err
+	}
+	for i, c := range t.Commits {
+		t.Commits[i].Manual = manual[c.SHA]
+	}
+
+	ranges, err := runHeadRanges(ctx, meta.ID)
+	if err != nil {
+		return t, err
+	}
+	pos := make(map[string]int, len(t.Commits))
+	for i, c := range t.Commits {
+		pos[c.SHA] = i
+	}
+	for _, h := range ranges {
+		if len(pos) == 0 {
+			break
+		}
+		rl := exec.CommandContext(ctx, "git", "rev-list", h.before+".."+h.after)
+		rl.Dir = dir
+		out, err := rl.Output()
+		if err != nil {
+			continue // rewritten or pruned since
+		}
+		for _, sha := range strings.Fields(string(out)) {
+			if i, ok := pos[sha]; ok {
+				t.Commits[i].Idx, t.Commits[i].Model = h.idx, h.model
+				delete(pos, sha)
+			}
+		}
+	}
+	return t, nil
+}
+
+// GET /api/timeline?nb=..
+func timelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.URL.Query().Get("nb"))
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	t, err := notebookTimeline(r.Context(), meta)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "timelineHandler", "err", err)
+		http.Error(w, "timeline failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(t)
+}
@@ -0,0 +1,243 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Speech to text for prompts. With "transcribe" in the config the prompt
+// box gets a microphone button: the page records audio in the browser,
+// POSTs it to /api/transcribe, and puts the transcript in the box. The
+// audio is transcribed either by a local command such as whisper.cpp,
+// which gets the recording's path as {audio} and prints the text, or by an
+// OpenAI-compatible /v1/audio/transcriptions endpoint. Recordings are not
+// kept.
+
+const (
+	transcribeMaxBytes = 25 << 20 // the OpenAI API's limit
+	transcribeTimeout  = 2 * time.Minute
+)
+
+type transcribeConfig struct {
+	// Command transcribes the file {audio} and prints the text, e.g.
+	// ["sh", "-c", "ffmpeg -loglevel error -i \"$1\" -ar 16000 -ac 1 \"$1.wav\" && whisper-cli -m /models/ggml-base.en.bin -nt -np -f \"$1.wav\"", "sh", "{audio}"].
+	Command []string `json:"command,omitempty"`
+	// URL is an OpenAI-compatible transcription endpoint, e.g.
+	// https://api.openai.com/v1/audio/transcriptions.
+	URL string `json:"url,omitempty"`
+	// Model is sent with URL requests (default "whisper-1").
+	Model string `json:"model,omitempty"`
+	// APIKeyEnv names the variable (or saved API key) holding the bearer
+	// token for URL (default OPENAI_API_KEY).
+	APIKeyEnv string `json:"api_key_env,omitempty"`
+	// Language is an ISO-639-1 hint such as "en", sent with URL requests.
+	Language string `json:"language,omitempty"`
+}
+
+func (t transcribeConfig) enabled() bool { return len(t.Command) > 0 || t.URL != "" }
+
+func (t transcribeConfig) validate() error {
+	if len(t.Command) > 0 && t.URL != "" {
+		return fmt.Errorf("set command or url, not both")
+	}
+	if len(t.Command) > 0 && !strings.Contains(strings.Join(t.Command, " "), "{audio}") {
+		return fmt.Errorf("command does not use {audio}")
+	}
+	if t.URL != "" {
+		if p, err := url.Parse(t.URL); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("invalid URL %q", t.URL)
+		}
+	}
+	return nil
+}
+
+var errNoTranscript = errors.New("nothing was heard")
+
+// transcribe returns the text spoken in the audio file at path.
+func (t transcribeConfig) transcribe(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, transcribeTimeout)
+	defer cancel()
+	var text string
+	var err error
+	if len(t.Command) > 0 {
+		text, err = t.runCommand(ctx, path)
+	} else {
+		text, err = t.post(ctx, path)
+	}
+	if err != nil {
+		return "", err
+	}
+	if text = strings.TrimSpace(text); text == "" {
+		return "", errNoTranscript
+	}
+	return text, nil
+}
+
+func (t transcribeConfig) runCommand(ctx context.Context, path string) (string, error) {
+	argv := make([]string, len(t.Command))
+	for i, a := range t.Command {
+		argv[i] = strings.ReplaceAll(a, "{audio}", path)
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = filepath.Dir(path)
+	cmd.Env = modelEnv()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v\n%s", argv[0], err, truncate(strings.TrimSpace(stderr.String()), 2000))
+	}
+	return string(out), nil
+}
+
+func (t transcribeConfig) post(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	model := t.Model
+	if model == "" {
+		model = "whisper-1"
+	}
+	_ = mw.WriteField("model", model)
+	if t.Language != "" {
+		_ = mw.WriteField("language", t.Language)
+	}
+	fw, err := mw.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(fw, f); err != nil {
+		return "", err
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	keyEnv := t.APIKeyEnv
+	if keyEnv == "" {
+		keyEnv = "OPENAI_API_KEY"
+	}
+	if key := apiKey(keyEnv); key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s: %s", t.URL, resp.Status, truncate(strings.TrimSpace(string(b)), 500))
+	}
+	var res struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return "", fmt.Errorf("%s: %w", t.URL, err)
+	}
+	return res.Text, nil
+}
+
+// audioExt picks a file extension for an upload, which tools such as
+// ffmpeg and the OpenAI API go by.
+func audioExt(name, contentType string) string {
+	if ext := strings.ToLower(filepath.Ext(name)); ext != "" && len(ext) <= 5 {
+		return ext
+	}
+	ct, _, _ := strings.Cut(contentType, ";")
+	switch strings.TrimSpace(ct) {
+	case "audio/ogg":
+		return ".ogg"
+	case "audio/mp4", "audio/aac":
+		return ".m4a"
+	case "audio/mpeg":
+		return ".mp3"
+	case "audio/wav", "audio/x-wav", "audio/wave":
+		return ".wav"
+	}
+	return ".webm"
+}
+
+// POST /api/transcribe (multipart: audio) returns {"text": "..."}.
+func transcribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tc := currentConfig().Transcribe
+	if !tc.enabled() {
+		http.Error(w, "transcription is not configured", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, transcribeMaxBytes+1<<20)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		http.Error(w, "recording too large or malformed", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	f, fh, err := r.FormFile("audio")
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	if fh.Size > transcribeMaxBytes {
+		http.Error(w, "recording too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	dir, err := os.MkdirTemp("", "trybook-audio-")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "transcribeHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "recording"+audioExt(fh.Filename, fh.Header.Get("Content-Type")))
+	out, err := os.Create(path)
+	if err == nil {
+		_, err = io.Copy(out, f)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "transcribeHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	start := time.Now()
+	text, err := tc.transcribe(r.Context(), path)
+	if errors.Is(err, errNoTranscript) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "transcribeHandler", "err", err)
+		http.Error(w, "transcription failed", http.StatusBadGateway)
+		return
+	}
+	slog.InfoContext(r.Context(), "transcribeHandler: done", "bytes", fh.Size, "chars", len(text), "duration", time.Since(start).Round(time.Millisecond))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]string{"text": text})
+}
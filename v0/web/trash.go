@@ -0,0 +1,211 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The trash. Deleting a notebook sets notebooks.deleted_at instead of
+// removing it: its runs stop, it leaves the index, search and the repo
+// pages, and it no longer opens, but its rows, worktree and branch stay.
+// The Trash page (/trash) lists a user's deleted notebooks to restore or
+// purge at once; the server purges (notebook_delete.go) those deleted more
+// than -trash-days ago.
+
+var trashDays = flag.Int("trash-days", 7, "days a deleted notebook stays in the trash before it is purged")
+
+// trashPurgeInterval is how often the server looks for notebooks to purge.
+const trashPurgeInterval = time.Hour
+
+func trashRetention() time.Duration {
+	return time.Duration(*trashDays) * 24 * time.Hour
+}
+
+// trashNotebook stops the notebook's runs and moves it to the trash.
+func trashNotebook(ctx context.Context, id string) error {
+	res, err := execDB(ctx, `
+		UPDATE notebooks SET deleted_at = strftime('%Y-%m-%dT%H:%M:%SZ','now')
+		WHERE id = ? AND deleted_at = ''
+	`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotebookNotFound
+	}
+	stopPipelines(id)
+	cancelLiveRuns(id)
+	cancelClone(id)
+	return nil
+}
+
+// restoreNotebook takes the notebook out of the trash.
+func restoreNotebook(ctx context.Context, id string) error {
+	res, err := execDB(ctx, `UPDATE notebooks SET deleted_at = '' WHERE id = ? AND deleted_at != ''`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotebookNotFound
+	}
+	return nil
+}
+
+// trashedNotebook is a row of the Trash page.
+type trashedNotebook struct {
+	ID, Host, Org, Repo, Title string
+	DeletedAt, PurgeAt         string
+}
+
+// loadTrash returns the notebooks in the trash that user can see, most
+// recently deleted first.
+func loadTrash(ctx context.Context, user string) ([]trashedNotebook, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, host, org, repo, title, deleted_at FROM notebooks
+		WHERE (?1 = '' OR owner = '' OR owner = ?1) AND deleted_at != ''
+		ORDER BY deleted_at DESC, id
+	`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []trashedNotebook
+	for rows.Next() {
+		var t trashedNotebook
+		if err := rows.Scan(&t.ID, &t.Host, &t.Org, &t.Repo, &t.Title, &t.DeletedAt); err != nil {
+			return nil, err
+		}
+		if at, err := time.Parse(time.RFC3339, t.DeletedAt); err == nil {
+			t.DeletedAt = at.Format("2006-01-02 15:04 UTC")
+			t.PurgeAt = at.Add(trashRetention()).Format("2006-01-02")
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// purgeTrash purges the notebooks deleted before cutoff.
+func purgeTrash(ctx context.Context, cutoff time.Time) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id FROM notebooks WHERE deleted_at != '' AND deleted_at < ?
+	`, cutoff.UTC().Format("2006-01-02T15:04:05Z"))
+	if err != nil {
+		slog.ErrorContext(ctx, "trash: list", "err", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			slog.ErrorContext(ctx, "trash: list", "err", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		warnings, err := purgeNotebook(ctx, id)
+		for _, w := range warnings {
+			slog.WarnContext(ctx, "trash: purge: "+w, "nb", id)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "trash: purge", "nb", id, "err", err)
+			continue
+		}
+		slog.InfoContext(ctx, "trash: purged", "nb", id)
+	}
+}
+
+func runTrashPurge(ctx context.Context) {
+	if *trashDays <= 0 {
+		return
+	}
+	t := time.NewTicker(trashPurgeInterval)
+	defer t.Stop()
+	for {
+		purgeTrash(ctx, time.Now().Add(-trashRetention()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+type trashView struct {
+	Notebooks []trashedNotebook
+	Days      int
+	Message   string
+	MsgClass  string
+}
+
+// GET, POST /trash (action restore or purge: nb)
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	v := trashView{Days: *trashDays}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		nbID := strings.TrimSpace(r.FormValue("nb"))
+		if !isSafeToken(nbID) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch r.FormValue("action") {
+		case "restore":
+			err = restoreNotebook(r.Context(), nbID)
+			v.Message = "Notebook restored."
+		case "purge":
+			if err = checkInTrash(r.Context(), nbID); err != nil {
+				break
+			}
+			var warnings []string
+			warnings, err = purgeNotebook(r.Context(), nbID)
+			for _, wmsg := range warnings {
+				slog.WarnContext(r.Context(), "trashHandler: "+wmsg)
+			}
+			v.Message = "Notebook deleted for good."
+		default:
+			http.Error(w, "bad action", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errNotebookNotFound) {
+			v.Message, v.MsgClass = "That notebook is not in the trash.", "error"
+		} else if err != nil {
+			slog.ErrorContext(r.Context(), "trashHandler", "err", err)
+			v.Message, v.MsgClass = "Failed: "+err.Error(), "error"
+		} else {
+			slog.InfoContext(r.Context(), "trashHandler", "nb", nbID, "action", r.FormValue("action"))
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbs, err := loadTrash(r.Context(), currentUser(r.Context()))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "trashHandler", "err", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	v.Notebooks = nbs
+	setHTMLHeaders(w)
+	_ = renderPage(w, "trash", v)
+}
+
+// checkInTrash returns errNotebookNotFound unless notebook id is in the
+// trash.
+func checkInTrash(ctx context.Context, id string) error {
+	var deletedAt string
+	err := db.QueryRowContext(ctx, `SELECT deleted_at FROM notebooks WHERE id = ?`, id).Scan(&deletedAt)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && deletedAt == "") {
+		return errNotebookNotFound
+	}
+	return err
+}
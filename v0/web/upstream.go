@@ -0,0 +1,213 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"trybook/runner"
+)
+
+// Keeping clones current. A background refresher runs git fetch in every
+// clone each -fetch-interval, so notebook pages can show how far their
+// worktree is behind origin/<branch> (the branch the repo was cloned at).
+// "Update from upstream" fetches once more and rebases the notebook's
+// branch onto it, or merges it in.
+
+var fetchInterval = flag.Duration("fetch-interval", 15*time.Minute, "how often to git fetch every clone (0 disables)")
+
+// gitIdentity lets rebase and merge commit without a configured user.
+var gitIdentity = []string{"-c", "user.name=Trybook", "-c", "user.email=trybook@localhost"}
+
+func fetchClone(ctx context.Context, spec repoSpec) error {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoDirPath(spec.Host, spec.Org, spec.Repo), "fetch", "--quiet", "origin")
+	cmd.Env = remoteEnv(ctx, spec)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git fetch %s: %v\n%s", spec, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// refreshClones fetches every recorded clone. Private clones are fetched
+// with the server's token (GITHUB_TOKEN), if any.
+func refreshClones(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, `SELECT host, org, repo, clone_url FROM clones`)
+	if err != nil {
+		slog.ErrorContext(ctx, "refresher: list clones", "err", err)
+		return
+	}
+	var specs []repoSpec
+	for rows.Next() {
+		var s repoSpec
+		if err := rows.Scan(&s.Host, &s.Org, &s.Repo, &s.CloneURL); err != nil {
+			slog.ErrorContext(ctx, "refresher", "err", err)
+			continue
+		}
+		specs = append(specs, s)
+	}
+	rows.Close()
+	for _, s := range specs {
+		if ctx.Err() != nil {
+			return
+		}
+		if !pathExists(repoDirPath(s.Host, s.Org, s.Repo)) {
+			continue
+		}
+		fctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		if err := fetchClone(fctx, s); err != nil {
+			slog.ErrorContext(ctx, "refresher", "err", err)
+		}
+		cancel()
+	}
+}
+
+func runCloneRefresher(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		refreshClones(ctx)
+	}
+}
+
+// cloneSpec is the notebook's repoSpec with the clone's remote URL.
+func cloneSpec(ctx context.Context, meta notebookMeta) repoSpec {
+	spec := meta.repoSpec()
+	_ = db.QueryRowContext(ctx, `
+		SELECT clone_url FROM clones WHERE host = ? AND org = ? AND repo = ?
+	`, meta.Host, meta.Org, meta.Repo).Scan(&spec.CloneURL)
+	return spec
+}
+
+// upstreamRef is the remote-tracking ref the notebook was branched from.
+func upstreamRef(ctx context.Context, meta notebookMeta) (string, error) {
+	base, err := baseBranch(ctx, meta)
+	if err != nil {
+		return "", fmt.Errorf("base branch: %w", err)
+	}
+	return "origin/" + base, nil
+}
+
+// commitsBehind counts upstream commits the worktree does not have yet.
+func commitsBehind(ctx context.Context, meta notebookMeta) (int, string, error) {
+	ref, err := upstreamRef(ctx, meta)
+	if err != nil {
+		return 0, "", err
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-list", "--count", "HEAD.."+ref).Output()
+	if err != nil {
+		return 0, ref, fmt.Errorf("rev-list %s: %w", ref, err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	return n, ref, err
+}
+
+var errNotebookBusy = errors.New("runs are in progress on this notebook")
+
+// notebookBusy reports whether any run for the notebook is queued or running.
+func notebookBusy(nbID string) bool {
+	liveRuns.Lock()
+	defer liveRuns.Unlock()
+	busy := false
+	liveRuns.Notebook(nbID, func(_ string, lr *runner.Run) {
+		busy = busy || !lr.Finished()
+	})
+	return busy
+}
+
+// updateFromUpstream fetches and rebases (or merges) the worktree onto its
+// upstream. A conflicted rebase or merge is aborted, leaving the worktree
+// as it was. On success the upstream tip becomes the notebook's start
+// commit, so diffs and pull requests cover only the notebook's own changes.
+func updateFromUpstream(ctx context.Context, meta notebookMeta, mode string) (string, error) {
+	if notebookBusy(meta.ID) {
+		return "", errNotebookBusy
+	}
+	if err := fetchClone(ctx, cloneSpec(ctx, meta)); err != nil {
+		return "", err
+	}
+	ref, err := upstreamRef(ctx, meta)
+	if err != nil {
+		return "", err
+	}
+	dir := worktreeDirPath(meta.Host, meta.Org, meta.Repo, meta.Worktree)
+	var args, abort []string
+	switch mode {
+	case "rebase":
+		args = []string{"rebase", "--autostash", ref}
+		abort = []string{"rebase", "--abort"}
+	case "merge":
+		args = []string{"merge", "--no-edit", "--autostash", ref}
+		abort = []string{"merge", "--abort"}
+	default:
+		return "", fmt.Errorf("unknown mode %q", mode)
+	}
+	cmd := exec.CommandContext(ctx, "git", append(append([]string{"-C", dir}, gitIdentity...), args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		_ = exec.CommandContext(ctx, "git", append([]string{"-C", dir}, abort...)...).Run()
+		return "", fmt.Errorf("git %s %s failed and was aborted:\n%s", mode, ref, strings.TrimSpace(string(out)))
+	}
+	base, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", ref).Output()
+	if err != nil {
+		return "", fmt.Errorf("rev-parse %s: %w", ref, err)
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE notebooks SET commit_sha = ? WHERE id = ?
+	`, strings.TrimSpace(string(base)), meta.ID); err != nil {
+		return "", err
+	}
+	return gitHead(ctx, dir)
+}
+
+// POST /api/upstream?nb=..&mode=rebase|merge
+func upstreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nbID := strings.TrimSpace(r.FormValue("nb"))
+	mode := r.FormValue("mode")
+	if mode == "" {
+		mode = "rebase"
+	}
+	if !isSafeToken(nbID) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	meta, _, err := loadNotebook(r.Context(), nbID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+	defer cancel()
+	head, err := updateFromUpstream(ctx, meta, mode)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "upstreamHandler", "err", err)
+		status := http.StatusConflict
+		if strings.HasPrefix(err.Error(), "unknown mode") {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	slog.InfoContext(r.Context(), "upstreamHandler: updated", "mode", mode, "head", head)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(head))
+}
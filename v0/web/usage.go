@@ -0,0 +1,218 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"trybook/runner"
+)
+
+// Token and cost accounting. Runners that know how to read usage out of
+// their CLI's output implement usageRunner; for configured models that is a
+// set of regular expressions (modelConfig.Usage). Every match in the output
+// is summed, since agents like aider report usage once per message.
+
+type usageConfig struct {
+	// Each is a regexp whose first group is a number; k/m suffixes and
+	// thousands separators are understood (e.g. "12.5k", "1,024").
+	InputTokens  string `json:"input_tokens,omitempty"`
+	OutputTokens string `json:"output_tokens,omitempty"`
+	Cost         string `json:"cost,omitempty"` // USD
+}
+
+type runUsage struct {
+	InputTokens  int64
+	OutputTokens int64
+	CostUSD      float64
+}
+
+func (u runUsage) add(o runUsage) runUsage {
+	return runUsage{u.InputTokens + o.InputTokens, u.OutputTokens + o.OutputTokens, u.CostUSD + o.CostUSD}
+}
+
+// Cost formats the cost for templates.
+func (u runUsage) Cost() string { return fmt.Sprintf("$%.4f", u.CostUSD) }
+
+// Tokens formats the token counts for templates.
+func (u runUsage) Tokens() string {
+	return fmt.Sprintf("%s in / %s out", humanCount(u.InputTokens), humanCount(u.OutputTokens))
+}
+
+func (u runUsage) IsZero() bool { return u == runUsage{} }
+
+func humanCount(n int64) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// usageRunner is implemented by runners that can report usage.
+type usageRunner interface {
+	ParseUsage(output string) (runUsage, bool)
+}
+
+type usageParser struct {
+	in, out, cost *regexp.Regexp
+}
+
+func compileUsage(uc *usageConfig) (*usageParser, error) {
+	if uc == nil {
+		return nil, nil
+	}
+	p := &usageParser{}
+	for _, f := range []struct {
+		dst **regexp.Regexp
+		src string
+	}{{&p.in, uc.InputTokens}, {&p.out, uc.OutputTokens}, {&p.cost, uc.Cost}} {
+		if f.src == "" {
+			continue
+		}
+		re, err := regexp.Compile(f.src)
+		if err != nil {
+			return nil, err
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("%q has no capture group", f.src)
+		}
+		*f.dst = re
+	}
+	return p, nil
+}
+
+// parseAmount parses "12", "1,024", "12.5k" or "1.2M".
+func parseAmount(s string) (float64, bool) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", "")
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(s, "k") || strings.HasSuffix(s, "K"):
+		mult, s = 1e3, s[:len(s)-1]
+	case strings.HasSuffix(s, "m") || strings.HasSuffix(s, "M"):
+		mult, s = 1e6, s[:len(s)-1]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f * mult, true
+}
+
+func sumMatches(re *regexp.Regexp, s string) (float64, bool) {
+	if re == nil {
+		return 0, false
+	}
+	var total float64
+	found := false
+	for _, m := range re.FindAllStringSubmatch(s, -1) {
+		if f, ok := parseAmount(m[1]); ok {
+			total += f
+			found = true
+		}
+	}
+	return total, found
+}
+
+func (p *usageParser) parse(output string) (runUsage, bool) {
+	if p == nil {
+		return runUsage{}, false
+	}
+	in, okIn := sumMatches(p.in, output)
+	out, okOut := sumMatches(p.out, output)
+	cost, okCost := sumMatches(p.cost, output)
+	return runUsage{int64(in), int64(out), cost}, okIn || okOut || okCost
+}
+
+const runStatsSchema = `
+	CREATE TABLE IF NOT EXISTS run_stats (
+		run_id        INTEGER PRIMARY KEY,
+		notebook_id   TEXT NOT NULL,
+		idx           INTEGER NOT NULL,
+		model         TEXT NOT NULL,
+		input_tokens  INTEGER NOT NULL DEFAULT 0,
+		output_tokens INTEGER NOT NULL DEFAULT 0,
+		cost_usd      REAL NOT NULL DEFAULT 0,
+		created_at    TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%SZ','now')),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS run_stats_notebook ON run_stats(notebook_id);`
+
+// recordUsage stores the usage found in a finished run's output, if the
+// runner can parse it.
+func recordUsage(ctx context.Context, rn runner.Runner, runID int64, nbID string, idx int, model, output string) {
+	ur, ok := rn.(usageRunner)
+	if !ok || runID == 0 {
+		return
+	}
+	u, ok := ur.ParseUsage(output)
+	if !ok {
+		return
+	}
+	if _, err := execDB(ctx, `
+		INSERT OR REPLACE INTO run_stats(run_id, notebook_id, idx, model, input_tokens, output_tokens, cost_usd)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+	`, runID, nbID, idx, model, u.InputTokens, u.OutputTokens, u.CostUSD); err != nil {
+		slog.ErrorContext(ctx, "run: record usage", "model", model, "err", err)
+	}
+}
+
+func scanUsage(ctx context.Context, q string, args ...any) (map[string]runUsage, error) {
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]runUsage)
+	for rows.Next() {
+		var k string
+		var u runUsage
+		if err := rows.Scan(&k, &u.InputTokens, &u.OutputTokens, &u.CostUSD); err != nil {
+			return nil, err
+		}
+		out[k] = u
+	}
+	return out, rows.Err()
+}
+
+// notebookUsage returns usage totals keyed by notebook id.
+func notebookUsage(ctx context.Context) (map[string]runUsage, error) {
+	return scanUsage(ctx, `
+		SELECT notebook_id, SUM(input_tokens), SUM(output_tokens), SUM(cost_usd)
+		FROM run_stats GROUP BY notebook_id
+	`)
+}
+
+// totalUsage sums usage over the notebooks visible to user (all of them
+// when auth is disabled).
+func totalUsage(ctx context.Context, user string) (runUsage, error) {
+	var u runUsage
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(s.input_tokens), 0), COALESCE(SUM(s.output_tokens), 0), COALESCE(SUM(s.cost_usd), 0)
+		FROM run_stats s JOIN notebooks n ON n.id = s.notebook_id
+		WHERE ? = '' OR n.owner = '' OR n.owner = ?
+	`, user, user).Scan(&u.InputTokens, &u.OutputTokens, &u.CostUSD)
+	return u, err
+}
+
+// entryUsage returns usage totals for one notebook keyed by entry index.
+func entryUsage(ctx context.Context, nbID string) (map[int]runUsage, error) {
+	m, err := scanUsage(ctx, `
+		SELECT CAST(idx AS TEXT), SUM(input_tokens), SUM(output_tokens), SUM(cost_usd)
+		FROM run_stats WHERE notebook_id = ? GROUP BY idx
+	`, nbID)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int]runUsage, len(m))
+	for k, u := range m {
+		i, _ := strconv.Atoi(k)
+		out[i] = u
+	}
+	return out, nil
+}
@@ -0,0 +1,83 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Run timeouts. A model run is killed once it has taken longer than its
+// timeouts.run_minutes, or has written nothing for timeouts.idle_minutes
+// (aider, for one, can sit waiting for input despite --yes-always). The
+// run is recorded as timed out in runs and jobs, and its box says so.
+
+// runTimeoutError is the cause of a run killed by watchRun.
+type runTimeoutError struct {
+	idle bool
+	d    time.Duration
+}
+
+func (e runTimeoutError) Error() string {
+	if e.idle {
+		return fmt.Sprintf("timed out: no output for %s", e.d)
+	}
+	return fmt.Sprintf("timed out after %s", e.d)
+}
+
+func isRunTimeout(err error) bool {
+	var te runTimeoutError
+	return errors.As(err, &te)
+}
+
+// activityWriter records when anything was last written through it.
+type activityWriter struct {
+	w    io.Writer
+	last *atomic.Int64 // Unix nanoseconds
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	a.last.Store(time.Now().UnixNano())
+	return a.w.Write(p)
+}
+
+// watchRun returns a context that is canceled, with a runTimeoutError as
+// its cause, once run has passed or nothing has been written for idle
+// according to last. Zero durations are no limit. stop releases it; read
+// the cause before calling stop.
+func watchRun(ctx context.Context, run, idle time.Duration, last *atomic.Int64) (_ context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	var timer *time.Timer
+	if run > 0 {
+		timer = time.AfterFunc(run, func() { cancel(runTimeoutError{d: run}) })
+	}
+	if idle > 0 {
+		go func() {
+			tick := time.NewTicker(min(idle/10, 10*time.Second))
+			defer tick.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				case <-tick.C:
+				}
+				if time.Since(time.Unix(0, last.Load())) >= idle {
+					cancel(runTimeoutError{idle: true, d: idle})
+					return
+				}
+			}
+		}()
+	}
+	return ctx, func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		close(done)
+		cancel(nil)
+	}
+}
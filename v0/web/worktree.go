@@ -0,0 +1,72 @@
+package web
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"trybook/gitops"
+)
+
+// Clones and notebook worktrees are laid out, created and removed by
+// package gitops; worktrees binds it to the -dir data directory.
+func worktrees() *gitops.WorktreeManager {
+	return &gitops.WorktreeManager{
+		CloneRoot:    cloneBaseDir(),
+		WorktreeRoot: worktreeBaseDir(),
+		NewID:        genNotebookID,
+	}
+}
+
+func repoDirPath(host, org, repo string) string {
+	return worktrees().RepoDir(host, org, repo)
+}
+
+func worktreeDirPath(host, org, repo, name string) string {
+	return worktrees().WorktreeDir(host, org, repo, name)
+}
+
+// relayoutRepos moves the clones and worktrees of every known repository
+// from the old disk layout to the current one; see gitops.Relayout. It runs
+// once at startup, before anything else uses them.
+func relayoutRepos() {
+	ctx := context.Background()
+	type repoKey struct{ host, org, repo string }
+	names := map[repoKey][]string{}
+	rows, err := db.Query(`
+		SELECT host, org, repo, worktree FROM notebooks
+		UNION ALL SELECT host, org, repo, '' FROM clones`)
+	if err != nil {
+		slog.Error("relayout: list repos", "err", err)
+		return
+	}
+	for rows.Next() {
+		var k repoKey
+		var wt string
+		if err := rows.Scan(&k.host, &k.org, &k.repo, &wt); err != nil {
+			slog.Error("relayout: list repos", "err", err)
+			rows.Close()
+			return
+		}
+		if wt != "" {
+			names[k] = append(names[k], wt)
+		} else if _, ok := names[k]; !ok {
+			names[k] = nil
+		}
+	}
+	rows.Close()
+	keys := make([]repoKey, 0, len(names))
+	for k := range names {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Count(keys[i].org, "/") > strings.Count(keys[j].org, "/")
+	})
+	m := worktrees()
+	for _, k := range keys {
+		if err := m.Relayout(ctx, k.host, k.org, k.repo, names[k]); err != nil {
+			slog.Error("relayout", "repo", k.host+"/"+k.org+"/"+k.repo, "err", err)
+		}
+	}
+}